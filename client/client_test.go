@@ -0,0 +1,1580 @@
+package client
+
+// Concurrency tests for the client, meant for the race detector:
+//
+//	go test -race .
+//
+// and benchmarks of its locking under contention:
+//
+//	go test -run NONE -bench . -cpu 1,4,16 .
+//
+// They run the client against fakeBroker, an in-process stand-in for
+// `shortbus pipe`, so no rendezvous or engine is needed.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeBroker answers the client's commands the way pipe mode would, as far
+// as these tests need: publishes are delivered to the publishing client's
+// subscriptions, and anything else is acknowledged.
+type fakeBroker struct {
+	commands *io.PipeReader // what the client writes
+	replies  *io.PipeWriter // what the client reads
+
+	mu         sync.Mutex
+	subscribed map[string]bool
+	published  int
+	ops        map[string]int
+	last       map[string]map[string]interface{} // latest command per op
+	kv         map[string]string                 // bucket/key => value
+	locks      map[string]int                    // held lock => token
+	tokens     int
+	streams    map[string]int // stream => version
+	limited    int            // publishes and fetches still to refuse for rate limits
+	inboxes    int
+}
+
+func newFakeClient(t testing.TB, opts ...Option) (*ShortbusClient, *fakeBroker) {
+	t.Helper()
+
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+
+	broker := &fakeBroker{
+		commands:   stdinR,
+		replies:    stdoutW,
+		subscribed: make(map[string]bool),
+		ops:        make(map[string]int),
+		last:       make(map[string]map[string]interface{}),
+		kv:         make(map[string]string),
+		locks:      make(map[string]int),
+		streams:    make(map[string]int),
+	}
+
+	client := newClient(opts)
+	client.start(stdinW, stdoutR, nil)
+	go broker.serve()
+
+	t.Cleanup(func() { client.Close() })
+	return client, broker
+}
+
+func (b *fakeBroker) serve() {
+	defer b.replies.Close()
+
+	b.write(map[string]interface{}{"status": "ready", "connection_id": "fake"})
+
+	scanner := bufio.NewScanner(b.commands)
+	for scanner.Scan() {
+		var command map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &command); err != nil {
+			continue
+		}
+
+		op, _ := command["op"].(string)
+		topic, _ := command["topic"].(string)
+		reply := map[string]interface{}{"status": "ok", "op": op, "request_id": command["request_id"]}
+
+		b.mu.Lock()
+		b.ops[op]++
+		b.last[op] = command
+		var deliver bool
+		var id int
+		switch op {
+		case "subscribe":
+			b.subscribed[topic] = true
+		case "publish":
+			if refusal := b.rateLimit(op, command); refusal != nil {
+				reply = refusal
+				break
+			}
+			if expected, ok := command["expected_last_sequence"].(float64); ok && int(expected) != b.published {
+				reply = map[string]interface{}{"type": "error", "error": "Publish failed: head moved", "request_id": command["request_id"]}
+				reply["conflict"], reply["last_sequence"] = true, b.published
+				break
+			}
+			b.published++
+			id = b.published
+			reply["message_id"] = fmt.Sprintf("01927c4e-8f3a-7%03x-9c0e-5b7a2f1e4d3c", id)
+			reply["offset"] = id
+			deliver = b.subscribed[topic]
+		case "fetch":
+			if refusal := b.rateLimit(op, command); refusal != nil {
+				reply = refusal
+			}
+		case "inbox":
+			b.inboxes++
+			reply["topic"] = fmt.Sprintf("_INBOX.fake.%d", b.inboxes)
+		case "kv":
+			b.answerKV(command, reply)
+		case "acquire", "renew", "release":
+			b.answerLock(op, command, reply)
+		case "append":
+			b.answerAppend(command, reply)
+		}
+		b.mu.Unlock()
+
+		b.write(reply)
+		if deliver {
+			b.write(map[string]interface{}{"type": "message", "topic": topic, "payload": command["payload"], "metadata": command["metadata"], "id": id})
+		}
+	}
+}
+
+// rateLimit refuses command while limited refusals are left, nil after
+func (b *fakeBroker) rateLimit(op string, command map[string]interface{}) map[string]interface{} {
+	if b.limited == 0 {
+		return nil
+	}
+	b.limited--
+
+	refusal := map[string]interface{}{"type": "error", "error": "Unauthorized: Rate limit of 2.0/s for " + op + " exceeded", "request_id": command["request_id"]}
+	refusal["retry_after"], refusal["pressure"] = 0.01, 0.5
+	return refusal
+}
+
+// answerKV keeps one bucket's values in memory, revisions counted with
+// publishes
+func (b *fakeBroker) answerKV(command, reply map[string]interface{}) {
+	bucket, _ := command["bucket"].(string)
+	key, _ := command["key"].(string)
+	entry := map[string]interface{}{"bucket": bucket, "key": key, "operation": command["action"]}
+
+	switch command["action"] {
+	case "put":
+		b.published++
+		b.kv[bucket+"/"+key], _ = command["value"].(string)
+		entry["value"], entry["revision"] = command["value"], b.published
+		reply["entry"] = entry
+	case "delete":
+		b.published++
+		delete(b.kv, bucket+"/"+key)
+		entry["revision"] = b.published
+		reply["entry"] = entry
+	case "get":
+		if value, ok := b.kv[bucket+"/"+key]; ok {
+			entry["value"], entry["operation"] = value, "put"
+			reply["entry"] = entry
+		}
+	case "keys":
+		keys := []string{}
+		for name := range b.kv {
+			keys = append(keys, strings.TrimPrefix(name, bucket+"/"))
+		}
+		sort.Strings(keys)
+		reply["keys"] = keys
+	}
+}
+
+// answerLock grants each lock to the first acquire until it is released
+func (b *fakeBroker) answerLock(op string, command, reply map[string]interface{}) {
+	name, _ := command["name"].(string)
+	token, _ := command["token"].(float64)
+	held, taken := b.locks[name]
+	lease := map[string]interface{}{"name": name, "owner": "fake", "expires_at": time.Now().Add(time.Minute).Format(time.RFC3339)}
+
+	switch op {
+	case "acquire":
+		reply["acquired"] = !taken
+		if !taken {
+			b.tokens++
+			b.locks[name] = b.tokens
+			lease["token"] = b.tokens
+		}
+		reply["lease"] = lease
+	case "renew":
+		if taken && held == int(token) {
+			reply["renewed"], reply["lease"] = true, lease
+		}
+	case "release":
+		reply["released"] = taken && held == int(token)
+		if taken && held == int(token) {
+			delete(b.locks, name)
+		}
+	}
+}
+
+// answerAppend checks expected_version the way Streams does
+func (b *fakeBroker) answerAppend(command, reply map[string]interface{}) {
+	stream, _ := command["stream"].(string)
+	events, _ := command["events"].([]interface{})
+	version := b.streams[stream]
+
+	if expected, ok := command["expected_version"].(float64); ok && int(expected) != version {
+		for key := range reply {
+			delete(reply, key)
+		}
+		reply["type"], reply["error"], reply["request_id"] = "error", "Append failed: version conflict", command["request_id"]
+		reply["conflict"], reply["version"] = true, version
+		return
+	}
+
+	b.streams[stream] = version + len(events)
+	reply["version"] = b.streams[stream]
+}
+
+// write sends a line to the client, as pipe mode's write lock does
+func (b *fakeBroker) write(line map[string]interface{}) {
+	data, _ := json.Marshal(line)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.replies.Write(append(data, '\n'))
+}
+
+// disconnect drops the connection as a broker that exits would
+func (b *fakeBroker) disconnect() {
+	b.replies.Close()
+	b.commands.Close()
+}
+
+func (b *fakeBroker) count(op string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ops[op]
+}
+
+func TestConcurrentPublishes(t *testing.T) {
+	client, broker := newFakeClient(t)
+
+	const writers, each = 20, 50
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*each)
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				if _, err := client.Publish("events", fmt.Sprintf("%d-%d", w, i), map[string]interface{}{"writer": w}); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+
+	// Stats reads the same state the publishers are changing
+	go func() {
+		for i := 0; i < 100; i++ {
+			client.Stats()
+		}
+	}()
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("publish: %v", err)
+	}
+
+	if got := broker.count("publish"); got != writers*each {
+		t.Fatalf("broker saw %d publishes, want %d", got, writers*each)
+	}
+	if stats := client.Stats(); stats.InFlightRequests != 0 {
+		t.Fatalf("%d requests left in flight", stats.InFlightRequests)
+	}
+}
+
+func TestConcurrentSubscribesAndDeliveries(t *testing.T) {
+	client, _ := newFakeClient(t)
+
+	var received int64
+	var wg sync.WaitGroup
+
+	for s := 0; s < 10; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			topic := fmt.Sprintf("topic.%d", s%3)
+			if _, err := client.Subscribe(topic, func(msg Response) { atomic.AddInt64(&received, 1) }); err != nil {
+				t.Errorf("subscribe: %v", err)
+				return
+			}
+			for i := 0; i < 20; i++ {
+				if _, err := client.Publish(topic, "hi", nil); err != nil {
+					t.Errorf("publish: %v", err)
+				}
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&received) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt64(&received) == 0 {
+		t.Fatal("no deliveries reached the handlers")
+	}
+}
+
+func TestRequestsDuringDisconnectFailFast(t *testing.T) {
+	var disconnected int32
+	client, broker := newFakeClient(t, WithOnDisconnect(func(err error) { atomic.StoreInt32(&disconnected, 1) }))
+
+	if _, err := client.Ping(); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for s := 0; s < 20; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			_, err := client.Subscribe(fmt.Sprintf("jobs.%d", s), func(Response) {})
+			if err != nil && !errors.Is(err, ErrDisconnected) && !errors.Is(err, io.ErrClosedPipe) {
+				t.Errorf("subscribe: unexpected error %v", err)
+			}
+		}(s)
+	}
+
+	broker.disconnect()
+
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscribes still waiting after the broker went away")
+	}
+
+	start := time.Now()
+	if _, err := client.Publish("jobs", "late", nil); !errors.Is(err, ErrDisconnected) {
+		t.Fatalf("publish after disconnect: got %v, want ErrDisconnected", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("publish after disconnect waited for the request timeout")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&disconnected) != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&disconnected) != 1 {
+		t.Fatal("WithOnDisconnect not called")
+	}
+}
+
+func TestCloseDuringHandlers(t *testing.T) {
+	client, _ := newFakeClient(t)
+
+	var started, finished int64
+	_, err := client.Subscribe("work", func(msg Response) {
+		atomic.AddInt64(&started, 1)
+		time.Sleep(20 * time.Millisecond)
+
+		// Requests from a handler racing Close must fail cleanly
+		if _, err := client.Publish("work.done", msg.Payload, nil); err != nil && !errors.Is(err, ErrClosed) && !errors.Is(err, ErrDisconnected) && !errors.Is(err, io.ErrClosedPipe) {
+			t.Errorf("publish from handler: %v", err)
+		}
+		atomic.AddInt64(&finished, 1)
+	})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		if _, err := client.Publish("work", fmt.Sprint(i), nil); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if s, f := atomic.LoadInt64(&started), atomic.LoadInt64(&finished); s != f {
+		t.Fatalf("Close returned with %d of %d handlers unfinished", s-f, s)
+	}
+	if _, err := client.Ping(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("ping after close: got %v, want ErrClosed", err)
+	}
+}
+
+func TestSubscriberSnapshotsDontChange(t *testing.T) {
+	var shard topicShard
+	shard.init()
+
+	first := func(Response) {}
+	shard.updateSubscribers("orders", func(subs *subscribers) { subs.handlers = append(subs.handlers, first) })
+	snapshot := shard.subscribers("orders")
+
+	shard.updateSubscribers("orders", func(subs *subscribers) {
+		subs.handlers = append(subs.handlers[:len(subs.handlers):len(subs.handlers)], func(Response) {})
+	})
+	if len(snapshot.handlers) != 1 || len(shard.subscribers("orders").handlers) != 2 {
+		t.Fatalf("snapshot has %d handlers, current %d; want 1 and 2", len(snapshot.handlers), len(shard.subscribers("orders").handlers))
+	}
+
+	old := shard.updateSubscribers("orders", func(subs *subscribers) { subs.handlers = nil })
+	if len(old.handlers) != 2 {
+		t.Fatalf("replaced subscribers had %d handlers, want 2", len(old.handlers))
+	}
+	if _, ok := (*shard.subs.Load())["orders"]; ok {
+		t.Fatal("a topic without subscribers stayed in the snapshot")
+	}
+}
+
+func TestCloseIsIdempotentAcrossGoroutines(t *testing.T) {
+	client, _ := newFakeClient(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.Close()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMessageIDs(t *testing.T) {
+	client, _ := newFakeClient(t)
+
+	response, err := client.Publish("events", "hi", nil)
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if response.MessageID != "01927c4e-8f3a-7001-9c0e-5b7a2f1e4d3c" || response.Offset != 1 {
+		t.Fatalf("got message_id %q offset %d", response.MessageID, response.Offset)
+	}
+	if want := time.UnixMilli(0x01927c4e8f3a); !response.MessageID.Time().Equal(want) {
+		t.Fatalf("MessageID.Time() = %v, want %v", response.MessageID.Time(), want)
+	}
+
+	// Older brokers sent integers
+	var old Response
+	if err := json.Unmarshal([]byte(`{"message_id": 41}`), &old); err != nil || old.MessageID != "41" {
+		t.Fatalf("integer message_id: got %q, %v", old.MessageID, err)
+	}
+	if !old.MessageID.Time().IsZero() {
+		t.Fatal("integer message_id has a time")
+	}
+}
+
+func TestGapsAreReported(t *testing.T) {
+	gaps := make(chan Gap, 4)
+	client, broker := newFakeClient(t, WithOnGap(func(gap Gap) { gaps <- gap }))
+
+	if _, err := client.Subscribe("ticks", func(Response) {}); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	broker.mu.Lock()
+	asked := broker.last["subscribe"]["gaps"]
+	broker.mu.Unlock()
+	if asked != true {
+		t.Fatal("subscribe did not ask for gap reports")
+	}
+
+	delivery := func(sequence int, prev interface{}) map[string]interface{} {
+		return map[string]interface{}{"type": "message", "topic": "ticks", "id": sequence, "sequence": sequence, "prev_sequence": prev}
+	}
+	broker.write(delivery(5, nil))
+	broker.write(delivery(6, 5))
+	broker.write(map[string]interface{}{"type": "gap", "topic": "ticks", "from": 7, "to": 7, "missed": 1})
+	broker.write(delivery(10, 8)) // 8 was sent but never arrived; 9 was filtered
+
+	want := []Gap{{Topic: "ticks", From: 7, To: 7, InTopic: true}, {Topic: "ticks", From: 7, To: 8}}
+	for _, w := range want {
+		select {
+		case got := <-gaps:
+			if got != w {
+				t.Fatalf("got gap %+v, want %+v", got, w)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no gap reported, want %+v", w)
+		}
+	}
+}
+
+func TestLastWillIsRegisteredAndCloseSaysGoodbye(t *testing.T) {
+	client, broker := newFakeClient(t, WithName("billing"), WithLastWill("presence.billing", "offline", nil))
+	if _, err := client.handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+
+	broker.mu.Lock()
+	hello := broker.last["hello"]
+	broker.mu.Unlock()
+	will, _ := hello["will"].(map[string]interface{})
+	if hello["name"] != "billing" || will["topic"] != "presence.billing" || will["payload"] != "offline" {
+		t.Fatalf("hello sent %v", hello)
+	}
+
+	client.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for broker.count("shutdown") == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if broker.count("shutdown") != 1 {
+		t.Fatal("Close did not send shutdown, so the broker would publish the will")
+	}
+}
+
+func TestKV(t *testing.T) {
+	client, broker := newFakeClient(t, WithOnGap(func(Gap) {}))
+
+	entry, err := client.KVPut("config", "billing.rate_limit", "100")
+	if err != nil || entry.Revision != 1 || entry.Value != "100" {
+		t.Fatalf("put: got %+v, %v", entry, err)
+	}
+	client.KVPut("config", "billing.currency", "EUR")
+
+	if entry, err := client.KVGet("config", "billing.rate_limit"); err != nil || entry.Value != "100" {
+		t.Fatalf("get: got %+v, %v", entry, err)
+	}
+	if keys, err := client.KVKeys("config"); err != nil || strings.Join(keys, ",") != "billing.currency,billing.rate_limit" {
+		t.Fatalf("keys: got %v, %v", keys, err)
+	}
+
+	if _, err := client.KVDelete("config", "billing.rate_limit"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := client.KVGet("config", "billing.rate_limit"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("get after delete: got %v, want ErrKeyNotFound", err)
+	}
+
+	entries := make(chan KVEntry, 2)
+	if _, err := client.KVWatch("config", func(entry KVEntry) { entries <- entry }); err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	broker.mu.Lock()
+	subscribe := broker.last["subscribe"]
+	broker.mu.Unlock()
+	if subscribe["topic"] != "kv.config" || subscribe["deliver"] != DeliverAll || subscribe["gaps"] != false {
+		t.Fatalf("watch subscribed with %v", subscribe)
+	}
+
+	broker.write(map[string]interface{}{"type": "message", "topic": "kv.config", "id": 2, "payload": "EUR", "metadata": map[string]interface{}{"key": "billing.currency"}})
+	broker.write(map[string]interface{}{"type": "message", "topic": "kv.config", "id": 3, "payload": "", "metadata": map[string]interface{}{"key": "billing.rate_limit", "tombstone": true}})
+
+	want := map[string]KVEntry{
+		"billing.currency":   {Bucket: "config", Key: "billing.currency", Value: "EUR", Revision: 2, Operation: "put"},
+		"billing.rate_limit": {Bucket: "config", Key: "billing.rate_limit", Revision: 3, Operation: "delete"},
+	}
+	for range want {
+		select {
+		case got := <-entries:
+			if got != want[got.Key] {
+				t.Fatalf("watch got %+v, want %+v", got, want[got.Key])
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("watch missed an entry")
+		}
+	}
+}
+
+func TestLocks(t *testing.T) {
+	client, _ := newFakeClient(t)
+
+	lease, err := client.Acquire("reconcile", 30*time.Second)
+	if err != nil || lease.Token != 1 {
+		t.Fatalf("acquire: got %+v, %v", lease, err)
+	}
+	if _, err := client.Acquire("reconcile", 30*time.Second); !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("second acquire: got %v, want ErrLockHeld", err)
+	}
+	if _, err := lease.Renew(30 * time.Second); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	if released, err := lease.Release(); !released || err != nil {
+		t.Fatalf("release: got %v, %v", released, err)
+	}
+	if _, err := lease.Renew(30 * time.Second); !errors.Is(err, ErrLockLost) {
+		t.Fatalf("renew after release: got %v, want ErrLockLost", err)
+	}
+}
+
+func TestCampaign(t *testing.T) {
+	client, broker := newFakeClient(t)
+
+	incumbent, err := client.Acquire("leader", time.Minute)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+
+	elected := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		result <- client.Campaign(context.Background(), "leader", time.Second, func(ctx context.Context) error {
+			close(elected)
+			<-ctx.Done()
+			return ctx.Err()
+		})
+	}()
+
+	select {
+	case <-elected:
+		t.Fatal("elected while the lock was held")
+	case <-time.After(500 * time.Millisecond):
+	}
+	incumbent.Release()
+
+	select {
+	case <-elected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("not elected after the lock was released")
+	}
+
+	// The lease lapses behind the leader's back
+	broker.mu.Lock()
+	delete(broker.locks, "leader")
+	broker.mu.Unlock()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrLockLost) {
+			t.Fatalf("campaign: got %v, want ErrLockLost", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("leader never noticed it lost the lock")
+	}
+}
+
+func TestWatchStats(t *testing.T) {
+	client, broker := newFakeClient(t)
+
+	summaries := make(chan TopicStats, 1)
+	if _, err := client.WatchStats("orders", func(stats TopicStats) { summaries <- stats }); err != nil {
+		t.Fatalf("watch stats: %v", err)
+	}
+
+	payload := `{"topic": "orders", "at": "2026-10-14T09:30:00.000Z", "total": 98, "windows": {"1m": {"window": 60, "count": 120, "bytes": 9600, "rate": 2.0}}}`
+	broker.write(map[string]interface{}{"type": "message", "topic": "stats.orders", "id": 1, "payload": payload})
+
+	select {
+	case stats := <-summaries:
+		if stats.Topic != "orders" || stats.Total != 98 || stats.Windows["1m"] != (StatsWindow{Window: 60, Count: 120, Bytes: 9600, Rate: 2}) {
+			t.Fatalf("got %+v", stats)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no summary")
+	}
+}
+
+func TestExpectedLastSequence(t *testing.T) {
+	client, broker := newFakeClient(t)
+
+	response, err := client.Publish("thermostat", "21", nil, WithExpectedLastSequence(0))
+	if err != nil || response.Offset != 1 {
+		t.Fatalf("publish at head: got %+v, %v", response, err)
+	}
+
+	broker.mu.Lock()
+	sent := broker.last["publish"]
+	broker.mu.Unlock()
+	if sent["expected_last_sequence"] != float64(0) {
+		t.Fatalf("publish sent %v", sent)
+	}
+
+	response, err = client.Publish("thermostat", "19", nil, WithExpectedLastSequence(0))
+	if !errors.Is(err, ErrConflict) || response.LastSequence != 1 {
+		t.Fatalf("stale publish: got %+v, %v; want ErrConflict at 1", response, err)
+	}
+
+	if response, err := client.Publish("thermostat", "19", nil, WithExpectedLastSequence(1)); err != nil || response.Offset != 2 {
+		t.Fatalf("publish after re-read: got %+v, %v", response, err)
+	}
+}
+
+func TestAppendToStream(t *testing.T) {
+	client, broker := newFakeClient(t)
+
+	version, err := client.AppendToStream("order-42", NoStream, StreamEvent{Type: "placed", Payload: `{"total": 30}`})
+	if err != nil || version != 1 {
+		t.Fatalf("append: got version %d, %v", version, err)
+	}
+
+	broker.mu.Lock()
+	sent := broker.last["append"]
+	broker.mu.Unlock()
+	events, _ := sent["events"].([]interface{})
+	if sent["expected_version"] != float64(0) || len(events) != 1 || events[0].(map[string]interface{})["type"] != "placed" {
+		t.Fatalf("append sent %v", sent)
+	}
+
+	version, err = client.AppendToStream("order-42", NoStream, StreamEvent{Type: "placed"})
+	if !errors.Is(err, ErrConflict) || version != 1 {
+		t.Fatalf("conflicting append: got version %d, %v; want ErrConflict at 1", version, err)
+	}
+
+	if version, err := client.AppendToStream("order-42", AnyVersion, StreamEvent{}, StreamEvent{}); err != nil || version != 3 {
+		t.Fatalf("append any: got version %d, %v", version, err)
+	}
+}
+
+func TestServeDebug(t *testing.T) {
+	client, _ := newFakeClient(t, WithName("debug-test"))
+
+	addr, err := client.ServeDebug("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("serve debug: %v", err)
+	}
+	if _, err := client.ServeDebug("127.0.0.1:0"); err == nil {
+		t.Fatal("second ServeDebug should fail")
+	}
+
+	resp, err := http.Get("http://" + addr.String() + "/debug/vars")
+	if err != nil {
+		t.Fatalf("get vars: %v", err)
+	}
+	var vars map[string]json.RawMessage
+	err = json.NewDecoder(resp.Body).Decode(&vars)
+	resp.Body.Close()
+	if err != nil || !strings.Contains(string(vars["shortbus"]), `"debug-test"`) {
+		t.Fatalf("vars: got shortbus=%s, %v", vars["shortbus"], err)
+	}
+
+	resp, err = http.Get("http://" + addr.String() + "/debug/pprof/goroutine?debug=1")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("goroutine profile: got %v, %v", resp, err)
+	}
+	resp.Body.Close()
+
+	client.Close()
+	if _, err := http.Get("http://" + addr.String() + "/debug/vars"); err == nil {
+		t.Fatal("debug endpoints still served after Close")
+	}
+}
+
+func TestWaitOutlastsHandlers(t *testing.T) {
+	client, _ := newFakeClient(t)
+
+	started := make(chan struct{})
+	var finished int32
+	_, err := client.SubscribeContext("jobs", func(ctx context.Context, msg Response) error {
+		close(started)
+		<-ctx.Done() // Close cancels it
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&finished, 1)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if _, err := client.Publish("jobs", "work", nil); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	<-started
+
+	waited := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(waited)
+	}()
+
+	select {
+	case <-waited:
+		t.Fatal("Wait returned while the client was still running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	client.Shutdown()
+	<-waited
+	if atomic.LoadInt32(&finished) != 1 {
+		t.Fatal("Wait returned before the handler finished")
+	}
+}
+
+func TestRateLimitRetries(t *testing.T) {
+	client, broker := newFakeClient(t)
+	broker.mu.Lock()
+	broker.limited = 1
+	broker.mu.Unlock()
+
+	response, err := client.Publish("events", "hello", nil)
+	if !errors.Is(err, ErrRateLimited) || response.RetryAfter != 0.01 || response.Pressure != 0.5 {
+		t.Fatalf("limited publish: got %+v, %v; want ErrRateLimited", response, err)
+	}
+
+	client, broker = newFakeClient(t, WithRateLimitRetries(3))
+	broker.mu.Lock()
+	broker.limited = 2
+	broker.mu.Unlock()
+
+	start := time.Now()
+	if _, err := client.Publish("events", "hello", nil); err != nil {
+		t.Fatalf("retried publish: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Fatalf("retried after %s; want RetryAfter stretched by pressure, twice", elapsed)
+	}
+
+	broker.mu.Lock()
+	attempts := broker.ops["publish"]
+	broker.mu.Unlock()
+	if attempts != 3 {
+		t.Fatalf("publish sent %d times; want 3", attempts)
+	}
+
+	// Long-polls go through the same retries
+	broker.mu.Lock()
+	broker.limited = 1
+	broker.mu.Unlock()
+	if _, err := client.Fetch("events", "workers", 10, 10*time.Millisecond); err != nil {
+		t.Fatalf("retried fetch: %v", err)
+	}
+	broker.mu.Lock()
+	attempts = broker.ops["fetch"]
+	broker.mu.Unlock()
+	if attempts != 2 {
+		t.Fatalf("fetch sent %d times; want 2", attempts)
+	}
+}
+
+func TestCreditsReturnOncePerDelivery(t *testing.T) {
+	client, broker := newFakeClient(t, WithCredits(4))
+
+	var handled sync.WaitGroup
+	handled.Add(8)
+	for i := 0; i < 2; i++ {
+		if _, err := client.Subscribe("events", func(Response) { handled.Done() }); err != nil {
+			t.Fatalf("subscribe: %v", err)
+		}
+		broker.mu.Lock()
+		_, granted := broker.last["subscribe"]["credits"]
+		broker.mu.Unlock()
+		if granted != (i == 0) {
+			t.Fatalf("subscribe %d granted credits: %v; want only the first to", i+1, granted)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		if _, err := client.Publish("events", "tick", nil); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+	handled.Wait()
+
+	// Four deliveries, each handled twice: four credits back, in two grants
+	// of half the window
+	deadline := time.Now().Add(time.Second)
+	for {
+		broker.mu.Lock()
+		grants := broker.ops["credit"]
+		broker.mu.Unlock()
+		if grants == 2 {
+			break
+		}
+		if grants > 2 || time.Now().After(deadline) {
+			t.Fatalf("%d credit grants; want 2", grants)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLastValueCache(t *testing.T) {
+	client, broker := newFakeClient(t, WithLastValueCache())
+
+	if _, ok := client.LastValue("temps"); ok {
+		t.Fatal("LastValue hit before anything was delivered")
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		broker.mu.Lock()
+		subscribed := broker.subscribed["temps"]
+		command := broker.last["subscribe"]
+		broker.mu.Unlock()
+		if subscribed {
+			if command["deliver"] != DeliverLast {
+				t.Fatalf("cache subscribed with %v, want deliver last", command)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("LastValue never subscribed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for _, payload := range []string{"19.5", "20.1"} {
+		if _, err := client.Publish("temps", payload, nil); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+
+	deadline = time.Now().Add(time.Second)
+	for {
+		if msg, ok := client.LastValue("temps"); ok && msg.Payload == "20.1" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("LastValue never caught up with the latest delivery")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// A redelivery of an older message leaves the newer one cached
+	broker.write(map[string]interface{}{"type": "message", "topic": "temps", "payload": "19.5", "id": 1})
+	if _, err := client.Publish("other", "flush", nil); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if msg, _ := client.LastValue("temps"); msg.Payload != "20.1" {
+		t.Fatalf("LastValue = %q after a redelivery, want 20.1", msg.Payload)
+	}
+}
+
+func TestUnsubscribeDropsLastValue(t *testing.T) {
+	client, _ := newFakeClient(t, WithLastValueCache())
+
+	if _, err := client.Subscribe("temps", func(Response) {}); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if _, err := client.Publish("temps", "19.5", nil); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := client.LastValue("temps"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("LastValue never saw the delivery")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if _, err := client.Unsubscribe("temps"); err != nil {
+		t.Fatalf("unsubscribe: %v", err)
+	}
+	if msg, ok := client.LastValue("temps"); ok {
+		t.Fatalf("LastValue = %q after unsubscribing, want a miss", msg.Payload)
+	}
+}
+
+func TestEnrichment(t *testing.T) {
+	traces := 0
+	client, broker := newFakeClient(t, WithEnrichment(map[string]interface{}{
+		"service":  "billing",
+		"trace_id": func() interface{} { traces++; return fmt.Sprintf("t%d", traces) },
+		"schema":   func(topic string) interface{} { return map[string]interface{}{"invoices": "v2"}[topic] },
+	}))
+
+	metadata := map[string]interface{}{"service": "override"}
+	if _, err := client.Publish("invoices", "{}", metadata); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if len(metadata) != 1 {
+		t.Fatalf("enrichment changed the caller's metadata: %v", metadata)
+	}
+	if _, err := client.Signal("heartbeat", nil); err != nil {
+		t.Fatalf("signal: %v", err)
+	}
+
+	broker.mu.Lock()
+	published := broker.last["publish"]["metadata"].(map[string]interface{})
+	signalled := broker.last["signal"]["metadata"].(map[string]interface{})
+	broker.mu.Unlock()
+
+	if published["service"] != "override" || published["trace_id"] != "t1" || published["schema"] != "v2" {
+		t.Fatalf("publish metadata = %v", published)
+	}
+	if signalled["service"] != "billing" || signalled["trace_id"] != "t2" {
+		t.Fatalf("signal metadata = %v", signalled)
+	}
+	if _, ok := signalled["schema"]; ok {
+		t.Fatalf("schema stamped on a topic without one: %v", signalled)
+	}
+}
+
+func TestCorrelationIDs(t *testing.T) {
+	client, broker := newFakeClient(t)
+
+	ids := make(chan string, 1)
+	_, err := client.SubscribeContext("orders", func(ctx context.Context, msg Response) error {
+		ids <- CorrelationIDFromContext(ctx)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	ctx := ContextWithCorrelationID(context.Background(), "req-1")
+	if _, err := client.Publish("orders", "{}", nil, WithCorrelation(ctx)); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if id := <-ids; id != "req-1" {
+		t.Fatalf("handler saw correlation id %q, want req-1", id)
+	}
+
+	if _, err := client.Publish("orders", "{}", nil, WithCorrelation(context.Background())); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if id := <-ids; len(id) != 32 {
+		t.Fatalf("generated correlation id %q, want 32 hex digits", id)
+	}
+
+	request := Response{Metadata: map[string]interface{}{"reply_to": "_INBOX.fake.1", "correlation_id": "req-1"}}
+	if _, err := client.Reply(request, "ok", nil); err != nil {
+		t.Fatalf("reply: %v", err)
+	}
+	broker.mu.Lock()
+	replied := broker.last["publish"]["metadata"].(map[string]interface{})
+	broker.mu.Unlock()
+	if replied["correlation_id"] != "req-1" {
+		t.Fatalf("reply metadata = %v, want the request's correlation id", replied)
+	}
+}
+
+func TestRequest(t *testing.T) {
+	client, _ := newFakeClient(t)
+
+	_, err := client.Subscribe("prices", func(msg Response) {
+		client.Reply(msg, "42", nil)
+	})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	reply, err := client.Request("prices", "widget", nil, time.Second)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	if reply.Payload != "42" || !strings.HasPrefix(reply.Topic, "_INBOX.") {
+		t.Fatalf("reply = %+v, want 42 on an inbox", reply)
+	}
+
+	if _, err := client.Request("nobody.home", "hello", nil, 50*time.Millisecond); !errors.Is(err, ErrNoReply) {
+		t.Fatalf("unanswered request: %v, want ErrNoReply", err)
+	}
+}
+
+func TestSubscribeAckedAcksAndNacks(t *testing.T) {
+	client, broker := newFakeClient(t)
+
+	handled := make(chan struct{}, 2)
+	_, err := client.SubscribeAcked("jobs", "workers", func(ctx context.Context, msg Response) error {
+		defer func() { handled <- struct{}{} }()
+		if msg.Payload == "bad" {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	broker.mu.Lock()
+	subscribe := broker.last["subscribe"]
+	broker.mu.Unlock()
+	if subscribe["queue_group"] != "workers" || subscribe["manual_ack"] != true {
+		t.Fatalf("subscribe = %v, want an acked queue group", subscribe)
+	}
+
+	for _, payload := range []string{"good", "bad"} {
+		if _, err := client.Publish("jobs", payload, nil); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+		<-handled
+	}
+
+	// The ack or nack follows the handler's return
+	deadline := time.Now().Add(time.Second)
+	for {
+		broker.mu.Lock()
+		acks, nack := broker.ops["ack"], broker.last["nack"]
+		broker.mu.Unlock()
+
+		if acks == 1 && nack != nil {
+			if nack["group"] != "workers" || nack["error"] != "boom" || !reflect.DeepEqual(nack["ids"], []interface{}{float64(2)}) {
+				t.Fatalf("nack = %v, want #2 with the handler's error", nack)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("acks = %d, nack = %v; want one of each", acks, nack)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSubscribeBatch(t *testing.T) {
+	client, broker := newFakeClient(t)
+
+	batches := make(chan []Response, 3)
+	_, err := client.SubscribeBatch("rows", "writers", func(ctx context.Context, msgs []Response) error {
+		batches <- msgs
+		if msgs[0].ID == 1 {
+			return errors.New("db down")
+		}
+		return nil
+	}, WithBatch(2, 100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	broker.mu.Lock()
+	subscribe := broker.last["subscribe"]
+	broker.mu.Unlock()
+	if subscribe["max_in_flight"] != float64(2) || subscribe["manual_ack"] != true || subscribe["queue_group"] != "writers" {
+		t.Fatalf("subscribe = %v, want a batch-sized window of manual acks", subscribe)
+	}
+	if _, leaked := subscribe[batchOption]; leaked {
+		t.Fatalf("subscribe = %v, sent WithBatch's window to the broker", subscribe)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.Publish("rows", fmt.Sprint(i), nil); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+		// Full batches go as soon as they fill; the odd one out waits
+		if i == 1 {
+			if got := <-batches; len(got) != 2 || got[0].ID != 1 || got[1].ID != 2 {
+				t.Fatalf("first batch = %+v, want #1 and #2 in order", got)
+			}
+		}
+	}
+
+	start := time.Now()
+	if got := <-batches; len(got) != 1 || got[0].ID != 3 {
+		t.Fatalf("second batch = %+v, want #3 alone", got)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Fatalf("partial batch handed over after %s, want it held for the window", waited)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		broker.mu.Lock()
+		ack, nack := broker.last["ack"], broker.last["nack"]
+		broker.mu.Unlock()
+
+		if ack != nil && nack != nil {
+			if !reflect.DeepEqual(nack["ids"], []interface{}{float64(1), float64(2)}) || nack["error"] != "db down" {
+				t.Fatalf("nack = %v, want the failed batch with its error", nack)
+			}
+			if !reflect.DeepEqual(ack["ids"], []interface{}{float64(3)}) || ack["group"] != "writers" {
+				t.Fatalf("ack = %v, want the second batch", ack)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("ack = %v, nack = %v; want one of each", ack, nack)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLatencyPercentiles(t *testing.T) {
+	var metrics TopicMetrics
+	data := `{"topic": "orders", "latency": {"count": 10, "sum_ms": 160, "buckets": {"4": 5, "8": 4, "64": 1}}}`
+	if err := json.Unmarshal([]byte(data), &metrics); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	latency := metrics.Latency
+	for q, want := range map[float64]time.Duration{0.5: 4 * time.Millisecond, 0.9: 8 * time.Millisecond, 0.99: 64 * time.Millisecond} {
+		if got := latency.Percentile(q); got != want {
+			t.Errorf("p%v = %s, want %s", q*100, got, want)
+		}
+	}
+	if latency.Mean() != 16*time.Millisecond {
+		t.Errorf("mean = %s, want 16ms", latency.Mean())
+	}
+	if (LatencyHistogram{}).Percentile(0.5) != 0 {
+		t.Errorf("empty histogram has a percentile")
+	}
+}
+
+// capture is a golden wire capture from ../conformance (see its README):
+// the frames each side sent, with $placeholders for what differs by run.
+type capture struct {
+	id      string
+	samples map[string]interface{}
+	steps   []captureStep
+}
+
+type captureStep struct {
+	broker bool // sent by the broker, else by the client
+	frames []map[string]interface{}
+}
+
+func loadCaptures(t *testing.T) []capture {
+	t.Helper()
+
+	paths, err := filepath.Glob(filepath.Join("..", "conformance", "v*", "*.jsonl"))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no captures in ../conformance: %v", err)
+	}
+	sort.Strings(paths)
+
+	var captures []capture
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read %s: %v", path, err)
+		}
+
+		c := capture{
+			id:      filepath.Base(filepath.Dir(path)) + "/" + strings.TrimSuffix(filepath.Base(path), ".jsonl"),
+			samples: map[string]interface{}{},
+		}
+		for n, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || line[0] == '#' {
+				continue
+			}
+
+			var frame map[string]interface{}
+			if err := json.Unmarshal([]byte(line[1:]), &frame); err != nil {
+				t.Fatalf("%s:%d: %v", path, n+1, err)
+			}
+
+			switch line[0] {
+			case '=':
+				for key, value := range frame {
+					c.samples[key] = value
+				}
+			case '<', '>':
+				broker := line[0] == '<'
+				if len(c.steps) == 0 || c.steps[len(c.steps)-1].broker != broker {
+					c.steps = append(c.steps, captureStep{broker: broker})
+				}
+				step := &c.steps[len(c.steps)-1]
+				step.frames = append(step.frames, frame)
+			default:
+				t.Fatalf("%s:%d: lines start with #, =, > or <", path, n+1)
+			}
+		}
+		captures = append(captures, c)
+	}
+	return captures
+}
+
+func isPlaceholder(value interface{}) (string, bool) {
+	s, ok := value.(string)
+	return s, ok && len(s) > 1 && s[0] == '$'
+}
+
+// matchFrame reports whether actual has every field of expected, binding
+// placeholders as it goes; bound is only updated on a match.
+func matchFrame(expected, actual interface{}, bound, samples map[string]interface{}) bool {
+	trial := make(map[string]interface{}, len(bound))
+	for key, value := range bound {
+		trial[key] = value
+	}
+	if !matchValue(expected, actual, trial, samples) {
+		return false
+	}
+	for key, value := range trial {
+		bound[key] = value
+	}
+	return true
+}
+
+func matchValue(expected, actual interface{}, bound, samples map[string]interface{}) bool {
+	if name, ok := isPlaceholder(expected); ok {
+		if value, ok := bound[name]; ok {
+			return reflect.DeepEqual(value, actual)
+		}
+		if sample, ok := samples[name]; ok && reflect.TypeOf(sample) != reflect.TypeOf(actual) {
+			return false
+		}
+		bound[name] = actual
+		return true
+	}
+
+	switch expected := expected.(type) {
+	case map[string]interface{}:
+		actual, ok := actual.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for key, value := range expected {
+			got, ok := actual[key]
+			if !ok || !matchValue(value, got, bound, samples) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		actual, ok := actual.([]interface{})
+		if !ok || len(actual) != len(expected) {
+			return false
+		}
+		for i := range expected {
+			if !matchValue(expected[i], actual[i], bound, samples) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(expected, actual)
+	}
+}
+
+// fillFrame is frame with its placeholders replaced by what was read, or
+// else by their samples.
+func fillFrame(frame interface{}, bound, samples map[string]interface{}) interface{} {
+	if name, ok := isPlaceholder(frame); ok {
+		if value, ok := bound[name]; ok {
+			return value
+		}
+		bound[name] = samples[name]
+		return samples[name]
+	}
+
+	switch frame := frame.(type) {
+	case map[string]interface{}:
+		filled := make(map[string]interface{}, len(frame))
+		for key, value := range frame {
+			filled[key] = fillFrame(value, bound, samples)
+		}
+		return filled
+	case []interface{}:
+		filled := make([]interface{}, len(frame))
+		for i, value := range frame {
+			filled[i] = fillFrame(value, bound, samples)
+		}
+		return filled
+	default:
+		return frame
+	}
+}
+
+// playBroker takes the broker's side of c: it writes the broker's frames
+// and checks the client's in between, in any order within a step. Client
+// frames the capture doesn't ask for (credit grants, say) are let through.
+// Replies are closed on the way out, as a broker exiting would, and later
+// commands are read and dropped so the client never blocks writing them.
+func playBroker(c capture, commands io.Reader, replies io.WriteCloser) error {
+	bound := map[string]interface{}{}
+	lines := make(chan []byte, 64)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(commands)
+		for scanner.Scan() {
+			lines <- append([]byte(nil), scanner.Bytes()...)
+		}
+	}()
+	defer func() {
+		replies.Close()
+		go func() {
+			for range lines {
+			}
+		}()
+	}()
+
+	for _, step := range c.steps {
+		if step.broker {
+			for _, frame := range step.frames {
+				data, _ := json.Marshal(fillFrame(frame, bound, c.samples))
+				if _, err := replies.Write(append(data, '\n')); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		pending := append([]map[string]interface{}(nil), step.frames...)
+		timeout := time.After(5 * time.Second)
+		for len(pending) > 0 {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					return fmt.Errorf("client closed the pipe waiting for %v", pending)
+				}
+				var actual map[string]interface{}
+				if err := json.Unmarshal(line, &actual); err != nil {
+					return fmt.Errorf("not a JSON frame: %s", line)
+				}
+				for i, frame := range pending {
+					if matchFrame(frame, actual, bound, c.samples) {
+						pending = append(pending[:i], pending[i+1:]...)
+						break
+					}
+				}
+			case <-timeout:
+				return fmt.Errorf("timed out waiting for %v", pending)
+			}
+		}
+	}
+	return nil
+}
+
+// conformanceScenarios drive the client through each capture, by name.
+var conformanceScenarios = map[string]func(client *ShortbusClient) error{
+	"handshake": func(client *ShortbusClient) error {
+		if _, err := client.Ping(); err != nil {
+			return err
+		}
+		if client.ConnectionID() == "" {
+			return errors.New("ready frame not understood: no connection id")
+		}
+		return nil
+	},
+	"publish": func(client *ShortbusClient) error {
+		response, err := client.Publish("conformance.publish", "hello", nil)
+		if err == nil && (response.Offset == 0 || response.MessageID == "") {
+			err = fmt.Errorf("published %+v, want an offset and message id", response)
+		}
+		return err
+	},
+	"subscribe": func(client *ShortbusClient) error {
+		got := make(chan Response, 1)
+		if _, err := client.Subscribe("conformance.subscribe", func(msg Response) { got <- msg }, WithDeliverPolicy(DeliverPolicy{Policy: DeliverNew})); err != nil {
+			return err
+		}
+		if _, err := client.Publish("conformance.subscribe", "hello", nil); err != nil {
+			return err
+		}
+		if msg := <-got; msg.Payload != "hello" {
+			return fmt.Errorf("delivered %q, want hello", msg.Payload)
+		}
+		return nil
+	},
+	"manual_ack": func(client *ShortbusClient) error {
+		got := make(chan Response, 1)
+		sub, err := client.Subscribe("conformance.ack", func(msg Response) { got <- msg },
+			WithDeliverPolicy(DeliverPolicy{Policy: DeliverNew}), WithMaxInflight(1), WithManualAck())
+		if err != nil {
+			return err
+		}
+		if _, err := client.Publish("conformance.ack", "work", nil); err != nil {
+			return err
+		}
+		return sub.Ack((<-got).ID)
+	},
+	"errors": func(client *ShortbusClient) error {
+		if _, err := client.Subscribe("conformance.errors", func(Response) {}, WithMaxInflight(0)); err == nil {
+			return errors.New("subscribe with max_in_flight 0 succeeded")
+		}
+		_, err := client.Ping()
+		return err
+	},
+}
+
+// TestConformance plays the broker's side of every golden capture against
+// the client, so a client change that breaks the protocol fails here the
+// way a broker change fails the Ruby suite.
+func TestConformance(t *testing.T) {
+	for _, c := range loadCaptures(t) {
+		c := c
+		t.Run(c.id, func(t *testing.T) {
+			scenario, ok := conformanceScenarios[filepath.Base(c.id)]
+			if !ok {
+				t.Fatalf("no client scenario for %s", c.id)
+			}
+
+			stdinR, stdinW := io.Pipe()
+			stdoutR, stdoutW := io.Pipe()
+			played := make(chan error, 1)
+			go func() { played <- playBroker(c, stdinR, stdoutW) }()
+
+			client := newClient(nil)
+			client.start(stdinW, stdoutR, nil)
+			defer client.Close()
+
+			if err := scenario(client); err != nil {
+				t.Fatalf("client: %v", err)
+			}
+			if err := <-played; err != nil {
+				t.Fatalf("broker side: %v", err)
+			}
+		})
+	}
+}
+
+// benchmarkDeliveries feeds deliveries spread over topics to subscribed
+// handlers from parallel goroutines, the way a busy reader would. Credits
+// are off so grants don't go out to the fake broker.
+func benchmarkDeliveries(b *testing.B, topics int) {
+	client, _ := newFakeClient(b, WithCredits(0))
+
+	names := make([]string, topics)
+	for i := range names {
+		names[i] = fmt.Sprintf("bench.%d", i)
+		if _, err := client.Subscribe(names[i], func(Response) {}); err != nil {
+			b.Fatalf("subscribe: %v", err)
+		}
+	}
+
+	var next int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			id := int(atomic.AddInt64(&next, 1))
+			client.handleResponse(Response{Type: "message", Topic: names[id%topics], ID: id})
+		}
+	})
+	client.handlers.Wait()
+}
+
+func BenchmarkDeliveriesOneTopic(b *testing.B) { benchmarkDeliveries(b, 1) }
+
+func BenchmarkDeliveriesAcrossTopics(b *testing.B) { benchmarkDeliveries(b, 64) }
+
+// BenchmarkDeliveriesDuringChurn delivers to one topic while other topics
+// are subscribed and unsubscribed as fast as the fake broker answers. With
+// -cpu 1 the churn and the fake broker share the one CPU with deliveries, so
+// it mostly measures that.
+func BenchmarkDeliveriesDuringChurn(b *testing.B) {
+	client, _ := newFakeClient(b, WithCredits(0))
+	if _, err := client.Subscribe("bench", func(Response) {}); err != nil {
+		b.Fatalf("subscribe: %v", err)
+	}
+
+	stop := make(chan struct{})
+	churned := make(chan struct{})
+	go func() {
+		defer close(churned)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			topic := fmt.Sprintf("churn.%d", i%64)
+			client.Subscribe(topic, func(Response) {})
+			client.Unsubscribe(topic)
+		}
+	}()
+
+	var next int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			client.handleResponse(Response{Type: "message", Topic: "bench", ID: int(atomic.AddInt64(&next, 1))})
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-churned
+	client.handlers.Wait()
+}
+
+// BenchmarkStatsUnderLoad reads Stats while deliveries are under way, as a
+// metrics scraper would.
+func BenchmarkStatsUnderLoad(b *testing.B) {
+	client, _ := newFakeClient(b, WithCredits(0))
+	if _, err := client.Subscribe("bench", func(Response) {}); err != nil {
+		b.Fatalf("subscribe: %v", err)
+	}
+
+	var next int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if id := int(atomic.AddInt64(&next, 1)); id%8 == 0 {
+				client.Stats()
+			} else {
+				client.handleResponse(Response{Type: "message", Topic: "bench", ID: id})
+			}
+		}
+	})
+	client.handlers.Wait()
+}
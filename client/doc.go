@@ -0,0 +1,41 @@
+// Package client is the Go client for shortbus, speaking its pipe protocol
+// to a `shortbus pipe` child process (NewClient) or to `shortbus listen`
+// over a socket (Dial):
+//
+//	import "github.com/ahoward/shortbus/client"
+//
+//	c, err := client.NewClient(client.WithName("billing"))
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//
+//	c.Subscribe("orders", func(msg client.Response) { ... })
+//	c.Publish("orders", `{"id": 42}`, nil)
+//
+// The client is safe for concurrent use. examples/README.md in the
+// repository covers each feature in depth.
+//
+// Code that only publishes, subscribes and makes requests can take a
+// Client instead of a *ShortbusClient, and be tested against a Fake, which
+// routes messages in memory, or a Mock, which records what it was asked.
+//
+// # Versions and stability
+//
+// The module is versioned on its own, with tags of the form client/vX.Y.Z,
+// and follows semantic versioning. Until v1 a minor release may still
+// change the API, each such change listed in its release notes; from v1 on
+// nothing exported is removed or changed incompatibly within a major
+// version. Fields and options are added as the protocol grows, so:
+//
+//   - construct Response, TopicSettings and the other structs with field
+//     names, never positionally;
+//   - don't implement the package's interfaces outside it, since they may
+//     gain methods.
+//
+// Error values (ErrClosed, ErrRateLimited, ...) are part of the API: check
+// them with errors.Is. Error messages are not.
+//
+// The client speaks protocol version 1 (see Response.Protocol), which the
+// broker keeps serving, so upgrading the broker doesn't need a new client.
+package client
@@ -0,0 +1,51 @@
+package client_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ahoward/shortbus/client"
+)
+
+func Example() {
+	c, err := client.NewClient(
+		client.WithName("go-example"),
+		client.WithOnConnect(func(id string) { fmt.Printf("Connected: %s\n", id) }),
+		client.WithOnDisconnect(func(err error) { fmt.Printf("Disconnected: %v\n", err) }),
+	)
+	if err != nil {
+		panic(err)
+	}
+	defer c.Shutdown()
+
+	resp, err := c.Ping()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Ping: %+v\n", resp)
+
+	c.Subscribe("events", func(msg client.Response) {
+		fmt.Printf("Received: %s %s (from %v)\n", msg.Topic, msg.Payload, msg.Metadata["published_by"])
+	})
+
+	c.Publish("events", "Hello from Go!", nil)
+	c.Publish("events", `{"user":"charlie","action":"purchase"}`, nil)
+
+	time.Sleep(2 * time.Second)
+}
+
+// ServeDebug serves pprof and expvar, with the client's stats, for a
+// process that misbehaves in production.
+func ExampleShortbusClient_ServeDebug() {
+	c, err := client.NewClient(client.WithName("billing"))
+	if err != nil {
+		panic(err)
+	}
+	defer c.Close()
+
+	addr, err := c.ServeDebug("localhost:6060")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Debug endpoints on http://%s/debug/pprof/\n", addr)
+}
@@ -0,0 +1,341 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Fake is an in-memory Client for tests of code that takes a Client: what
+// is published to a topic is handed to that topic's subscribers before
+// Publish returns, and Request gets its reply from whichever of them
+// publishes to the request's reply_to. There is no broker, so there are no
+// groups, acks or redeliveries: subscribe options are ignored, Ack does
+// nothing, and topics match exactly. Pause holds deliveries until Resume.
+//
+// Example:
+//
+//	fake := client.NewFake()
+//	fake.Subscribe("prices", func(msg client.Response) {
+//		fake.Publish(msg.Metadata["reply_to"].(string), "42", nil)
+//	})
+//	reply, _ := fake.Request("prices", "widget", nil, time.Second)
+type Fake struct {
+	mu        sync.Mutex
+	closed    bool
+	published map[string][]Response
+	subs      []*fakeSubscription
+	offsets   map[string]int
+	messages  int // across topics, for unique message IDs
+	inboxes   int
+}
+
+type fakeSubscription struct {
+	sub     *Subscription
+	handler MessageHandler
+	paused  bool
+	held    []Response
+	left    int // AutoUnsubscribe: deliveries until it ends, 0 for no limit
+}
+
+var _ Client = (*Fake)(nil)
+
+func NewFake() *Fake {
+	return &Fake{published: map[string][]Response{}, offsets: map[string]int{}}
+}
+
+// Publish delivers to topic's subscribers, in the order they subscribed,
+// and returns once they have all handled the message.
+func (f *Fake) Publish(topic, payload string, metadata map[string]interface{}, opts ...PublishOption) (Response, error) {
+	command := map[string]interface{}{"metadata": copyMetadata(metadata)}
+	for _, opt := range opts {
+		opt(command)
+	}
+
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return Response{}, ErrClosed
+	}
+
+	f.offsets[topic]++
+	f.messages++
+	msg := Response{
+		Type:      "message",
+		Topic:     topic,
+		Payload:   payload,
+		Metadata:  command["metadata"].(map[string]interface{}),
+		MessageID: MessageID(fmt.Sprintf("fake-%d", f.messages)),
+		ID:        f.offsets[topic],
+		Offset:    f.offsets[topic],
+		Sequence:  f.offsets[topic],
+		Timestamp: time.Now().UnixMilli(),
+	}
+	f.published[topic] = append(f.published[topic], msg)
+
+	var deliver []MessageHandler
+	for _, s := range f.subscriptions(topic) {
+		if s.paused {
+			s.held = append(s.held, msg)
+			continue
+		}
+		deliver = append(deliver, s.handler)
+		f.delivered(s)
+	}
+	f.mu.Unlock()
+
+	for _, handler := range deliver {
+		handler(msg)
+	}
+
+	return Response{Status: "ok", Op: "published", Topic: topic, MessageID: msg.MessageID, Offset: msg.Offset, AckedAfter: "fsync"}, nil
+}
+
+func (f *Fake) Subscribe(topic string, handler MessageHandler, opts ...SubscribeOption) (*Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil, ErrClosed
+	}
+
+	sub := &Subscription{Topic: topic, fake: f}
+	f.subs = append(f.subs, &fakeSubscription{sub: sub, handler: handler})
+	return sub, nil
+}
+
+// Request publishes with a reply_to inbox, as ShortbusClient.Request does,
+// and returns the first reply published to it.
+func (f *Fake) Request(topic, payload string, metadata map[string]interface{}, timeout time.Duration) (Response, error) {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	f.mu.Lock()
+	f.inboxes++
+	inbox := fmt.Sprintf("_INBOX.fake.%d", f.inboxes)
+	f.mu.Unlock()
+
+	replies := make(chan Response, 1)
+	sub, err := f.Subscribe(inbox, func(msg Response) {
+		select {
+		case replies <- msg:
+		default:
+		}
+	})
+	if err != nil {
+		return Response{}, err
+	}
+	defer sub.Unsubscribe()
+
+	metadata = copyMetadata(metadata)
+	metadata["reply_to"] = inbox
+	if _, err := f.Publish(topic, payload, metadata); err != nil {
+		return Response{}, err
+	}
+
+	select {
+	case reply := <-replies:
+		return reply, nil
+	case <-time.After(timeout):
+		return Response{}, ErrNoReply
+	}
+}
+
+// Close ends every subscription; later calls return ErrClosed.
+func (f *Fake) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	f.subs = nil
+	return nil
+}
+
+// Published is what has been published to topic, oldest first, as its
+// subscribers got it.
+func (f *Fake) Published(topic string) []Response {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]Response(nil), f.published[topic]...)
+}
+
+// subscriptions to topic; called with f.mu held.
+func (f *Fake) subscriptions(topic string) []*fakeSubscription {
+	var matched []*fakeSubscription
+	for _, s := range f.subs {
+		if s.sub.Topic == topic {
+			matched = append(matched, s)
+		}
+	}
+	return matched
+}
+
+// delivered counts a delivery towards s's AutoUnsubscribe; called with f.mu
+// held.
+func (f *Fake) delivered(s *fakeSubscription) {
+	if s.left == 0 {
+		return
+	}
+	if s.left--; s.left == 0 {
+		f.remove(s.sub)
+	}
+}
+
+func (f *Fake) remove(sub *Subscription) {
+	for i, s := range f.subs {
+		if s.sub == sub {
+			f.subs = append(f.subs[:i:i], f.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (f *Fake) find(sub *Subscription) *fakeSubscription {
+	for _, s := range f.subs {
+		if s.sub == sub {
+			return s
+		}
+	}
+	return nil
+}
+
+func (f *Fake) unsubscribe(sub *Subscription) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.remove(sub)
+	return nil
+}
+
+func (f *Fake) pause(sub *Subscription, paused bool) error {
+	f.mu.Lock()
+	s := f.find(sub)
+	if s == nil {
+		f.mu.Unlock()
+		return nil
+	}
+
+	s.paused = paused
+	var held []Response
+	if !paused {
+		held, s.held = s.held, nil
+	}
+	f.mu.Unlock()
+
+	for _, msg := range held {
+		f.mu.Lock()
+		live := f.find(sub) == s
+		if live {
+			f.delivered(s)
+		}
+		f.mu.Unlock()
+
+		if !live {
+			break
+		}
+		s.handler(msg)
+	}
+	return nil
+}
+
+func (f *Fake) autoUnsubscribe(sub *Subscription, n int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if s := f.find(sub); s != nil {
+		s.left = n
+	}
+	return nil
+}
+
+// Mock is a Client that records its calls and answers them with the
+// matching func field, or with a zero Response and nil error when that is
+// nil. Subscribe's default Subscription is inert: nothing is delivered to
+// it, and its methods return nil.
+//
+// Example:
+//
+//	mock := &client.Mock{
+//		PublishFunc: func(topic, payload string, metadata map[string]interface{}, opts ...client.PublishOption) (client.Response, error) {
+//			return client.Response{}, client.ErrDisconnected
+//		},
+//	}
+//	err := notify(mock)            // the code under test
+//	calls := mock.Calls("Publish") // what it tried to send
+type Mock struct {
+	PublishFunc   func(topic, payload string, metadata map[string]interface{}, opts ...PublishOption) (Response, error)
+	SubscribeFunc func(topic string, handler MessageHandler, opts ...SubscribeOption) (*Subscription, error)
+	RequestFunc   func(topic, payload string, metadata map[string]interface{}, timeout time.Duration) (Response, error)
+	CloseFunc     func() error
+
+	mu    sync.Mutex
+	calls []MockCall
+}
+
+// MockCall is one call to a Mock. Fields a method doesn't take are empty.
+type MockCall struct {
+	Method   string // Publish, Subscribe, Request or Close
+	Topic    string
+	Payload  string
+	Metadata map[string]interface{}
+	Handler  MessageHandler
+	Timeout  time.Duration
+}
+
+var _ Client = (*Mock)(nil)
+
+func (m *Mock) Publish(topic, payload string, metadata map[string]interface{}, opts ...PublishOption) (Response, error) {
+	m.record(MockCall{Method: "Publish", Topic: topic, Payload: payload, Metadata: metadata})
+	if m.PublishFunc == nil {
+		return Response{}, nil
+	}
+	return m.PublishFunc(topic, payload, metadata, opts...)
+}
+
+func (m *Mock) Subscribe(topic string, handler MessageHandler, opts ...SubscribeOption) (*Subscription, error) {
+	m.record(MockCall{Method: "Subscribe", Topic: topic, Handler: handler})
+	if m.SubscribeFunc == nil {
+		return &Subscription{Topic: topic, fake: NewFake()}, nil
+	}
+	return m.SubscribeFunc(topic, handler, opts...)
+}
+
+func (m *Mock) Request(topic, payload string, metadata map[string]interface{}, timeout time.Duration) (Response, error) {
+	m.record(MockCall{Method: "Request", Topic: topic, Payload: payload, Metadata: metadata, Timeout: timeout})
+	if m.RequestFunc == nil {
+		return Response{}, nil
+	}
+	return m.RequestFunc(topic, payload, metadata, timeout)
+}
+
+func (m *Mock) Close() error {
+	m.record(MockCall{Method: "Close"})
+	if m.CloseFunc == nil {
+		return nil
+	}
+	return m.CloseFunc()
+}
+
+// Calls returns the calls made to method so far, oldest first, or every
+// call when method is "".
+func (m *Mock) Calls(method string) []MockCall {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var calls []MockCall
+	for _, call := range m.calls {
+		if method == "" || call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+func (m *Mock) record(call MockCall) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.calls = append(m.calls, call)
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// quote stands in for application code written against Client.
+func quote(c Client, item string) (string, error) {
+	reply, err := c.Request("prices", item, nil, 100*time.Millisecond)
+	if err != nil {
+		return "", err
+	}
+	if _, err := c.Publish("quotes", item+"="+reply.Payload, nil); err != nil {
+		return "", err
+	}
+	return reply.Payload, nil
+}
+
+func TestFakeRoutesMessages(t *testing.T) {
+	fake := NewFake()
+
+	sub, err := fake.Subscribe("prices", func(msg Response) {
+		fake.Publish(msg.Metadata["reply_to"].(string), "42", nil)
+	})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	var quotes []string
+	quotesSub, _ := fake.Subscribe("quotes", func(msg Response) { quotes = append(quotes, msg.Payload) })
+
+	if price, err := quote(fake, "widget"); err != nil || price != "42" {
+		t.Fatalf("quote = %q, %v; want 42", price, err)
+	}
+	if len(quotes) != 1 || quotes[0] != "widget=42" {
+		t.Fatalf("quotes = %v, want the one published", quotes)
+	}
+	if published := fake.Published("quotes"); len(published) != 1 || published[0].Offset != 1 {
+		t.Fatalf("published = %+v", published)
+	}
+
+	quotesSub.Pause()
+	fake.Publish("quotes", "held", nil)
+	if len(quotes) != 1 {
+		t.Fatalf("paused subscription got %v", quotes)
+	}
+	quotesSub.Resume()
+	if len(quotes) != 2 || quotes[1] != "held" {
+		t.Fatalf("resumed subscription got %v, want the held message", quotes)
+	}
+
+	sub.Unsubscribe()
+	if _, err := quote(fake, "widget"); !errors.Is(err, ErrNoReply) {
+		t.Fatalf("quote with nobody answering: %v, want ErrNoReply", err)
+	}
+
+	fake.Close()
+	if _, err := fake.Publish("quotes", "late", nil); !errors.Is(err, ErrClosed) {
+		t.Fatalf("publish after close: %v, want ErrClosed", err)
+	}
+}
+
+func TestMockRecordsCalls(t *testing.T) {
+	mock := &Mock{
+		RequestFunc: func(topic, payload string, metadata map[string]interface{}, timeout time.Duration) (Response, error) {
+			return Response{Payload: "7"}, nil
+		},
+	}
+
+	if price, err := quote(mock, "gadget"); err != nil || price != "7" {
+		t.Fatalf("quote = %q, %v; want 7", price, err)
+	}
+
+	calls := mock.Calls("")
+	if len(calls) != 2 || calls[0].Method != "Request" || calls[1].Method != "Publish" || calls[1].Payload != "gadget=7" {
+		t.Fatalf("calls = %+v", calls)
+	}
+
+	mock.PublishFunc = func(topic, payload string, metadata map[string]interface{}, opts ...PublishOption) (Response, error) {
+		return Response{}, ErrDisconnected
+	}
+	if _, err := quote(mock, "gadget"); !errors.Is(err, ErrDisconnected) {
+		t.Fatalf("quote with publish failing: %v, want ErrDisconnected", err)
+	}
+
+	sub, _ := mock.Subscribe("prices", func(Response) {})
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatalf("unsubscribe from a mock subscription: %v", err)
+	}
+}
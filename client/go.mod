@@ -0,0 +1,3 @@
+module github.com/ahoward/shortbus/client
+
+go 1.22
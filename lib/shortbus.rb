@@ -16,6 +16,40 @@ module Shortbus
   class EngineError < Error
   end
 
+  class TopicError < Error
+  end
+
+  class AccessError < Error
+  end
+
+  # A rate limit refused the request: retry_after is how many seconds until
+  # it would be let through, pressure the share (0-1) of the last second's
+  # requests that were refused
+  class LimitError < AccessError
+    attr_reader :retry_after, :pressure
+
+    def initialize(message = nil, retry_after: nil, pressure: nil)
+      super(message)
+      @retry_after = retry_after
+      @pressure = pressure
+    end
+  end
+
+  # The broker was started read-only (SHORTBUS_READ_ONLY) and refused a write
+  class ReadOnlyError < AccessError
+  end
+
+  # A write's precondition (a stream's version, a topic's head) didn't hold;
+  # current is what it was instead
+  class ConflictError < Error
+    attr_reader :current
+
+    def initialize(message = nil, current: nil)
+      super(message)
+      @current = current
+    end
+  end
+
   class << Shortbus
     # Configuration
     def config
@@ -34,13 +68,22 @@ module Shortbus
       config.root = path
     end
 
+    # Serving a replica or snapshot: subscriptions and replays, no publishes
+    def read_only?
+      config.read_only?
+    end
+
+    def writable!
+      raise ReadOnlyError, "Broker is read-only" if read_only?
+    end
+
     # Logging
     def logger
       @logger
     end
 
-    def log!
-      @logger = Logger.new($stdout)
+    def log!(io = $stdout)
+      @logger = Logger.new(io)
       @logger.level = debug? ? Logger::DEBUG : Logger::INFO
       @logger
     end
@@ -71,16 +114,208 @@ module Shortbus
       @logger&.error("[shortbus] #{msg}")
     end
 
+    # Durations: 30, "30s", "5m", "2h", "7d" => seconds
+    def parse_duration(value)
+      return value.ceil if value.is_a?(Numeric)
+
+      match = value.to_s.strip.match(/\A(\d+(?:\.\d+)?)\s*(ms|s|m|h|d)?\z/)
+      raise ArgumentError, "invalid duration: #{value.inspect}" unless match
+
+      amount = Float(match[1])
+      scale = { 'ms' => 0.001, 's' => 1, 'm' => 60, 'h' => 3600, 'd' => 86_400 }.fetch(match[2] || 's')
+      (amount * scale).ceil
+    end
+
+    # Sizes: 4096, "512KB", "8MB", "1GB" => bytes
+    def parse_size(value)
+      return Integer(value) if value.is_a?(Numeric)
+
+      match = value.to_s.strip.match(/\A(\d+(?:\.\d+)?)\s*(b|kb|mb|gb)?\z/i)
+      raise ArgumentError, "invalid size: #{value.inspect}" unless match
+
+      scale = { 'b' => 1, 'kb' => 1024, 'mb' => 1024**2, 'gb' => 1024**3 }.fetch((match[2] || 'b').downcase)
+      (Float(match[1]) * scale).ceil
+    end
+
     # Engine (BlockQueue wrapper)
     def engine
       @engine ||= Engine.new
     end
 
+    # Per-topic settings
+    def topics
+      @topics ||= Topics.new
+    end
+
+    # Strict or automatic topic creation on publish
+    def topic_creation
+      @topic_creation ||= TopicCreation.new
+    end
+
+    # Cross-process subscriber registry
+    def subscribers
+      @subscribers ||= Subscribers.new
+    end
+
+    # Cross-process connection registry
+    def connections
+      @connections ||= Connections.new
+    end
+
+    # Consumer group positions
+    def groups
+      @groups ||= Groups.new
+    end
+
+    # Durable client sessions
+    def sessions
+      @sessions ||= Sessions.new
+    end
+
+    # Transaction commit markers
+    def transactions
+      @transactions ||= Transactions.new
+    end
+
+    # Publish dedupe keys
+    def dedupe
+      @dedupe ||= Dedupe.new
+    end
+
+    # Versioned event streams (event sourcing)
+    def streams
+      @streams ||= Streams.new
+    end
+
+    # Topic heads, for compare-and-publish
+    def heads
+      @heads ||= Heads.new
+    end
+
+    # Running message counts for max_depth
+    def depths
+      @depths ||= Depths.new
+    end
+
+    # Shared fsyncs for durable publishes
+    def group_commit
+      @group_commit ||= GroupCommit.new
+    end
+
+    # Exclusive use of the data directory, with fencing tokens
+    def data_lock
+      @data_lock ||= DataLock.new
+    end
+
+    # Engine recovery progress at startup
+    def recovery
+      @recovery ||= Recovery.new
+    end
+
+    # Idle topic collection
+    def topic_gc
+      @topic_gc ||= TopicGC.new
+    end
+
+    # Sparse time indexes, for replays that start at a time
+    def indexes
+      @indexes ||= Indexes.new
+    end
+
+    # Cron-style scheduled publishes
+    def schedules
+      @schedules ||= Schedules.new
+    end
+
+    # Background job state (enqueue/await)
+    def jobs
+      @jobs ||= Jobs.new
+    end
+
+    # Processing deadlines and expired-message counts
+    def deadlines
+      @deadlines ||= Deadlines.new
+    end
+
+    def delays
+      @delays ||= Delays.new
+    end
+
+    # Publish signature checks
+    def signatures
+      @signatures ||= Signatures.new
+    end
+
+    # Per-topic publish metrics
+    def metrics
+      @metrics ||= Metrics.new
+    end
+
+    # Rolling counts published to stats.TOPIC
+    def aggregates
+      @aggregates ||= Aggregates.new
+    end
+
+    # Routing rules applied to publishes (config/routes.yml)
+    def routes
+      @routes ||= Routes.new
+    end
+
+    # Shadow topics fed from mirrored topics
+    def mirrors
+      @mirrors ||= Mirrors.new
+    end
+
+    # Audit log of administrative actions
+    def audit
+      @audit ||= Audit.new
+    end
+
+    # Presence registry ($sys.presence)
+    def presence
+      @presence ||= Presence.new
+    end
+
+    # Leases on named locks (leader election)
+    def locks
+      @locks ||= Locks.new
+    end
+
+    # Aged-out message archival
+    def archiver
+      @archiver ||= Archiver.new
+    end
+
+    # Retention for topics that don't archive
+    def retention
+      @retention ||= Retention.new
+    end
+
+    # Compaction of compact: topics
+    def compactor
+      @compactor ||= Compactor.new
+    end
+
+    # Key-value buckets (over compacted topics)
+    def kv
+      @kv ||= KV.new
+    end
+
+    # Archived segment index (tiered storage)
+    def tiers
+      @tiers ||= Tiers.new
+    end
+
     # Process manager
     def process_manager
       @process_manager ||= ProcessManager.new
     end
 
+    # Daemon (background service lifecycle)
+    def daemon
+      @daemon ||= Daemon.new
+    end
+
     # File watcher
     def file_watcher
       @file_watcher ||= FileWatcher.new
@@ -92,9 +327,68 @@ module Shortbus
         version.rb
         config.rb
         engine.rb
+        message_id.rb
+        annotations.rb
+        envelope.rb
+        signatures.rb
+        auth.rb
+        topics.rb
+        backoff.rb
+        aging.rb
+        schema.rb
+        subscribers.rb
+        inbox.rb
+        topic_events.rb
+        topic_creation.rb
+        routes.rb
+        topic_gc.rb
+        connections.rb
+        groups.rb
+        sessions.rb
+        transactions.rb
+        dedupe.rb
+        streams.rb
+        heads.rb
+        depths.rb
+        group_commit.rb
+        deadlines.rb
+        metrics.rb
+        dashboard.rb
+        aggregates.rb
+        mirrors.rb
+        audit.rb
+        presence.rb
+        locks.rb
+        delays.rb
+        jobs.rb
+        cron.rb
+        schedules.rb
+        indexes.rb
+        deliver_policy.rb
+        work_queue.rb
+        tap.rb
+        admin.rb
+        archive.rb
+        s3.rb
+        archiver.rb
+        retention.rb
+        tiers.rb
+        compactor.rb
+        kv.rb
+        recovery.rb
+        data_lock.rb
         process_manager.rb
+        daemon.rb
         file_watcher.rb
+        outbound.rb
         pipe_mode.rb
+        listener.rb
+        http_gateway.rb
+        conformance.rb
+        repl.rb
+        completion.rb
+        doctor.rb
+        fsck.rb
       ]
 
       Shortbus.log! if config.log?
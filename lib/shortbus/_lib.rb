@@ -2,7 +2,7 @@ module Shortbus
   class << self
     def libs
       %w[
-        socket fileutils pathname yaml json logger uri net/http time date thread securerandom
+        socket fileutils pathname yaml json logger uri net/http openssl time date thread monitor securerandom zlib open3
       ]
     end
 
@@ -0,0 +1,125 @@
+module Shortbus
+  # Administrative operations on topic contents
+  #
+  # Shared by pipe mode and the CLI so both behave identically.
+  #
+  # Example:
+  #   Shortbus::Admin.purge('jobs')                  # drop the backlog
+  #   Shortbus::Admin.delete_message('jobs', 42)     # drop one message
+  #   Shortbus::Admin.requeue('jobs.dlq')            # DLQ -> original topic
+  #   Shortbus::Admin.quarantine('jobs', msg, errors: [...])  # -> poison topic
+  #   Shortbus::Admin.describe_topics('orders.*')    # discovery for clients
+  module Admin
+    # Messages per page when counting a topic's depth
+    DEPTH_PAGE = 1000
+
+    def purge(topic, engine: Shortbus.engine)
+      engine.purge(topic)
+    end
+
+    def delete_message(topic, id, engine: Shortbus.engine)
+      engine.delete_message(topic, id)
+    end
+
+    # Move messages out of a dead-letter topic and back where they came from.
+    # The destination is, in order: to:, the message's original_topic
+    # metadata, or the one topic configured with dlq: <this topic>.
+    def requeue(dlq, to: nil, limit: 1000, engine: Shortbus.engine, topics: Shortbus.topics)
+      fallback = to || dlq_source(dlq, topics:)
+      messages = engine.fetch_messages(dlq, offset: 0, limit:)
+      requeued = Hash.new(0)
+
+      messages.each do |message|
+        metadata = message[:metadata] || {}
+        destination = to || metadata[:original_topic] || fallback
+        raise TopicError, "Cannot tell where #{dlq} message #{message[:id]} came from, pass a destination" unless destination
+
+        metadata = metadata.reject { |key, _| key == :original_topic }.merge(requeued_from: dlq)
+        engine.publish(destination, message[:payload], metadata:, **same_id(message))
+        engine.delete_message(dlq, message[:id])
+
+        requeued[destination] += 1
+      end
+
+      { topic: dlq, requeued: requeued.values.sum, destinations: requeued }
+    end
+
+    # Move a message that keeps failing out of the way, with its error
+    # history. It carries original_topic, so requeue can send it back once
+    # the handler is fixed.
+    def quarantine(topic, message, errors:, engine: Shortbus.engine, topics: Shortbus.topics)
+      poison = topics.poison_topic(topic)
+      metadata = (message[:metadata] || {}).merge(
+        original_topic: topic,
+        original_id: message[:id],
+        errors: errors,
+        quarantined_at: Time.now.utc.iso8601
+      )
+
+      engine.publish(poison, message[:payload], metadata:, **same_id(message))
+      poison
+    end
+
+    # A moved message keeps its message_id (its offset is new)
+    def same_id(message)
+      message[:message_id] ? { annotations: { message_id: message[:message_id] } } : {}
+    end
+
+    # Every topic the broker knows of, in the engine or in config, whose name
+    # matches pattern (a glob, e.g. "orders.*"), with what a client needs to
+    # choose one. Inboxes are private to their connection, so never listed.
+    def describe_topics(pattern = nil, engine: Shortbus.engine, topics: Shortbus.topics, subscribers: Shortbus.subscribers)
+      configured = topics.all
+      names = engine.list_topics.map { |topic| topic.is_a?(Hash) ? topic[:name].to_s : topic.to_s } | configured.keys
+      names = names.reject { |name| Inbox.inbox?(name) }
+      names = names.select { |name| File.fnmatch?(pattern.to_s, name) } if pattern
+
+      names.sort.map do |name|
+        settings = configured[name] || {}
+
+        {
+          name: name,
+          depth: depth(name, engine:),
+          subscribers: subscribers.count(name),
+          retention: settings[:retention],
+          settings: settings
+        }
+      end
+    end
+
+    # Messages retained in the engine; archived ones don't count. Counting
+    # stops at up_to, for callers that only need to know if it's reached.
+    def depth(topic, engine: Shortbus.engine, up_to: nil)
+      depth = 0
+      offset = 0
+
+      loop do
+        page = engine.fetch_messages(topic, offset:, limit: DEPTH_PAGE, tiered: false)
+        depth += page.size
+        break if page.size < DEPTH_PAGE || (up_to && depth >= up_to)
+
+        offset = page.last[:id] + 1
+      end
+
+      depth
+    end
+
+    # Refuses adding messages (one publish, or a transaction's share) to a
+    # topic they would take past max_depth. The count is kept running (see
+    # Depths), so a check reads only what was published since the last one;
+    # topics without a limit pay nothing.
+    def check_depth!(topic, adding: 1, engine: Shortbus.engine, topics: Shortbus.topics, depths: Shortbus.depths)
+      max = topics.max_depth(topic)
+      return unless max
+
+      raise TopicError, "#{topic} is full: max_depth is #{max}" if depths.full?(topic, max, adding:, engine:)
+    end
+
+    def dlq_source(dlq, topics: Shortbus.topics)
+      sources = topics.all.select { |_, settings| settings[:dlq] == dlq.to_s }.keys
+      sources.size == 1 ? sources.first : nil
+    end
+
+    extend self
+  end
+end
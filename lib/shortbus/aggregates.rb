@@ -0,0 +1,153 @@
+module Shortbus
+  # Rolling publish counts, published to stats.TOPIC
+  #
+  # Topics with stats set have their messages counted over rolling windows,
+  # and a summary published to stats.TOPIC every INTERVAL, for dashboards
+  # that only need counts and rates:
+  #
+  #   shortbus topic update orders --stats true        # 1m and 1h windows
+  #   shortbus topic update orders --stats 10s,5m,1d
+  #
+  #   { "topic": "orders", "at": "...", "total": 98231,
+  #     "windows": { "1m": { "window": 60, "count": 120, "bytes": 9600, "rate": 2.0 }, "1h": {...} } }
+  #
+  # rate is messages per second over the window. The daemon reads each
+  # topic from where its last pass stopped, so every process's publishes
+  # are counted, and keeps per-window counts in stats/TOPIC.json: SLOTS
+  # slots per window, so counts are exact to within a slot's width.
+  # stats.* topics can't have stats of their own.
+  class Aggregates
+    PREFIX = 'stats.'
+    DEFAULT_WINDOWS = [60, 3600].freeze
+    SLOTS = 60
+    BATCH = 500
+    INTERVAL = 10
+
+    attr_reader :config
+
+    # true for DEFAULT_WINDOWS, else durations: "10s,5m" or a list
+    def self.normalize(value)
+      return DEFAULT_WINDOWS.dup if value == true || value.to_s.match?(/\A(true|1|yes)\z/i)
+
+      windows = (value.is_a?(String) ? value.split(',') : Array(value)).map { |window| Shortbus.parse_duration(window) }
+      raise ArgumentError, "stats needs at least one window" if windows.empty?
+      raise ArgumentError, "stats windows must be positive" unless windows.all?(&:positive?)
+
+      windows.uniq.sort
+    end
+
+    # 60 => "1m", 86400 => "1d"
+    def self.label(seconds)
+      { 'd' => 86_400, 'h' => 3600, 'm' => 60 }.each do |unit, scale|
+        return "#{seconds / scale}#{unit}" if (seconds % scale).zero?
+      end
+      "#{seconds}s"
+    end
+
+    def initialize(config: Shortbus.config, engine: Shortbus.engine, topics: Shortbus.topics)
+      @config = config
+      @engine = engine
+      @topics = topics
+    end
+
+    # Count what each stats topic (or just topic) has gained and publish its
+    # summary; returns { topic => summary }
+    def tick!(topic = nil, now: Time.now)
+      names = topic ? [topic.to_s] : @topics.all.keys
+
+      names.each_with_object({}) do |name, summaries|
+        windows = (@topics.get(name) || {})[:stats]
+        next unless windows
+        next if name.start_with?(PREFIX)
+
+        summary = locked(name) do |state|
+          count!(name, state, windows, now)
+          summarize(name, state, windows, now)
+        end
+
+        publish(name, summary)
+        summaries[name] = summary
+      end
+    end
+
+    def path(topic)
+      config.stats_dir / "#{topic}.json"
+    end
+
+    private
+
+    def count!(name, state, windows, now)
+      loop do
+        messages = @engine.fetch_messages(name, offset: state[:offset], limit: BATCH, tiered: false)
+        break if messages.empty?
+
+        messages.each do |message|
+          time = (DeliverPolicy.message_time(message) || now).to_i
+          size = message[:payload].to_s.bytesize
+          state[:total] += 1
+
+          windows.each do |window|
+            next if time <= now.to_i - window
+
+            slots = state[:slots][window.to_s.to_sym] ||= {}
+            slot = slots[slot_for(time, window).to_s.to_sym] ||= [0, 0]
+            slot[0] += 1
+            slot[1] += size
+          end
+        end
+
+        state[:offset] = messages.last[:id] + 1
+        break if messages.size < BATCH
+      end
+
+      # Slots that have slid out of every window go
+      state[:slots].each do |window, slots|
+        slots.reject! { |slot, _| slot.to_s.to_i <= now.to_i - window.to_s.to_i - width(window.to_s.to_i) }
+      end
+    end
+
+    def summarize(name, state, windows, now)
+      summaries = windows.to_h do |window|
+        slots = (state[:slots][window.to_s.to_sym] || {}).select { |slot, _| slot.to_s.to_i > now.to_i - window - width(window) }
+        count = slots.values.sum { |slot| slot[0] }
+        bytes = slots.values.sum { |slot| slot[1] }
+
+        [Aggregates.label(window), { window:, count:, bytes:, rate: (count.to_f / window).round(3) }]
+      end
+
+      { topic: name, at: now.utc.iso8601(3), total: state[:total], windows: summaries }
+    end
+
+    def slot_for(time, window)
+      time - time % width(window)
+    end
+
+    def width(window)
+      [window / SLOTS, 1].max
+    end
+
+    # Best effort, as with topic events
+    def publish(name, summary)
+      @engine.publish("#{PREFIX}#{name}", JSON.generate(summary), metadata: { stats: name })
+    rescue Shortbus::Error => e
+      Shortbus.warn "Failed to publish stats for #{name}: #{e.message}"
+    end
+
+    def locked(topic)
+      FileUtils.mkdir_p(config.stats_dir)
+
+      File.open(path(topic), File::RDWR | File::CREAT, 0o644) do |file|
+        file.flock(File::LOCK_EX)
+        json = file.read
+        state = json.strip.empty? ? {} : JSON.parse(json, symbolize_names: true)
+        state = { offset: state[:offset] || 0, total: state[:total] || 0, slots: state[:slots] || {} }
+        result = yield state
+
+        file.rewind
+        file.truncate(0)
+        file.write(JSON.generate(state))
+        result
+      end
+    end
+  end
+end
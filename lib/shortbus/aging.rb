@@ -0,0 +1,72 @@
+module Shortbus
+  # Priority aging
+  #
+  # Group fetches hand out higher metadata.priority first, so a steady flood
+  # of high-priority work would keep pushing low-priority messages to the back
+  # of every batch. A topic's priority_aging setting raises a message's
+  # effective priority the longer it has waited since it was published:
+  #
+  #   priority_aging: 1m                        # +1 per minute waited
+  #   priority_aging: { every: 1m, max: 5 }     # likewise, never more than +5
+  #   priority_aging: [30s, 2m, 10m]            # +1 after 30s, +2 after 2m, +3 after 10m
+  #
+  # Aging only reorders; the priority stored on the message is unchanged.
+  # Policies are stored normalized, with string keys and durations in
+  # seconds, so they round-trip through topics.yml.
+  module Aging
+    STRATEGIES = %w[linear schedule].freeze
+
+    module_function
+
+    def normalize(value)
+      case value
+      when String
+        # "30s,2m,10m" (e.g. from the CLI) is a schedule
+        return normalize(value.split(',').map(&:strip)) if value.include?(',')
+
+        normalize('strategy' => 'linear', 'every' => value)
+      when Numeric
+        normalize('strategy' => 'linear', 'every' => value)
+      when Array
+        normalize('strategy' => 'schedule', 'after' => value)
+      when Hash
+        policy = value.transform_keys(&:to_s)
+
+        case policy['strategy']&.to_s || (policy.key?('after') ? 'schedule' : 'linear')
+        when 'linear'
+          every = Shortbus.parse_duration(policy['every'])
+          raise ArgumentError, "priority_aging every must be positive" unless every.positive?
+
+          max = policy['max'] && Integer(policy['max'])
+          raise ArgumentError, "priority_aging max must be positive" if max && !max.positive?
+
+          { 'strategy' => 'linear', 'every' => every, 'max' => max }.compact
+        when 'schedule'
+          after = Array(policy['after']).map { |age| Shortbus.parse_duration(age) }
+          raise ArgumentError, "priority_aging schedule must list at least one age" if after.empty?
+
+          { 'strategy' => 'schedule', 'after' => after.sort }
+        else
+          raise ArgumentError, "priority_aging strategy must be one of: #{STRATEGIES.join(', ')}"
+        end
+      else
+        raise ArgumentError, "invalid priority_aging: #{value.inspect}"
+      end
+    end
+
+    # Levels added to the priority of a message waiting age seconds
+    def boost(policy, age)
+      return 0 unless policy && age.positive?
+
+      policy = policy.transform_keys(&:to_s)
+
+      case policy['strategy']
+      when 'schedule'
+        policy['after'].count { |after| age >= after }
+      else
+        levels = (age / policy['every']).floor
+        policy['max'] ? [levels, policy['max']].min : levels
+      end
+    end
+  end
+end
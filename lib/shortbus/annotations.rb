@@ -0,0 +1,82 @@
+module Shortbus
+  # Broker-side message annotations
+  #
+  # Facts the broker (not the publisher) records about a message, kept apart
+  # from user metadata so clients can trust them and publishers can't forge
+  # them:
+  #
+  #   message_id        the message's id (a UUIDv7, see MessageId)
+  #   received_at       when the broker accepted the publish (ISO8601)
+  #   node_id           which broker accepted it (SHORTBUS_NODE_ID, else the host)
+  #   redelivery_count  acked fetches: how many times it was handed out before
+  #   origin            where a bridge or import brought it in from
+  #
+  # They travel through the engine in metadata under a reserved key and are
+  # split back out on every read, so deliveries carry them as their own
+  # "annotations" section. Plugins add their own at publish time:
+  #
+  #   Shortbus::Annotations.register(:region) { |topic, metadata| ENV['REGION'] }
+  #
+  # A hook returning nil adds nothing; one that raises is logged and skipped.
+  module Annotations
+    KEY = :_annotations
+
+    @hooks = {}
+    @mutex = Mutex.new
+
+    def register(name, &block)
+      raise ArgumentError, "Annotation hook needs a block" unless block
+
+      @mutex.synchronize { @hooks[name.to_sym] = block }
+    end
+
+    def unregister(name)
+      @mutex.synchronize { @hooks.delete(name.to_sym) }
+    end
+
+    def hooks
+      @mutex.synchronize { @hooks.dup }
+    end
+
+    # metadata as published, carrying the broker's annotations (plus extra,
+    # e.g. a bridge's origin, or the message_id of a message being moved);
+    # anything a client put under KEY is dropped
+    def stamp(topic, metadata, extra = {}, config: Shortbus.config)
+      metadata = (metadata || {}).transform_keys(&:to_sym).except(KEY)
+
+      now = Time.now
+      annotations = { message_id: MessageId.generate(now), received_at: now.utc.iso8601(3), node_id: config.node_id }
+
+      hooks.each do |name, hook|
+        value = hook.call(topic.to_s, metadata)
+        annotations[name] = value unless value.nil?
+      rescue => e
+        Shortbus.warn "Annotation hook #{name} failed: #{e.message}"
+      end
+
+      metadata.merge(KEY => annotations.merge(extra.transform_keys(&:to_sym)).compact)
+    end
+
+    # A message as read from the engine, with its annotations moved out of
+    # metadata into their own section, and its message_id alongside its id
+    def split(message)
+      metadata = message[:metadata]
+      message =
+        if metadata.is_a?(Hash) && metadata.key?(KEY)
+          message.merge(metadata: metadata.except(KEY), annotations: (message[:annotations] || {}).merge(metadata[KEY] || {}))
+        else
+          message.merge(annotations: message[:annotations] || {})
+        end
+
+      message_id = message[:annotations][:message_id]
+      message_id ? message.merge(message_id:) : message
+    end
+
+    # Delivery-time annotations (e.g. redelivery_count)
+    def annotate(message, **annotations)
+      message.merge(annotations: (message[:annotations] || {}).merge(annotations))
+    end
+
+    extend self
+  end
+end
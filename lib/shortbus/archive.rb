@@ -0,0 +1,107 @@
+module Shortbus
+  # Portable topic archives
+  #
+  # An archive is NDJSON, one retained message per line, gzipped when the
+  # file name ends in .gz ('-' is stdin/stdout):
+  #
+  #   {"id": 41, "topic": "jobs", "payload": "...", "metadata": {...}, "timestamp": 1729425600}
+  #
+  # Exports are in id order and are plain enough for jq, DuckDB, or Spark.
+  # The engine assigns new ids on import, so each imported message carries
+  # original_id and original_timestamp in its metadata (messages that
+  # already have them, from an earlier hop, keep the first ones), and an
+  # import:TOPIC origin annotation unless it came in with one; its
+  # message_id, being global, is kept as it was. Imports are
+  # deduplicated on the original topic and id, so re-running one after a
+  # failure doesn't double anything up.
+  #
+  # Example:
+  #   Shortbus::Archive.export('jobs', 'jobs.ndjson.gz')      # => 1200
+  #   Shortbus::Archive.import('jobs.ndjson.gz', to: 'jobs.replay')
+  module Archive
+    BATCH = 500
+
+    # Write topic's retained messages to path, returning how many
+    def export(topic, path, limit: nil, engine: Shortbus.engine)
+      count = 0
+
+      open_archive(path, 'w') do |io|
+        offset = 0
+
+        loop do
+          batch = limit ? [BATCH, limit - count].min : BATCH
+          break if batch <= 0
+
+          messages = engine.fetch_messages(topic, offset:, limit: batch)
+          break if messages.empty?
+
+          messages.each { |message| io.puts JSON.generate(message.compact) }
+          count += messages.size
+          offset = messages.last[:id] + 1
+        end
+      end
+
+      count
+    end
+
+    # Publish every message in the archive at path, to its own topic or to:,
+    # returning { imported:, duplicates:, topics: { name => count } }
+    def import(path, to: nil, engine: Shortbus.engine, dedupe: Shortbus.dedupe)
+      imported = Hash.new(0)
+      duplicates = 0
+
+      open_archive(path, 'r') do |io|
+        io.each_line do |line|
+          next if line.strip.empty?
+
+          message = JSON.parse(line, symbolize_names: true)
+          topic = to || message[:topic]
+          raise ArgumentError, "Archive line has no topic and no destination was given" unless topic
+
+          metadata = message[:metadata] || {}
+          metadata = {
+            original_id: message[:id],
+            original_timestamp: message[:timestamp],
+            **metadata
+          }.compact
+
+          key = metadata[:original_id] && "import:#{message[:topic]}:#{metadata[:original_id]}"
+          origin = { origin: message.dig(:annotations, :origin) || "import:#{message[:topic]}", message_id: message[:message_id] }.compact
+          result = dedupe.publish(topic, key) { engine.publish(topic, message[:payload], metadata:, annotations: origin) }
+
+          if result[:duplicate]
+            duplicates += 1
+          else
+            imported[topic] += 1
+          end
+        end
+      end
+
+      { imported: imported.values.sum, duplicates:, topics: imported }
+    end
+
+    def open_archive(path, mode, &block)
+      path = path.to_s
+
+      if path == '-'
+        io = mode == 'w' ? $stdout : $stdin
+        gzip = false
+      else
+        io = File.open(path, "#{mode}b")
+        gzip = path.end_with?('.gz')
+      end
+
+      if gzip
+        io = mode == 'w' ? Zlib::GzipWriter.new(io) : Zlib::GzipReader.new(io)
+      end
+
+      begin
+        block.call(io)
+      ensure
+        io.close unless io == $stdout || io == $stdin
+      end
+    end
+
+    extend self
+  end
+end
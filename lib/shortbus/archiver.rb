@@ -0,0 +1,270 @@
+module Shortbus
+  # Archival of aged-out messages
+  #
+  # Topics with both retention and archive set have messages older than
+  # retention moved out of the engine into archive files, partitioned the way
+  # DuckDB, Spark, and Athena expect:
+  #
+  #   DEST/topic=jobs/date=2024-10-20/jobs-41-97.ndjson.gz
+  #   DEST/topic=jobs/date=2024-10-20/jobs-41-97.parquet
+  #
+  #   shortbus topic update jobs --retention 7d --archive true                 # rendezvous/archive
+  #   shortbus topic update jobs --retention 7d --archive s3://bucket/shortbus  # S3 or compatible
+  #   shortbus topic update jobs --archive-format parquet                      # needs red-parquet
+  #
+  # The daemon runs a pass every ARCHIVE_INTERVAL; `shortbus archive` runs
+  # one by hand. A file is written in full before its messages are deleted,
+  # so a crash in between archives them again on the next pass rather than
+  # losing them: expect the occasional duplicate, keyed by id, downstream.
+  # Topics with retention but no archive simply lose them (see Retention).
+  #
+  # Each file is recorded in the tier index (see Tiers), so replays from an
+  # offset that has aged out read it back transparently. Recording checks
+  # the data directory's fencing token first (see DataLock): an archiver
+  # whose broker has been superseded stops before deleting anything.
+  class Archiver
+    FORMATS = %w[ndjson parquet].freeze
+    BATCH = 500
+    ARCHIVE_INTERVAL = 60
+
+    attr_reader :config
+
+    def initialize(config: Shortbus.config, engine: Shortbus.engine, topics: Shortbus.topics, tiers: Shortbus.tiers,
+                   data_lock: Shortbus.data_lock)
+      @config = config
+      @engine = engine
+      @topics = topics
+      @tiers = tiers
+      @data_lock = data_lock
+    end
+
+    # One pass over every archiving topic (or just topic); returns
+    # { topic => messages archived }
+    def archive!(topic = nil, now: Time.now)
+      names = topic ? [topic.to_s] : @topics.all.keys
+
+      names.each_with_object({}) do |name, archived|
+        settings = @topics.get(name) || {}
+        next unless settings[:archive] && settings[:retention]
+
+        archived[name] = archive_topic(name, settings, cutoff: now - settings[:retention])
+      end
+    end
+
+    # Where archive files go for a topic's archive setting
+    def sink(destination)
+      case destination
+      when true, 'true' then LocalSink.new(config.archive_dir)
+      when %r{\As3://} then S3Sink.new(*S3.from_url(destination))
+      else LocalSink.new(Pathname.new(destination.to_s))
+      end
+    end
+
+    def encode(messages, format)
+      case format
+      when 'parquet'
+        parquet(messages)
+      else
+        Zlib.gzip(messages.map { |message| JSON.generate(message.compact) + "\n" }.join)
+      end
+    end
+
+    def decode(body, format)
+      case format
+      when 'parquet'
+        load_parquet(body)
+      else
+        Zlib.gunzip(body).each_line.map { |line| JSON.parse(line, symbolize_names: true) }
+      end
+    end
+
+    # The messages in an archive file. Local ndjson files are read through a
+    # memory map and inflated a chunk at a time, so replaying a large segment
+    # doesn't hold it in the heap both compressed and inflated; anything else
+    # is decoded from the whole body.
+    def load(sink, key, format)
+      return inflate_lines(sink, key) if sink.is_a?(LocalSink) && format != 'parquet'
+
+      decode(sink.read(key), format)
+    end
+
+    private
+
+    def archive_topic(name, settings, cutoff:)
+      sink = sink(settings[:archive])
+      format = settings[:archive_format] || 'ndjson'
+      archived = 0
+
+      loop do
+        # Aged-out messages are always the oldest, so the head is all we need
+        expired = @engine.fetch_messages(name, offset: 0, limit: BATCH, tiered: false).take_while do |message|
+          time = DeliverPolicy.message_time(message)
+          time && time < cutoff
+        end
+        break if expired.empty?
+
+        expired.group_by { |message| DeliverPolicy.message_time(message).utc.strftime('%Y-%m-%d') }.each do |date, messages|
+          # Published with persist: false; they go without a trace
+          kept = messages.reject { |message| message.dig(:metadata, :transient) }
+
+          if kept.any?
+            key = key(name, date, kept, format)
+            sink.write(key, encode(kept, format))
+            # Superseded by another broker: leave its topics to it
+            token = @data_lock.fence!
+            @tiers.record(name, first: kept.first[:id], last: kept.last[:id], destination: settings[:archive], key:, format:, token:)
+          end
+
+          messages.each { |message| @engine.delete_message(name, message[:id]) }
+          archived += kept.size
+        end
+
+        break if expired.size < BATCH
+      end
+
+      Shortbus.info "Archived #{archived} message(s) from #{name}" if archived > 0
+      archived
+    end
+
+    def key(topic, date, messages, format)
+      extension = format == 'parquet' ? 'parquet' : 'ndjson.gz'
+      "topic=#{topic}/date=#{date}/#{topic}-#{messages.first[:id]}-#{messages.last[:id]}.#{extension}"
+    end
+
+    def parquet(messages)
+      require_parquet!
+
+      table = Arrow::Table.new(
+        'id' => messages.map { |message| message[:id].to_i },
+        'topic' => messages.map { |message| message[:topic].to_s },
+        'payload' => messages.map { |message| message[:payload].to_s },
+        'metadata' => messages.map { |message| JSON.generate(message[:metadata] || {}) },
+        'timestamp' => messages.map { |message| DeliverPolicy.message_time(message).to_i }
+      )
+
+      buffer = Arrow::ResizableBuffer.new(4096)
+      table.save(buffer, format: :parquet)
+      buffer.data.to_s
+    end
+
+    def inflate_lines(sink, key)
+      inflate = Zlib::Inflate.new(Zlib::MAX_WBITS + 32) # gzip framing
+      messages = []
+      rest = +''
+
+      parse = lambda do |text|
+        rest << text
+        lines = rest.split("\n", -1)
+        rest = lines.pop
+        lines.each { |line| messages << JSON.parse(line, symbolize_names: true) unless line.empty? }
+      end
+
+      sink.each_chunk(key) { |chunk| parse.call(inflate.inflate(chunk)) }
+      parse.call(inflate.finish + "\n")
+      messages
+    ensure
+      inflate&.close
+    end
+
+    def load_parquet(body)
+      require_parquet!
+
+      table = Arrow::Table.load(Arrow::Buffer.new(body), format: :parquet)
+      table.each_record.map do |record|
+        {
+          id: record['id'],
+          topic: record['topic'],
+          payload: record['payload'],
+          metadata: JSON.parse(record['metadata'], symbolize_names: true),
+          timestamp: record['timestamp']
+        }
+      end
+    end
+
+    def require_parquet!
+      require 'parquet'
+    rescue LoadError
+      raise ConfigurationError, "Parquet archives need the red-parquet gem (gem install red-parquet)"
+    end
+
+    class LocalSink
+      CHUNK = 1 << 20
+
+      attr_reader :dir
+
+      def initialize(dir)
+        @dir = dir
+      end
+
+      def write(key, body)
+        path = dir / key
+        FileUtils.mkdir_p(path.dirname)
+
+        tmp = path.sub_ext("#{path.extname}.#{Process.pid}.tmp")
+        File.binwrite(tmp, body)
+        File.rename(tmp, path)
+      end
+
+      def read(key)
+        File.binread(dir / key)
+      end
+
+      # Yields the file's bytes CHUNK at a time, from a read-only memory map
+      # where the platform supports one, else read as usual
+      def each_chunk(key)
+        File.open(dir / key, 'rb') do |file|
+          buffer = map(file)
+
+          unless buffer
+            while (chunk = file.read(CHUNK))
+              yield chunk
+            end
+            return
+          end
+
+          begin
+            (0...buffer.size).step(CHUNK) { |offset| yield buffer.get_string(offset, [CHUNK, buffer.size - offset].min) }
+          ensure
+            buffer.free
+          end
+        end
+      end
+
+      private
+
+      def map(file)
+        return nil unless defined?(IO::Buffer) && file.size.positive?
+
+        # IO::Buffer warns that it is experimental on first use
+        experimental = Warning[:experimental]
+        Warning[:experimental] = false
+        IO::Buffer.map(file, nil, 0, IO::Buffer::READONLY)
+      rescue NotImplementedError, SystemCallError, IO::Buffer::AllocationError
+        nil
+      ensure
+        Warning[:experimental] = experimental unless experimental.nil?
+      end
+    end
+
+    class S3Sink
+      def initialize(s3, prefix)
+        @s3 = s3
+        @prefix = prefix
+      end
+
+      def write(key, body)
+        @s3.put(object(key), body)
+      end
+
+      def read(key)
+        @s3.get(object(key))
+      end
+
+      private
+
+      def object(key)
+        [@prefix, key].reject(&:empty?).join('/')
+      end
+    end
+  end
+end
@@ -0,0 +1,79 @@
+module Shortbus
+  # Audit log of administrative actions
+  #
+  # Topic creates, updates (settings such as signers and schema, the
+  # topic's access rules) and deletes, purges, message deletes and
+  # requeues, group pauses and resumes, and schedule changes, whether from
+  # pipe mode, the CLI or the REPL, are appended to logs/audit.log inside
+  # the rendezvous, one JSON line each:
+  #
+  #   {"at": "2026-10-14T09:30:00.123Z", "action": "purge", "by": "billing", "via": "pipe", "outcome": "ok", "params": {"topic": "jobs"}}
+  #
+  # Admin ops an authenticated connection isn't permitted are recorded with
+  # outcome "denied". Each entry is also published to $sys.audit, which
+  # clients can't publish to, for anyone who wants to watch. The file is
+  # only ever appended to, under a lock, so entries from concurrent
+  # processes don't interleave.
+  #
+  # Example:
+  #   Shortbus.audit.record(:purge, by: 'cli', via: 'cli', topic: 'jobs')
+  #   Shortbus.audit.entries(action: 'purge', limit: 10)
+  class Audit
+    TOPIC = '$sys.audit'
+
+    attr_reader :config
+
+    def initialize(config: Shortbus.config)
+      @config = config
+    end
+
+    def record(action, by:, via:, outcome: 'ok', engine: Shortbus.engine, **params)
+      entry = {
+        at: Time.now.utc.iso8601(3),
+        action: action.to_s,
+        by: by.to_s,
+        via: via.to_s,
+        outcome: outcome.to_s,
+        params: params.compact
+      }
+
+      FileUtils.mkdir_p(path.dirname)
+      File.open(path, File::WRONLY | File::APPEND | File::CREAT) do |file|
+        file.flock(File::LOCK_EX)
+        file.write(JSON.generate(entry) + "\n")
+      end
+
+      publish(entry, engine)
+      entry
+    end
+
+    # Recorded entries, oldest first, optionally filtered; since is a Time
+    def entries(action: nil, by: nil, since: nil, limit: nil)
+      return [] unless path.exist?
+
+      entries = File.foreach(path).filter_map do |line|
+        JSON.parse(line, symbolize_names: true)
+      rescue JSON::ParserError
+        nil
+      end
+
+      entries.select! { |entry| entry[:action] == action.to_s } if action
+      entries.select! { |entry| entry[:by] == by.to_s } if by
+      entries.select! { |entry| Time.iso8601(entry[:at]) >= since } if since
+      limit ? entries.last(limit) : entries
+    end
+
+    def path
+      config.audit_log
+    end
+
+    private
+
+    # Best effort: the file is the record, the topic a convenience
+    def publish(entry, engine)
+      engine.publish(TOPIC, JSON.generate(entry), metadata: { action: entry[:action], by: entry[:by] })
+    rescue Shortbus::Error => e
+      Shortbus.debug "Audit entry not published to #{TOPIC}: #{e.message}"
+    end
+  end
+end
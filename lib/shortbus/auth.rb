@@ -0,0 +1,424 @@
+module Shortbus
+  # Pluggable authentication for `shortbus listen`
+  #
+  # A provider turns a connection's credentials into an Identity, or nil
+  # when they aren't its kind or don't check out. Credentials are the
+  # connect line's fields (token, username, password) plus, over TLS with a
+  # client CA, the peer certificate. Providers are tried in order and the
+  # first identity wins; config/auth.yml lists them:
+  #
+  #   providers:
+  #     - type: token                       # a shared secret (SHORTBUS_TOKEN works too)
+  #       token: s3cret
+  #     - type: mtls                        # client certificates, by common name
+  #       users: { pos-1: { publish: ["sales.*"] } }
+  #     - type: password                    # config/users.yml, see PasswordProvider.digest
+  #     - type: http                        # an external check, e.g. the org's SSO
+  #       url: https://sso.example.com/shortbus/check
+  #     - type: jwt                         # signed tokens, claims mapped to permissions
+  #       public_key: config/jwt.pem
+  #       issuer: https://sso.example.com
+  #
+  # Identities carry permissions, glob patterns per action (nil allows
+  # everything):
+  #
+  #   { publish: ["orders.*"], subscribe: ["orders.*", "audit"], admin: false }
+  #
+  # and optionally rate limits, per action ("100/s", "600/m", or a number
+  # per second), and an expiry after which everything is refused until the
+  # connection sends a fresh token (the refresh_token op).
+  #
+  # The listener hands the identity to the connection's pipe process, which
+  # refuses ops it doesn't allow. Plug in a provider of your own with
+  #
+  #   Shortbus::Auth.register(:ldap, LdapProvider)   # LdapProvider.new(**settings).authenticate(credentials)
+  module Auth
+    PUBLISH_OPS = %w[publish pub signal enqueue].freeze
+    SUBSCRIBE_OPS = %w[subscribe sub auto_unsubscribe fetch pull peek browse ack nack touch extend pending claim credit pause resume commit].freeze
+    ADMIN_OPS = %w[purge delete_message requeue create_topic update_topic delete_topic pause_group resume_group drain_group $sys.schedules schedules].freeze
+
+    Identity = Struct.new(:name, :provider, :permissions, :limits, :expires_at, keyword_init: true) do
+      def self.from_h(hash)
+        return nil unless hash
+
+        hash = hash.transform_keys(&:to_sym)
+        new(**hash.slice(:name, :provider, :expires_at), permissions: Auth.permissions(hash[:permissions]), limits: Auth.limits(hash[:limits]))
+      end
+
+      # The identity the listener handed a connection's pipe process
+      def self.from_env(env = ENV)
+        from_h(env['SHORTBUS_IDENTITY'] && JSON.parse(env['SHORTBUS_IDENTITY']))
+      end
+
+      def expired?(now: Time.now)
+        !expires_at.nil? && Time.at(expires_at.to_f) <= now
+      end
+
+      # Raise unless the identity may run op on topic
+      def authorize!(op, topic = nil)
+        raise AccessError, "Credentials for #{name} expired" if expired?
+        return true if permissions.nil?
+
+        action = Auth.action(op)
+        return true unless action
+
+        allowed = action == :admin ? permissions[:admin] == true : Auth.matches?(permissions[action], topic)
+        raise AccessError, "#{name} may not #{op} #{topic}".strip unless allowed
+
+        true
+      end
+
+      def to_h
+        super.compact
+      end
+    end
+
+    @providers = {}
+
+    def register(type, provider)
+      @providers[type.to_s] = provider
+    end
+
+    def provider(type)
+      @providers.fetch(type.to_s) { raise ConfigurationError, "Unknown auth provider: #{type}" }
+    end
+
+    # The providers in config/auth.yml, else a token provider for
+    # config.token, else none (connections go unauthenticated)
+    def providers(config: Shortbus.config)
+      if config.auth_yml.exist?
+        settings = YAML.safe_load(File.read(config.auth_yml)) || {}
+
+        return Array(settings['providers']).map do |entry|
+          entry = entry.transform_keys(&:to_sym)
+          provider(entry[:type]).new(config:, **entry.except(:type))
+        end
+      end
+
+      config.token ? [TokenProvider.new(token: config.token)] : []
+    end
+
+    # The identity the first provider vouches for, or nil
+    def authenticate(credentials, providers)
+      providers.each do |provider|
+        identity = provider.authenticate(credentials)
+        return identity if identity
+      rescue => e
+        Shortbus.warn "Auth provider #{provider.class.name} failed: #{e.message}"
+      end
+
+      nil
+    end
+
+    # :publish, :subscribe, or :admin, for the ops permissions cover
+    def action(op)
+      if PUBLISH_OPS.include?(op) then :publish
+      elsif SUBSCRIBE_OPS.include?(op) then :subscribe
+      elsif ADMIN_OPS.include?(op) then :admin
+      end
+    end
+
+    # Normalized permissions: patterns as arrays of strings, admin a boolean
+    def permissions(value)
+      return nil if value.nil?
+
+      value = value.transform_keys(&:to_sym)
+      {
+        publish: Array(value[:publish]).map(&:to_s),
+        subscribe: Array(value[:subscribe]).map(&:to_s),
+        admin: value[:admin] == true || value[:admin].to_s == 'true'
+      }
+    end
+
+    # Normalized rate limits: { action => max per second }, nil for none;
+    # a bare rate limits publishing
+    def limits(value)
+      return nil if value.nil? || value == {}
+
+      value = { publish: value } unless value.is_a?(Hash)
+      value.to_h { |action, rate| [action.to_sym, rate(rate)] }
+    end
+
+    # "100/s", "600/m", "3600/h", or a number, as a rate per second
+    def rate(value)
+      return Float(value) if value.is_a?(Numeric)
+
+      count, per = value.to_s.strip.split('/', 2)
+      Float(count) / { nil => 1, 's' => 1, 'm' => 60, 'h' => 3600 }.fetch(per&.strip) { raise ArgumentError, "Bad rate: #{value.inspect}" }
+    end
+
+    # A token bucket per action, holding up to a second's worth (at least
+    # one) so short bursts get through. Refusals say when the next token is
+    # due and how hard the limit is being pushed, so clients can back off.
+    class RateLimit
+      def initialize(limits, clock: -> { Process.clock_gettime(Process::CLOCK_MONOTONIC) })
+        @limits = limits || {}
+        @clock = clock
+        @buckets = {}
+        @recent = {}
+      end
+
+      # Raise LimitError unless action may happen now
+      def take!(action)
+        rate = @limits[action]
+        return true unless rate
+
+        now = @clock.call
+        tokens, at = @buckets.fetch(action) { [[rate, 1.0].max, now] }
+        tokens = [tokens + (now - at) * rate, [rate, 1.0].max].min
+        pressure = count(action, now, refused: tokens < 1)
+
+        if tokens < 1
+          raise LimitError.new("Rate limit of #{rate.round(2)}/s for #{action} exceeded",
+                               retry_after: ((1 - tokens) / rate).round(3), pressure:)
+        end
+
+        @buckets[action] = [tokens - 1, now]
+        true
+      end
+
+      private
+
+      # Share of this second's attempts at action that were refused
+      def count(action, now, refused:)
+        since, attempts, refusals = @recent[action]
+        since, attempts, refusals = now, 0, 0 if since.nil? || now - since >= 1
+
+        attempts += 1
+        refusals += 1 if refused
+        @recent[action] = [since, attempts, refusals]
+        (refusals.to_f / attempts).round(2)
+      end
+    end
+
+    # Replies go to inboxes, so anyone may use them; inbox ownership is
+    # checked separately
+    def matches?(patterns, topic)
+      return true if topic.nil? || Inbox.inbox?(topic)
+
+      Array(patterns).any? { |pattern| File.fnmatch?(pattern, topic.to_s) }
+    end
+
+    # A shared secret
+    class TokenProvider
+      def initialize(token:, name: 'token', permissions: nil, config: Shortbus.config)
+        @token = token.to_s
+        @name = name
+        @permissions = permissions
+      end
+
+      def authenticate(credentials)
+        token = credentials[:token]
+        return nil unless token.is_a?(String) && OpenSSL.secure_compare(token, @token)
+
+        Identity.new(name: @name, provider: 'token', permissions: Auth.permissions(@permissions))
+      end
+    end
+
+    # Client certificates (the listener needs --tls-ca), named by the
+    # certificate's common name; users maps names to permissions
+    class MtlsProvider
+      def initialize(users: nil, permissions: nil, config: Shortbus.config)
+        @users = users&.transform_keys(&:to_s)
+        @permissions = permissions
+      end
+
+      def authenticate(credentials)
+        cert = credentials[:peer_cert]
+        return nil unless cert
+
+        name = cert.subject.to_a.find { |field, _, _| field == 'CN' }&.at(1)
+        return nil unless name
+        return nil if @users && !@users.key?(name)
+
+        Identity.new(name: name, provider: 'mtls', permissions: Auth.permissions(@users ? @users[name] : @permissions))
+      end
+    end
+
+    # Usernames and PBKDF2 password digests in config/users.yml:
+    #
+    #   alice:
+    #     password: "pbkdf2-sha256$100000$<salt>$<digest>"
+    #     permissions: { subscribe: ["*"] }
+    class PasswordProvider
+      ITERATIONS = 100_000
+
+      def self.digest(password, salt: SecureRandom.bytes(16), iterations: ITERATIONS)
+        hash = OpenSSL::KDF.pbkdf2_hmac(password.to_s, salt:, iterations:, length: 32, hash: 'SHA256')
+        ['pbkdf2-sha256', iterations, [salt].pack('m0'), [hash].pack('m0')].join('$')
+      end
+
+      def initialize(users: nil, config: Shortbus.config)
+        @path = users ? Pathname.new(users) : config.users_yml
+      end
+
+      def authenticate(credentials)
+        username = (credentials[:username] || credentials[:user]).to_s
+        user = users[username]
+        return nil unless user && credentials[:password]
+
+        scheme, iterations, salt, _digest = user['password'].to_s.split('$')
+        return nil unless scheme == 'pbkdf2-sha256'
+
+        expected = self.class.digest(credentials[:password], salt: salt.unpack1('m0'), iterations: Integer(iterations))
+        return nil unless OpenSSL.secure_compare(expected, user['password'].to_s)
+
+        Identity.new(name: username, provider: 'password', permissions: Auth.permissions(user['permissions']))
+      end
+
+      private
+
+      def users
+        @path.exist? ? (YAML.safe_load(File.read(@path)) || {}) : {}
+      end
+    end
+
+    # Asks an external service: the credentials are POSTed as JSON, and a
+    # 200 answering { "name": ..., "permissions": {...} } lets the client in
+    class HttpProvider
+      def initialize(url:, timeout: 5, headers: {}, config: Shortbus.config)
+        @uri = URI(url)
+        @timeout = timeout
+        @headers = headers.transform_keys(&:to_s)
+      end
+
+      def authenticate(credentials)
+        body = credentials.slice(:token, :username, :user, :password)
+        body[:certificate] = credentials[:peer_cert].to_pem if credentials[:peer_cert]
+
+        request = Net::HTTP::Post.new(@uri, { 'Content-Type' => 'application/json' }.merge(@headers))
+        request.body = JSON.generate(body)
+
+        response = Net::HTTP.start(@uri.host, @uri.port, use_ssl: @uri.scheme == 'https', open_timeout: @timeout, read_timeout: @timeout) do |http|
+          http.request(request)
+        end
+        return nil unless response.is_a?(Net::HTTPOK)
+
+        result = JSON.parse(response.body, symbolize_names: true)
+        Identity.new(name: result[:name].to_s, provider: 'http', permissions: Auth.permissions(result[:permissions]), expires_at: result[:expires_at])
+      end
+    end
+
+    # Signed JSON Web Tokens, sent as the connect line's token (and by the
+    # refresh_token op, before exp, to extend the connection). Permissions
+    # come from the token's claims (named by claims:), else from the roles
+    # listed in role_claim (looked up in roles:), else permissions:. A
+    # rate_limit claim ({ "publish": "100/s" }) limits the connection.
+    #
+    #   - type: jwt
+    #     public_key: config/jwt.pem          # RS256, ES256, EdDSA; or secret: for HS256
+    #     issuer: https://sso.example.com
+    #     audience: shortbus
+    #     claims: { name: email, publish: bus_publish, subscribe: bus_subscribe }
+    #     role_claim: groups
+    #     roles: { ops: { publish: ["*"], subscribe: ["*"], admin: true } }
+    class JwtProvider
+      ALGORITHMS = %w[HS256 RS256 ES256 EdDSA].freeze
+      CLAIMS = { name: 'sub', publish: 'publish', subscribe: 'subscribe', admin: 'admin', rate_limit: 'rate_limit' }.freeze
+
+      def initialize(public_key: nil, secret: nil, issuer: nil, audience: nil, claims: {}, role_claim: 'roles', roles: nil, permissions: nil, leeway: 30, config: Shortbus.config)
+        raise ConfigurationError, "JWT provider needs a public_key or a secret" unless public_key || secret
+
+        @key = public_key && read_key(public_key.to_s, config)
+        @secret = secret&.to_s
+        @issuer = issuer
+        @audience = audience
+        @claims = CLAIMS.merge(claims.transform_keys(&:to_sym).transform_values(&:to_s))
+        @role_claim = role_claim.to_s
+        @roles = roles&.transform_keys(&:to_s)
+        @permissions = permissions
+        @leeway = Integer(leeway)
+      end
+
+      def authenticate(credentials)
+        claims = decode(credentials[:token])
+        return nil unless claims
+
+        Identity.new(
+          name: claims[@claims[:name]].to_s,
+          provider: 'jwt',
+          permissions: permissions(claims),
+          limits: Auth.limits(claims[@claims[:rate_limit]]),
+          expires_at: claims['exp']
+        )
+      end
+
+      # The token's claims, or nil unless it is well formed, signed with the
+      # configured key, current, and for this issuer and audience
+      def decode(token, now: Time.now)
+        return nil unless token.is_a?(String) && token.count('.') == 2
+
+        header, payload, signature = token.split('.')
+        header = JSON.parse(base64url(header))
+        claims = JSON.parse(base64url(payload))
+        return nil unless claims.is_a?(Hash) && verify?(header['alg'], token[0...token.rindex('.')], base64url(signature))
+
+        return nil if claims['exp'] && now.to_i > claims['exp'].to_i + @leeway
+        return nil if claims['nbf'] && now.to_i < claims['nbf'].to_i - @leeway
+        return nil if @issuer && claims['iss'] != @issuer
+        return nil if @audience && !Array(claims['aud']).include?(@audience)
+
+        claims
+      rescue JSON::ParserError, ArgumentError, OpenSSL::PKey::PKeyError
+        nil
+      end
+
+      private
+
+      def permissions(claims)
+        explicit = %i[publish subscribe admin].select { |action| claims.key?(@claims[action]) }
+        if explicit.any?
+          return Auth.permissions(explicit.to_h { |action| [action, claims[@claims[action]]] })
+        end
+
+        roles = Array(claims[@role_claim]).map(&:to_s) & (@roles || {}).keys
+        return Auth.permissions(@permissions) if roles.empty?
+
+        granted = roles.map { |role| Auth.permissions(@roles[role]) }
+        {
+          publish: granted.flat_map { |grant| grant[:publish] }.uniq,
+          subscribe: granted.flat_map { |grant| grant[:subscribe] }.uniq,
+          admin: granted.any? { |grant| grant[:admin] }
+        }
+      end
+
+      def verify?(alg, input, signature)
+        case alg
+        when 'HS256'
+          @secret && OpenSSL.secure_compare(OpenSSL::HMAC.digest('SHA256', @secret, input), signature)
+        when 'RS256'
+          @key.is_a?(OpenSSL::PKey::RSA) && @key.verify('SHA256', signature, input)
+        when 'ES256'
+          # JWS signatures are r || s; OpenSSL wants them DER encoded
+          r, s = signature.unpack('a32a32').map { |half| OpenSSL::BN.new(half, 2) }
+          @key.is_a?(OpenSSL::PKey::EC) && @key.verify('SHA256', OpenSSL::ASN1::Sequence([OpenSSL::ASN1::Integer(r), OpenSSL::ASN1::Integer(s)]).to_der, input)
+        when 'EdDSA'
+          @key&.oid == 'ED25519' && @key.verify(nil, signature, input)
+        else
+          false
+        end
+      end
+
+      def base64url(value)
+        value = value.to_s.tr('-_', '+/')
+        (value + '=' * (-value.size % 4)).unpack1('m0')
+      end
+
+      def read_key(value, config)
+        return OpenSSL::PKey.read(value) if value.include?('-----BEGIN')
+
+        path = Pathname.new(value)
+        path = config.root_path / path if path.relative?
+        OpenSSL::PKey.read(File.read(path))
+      end
+    end
+
+    extend self
+
+    register(:token, TokenProvider)
+    register(:mtls, MtlsProvider)
+    register(:password, PasswordProvider)
+    register(:http, HttpProvider)
+    register(:jwt, JwtProvider)
+  end
+end
@@ -0,0 +1,77 @@
+module Shortbus
+  # Redelivery backoff policies
+  #
+  # A topic's backoff setting decides how long a nacked message waits before
+  # it is handed out again, by attempt number (1 = first delivery):
+  #
+  #   backoff: 5s                                             # fixed
+  #   backoff: { strategy: exponential, initial: 1s, max: 5m, multiplier: 2 }
+  #   backoff: [1s, 10s, 1m, 10m]                             # schedule; the last
+  #                                                           # delay repeats
+  #
+  # Policies are stored normalized, with string keys and delays in seconds, so
+  # they round-trip through topics.yml.
+  module Backoff
+    STRATEGIES = %w[fixed exponential schedule].freeze
+    DEFAULT = { 'strategy' => 'exponential', 'initial' => 1, 'max' => 60, 'multiplier' => 2 }.freeze
+
+    module_function
+
+    def normalize(value)
+      case value
+      when String
+        # "1s,10s,1m" (e.g. from the CLI) is a schedule
+        return normalize(value.split(',').map(&:strip)) if value.include?(',')
+
+        { 'strategy' => 'fixed', 'delay' => Shortbus.parse_duration(value) }
+      when Numeric
+        { 'strategy' => 'fixed', 'delay' => Shortbus.parse_duration(value) }
+      when Array
+        normalize('strategy' => 'schedule', 'delays' => value)
+      when Hash
+        policy = value.transform_keys(&:to_s)
+        strategy = policy['strategy'].to_s
+
+        case strategy
+        when 'fixed'
+          { 'strategy' => strategy, 'delay' => Shortbus.parse_duration(policy['delay'] || 0) }
+        when 'exponential'
+          multiplier = Float(policy['multiplier'] || DEFAULT['multiplier'])
+          raise ArgumentError, "backoff multiplier must be at least 1" if multiplier < 1
+
+          {
+            'strategy' => strategy,
+            'initial' => Shortbus.parse_duration(policy['initial'] || DEFAULT['initial']),
+            'max' => Shortbus.parse_duration(policy['max'] || DEFAULT['max']),
+            'multiplier' => multiplier
+          }
+        when 'schedule'
+          delays = Array(policy['delays']).map { |delay| Shortbus.parse_duration(delay) }
+          raise ArgumentError, "backoff schedule must list at least one delay" if delays.empty?
+
+          { 'strategy' => strategy, 'delays' => delays }
+        else
+          raise ArgumentError, "backoff strategy must be one of: #{STRATEGIES.join(', ')}"
+        end
+      else
+        raise ArgumentError, "invalid backoff: #{value.inspect}"
+      end
+    end
+
+    # Seconds to wait before attempt + 1, after attempt failed
+    def delay(policy, attempt)
+      policy = (policy || DEFAULT).transform_keys(&:to_s)
+      attempt = [attempt.to_i, 1].max
+
+      case policy['strategy']
+      when 'fixed'
+        policy['delay'].to_i
+      when 'schedule'
+        policy['delays'].fetch(attempt - 1) { policy['delays'].last }.to_i
+      else
+        exponential = policy['initial'].to_f * (policy['multiplier'].to_f**(attempt - 1))
+        [exponential, policy['max'].to_f].min.ceil
+      end
+    end
+  end
+end
@@ -5,11 +5,44 @@ module Shortbus
         shortbus - local-first message bus
 
       TL;DR
-        ~> shortbus run                    # start daemon
+        ~> shortbus run                    # start engine in background
+        ~> shortbus daemon start           # start supervised service (start|stop|status|restart)
         ~> shortbus pipe                   # pipe mode (JSONL stdin/stdout)
+        ~> shortbus pipe --name billing    # named connection (or SHORTBUS_CLIENT_NAME)
+        ~> shortbus pipe --durable billing # resume subscriptions across reconnects (--session-timeout 60s)
+        ~> shortbus pipe --slow-consumer drop # when 8MB (--outbound-buffer) is waiting to be read: block, drop, or disconnect
+        ~> shortbus listen                 # pipe mode over ROOT/shortbus.sock (--socket PATH, or --port 7070 [--tls-cert F --tls-key F [--tls-ca F]])
+        ~> shortbus http --port 9090       # HTTP long-poll gateway (GET /topics/T/next?group=G&wait=30s)
+        ~> shortbus openapi                # print the HTTP gateway's OpenAPI 3 document (--server URL)
+        ~> shortbus connections            # list connected clients
+        ~> shortbus presence [billing/*]   # services announced in the presence registry
+        ~> shortbus locks                  # held locks (leases) and their owners
+        ~> shortbus doctor                 # check rendezvous, config, groups, storage, engine
+        ~> shortbus fsck --repair          # verify (and repair) persisted state; engine must be stopped
+        ~> shortbus conformance --target python3 driver.py   # check a client against the protocol captures (--protocol N --only publish,subscribe)
+        ~> shortbus conformance            # check this broker's pipe mode against them
         ~> shortbus publish events "msg"   # publish message
         ~> shortbus subscribe events       # subscribe to topic
-        ~> shortbus console                # interactive REPL
+        ~> shortbus peek events --limit 5  # browse without consuming (--offset N)
+        ~> shortbus tap 'orders.*' --sample 1%   # sampled copy of live traffic; consumers are unaffected (--to TOPIC)
+        ~> shortbus purge jobs             # drop backlog (--id ID drops one message)
+        ~> shortbus requeue jobs.dlq       # move DLQ messages back (--to TOPIC)
+        ~> shortbus export jobs jobs.ndjson.gz   # retained messages to NDJSON (--limit N; - for stdout)
+        ~> shortbus import jobs.ndjson.gz  # publish an export back (--to TOPIC; - for stdin)
+        ~> shortbus archive [jobs]         # archive aged-out messages now (topics with --archive)
+        ~> shortbus metrics [orders]       # payload sizes, producers, schema failures, metadata cardinality (--reset)
+        ~> shortbus metrics dashboard > shortbus.json   # Grafana dashboard for GET /metrics (--alerts [--latency 30s]: Prometheus rules)
+        ~> shortbus audit --action purge   # admin actions log (--by NAME --since 1d --limit N)
+        ~> shortbus topic create jobs --retention 7d --max-depth 10000 --dlq jobs.dlq
+        ~> shortbus topic create session.42 --ephemeral true --grace-period 30s
+        ~> shortbus topic list             # (create|update|delete|show|list|classes)
+        ~> shortbus group drain jobs workers --wait 5m  # pause a group and wait for in-flight work (pause|resume|drain|status)
+        ~> shortbus schedule add heartbeat --cron "*/5 * * * *" --topic heartbeat --payload tick
+        ~> shortbus schedule list          # (add|remove|list) publishes run by the daemon
+        ~> shortbus kv put config billing.rate_limit 100   # key-value buckets (put|get|delete|keys|buckets)
+        ~> shortbus topic list --output json   # machine-readable output for any command (or SHORTBUS_OUTPUT=json)
+        ~> shortbus repl                   # interactive shell with history and topic completion
+        ~> source <(shortbus completion bash)  # shell completion (bash|zsh|fish)
         ~> shortbus stop                   # stop daemon
 
       PIPE MODE (for integration)
@@ -38,14 +71,25 @@ module Shortbus
 
         Commands (stdin):
           {"op": "publish", "topic": "events", "payload": "hello"}
+          {"op": "signal", "topic": "heartbeat", "metadata": {"host": "pos-1"}}
           {"op": "subscribe", "topic": "events"}
           {"op": "unsubscribe", "topic": "events"}
+          {"op": "create_topic", "topic": "jobs", "settings": {"retention": "7d", "dlq": "jobs.dlq"}}
+          {"op": "update_topic", "topic": "jobs", "settings": {"ordering": "fifo"}}
+          {"op": "delete_topic", "topic": "jobs"}
+          {"op": "hello", "name": "billing-worker"}
+          {"op": "announce", "name": "billing/7f3a", "ttl": "30s", "info": {"version": "2.1"}}
+          {"op": "presence", "pattern": "billing/*"}
+          {"op": "acquire", "name": "billing.reconcile", "ttl": "30s"}
+          {"op": "renew", "name": "billing.reconcile", "token": 7, "ttl": "30s"}
+          {"op": "kv", "action": "put", "bucket": "config", "key": "billing.rate_limit", "value": "100"}
+          {"op": "connections"}
           {"op": "ping"}
           {"op": "shutdown"}
 
         Responses (stdout):
-          {"status": "ok", "op": "published", "message_id": 123}
-          {"type": "message", "topic": "events", "payload": "hello", "id": 123}
+          {"status": "ok", "op": "published", "message_id": "01927c4e-8f3a-7d21-9c0e-5b7a2f1e4d3c", "offset": 123}
+          {"type": "message", "topic": "events", "payload": "hello", "id": 123, "message_id": "01927c4e-...", "offset": 123}
           {"type": "error", "error": "message"}
     ____
 
@@ -53,13 +97,40 @@ module Shortbus
       help
       version
       run
+      daemon
       pipe
+      listen
+      http
+      openapi
+      connections
+      presence
+      locks
+      doctor
+      fsck
+      conformance
       publish
       subscribe
+      peek
+      tap
+      purge
+      requeue
+      export
+      import
+      archive
+      metrics
+      audit
+      topic
+      group
+      schedule
+      kv
       stop
+      repl
       console
+      completion
     ]
 
+    OUTPUTS = %w[text json].freeze
+
     def run!
       setup!
       run_mode!
@@ -85,9 +156,11 @@ module Shortbus
     end
 
     def run_version!
-      puts "shortbus v#{Shortbus.version}"
-      puts
-      puts Shortbus.description
+      render(version: Shortbus.version, description: Shortbus.description) do
+        puts "shortbus v#{Shortbus.version}"
+        puts
+        puts Shortbus.description
+      end
       exit(0)
     end
 
@@ -96,16 +169,18 @@ module Shortbus
       pm = Shortbus.process_manager
 
       if pm.running?
-        puts "shortbus is already running"
-        puts
         status = pm.status
-        puts "  pid: #{status[:pid]}"
-        puts "  port: #{status[:port]}"
-        puts "  url: #{status[:url]}"
+        render(status) do
+          puts "shortbus is already running"
+          puts
+          puts "  pid: #{status[:pid]}"
+          puts "  port: #{status[:port]}"
+          puts "  url: #{status[:url]}"
+        end
         exit(0)
       end
 
-      puts "Starting shortbus..."
+      say "Starting shortbus..."
 
       # Ensure directory structure exists
       ensure_directories!
@@ -114,22 +189,227 @@ module Shortbus
       pm.start!
 
       status = pm.status
-      puts "shortbus is running"
-      puts
-      puts "  pid: #{status[:pid]}"
-      puts "  port: #{status[:port]}"
-      puts "  url: #{status[:url]}"
-      puts
-      puts "Logs: #{Shortbus.config.engine_log_path}"
-      puts
-      puts "Use 'shortbus stop' to stop the service"
+      render(status.merge(log: Shortbus.config.engine_log_path.to_s)) do
+        puts "shortbus is running"
+        puts
+        puts "  pid: #{status[:pid]}"
+        puts "  port: #{status[:port]}"
+        puts "  url: #{status[:url]}"
+        puts
+        puts "Logs: #{Shortbus.config.engine_log_path}"
+        puts
+        puts "Use 'shortbus stop' to stop the service"
+      end
     rescue Shortbus::Error => e
       abort "Failed to start shortbus: #{e.message}"
     end
 
+    def run_daemon!
+      # Service lifecycle: forked, supervised, PID file in the rendezvous
+      action = ARGV.shift || 'status'
+      daemon = Shortbus.daemon
+
+      case action
+      when 'start'
+        ensure_directories!
+        say "Starting shortbus daemon..."
+        daemon.start!
+        print_daemon_status(daemon.status)
+
+      when 'stop'
+        stopped = daemon.stop!
+        render(status: :stopped, was_running: stopped) do
+          puts(stopped ? "shortbus daemon stopped" : "shortbus daemon is not running")
+        end
+
+      when 'restart'
+        ensure_directories!
+        say "Restarting shortbus daemon..."
+        daemon.restart!
+        print_daemon_status(daemon.status)
+
+      when 'status'
+        print_daemon_status(daemon.status)
+        exit(daemon.running? ? 0 : 3)
+
+      else
+        abort "Usage: shortbus daemon start|stop|status|restart"
+      end
+    rescue Shortbus::Error => e
+      abort "shortbus daemon #{action} failed: #{e.message}"
+    end
+
+    def print_daemon_status(status)
+      render(status) do
+        if status[:status] == :running
+          puts "shortbus daemon is running"
+          puts
+          puts "  pid: #{status[:pid]}"
+          puts "  log: #{status[:log]}"
+          puts "  mode: read-only" if status[:read_only]
+          puts "  engine: #{status[:engine][:status]}"
+          if (recovery = status[:engine][:recovery])
+            puts "  recovery: #{recovery[:percent] ? "#{recovery[:percent]}%" : 'in progress'}#{" (ETA #{recovery[:eta]}s)" if recovery[:eta]}"
+          end
+        else
+          puts "shortbus daemon is stopped"
+        end
+      end
+    end
+
     def run_pipe!
       # Pipe mode: JSONL bidirectional communication
-      Shortbus::PipeMode.new.run!
+      options = parse_options!
+      name = options[:name] || ENV['SHORTBUS_CLIENT_NAME']
+
+      Shortbus::PipeMode.new(
+        name:,
+        durable: options[:durable],
+        session_timeout: options[:session_timeout],
+        outbound_buffer: options[:outbound_buffer],
+        slow_consumer: options[:slow_consumer]
+      ).run!
+    end
+
+    def run_listen!
+      # Pipe mode for clients that Dial a socket instead of spawning a process
+      options = parse_options!
+
+      Shortbus.log!
+      Shortbus::Listener.new(
+        socket: options[:socket],
+        port: options[:port],
+        bind: options[:bind] || '127.0.0.1',
+        tls_cert: options[:tls_cert],
+        tls_key: options[:tls_key],
+        tls_ca: options[:tls_ca],
+        token: options[:token]
+      ).run!
+    rescue ArgumentError, Shortbus::ConfigurationError => e
+      abort e.message
+    end
+
+    def run_http!
+      # HTTP gateway: long-poll consume + ack for HTTP-only environments
+      options = parse_options!
+
+      Shortbus.log!
+      Shortbus::HttpGateway.new(
+        port: options[:port] || Shortbus.config.port,
+        bind: options[:bind] || '127.0.0.1'
+      ).run!
+    end
+
+    def run_openapi!
+      options = parse_options!
+      server = options[:server] || "http://127.0.0.1:#{Shortbus.config.port}"
+
+      puts JSON.pretty_generate(Shortbus::HttpGateway.openapi(server:))
+    end
+
+    def run_connections!
+      connections = Shortbus.connections.list
+
+      render(connections) do
+        puts "No connections" if connections.empty?
+
+        connections.each do |connection|
+          puts "#{connection[:name] || '(anonymous)'} #{connection[:id]}"
+          puts "  pid: #{connection[:pid]}"
+          puts "  connected_at: #{connection[:connected_at]}"
+          puts "  subscriptions: #{Array(connection[:subscriptions]).join(', ')}"
+          if (outbound = connection[:outbound])
+            puts "  outbound: high watermark #{outbound[:high_watermark]} of #{outbound[:buffer]} bytes (#{outbound[:policy]}, #{outbound[:dropped]} dropped)"
+          end
+        end
+      end
+    end
+
+    def run_presence!
+      pattern = ARGV.shift unless ARGV.first.to_s.start_with?('--')
+      members = Shortbus.presence.list(pattern)
+
+      render(members) do
+        puts "No one present" if members.empty?
+
+        members.each do |member|
+          puts "#{member[:name]} (expires #{member[:expires_at]})"
+          member[:info].each { |key, value| puts "  #{key}: #{value}" }
+        end
+      end
+    end
+
+    def run_locks!
+      leases = Shortbus.locks.list
+
+      render(leases) do
+        puts "No locks held" if leases.empty?
+        leases.each { |lease| puts "#{lease[:name]}  #{lease[:owner]} (token #{lease[:token]}, expires #{lease[:expires_at]})" }
+      end
+    end
+
+    def run_doctor!
+      doctor = Shortbus::Doctor.new
+      findings = doctor.run
+
+      render(healthy: doctor.healthy?, findings: findings.map(&:to_h)) do
+        findings.each do |finding|
+          puts format('%-6s %-11s %s', finding.level, finding.check, finding.message)
+          puts format('%-18s fix: %s', '', finding.fix) if finding.fix
+        end
+      end
+
+      exit(doctor.healthy? ? 0 : 1)
+    end
+
+    def run_fsck!
+      options = parse_options!
+      fsck = Shortbus::Fsck.new(repair: options.key?(:repair))
+      problems = fsck.run
+
+      render(clean: fsck.clean?, repair: fsck.repair?, problems: problems.map(&:to_h)) do
+        puts "No problems found" if problems.empty?
+
+        problems.each do |problem|
+          verdict = problem.repaired ? 'repaired' : (fsck.repair? ? 'NOT repaired' : 'would repair')
+          puts "#{problem.path}: #{problem.problem}"
+          puts "  #{verdict}: #{problem.action}"
+          puts "  dropped: #{problem.dropped}" if problem.dropped
+        end
+      end
+
+      exit(fsck.clean? ? 0 : 1)
+    end
+
+    def run_conformance!
+      # Everything after --target is the client driver's command line
+      index = ARGV.index('--target')
+      target = index && ARGV.slice!(index..).drop(1)
+      options = parse_options!
+      abort "Usage: shortbus conformance [--protocol N] [--only NAME,...] [--target CMD...]" if target&.empty?
+
+      captures = Shortbus::Conformance.captures(version: options[:protocol])
+      captures = captures.select { |capture| options[:only].split(',').include?(capture.name) } if options[:only]
+      abort "No captures to play" if captures.empty?
+
+      results =
+        if target
+          Shortbus::Conformance.check(target, side: :client, captures:)
+        else
+          Shortbus::Conformance.check([File.expand_path('../../bin/shortbus', __dir__), 'pipe'], side: :broker, captures:)
+        end
+      passed = results.all? { |result| result[:passed] }
+
+      render(passed:, results:) do
+        results.each do |result|
+          puts format('%-24s %s', result[:id], result[:passed] ? 'ok' : 'FAIL')
+          result[:failures].each { |failure| puts "  #{failure}" }
+        end
+        puts
+        puts "#{results.count { |result| result[:passed] }}/#{results.size} passed"
+      end
+
+      exit(passed ? 0 : 1)
     end
 
     def run_publish!
@@ -137,14 +417,20 @@ module Shortbus
       message = ARGV.shift
 
       unless topic && message
-        abort "Usage: shortbus publish TOPIC MESSAGE"
+        abort "Usage: shortbus publish TOPIC MESSAGE [--deadline TIME | --deadline-in DURATION]"
       end
 
+      options = parse_options!
+      metadata = Shortbus.deadlines.stamp({}, deadline: options[:deadline], deadline_in: options[:deadline_in])
+
       # For now, use engine directly
       # In production, this would connect to running daemon
-      result = Shortbus.engine.publish(topic, message)
+      result = Shortbus.routes.publish(topic, message, metadata:)
 
-      puts "Published to #{topic}: message_id=#{result[:message_id]}"
+      render({ topic:, message_id: result[:message_id], offset: result[:offset], moved_to: result[:moved_to], copied_to: result[:copied_to] }.compact) do
+        puts "Published to #{result[:moved_to] || topic}: message_id=#{result[:message_id]} offset=#{result[:offset]}"
+        puts "Copied to #{result[:copied_to].join(', ')}" if result[:copied_to]
+      end
     rescue => e
       abort "Publish failed: #{e.message}"
     end
@@ -161,34 +447,474 @@ module Shortbus
       exit(1)
     end
 
+    def run_peek!
+      topic = ARGV.shift
+      abort "Usage: shortbus peek TOPIC [--limit N] [--offset N]" unless topic
+
+      options = parse_options!
+      messages = Shortbus.engine.fetch_messages(
+        topic,
+        offset: Integer(options[:offset] || 0),
+        limit: Integer(options[:limit] || 10)
+      )
+
+      # Text mode is already one JSON message per line; json wraps the page
+      render(topic:, messages:) do
+        messages.each { |message| puts JSON.generate(message) }
+      end
+    rescue ArgumentError => e
+      abort "Peek failed: #{e.message}"
+    end
+
+    # Runs until Ctrl-C; text and json both print one message a line
+    def run_tap!
+      pattern = ARGV.shift
+      abort "Usage: shortbus tap PATTERN [--sample 1%] [--to TOPIC]" unless pattern
+
+      options = parse_options!
+      tap = Shortbus::Tap.new(pattern, sample: Shortbus::Tap.parse_sample(options[:sample]), to: options[:to])
+      warn "Copying #{(tap.sample * 100).round(2)}% of #{pattern} to #{tap.to}" if tap.to
+
+      $stdout.sync = true
+      tap.run { |message| puts JSON.generate(message) }
+    rescue ArgumentError => e
+      abort "Tap failed: #{e.message}"
+    end
+
+    def run_purge!
+      topic = ARGV.shift
+      abort "Usage: shortbus purge TOPIC [--id MESSAGE_ID]" unless topic
+
+      options = parse_options!
+
+      if options[:id]
+        Shortbus::Admin.delete_message(topic, options[:id])
+        audit(:delete_message, topic:, id: options[:id])
+        render(topic:, deleted: options[:id]) { puts "Deleted #{topic}/#{options[:id]}" }
+      else
+        Shortbus::Admin.purge(topic)
+        audit(:purge, topic:)
+        render(topic:, purged: true) { puts "Purged #{topic}" }
+      end
+    end
+
+    def run_requeue!
+      topic = ARGV.shift
+      abort "Usage: shortbus requeue DLQ_TOPIC [--to TOPIC] [--limit N]" unless topic
+
+      options = parse_options!
+      result = Shortbus::Admin.requeue(topic, to: options[:to], limit: Integer(options[:limit] || 1000))
+      audit(:requeue, topic:, to: options[:to], requeued: result[:requeued])
+
+      render(topic:, requeued: result[:requeued], destinations: result[:destinations]) do
+        puts "Requeued #{result[:requeued]} message(s) from #{topic}"
+        result[:destinations].each { |destination, count| puts "  #{destination}: #{count}" }
+      end
+    end
+
+    def run_export!
+      topic = ARGV.shift
+      path = ARGV.shift
+      abort "Usage: shortbus export TOPIC FILE [--limit N]" unless topic && path
+
+      options = parse_options!
+      limit = options[:limit] && Integer(options[:limit])
+      count = Shortbus::Archive.export(topic, path, limit:)
+
+      # Keep stdout clean when the archive itself is going there
+      if path == '-'
+        $stderr.puts "Exported #{count} message(s) from #{topic}"
+      else
+        render(topic:, path:, exported: count) { puts "Exported #{count} message(s) from #{topic} to #{path}" }
+      end
+    end
+
+    def run_import!
+      path = ARGV.shift
+      abort "Usage: shortbus import FILE [--to TOPIC]" unless path
+
+      options = parse_options!
+      result = Shortbus::Archive.import(path, to: options[:to])
+
+      render(path:, **result) do
+        puts "Imported #{result[:imported]} message(s) from #{path}"
+        puts "  skipped #{result[:duplicates]} already imported" if result[:duplicates] > 0
+        result[:topics].each { |topic, count| puts "  #{topic}: #{count}" }
+      end
+    rescue JSON::ParserError => e
+      abort "Import failed: #{path} is not an NDJSON archive (#{e.message})"
+    end
+
+    def run_archive!
+      topic = ARGV.shift
+      archived = Shortbus.archiver.archive!(topic)
+
+      render(archived) do
+        puts "No topics with both retention and archive set" if archived.empty?
+        archived.each { |name, count| puts "#{name}: archived #{count} message(s)" }
+      end
+    end
+
+    def run_metrics!
+      topic = ARGV.shift unless ARGV.first.to_s.start_with?('--')
+      options = parse_options!
+
+      if topic == 'dashboard'
+        latency = options[:latency] ? Shortbus.parse_duration(options[:latency]) : 30
+        puts options.key?(:alerts) ? Dashboard.alert_rules_yaml(latency:) : JSON.pretty_generate(Dashboard.grafana)
+        return
+      end
+
+      if options.key?(:reset)
+        abort "Usage: shortbus metrics TOPIC --reset" unless topic
+
+        Shortbus.metrics.reset!(topic)
+        render(topic:, reset: true) { puts "Reset metrics for #{topic}" }
+        return
+      end
+
+      metrics = topic ? [Shortbus.metrics.get(topic)] : Shortbus.metrics.all
+
+      render(metrics) do
+        puts "No publishes recorded" if metrics.empty?
+
+        metrics.each do |metric|
+          puts "#{metric[:topic]}: #{metric[:published]} published, #{metric[:bytes]} bytes, largest #{metric[:max_size]}"
+          puts "  sizes: #{metric[:sizes].map { |bound, count| "<=#{bound} #{count}" }.join(', ')}" if metric[:sizes].any?
+          puts "  schema failures: #{metric[:schema_failures]} (last: #{metric[:last_schema_error]})" if metric[:schema_failures].positive?
+          puts "  latency: #{latency_summary(metric[:latency])}" if metric[:latency][:count].positive?
+          metric[:group_latency].each { |group, latency| puts "  group #{group} latency: #{latency_summary(latency)}" }
+
+          metric[:producers].sort_by { |_, usage| -usage[:bytes] }.first(5).each do |producer, usage|
+            puts "  producer #{producer}: #{usage[:published]} published, #{usage[:bytes]} bytes"
+          end
+
+          metric[:metadata_keys].sort_by { |_, count| -count }.first(5).each do |key, count|
+            capped = count >= Shortbus::Metrics::CARDINALITY_CAP ? '+' : ''
+            puts "  metadata #{key}: #{count}#{capped} distinct values"
+          end
+        end
+      end
+    end
+
+    # p50/p99 as bucket bounds, e.g. "p50 <=8ms, p99 <=256ms (40 deliveries)"
+    def latency_summary(latency)
+      metrics = Shortbus.metrics
+      "p50 <=#{metrics.percentile(latency, 0.5)}ms, p99 <=#{metrics.percentile(latency, 0.99)}ms (#{latency[:count]} deliveries)"
+    end
+
+    def run_audit!
+      options = parse_options!
+      since = options[:since] && Time.now - Shortbus.parse_duration(options[:since])
+      entries = Shortbus.audit.entries(action: options[:action], by: options[:by], since:, limit: Integer(options[:limit] || 50))
+
+      render(entries) do
+        puts "No admin actions recorded" if entries.empty?
+
+        entries.each do |entry|
+          params = entry[:params].map { |key, value| "#{key}=#{value.is_a?(String) ? value : JSON.generate(value)}" }.join(' ')
+          puts "#{entry[:at]}  #{entry[:by]} (#{entry[:via]})  #{entry[:action]}#{" [#{entry[:outcome]}]" unless entry[:outcome] == 'ok'}  #{params}".rstrip
+        end
+      end
+    end
+
+    def run_topic!
+      # Topic admin: settings are shared via config/topics.yml
+      action = ARGV.shift || 'list'
+      name = ARGV.shift unless %w[list classes].include?(action)
+      settings = parse_options!
+
+      topics = Shortbus.topics
+
+      case action
+      when 'create'
+        abort "Usage: shortbus topic create NAME [--retention 7d] [--max-depth N] [--dlq TOPIC] [--ordering none|fifo] [--backoff 30s|1s,10s,1m] [--archive true|DIR|s3://BUCKET/PREFIX]" unless name
+        settings = topics.create(name, **settings)
+        print_topic(name, settings)
+        begin
+          Shortbus.engine.create_topic(name)
+        rescue Shortbus::ConnectionError => e
+          Shortbus.warn "Engine not reachable, topic created in config only: #{e.message}"
+        end
+        audit(:create_topic, topic: name, settings:)
+
+      when 'update'
+        abort "Usage: shortbus topic update NAME [--retention 7d] [--max-depth N] [--dlq TOPIC] [--ordering none|fifo] [--backoff 30s|1s,10s,1m]" unless name
+        settings = topics.update(name, **settings)
+        Shortbus::TopicEvents.emit(:updated, name, settings:)
+        audit(:update_topic, topic: name, settings:)
+        print_topic(name, settings)
+
+      when 'delete'
+        abort "Usage: shortbus topic delete NAME" unless name
+        topics.delete(name)
+        begin
+          Shortbus.engine.delete_topic(name)
+        rescue Shortbus::ConnectionError => e
+          Shortbus.warn "Engine not reachable, topic removed from config only: #{e.message}"
+        end
+        audit(:delete_topic, topic: name)
+        render(name:, deleted: true) { puts "Deleted #{name}" }
+
+      when 'show'
+        abort "Usage: shortbus topic show NAME" unless name
+        settings = topics.get(name)
+        abort "Topic not found: #{name}" unless settings
+        print_topic(name, settings, expired: Shortbus.deadlines.expired(name), topic_class: topics.class_for(name))
+
+      when 'list'
+        all = topics.all
+        render(all.map { |topic, settings| { name: topic, settings: } }) do
+          all.each { |topic, settings| print_topic(topic, settings) }
+        end
+
+      when 'classes'
+        # Defaults by name pattern, from config/classes.yml
+        classes = topics.classes
+        render(classes.map { |class_name, definition| { name: class_name, **definition } }) do
+          puts "No topic classes (see #{Shortbus.config.classes_yml})" if classes.empty?
+          classes.each do |class_name, definition|
+            puts "#{class_name} (#{definition[:match].join(', ')})"
+            definition[:settings].each { |key, value| puts "  #{key}: #{value}" }
+          end
+        end
+
+      else
+        abort "Usage: shortbus topic create|update|delete|show|list|classes [NAME] [--setting value ...]"
+      end
+    end
+
+    def run_group!
+      # Operator control of a consumer group, across every process
+      action = ARGV.shift
+      topic = ARGV.shift
+      group = ARGV.shift
+      options = parse_options!
+
+      abort "Usage: shortbus group pause|resume|drain|status TOPIC GROUP [--wait 5m]" unless action && topic && group
+
+      groups = Shortbus.groups
+
+      case action
+      when 'pause'
+        groups.pause(topic, group, by: 'cli')
+        audit(:pause_group, topic:, group:)
+        render(topic:, group:, paused: true) { puts "Paused #{group} on #{topic}" }
+
+      when 'resume'
+        groups.resume(topic, group)
+        audit(:resume_group, topic:, group:)
+        render(topic:, group:, paused: false) { puts "Resumed #{group} on #{topic}" }
+
+      when 'drain'
+        wait = Shortbus.parse_duration(options[:wait] || '5m')
+        say "Draining #{group} on #{topic} (up to #{wait}s)..."
+        audit(:drain_group, topic:, group:, wait:)
+        result = groups.drain(topic, group, wait:)
+
+        render(topic:, group:, paused: true, **result) do
+          if result[:drained]
+            puts "Drained #{group} on #{topic}; paused until `shortbus group resume #{topic} #{group}`"
+          else
+            puts "#{result[:in_flight]} message(s) still in flight on #{group}; group left paused"
+          end
+        end
+        exit(1) unless result[:drained]
+
+      when 'status'
+        pending = groups.pending(topic, group)
+        in_flight = pending.count { |entry| entry[:consumer] }
+
+        render(topic:, group:, paused: groups.paused?(topic, group), offset: groups.offset(topic, group), in_flight:, pending: pending.size) do
+          puts "#{group} on #{topic}: #{groups.paused?(topic, group) ? 'paused' : 'active'}"
+          puts "  offset: #{groups.offset(topic, group)}"
+          puts "  in flight: #{in_flight} (pending #{pending.size})"
+        end
+
+      else
+        abort "Usage: shortbus group pause|resume|drain|status TOPIC GROUP [--wait 5m]"
+      end
+    end
+
+    def run_kv!
+      # Buckets are compacted topics named kv.BUCKET; see KV
+      action = ARGV.shift || 'buckets'
+      bucket = ARGV.shift unless action == 'buckets'
+      key = ARGV.shift if %w[put get delete].include?(action)
+      value = ARGV.shift if action == 'put'
+
+      kv = Shortbus.kv
+
+      case action
+      when 'put'
+        abort "Usage: shortbus kv put BUCKET KEY VALUE" unless bucket && key && value
+        entry = kv.put(bucket, key, value, metadata: { published_by: ENV['USER'] || 'cli' })
+        render(entry) { puts "#{bucket}/#{key} = #{value} (revision #{entry[:revision]})" }
+
+      when 'get'
+        abort "Usage: shortbus kv get BUCKET KEY" unless bucket && key
+        entry = kv.get(bucket, key)
+        abort "No such key: #{bucket}/#{key}" unless entry
+        render(entry) { puts entry[:value] }
+
+      when 'delete'
+        abort "Usage: shortbus kv delete BUCKET KEY" unless bucket && key
+        entry = kv.delete(bucket, key, metadata: { published_by: ENV['USER'] || 'cli' })
+        render(entry) { puts "Deleted #{bucket}/#{key} (revision #{entry[:revision]})" }
+
+      when 'keys'
+        abort "Usage: shortbus kv keys BUCKET" unless bucket
+        keys = kv.keys(bucket)
+        render(keys) { keys.each { |name| puts name } }
+
+      when 'buckets'
+        buckets = kv.buckets
+        render(buckets) do
+          puts "No buckets" if buckets.empty?
+          buckets.each { |name| puts name }
+        end
+
+      else
+        abort "Usage: shortbus kv put|get|delete|keys|buckets [BUCKET] [KEY] [VALUE]"
+      end
+    rescue ArgumentError => e
+      abort "KV #{action} failed: #{e.message}"
+    end
+
+    def run_schedule!
+      # Schedules are shared via config/schedules.yml; the daemon runs them
+      action = ARGV.shift || 'list'
+      name = ARGV.shift unless action == 'list'
+      options = parse_options!
+
+      schedules = Shortbus.schedules
+
+      case action
+      when 'add'
+        abort "Usage: shortbus schedule add NAME --cron EXPR --topic TOPIC [--payload PAYLOAD]" unless name
+        schedules.add(name, **options)
+        audit(:add_schedule, name:, schedule: options)
+
+      when 'remove'
+        abort "Usage: shortbus schedule remove NAME" unless name
+        schedules.remove(name)
+        audit(:remove_schedule, name:)
+
+      when 'list'
+        nil
+
+      else
+        abort "Usage: shortbus schedule add|remove|list [NAME] [--cron EXPR --topic TOPIC --payload PAYLOAD]"
+      end
+
+      status = schedules.status
+      render(status) do
+        status.each do |schedule|
+          puts "#{schedule[:name]}  #{schedule[:cron]} -> #{schedule[:topic]}  next #{schedule[:next_run_at] || 'never (invalid cron)'}"
+          puts "  last error: #{schedule[:last_error]}" if schedule[:last_error]
+        end
+      end
+    rescue ArgumentError => e
+      abort "Schedule failed: #{e.message}"
+    end
+
+    def print_topic(name, settings, expired: nil, topic_class: nil)
+      render({ name:, class: topic_class, settings:, expired: }.compact) do
+        puts topic_class ? "#{name} (class #{topic_class})" : name
+        settings.each { |key, value| puts "  #{key}: #{value}" }
+        puts "  expired: #{expired}" if expired&.positive?
+      end
+    end
+
+    # --max-depth 100 --dlq jobs.dlq  =>  { max_depth: "100", dlq: "jobs.dlq" }
+    def parse_options!
+      options = {}
+
+      while (arg = ARGV.shift)
+        key = arg.sub(/\A--/, '')
+        abort "Unexpected argument: #{arg}" if key == arg
+        options[key.tr('-', '_').to_sym] = ARGV.shift
+      end
+
+      options
+    end
+
     def run_stop!
       pm = Shortbus.process_manager
 
       unless pm.running?
-        puts "shortbus is not running"
+        render(status: :stopped, pid: nil) { puts "shortbus is not running" }
         exit(0)
       end
 
       status = pm.status
-      puts "Stopping shortbus (pid: #{status[:pid]})..."
+      say "Stopping shortbus (pid: #{status[:pid]})..."
 
-      if pm.stop!
-        puts "shortbus stopped"
-      else
-        abort "Failed to stop shortbus"
-      end
+      abort "Failed to stop shortbus" unless pm.stop!
+
+      render(status: :stopped, pid: status[:pid]) { puts "shortbus stopped" }
+    end
+
+    def run_repl!
+      Shortbus::Repl.new.run!
     end
 
     def run_console!
-      puts "Console mode not yet implemented"
-      puts "Use 'shortbus pipe' for now"
-      exit(1)
+      run_repl!
+    end
+
+    def run_completion!
+      shell = ARGV.shift
+      abort "Usage: shortbus completion bash|zsh|fish" unless shell
+
+      if shell == 'topics'
+        render(Shortbus::Completion.topic_names) { puts Shortbus::Completion.topic_names }
+      else
+        puts Shortbus::Completion.script(shell, commands: MODES)
+      end
+    rescue ArgumentError => e
+      abort e.message
     end
 
     def setup!
+      @output = extract_output!
       @mode = ARGV.shift || 'help'
     end
 
+    # --output json|text may appear anywhere on the command line, so it is
+    # pulled out before modes parse their own arguments
+    def extract_output!
+      index = ARGV.index('--output')
+      output = index ? ARGV.slice!(index, 2)[1] : ENV.fetch('SHORTBUS_OUTPUT', 'text')
+
+      abort "--output must be one of: #{OUTPUTS.join(', ')}" unless OUTPUTS.include?(output)
+      output
+    end
+
+    def json?
+      @output == 'json'
+    end
+
+    # One JSON document on stdout in json mode; otherwise the block prints
+    # the human-readable form
+    def render(data)
+      if json?
+        puts JSON.generate(data)
+      else
+        yield
+      end
+    end
+
+    # Admin actions from the CLI are recorded under the operator's login
+    def audit(action, **params)
+      Shortbus.audit.record(action, by: ENV['USER'] || 'cli', via: :cli, **params)
+    end
+
+    # Progress chatter goes to stderr in json mode so stdout stays parseable
+    def say(message)
+      json? ? $stderr.puts(message) : puts(message)
+    end
+
     def ensure_directories!
       require 'fileutils'
 
@@ -0,0 +1,89 @@
+module Shortbus
+  # Log compaction
+  #
+  # Topics with compact set keep only the latest message for each key
+  # (metadata.key, as set by a keyed publish): older messages with the same key
+  # are deleted from the engine, so a subscriber that reads the topic from the
+  # beginning sees the current value of every key instead of its history.
+  #
+  #   shortbus topic create prices --compact true
+  #   shortbus topic update prices --compact true --retention 1d   # tombstones go after a day
+  #
+  # A message with metadata.tombstone marks its key deleted. It replaces the
+  # key's last value like any other, and is itself dropped once it is older
+  # than the topic's retention; without retention tombstones are kept.
+  # Messages without a key are never compacted.
+  #
+  # The daemon runs a pass every COMPACT_INTERVAL. Compaction only ever
+  # deletes a message once a newer one for its key exists, so readers racing
+  # a pass still see each key's latest value; offsets are left with holes.
+  class Compactor
+    BATCH = 500
+    COMPACT_INTERVAL = 60
+
+    def initialize(engine: Shortbus.engine, topics: Shortbus.topics)
+      @engine = engine
+      @topics = topics
+    end
+
+    # One pass over every compacted topic (or just topic); returns
+    # { topic => messages deleted }
+    def compact!(topic = nil, now: Time.now)
+      names = topic ? [topic.to_s] : @topics.all.keys
+
+      names.each_with_object({}) do |name, compacted|
+        settings = @topics.get(name) || {}
+        next unless settings[:compact]
+
+        compacted[name] = compact_topic(name, settings, now:)
+      end
+    end
+
+    private
+
+    def compact_topic(name, settings, now:)
+      latest = {}
+      superseded = []
+      offset = 0
+
+      loop do
+        messages = @engine.fetch_messages(name, offset:, limit: BATCH, tiered: false)
+        break if messages.empty?
+
+        messages.each do |message|
+          key = message.dig(:metadata, :key)
+          next if key.nil?
+
+          superseded << latest[key][:id] if latest[key]
+          latest[key] = message
+        end
+
+        offset = messages.last[:id] + 1
+        break if messages.size < BATCH
+      end
+
+      if settings[:retention]
+        cutoff = now - settings[:retention]
+        superseded += latest.values.select { |message| expired_tombstone?(message, cutoff) }.map { |message| message[:id] }
+      end
+
+      deleted = superseded.count do |id|
+        @engine.delete_message(name, id)
+        true
+      rescue EngineError
+        # Already gone: deleted by hand, or by another pass
+        false
+      end
+
+      Shortbus.info "Compacted #{deleted} message(s) from #{name}" if deleted > 0
+      deleted
+    end
+
+    def expired_tombstone?(message, cutoff)
+      return false unless message.dig(:metadata, :tombstone)
+
+      time = DeliverPolicy.message_time(message)
+      time && time < cutoff
+    end
+  end
+end
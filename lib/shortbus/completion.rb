@@ -0,0 +1,115 @@
+module Shortbus
+  # Shell completion scripts
+  #
+  #   ~> source <(shortbus completion bash)
+  #   ~> shortbus completion zsh > "${fpath[1]}/_shortbus"
+  #   ~> shortbus completion fish > ~/.config/fish/completions/shortbus.fish
+  #
+  # Topic names are completed by calling back into `shortbus completion
+  # topics`, which reads topics.yml and never touches the engine, so
+  # completion stays fast when the bus is down.
+  module Completion
+    SHELLS = %w[bash zsh fish].freeze
+    TOPIC_COMMANDS = %w[publish subscribe peek purge requeue metrics].freeze
+    TOPIC_ACTIONS = %w[create update delete show list classes].freeze
+
+    def script(shell, commands:)
+      case shell.to_s
+      when 'bash' then bash(commands)
+      when 'zsh' then zsh(commands)
+      when 'fish' then fish(commands)
+      else
+        raise ArgumentError, "Unknown shell: #{shell} (expected one of #{SHELLS.join(', ')})"
+      end
+    end
+
+    def topic_names(topics: Shortbus.topics)
+      topics.all.keys.map(&:to_s).sort
+    end
+
+    private
+
+    def bash(commands)
+      <<~BASH
+        # shortbus bash completion
+        _shortbus() {
+          local cur="${COMP_WORDS[COMP_CWORD]}"
+          local cmd="${COMP_WORDS[1]}"
+
+          if [ "$COMP_CWORD" -eq 1 ]; then
+            COMPREPLY=($(compgen -W "#{commands.join(' ')}" -- "$cur"))
+            return
+          fi
+
+          case "$cmd" in
+            #{TOPIC_COMMANDS.join('|')})
+              [ "$COMP_CWORD" -eq 2 ] && COMPREPLY=($(compgen -W "$(shortbus completion topics 2>/dev/null)" -- "$cur"))
+              ;;
+            topic)
+              if [ "$COMP_CWORD" -eq 2 ]; then
+                COMPREPLY=($(compgen -W "#{TOPIC_ACTIONS.join(' ')}" -- "$cur"))
+              elif [ "$COMP_CWORD" -eq 3 ]; then
+                COMPREPLY=($(compgen -W "$(shortbus completion topics 2>/dev/null)" -- "$cur"))
+              fi
+              ;;
+            completion)
+              [ "$COMP_CWORD" -eq 2 ] && COMPREPLY=($(compgen -W "#{SHELLS.join(' ')}" -- "$cur"))
+              ;;
+          esac
+        }
+        complete -F _shortbus shortbus
+      BASH
+    end
+
+    def zsh(commands)
+      <<~ZSH
+        #compdef shortbus
+        # shortbus zsh completion
+        _shortbus() {
+          local -a topics
+
+          if (( CURRENT == 2 )); then
+            compadd -- #{commands.join(' ')}
+            return
+          fi
+
+          case "$words[2]" in
+            #{TOPIC_COMMANDS.join('|')})
+              if (( CURRENT == 3 )); then
+                topics=(${(f)"$(shortbus completion topics 2>/dev/null)"})
+                compadd -- $topics
+              fi
+              ;;
+            topic)
+              if (( CURRENT == 3 )); then
+                compadd -- #{TOPIC_ACTIONS.join(' ')}
+              elif (( CURRENT == 4 )); then
+                topics=(${(f)"$(shortbus completion topics 2>/dev/null)"})
+                compadd -- $topics
+              fi
+              ;;
+            completion)
+              (( CURRENT == 3 )) && compadd -- #{SHELLS.join(' ')}
+              ;;
+          esac
+        }
+        compdef _shortbus shortbus
+      ZSH
+    end
+
+    def fish(commands)
+      <<~FISH
+        # shortbus fish completion
+        complete -c shortbus -f
+        complete -c shortbus -n '__fish_use_subcommand' -a '#{commands.join(' ')}'
+        complete -c shortbus -n '__fish_seen_subcommand_from #{TOPIC_COMMANDS.join(' ')}' -a '(shortbus completion topics 2>/dev/null)'
+        complete -c shortbus -n '__fish_seen_subcommand_from topic; and not __fish_seen_subcommand_from #{TOPIC_ACTIONS.join(' ')}' -a '#{TOPIC_ACTIONS.join(' ')}'
+        complete -c shortbus -n '__fish_seen_subcommand_from topic; and __fish_seen_subcommand_from #{TOPIC_ACTIONS.join(' ')}' -a '(shortbus completion topics 2>/dev/null)'
+        complete -c shortbus -n '__fish_seen_subcommand_from completion' -a '#{SHELLS.join(' ')}'
+        complete -c shortbus -l output -a 'text json' -d 'output format'
+      FISH
+    end
+
+    extend self
+  end
+end
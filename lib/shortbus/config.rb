@@ -1,6 +1,6 @@
 module Shortbus
   class Config
-    attr_accessor :root, :port, :log, :debug, :engine_port
+    attr_accessor :root, :port, :log, :debug, :engine_port, :drain_timeout, :session_timeout, :dedupe_window, :node_id, :token, :auto_create, :durability, :group_commit_ms, :write_coalesce_ms, :outbound_buffer, :slow_consumer, :idle_topic_ttl, :read_only
 
     def initialize
       @root = env.root || defaults.root
@@ -8,6 +8,19 @@ module Shortbus
       @log = env.log || defaults.log
       @debug = env.debug || defaults.debug
       @engine_port = env.engine_port || defaults.engine_port
+      @drain_timeout = env.drain_timeout || defaults.drain_timeout
+      @session_timeout = env.session_timeout || defaults.session_timeout
+      @dedupe_window = env.dedupe_window || defaults.dedupe_window
+      @node_id = env.node_id || defaults.node_id
+      @token = env.token || defaults.token
+      @auto_create = env.auto_create || defaults.auto_create
+      @durability = env.durability || defaults.durability
+      @group_commit_ms = env.group_commit_ms || defaults.group_commit_ms
+      @write_coalesce_ms = env.write_coalesce_ms || defaults.write_coalesce_ms
+      @outbound_buffer = env.outbound_buffer || defaults.outbound_buffer
+      @slow_consumer = env.slow_consumer || defaults.slow_consumer
+      @idle_topic_ttl = env.idle_topic_ttl || defaults.idle_topic_ttl
+      @read_only = env.read_only || defaults.read_only
     end
 
     def env
@@ -17,6 +30,19 @@ module Shortbus
         log: ENV['SHORTBUS_LOG'],
         debug: ENV['SHORTBUS_DEBUG'],
         engine_port: ENV['SHORTBUS_ENGINE_PORT']&.to_i,
+        drain_timeout: ENV['SHORTBUS_DRAIN_TIMEOUT']&.to_i,
+        session_timeout: ENV['SHORTBUS_SESSION_TIMEOUT']&.to_i,
+        dedupe_window: ENV['SHORTBUS_DEDUPE_WINDOW']&.to_i,
+        node_id: ENV['SHORTBUS_NODE_ID'],
+        token: ENV['SHORTBUS_TOKEN'],
+        auto_create: ENV['SHORTBUS_AUTO_CREATE'],
+        durability: ENV['SHORTBUS_DURABILITY'],
+        group_commit_ms: ENV['SHORTBUS_GROUP_COMMIT_MS']&.to_i,
+        write_coalesce_ms: ENV['SHORTBUS_WRITE_COALESCE_MS']&.to_i,
+        outbound_buffer: ENV['SHORTBUS_OUTBOUND_BUFFER'],
+        slow_consumer: ENV['SHORTBUS_SLOW_CONSUMER'],
+        idle_topic_ttl: ENV['SHORTBUS_IDLE_TOPIC_TTL'],
+        read_only: ENV['SHORTBUS_READ_ONLY'],
       })
     end
 
@@ -27,6 +53,19 @@ module Shortbus
         log: nil,
         debug: nil,
         engine_port: 8080,  # BlockQueue default port
+        drain_timeout: 30,  # seconds to wait for daemon shutdown
+        session_timeout: 60,  # seconds a durable session survives disconnect
+        dedupe_window: 3600,  # seconds a dedupe key suppresses repeats
+        node_id: Socket.gethostname,  # stamped on messages as annotations.node_id
+        token: nil,  # required of socket clients by shortbus listen, when set
+        auto_create: 'auto',  # or strict: publishes to unknown topics fail (see TopicCreation)
+        durability: 'os',  # sync policy for topics without one: os, always, or an interval like 100ms (see GroupCommit)
+        group_commit_ms: 2,  # how long a sync waits for other publishes to share it
+        write_coalesce_ms: 0,  # how long pipe-mode frames wait for more to share a write (see Outbound)
+        outbound_buffer: 8 * 1024 * 1024,  # bytes of frames a pipe-mode connection may have waiting to be read
+        slow_consumer: 'block',  # when that fills: block, drop deliveries, or disconnect (see Outbound)
+        idle_topic_ttl: nil,  # e.g. 7d: the daemon deletes topics idle that long (see TopicGC)
+        read_only: false,  # serve subscriptions and replays, refuse publishes (a replica or snapshot)
       })
     end
 
@@ -50,10 +89,86 @@ module Shortbus
       topics_dir
     end
 
+    def subscribers_dir
+      root_path / 'subscribers'
+    end
+
+    def groups_dir
+      root_path / 'groups'
+    end
+
+    def sessions_dir
+      root_path / 'sessions'
+    end
+
+    def connections_dir
+      root_path / 'connections'
+    end
+
+    def transactions_dir
+      root_path / 'transactions'
+    end
+
+    def dedupe_dir
+      root_path / 'dedupe'
+    end
+
+    def streams_dir
+      root_path / 'streams'
+    end
+
+    def heads_dir
+      root_path / 'heads'
+    end
+
+    def indexes_dir
+      root_path / 'indexes'
+    end
+
+    def schedules_dir
+      root_path / 'schedules'
+    end
+
+    def jobs_dir
+      root_path / 'jobs'
+    end
+
+    def deadlines_dir
+      root_path / 'deadlines'
+    end
+
+    def delayed_dir
+      root_path / 'delayed'
+    end
+
+    def metrics_dir
+      root_path / 'metrics'
+    end
+
+    def stats_dir
+      root_path / 'stats'
+    end
+
+    def depths_dir
+      root_path / 'depths'
+    end
+
+    def mirrors_dir
+      root_path / 'mirrors'
+    end
+
     def logs_dir
       root_path / 'logs'
     end
 
+    def archive_dir
+      root_path / 'archive'
+    end
+
+    def tiers_dir
+      root_path / 'tiers'
+    end
+
     def socket_path
       root_path / 'shortbus.sock'
     end
@@ -70,10 +185,58 @@ module Shortbus
       logs_dir / 'blockqueue.log'
     end
 
+    def log_path
+      logs_dir / 'shortbus.log'
+    end
+
+    def audit_log
+      logs_dir / 'audit.log'
+    end
+
+    def presence_file
+      root_path / 'presence.json'
+    end
+
+    def locks_file
+      root_path / 'locks.json'
+    end
+
     def shortbus_yml
       config_dir / 'shortbus.yml'
     end
 
+    def schedules_yml
+      config_dir / 'schedules.yml'
+    end
+
+    def topics_yml
+      config_dir / 'topics.yml'
+    end
+
+    def classes_yml
+      config_dir / 'classes.yml'
+    end
+
+    def auto_create_yml
+      config_dir / 'auto_create.yml'
+    end
+
+    def routes_yml
+      config_dir / 'routes.yml'
+    end
+
+    def keys_yml
+      config_dir / 'keys.yml'
+    end
+
+    def auth_yml
+      config_dir / 'auth.yml'
+    end
+
+    def users_yml
+      config_dir / 'users.yml'
+    end
+
     def blockqueue_yml
       config_dir / 'blockqueue.yml'
     end
@@ -82,10 +245,46 @@ module Shortbus
       blockqueue_yml
     end
 
+    # BlockQueue's SQLite file (sqlite.db_name in blockqueue.yml), once it exists
+    def engine_database_path
+      settings = blockqueue_yml.exist? ? YAML.safe_load(blockqueue_yml.read) : nil
+      name = settings&.dig('sqlite', 'db_name') || 'blockqueue'
+
+      [name, "#{name}.db"].map { |file| root_path / file }.find(&:file?)
+    rescue Psych::Exception
+      nil
+    end
+
+    def group_commit_path
+      root_path / 'group_commit.lock'
+    end
+
+    def data_lock_path
+      root_path / 'data.lock'
+    end
+
+    def idle_topics_path
+      root_path / 'idle_topics.json'
+    end
+
+    # The engine database's write-ahead log, nil before there is a database
+    def engine_wal_path
+      database = engine_database_path
+      database && Pathname.new("#{database}-wal")
+    end
+
+    def recovery_path
+      root_path / 'recovery.json'
+    end
+
     def debug?
       !!@debug
     end
 
+    def read_only?
+      %w[1 true yes on].include?(@read_only.to_s.strip.downcase)
+    end
+
     def log?
       !!@log
     end
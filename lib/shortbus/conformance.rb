@@ -0,0 +1,243 @@
+module Shortbus
+  # Pipe protocol conformance: golden wire captures, and a player for them
+  #
+  # conformance/vN/ holds a capture per scenario of protocol version N, one
+  # frame a line as it crossed the pipe:
+  #
+  #   # comment
+  #   = {"$r1": 1, "$offset": 1}                          sample values
+  #   < {"status": "ready", "protocol": 1, ...}           broker to client
+  #   > {"op": "ping", "request_id": "$r1"}               client to broker
+  #
+  # Strings starting with $ stand for values that differ from run to run:
+  # the first frame read that carries one binds it (a value of the sample's
+  # JSON type), later frames must repeat it, and a side writing one it
+  # hasn't read uses the sample. A frame matches when it has every field of
+  # the capture's, recursively; fields it adds are fine, so the protocol can
+  # grow without breaking the captures, while removed, renamed, or retyped
+  # fields fail them.
+  #
+  # A player takes one side: it writes that side's frames and waits (up to
+  # TIMEOUT) for the other side's that follow, which may arrive in any
+  # order. Frames nobody asked for are let through, unless they are errors.
+  #
+  # The broker is held to every version it has ever spoken, so an older
+  # client keeps working: a change to a capture is a protocol change, and
+  # a new version gets a directory of its own (see PipeMode::PROTOCOL).
+  # The captures are plain files so that other clients can be checked
+  # against them too; conformance/README.md describes them for their authors.
+  #
+  # check runs a command once per capture and plays the other side over its
+  # stdin and stdout: `shortbus conformance --target CMD...` checks a
+  # client's driver that way, and plain `shortbus conformance` this broker's
+  # pipe mode. The command is told which scenario to act out in its
+  # environment (see SCENARIO_ENV).
+  #
+  # Example:
+  #   Conformance.captures.each do |capture|
+  #     result = Conformance.play(capture, side: :client, reader: stdout, writer: stdin)
+  #     puts "#{capture.id}: #{result[:passed] ? 'ok' : result[:failures].join('; ')}"
+  #   end
+  #
+  #   Conformance.check(%w[python3 driver.py], side: :broker)
+  #   # => [{ id: "v1/handshake", passed: true, failures: [] }, ...]
+  class Conformance
+    DIR = Pathname.new(File.expand_path('../../conformance', __dir__))
+    TIMEOUT = 5
+
+    # What a checked command is told: the capture's name, its protocol
+    # version, and its path, for drivers that read the capture themselves
+    SCENARIO_ENV = 'SHORTBUS_CONFORMANCE_SCENARIO'
+    PROTOCOL_ENV = 'SHORTBUS_CONFORMANCE_PROTOCOL'
+    CAPTURE_ENV = 'SHORTBUS_CONFORMANCE_CAPTURE'
+
+    Capture = Struct.new(:name, :version, :samples, :steps, :path, keyword_init: true) do
+      def id
+        "v#{version}/#{name}"
+      end
+    end
+
+    class << self
+      # Every capture, or those of one protocol version
+      def captures(version: nil, dir: DIR)
+        pattern = version ? "v#{Integer(version)}/*.jsonl" : 'v*/*.jsonl'
+        dir.glob(pattern).sort.map { |path| parse(path) }
+      end
+
+      def parse(path)
+        path = Pathname.new(path)
+        samples = {}
+        steps = []
+
+        path.each_line.with_index(1) do |line, number|
+          line = line.strip
+          next if line.empty? || line.start_with?('#')
+
+          marker, json = line[0], line[1..].strip
+          frame = JSON.parse(json)
+
+          case marker
+          when '=' then samples.merge!(frame)
+          when '>', '<'
+            side = marker == '>' ? :client : :broker
+            steps << [side, []] unless steps.last&.first == side
+            steps.last.last << frame
+          else
+            raise ArgumentError, "#{path}:#{number}: lines start with #, =, > or <"
+          end
+        rescue JSON::ParserError => e
+          raise ArgumentError, "#{path}:#{number}: #{e.message}"
+        end
+
+        Capture.new(name: path.basename('.jsonl').to_s, version: Integer(path.dirname.basename.to_s.delete_prefix('v')), samples:, steps:,
+                    path: path.to_s)
+      end
+
+      # Run command once per capture, for it to play side while this plays
+      # the other over its stdin and stdout; one result per capture
+      def check(command, side:, captures: self.captures, env: {}, timeout: TIMEOUT)
+        opposite = side == :client ? :broker : :client
+
+        captures.map do |capture|
+          run_env = env.merge(SCENARIO_ENV => capture.name, PROTOCOL_ENV => capture.version.to_s, CAPTURE_ENV => capture.path)
+
+          result = Open3.popen2(run_env, *command) do |stdin, stdout, process|
+            played = play(capture, side: opposite, reader: stdout, writer: stdin, timeout:)
+            stdin.close
+            finish(process, timeout)
+            played
+          end
+
+          { id: capture.id, **result }
+        rescue SystemCallError => e
+          { id: capture.id, passed: false, failures: ["couldn't run #{command.first}: #{e.message}"] }
+        end
+      end
+
+      # Take side (:client or :broker) of capture over reader and writer;
+      # returns { passed:, failures: }
+      def play(capture, side:, reader:, writer:, timeout: TIMEOUT)
+        bindings = {}
+        failures = []
+        lines = Queue.new
+        pump = Thread.new do
+          reader.each_line { |line| lines << line }
+          lines << :eof
+        end
+
+        capture.steps.each do |from, frames|
+          if from == side
+            frames.each { |frame| writer.write(JSON.generate(substitute(frame, bindings, capture.samples)) + "\n") }
+            writer.flush
+          else
+            failures.concat(expect(frames, lines, bindings, capture.samples, timeout))
+          end
+          break if failures.any?
+        end
+
+        { passed: failures.empty?, failures: }
+      rescue Errno::EPIPE, IOError => e
+        { passed: false, failures: failures + ["connection closed: #{e.message}"] }
+      ensure
+        pump&.kill
+      end
+
+      # bindings extended by matching actual against expected, nil if it doesn't
+      def match(expected, actual, bindings, samples)
+        case expected
+        when Hash
+          return nil unless actual.is_a?(Hash)
+
+          expected.reduce(bindings) do |bound, (key, value)|
+            bound && actual.key?(key) ? match(value, actual[key], bound, samples) : nil
+          end
+        when Array
+          return nil unless actual.is_a?(Array) && actual.size == expected.size
+
+          expected.zip(actual).reduce(bindings) { |bound, (value, got)| bound && match(value, got, bound, samples) }
+        when /\A\$\w+\z/
+          if bindings.key?(expected)
+            bindings[expected] == actual ? bindings : nil
+          elsif samples.key?(expected) && json_type(samples[expected]) != json_type(actual)
+            nil
+          else
+            bindings.merge(expected => actual)
+          end
+        else
+          expected == actual ? bindings : nil
+        end
+      end
+
+      # frame with its placeholders filled in
+      def substitute(frame, bindings, samples)
+        case frame
+        when Hash then frame.transform_values { |value| substitute(value, bindings, samples) }
+        when Array then frame.map { |value| substitute(value, bindings, samples) }
+        when /\A\$\w+\z/
+          bindings.fetch(frame) do
+            raise ArgumentError, "no sample for #{frame}" unless samples.key?(frame)
+
+            bindings[frame] = samples[frame]
+          end
+        else frame
+        end
+      end
+
+      private
+
+      # Read until every frame is matched, in any order
+      def expect(frames, lines, bindings, samples, timeout)
+        pending = frames.dup
+        deadline = Time.now + timeout
+
+        until pending.empty?
+          line = lines.pop(timeout: [deadline - Time.now, 0].max)
+          waiting = pending.map { |frame| JSON.generate(frame) }.join(', ')
+          return ["timed out waiting for #{waiting}"] unless line
+          return ["connection closed waiting for #{waiting}"] if line == :eof
+          next if line.strip.empty?
+
+          actual = frame(line)
+          return ["not a JSON frame: #{line.strip}"] unless actual.is_a?(Hash)
+
+          index = pending.index { |frame| match(frame, actual, bindings, samples) }
+
+          if index
+            bindings.replace(match(pending.delete_at(index), actual, bindings, samples))
+          elsif actual['type'] == 'error'
+            return ["unexpected error: #{line.strip}"]
+          end
+        end
+
+        []
+      end
+
+      # A command that doesn't exit once its stdin closes is stopped
+      def finish(process, timeout)
+        return if process.join(timeout)
+
+        Process.kill('KILL', process.pid)
+        process.join
+      rescue Errno::ESRCH
+        nil
+      end
+
+      def frame(line)
+        JSON.parse(line)
+      rescue JSON::ParserError
+        nil
+      end
+
+      def json_type(value)
+        case value
+        when Hash then :object
+        when Array then :array
+        when String then :string
+        when Integer, Float then :number
+        when true, false then :boolean
+        when nil then :null
+        end
+      end
+    end
+  end
+end
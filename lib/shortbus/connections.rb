@@ -0,0 +1,120 @@
+module Shortbus
+  # Cross-process connection registry
+  #
+  # Every pipe process records who it is under connections/ID.json so admin
+  # listings can show named clients:
+  #
+  #   { "id": "9f1c...", "name": "billing-worker", "pid": 4242,
+  #     "connected_at": "2025-10-20T12:00:00Z", "subscriptions": ["jobs"] }
+  #
+  # Entries whose process has died are pruned on read. A connection's last
+  # will (see PipeMode's hello) is kept here too, so that if its process is
+  # killed outright whoever prunes the entry publishes the will; only the
+  # process whose delete succeeds does, so it goes out once.
+  class Connections
+    attr_reader :config
+
+    def initialize(config: Shortbus.config)
+      @config = config
+    end
+
+    def register(id, name: nil, pid: Process.pid)
+      write(id, {
+        id: id,
+        name: name,
+        pid: pid,
+        connected_at: Time.now.utc.iso8601,
+        subscriptions: []
+      })
+    end
+
+    def update(id, **fields)
+      connection = get(id)
+      return nil unless connection
+
+      write(id, connection.merge(fields))
+    end
+
+    def unregister(id)
+      FileUtils.rm_f(path(id))
+    end
+
+    # Drop a dead connection's entry and publish its will, if it left one;
+    # false when another process got there first
+    def bury(connection, engine: Shortbus.engine)
+      File.delete(path(connection[:id]))
+      publish_will(connection, engine:) if connection[:will]
+      true
+    rescue Errno::ENOENT
+      false
+    end
+
+    def publish_will(connection, engine: Shortbus.engine)
+      will = connection[:will]
+      metadata = (will[:metadata] || {}).merge(will: true, connection_id: connection[:id], published_by: connection[:name] || connection[:id])
+
+      engine.publish(will[:topic], will[:payload].to_s, metadata:)
+    rescue Shortbus::Error => e
+      Shortbus.warn "Last will of connection #{connection[:id]} not published: #{e.message}"
+    end
+
+    # Publish the wills of connections whose process died; returns their ids
+    def reap!(engine: Shortbus.engine)
+      entries.reject { |connection| alive?(connection[:pid]) }
+             .select { |connection| bury(connection, engine:) }
+             .map { |connection| connection[:id] }
+    end
+
+    def get(id)
+      return nil unless path(id).exist?
+
+      JSON.parse(File.read(path(id)), symbolize_names: true)
+    rescue JSON::ParserError, Errno::ENOENT
+      nil
+    end
+
+    # Live connections, oldest first
+    def list
+      live, dead = entries.partition { |connection| alive?(connection[:pid]) }
+      dead.each { |connection| bury(connection) }
+
+      live.sort_by { |connection| connection[:connected_at].to_s }
+    end
+
+    private
+
+    def entries
+      return [] unless config.connections_dir.exist?
+
+      config.connections_dir.glob('*.json').filter_map do |file|
+        get(file.basename('.json').to_s)
+      end
+    end
+
+    def path(id)
+      config.connections_dir / "#{id}.json"
+    end
+
+    def write(id, connection)
+      FileUtils.mkdir_p(config.connections_dir)
+
+      # Write-then-rename so readers never see a half-written entry
+      tmp = path(id).sub_ext(".json.#{Process.pid}.tmp")
+      File.write(tmp, JSON.generate(connection))
+      File.rename(tmp, path(id))
+
+      connection
+    end
+
+    def alive?(pid)
+      return false unless pid.to_i > 0
+
+      Process.kill(0, pid.to_i)
+      true
+    rescue Errno::ESRCH
+      false
+    rescue Errno::EPERM
+      true
+    end
+  end
+end
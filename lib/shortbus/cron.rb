@@ -0,0 +1,114 @@
+module Shortbus
+  # Five-field cron expressions, in the broker's local time
+  #
+  #   minute hour day-of-month month day-of-week
+  #   */5 * * * *          every five minutes
+  #   0 9-17 * * 1-5       on the hour, 9 to 5, weekdays
+  #   30 2 1,15 * *        2:30 on the 1st and 15th
+  #
+  # Fields take *, numbers, ranges (a-b), lists (a,b), and steps (*/n, a-b/n);
+  # day-of-week is 0-7 with both 0 and 7 meaning Sunday. As in cron, when both
+  # day fields are restricted a day matching either one counts. The usual
+  # shorthands (@hourly, @daily, @weekly, @monthly, @yearly) work too.
+  #
+  # Example:
+  #   Shortbus::Cron.new('*/5 * * * *').next_after(Time.now)
+  class Cron
+    SHORTHANDS = {
+      '@hourly' => '0 * * * *',
+      '@daily' => '0 0 * * *',
+      '@midnight' => '0 0 * * *',
+      '@weekly' => '0 0 * * 0',
+      '@monthly' => '0 0 1 * *',
+      '@yearly' => '0 0 1 1 *',
+      '@annually' => '0 0 1 1 *'
+    }.freeze
+
+    FIELDS = { minute: 0..59, hour: 0..23, day: 1..31, month: 1..12, wday: 0..7 }.freeze
+
+    # Give up looking for a match this far out (e.g. "0 0 31 2 *")
+    HORIZON = 5 * 366 * 86_400
+
+    attr_reader :expression
+
+    def self.valid?(expression)
+      new(expression)
+      true
+    rescue ArgumentError
+      false
+    end
+
+    def initialize(expression)
+      @expression = expression.to_s.strip
+      fields = SHORTHANDS.fetch(@expression, @expression).split(/\s+/)
+      raise ArgumentError, "cron expression needs 5 fields: #{expression.inspect}" unless fields.size == 5
+
+      @sets = FIELDS.keys.zip(fields).to_h { |name, field| [name, parse(name, field)] }
+      @sets[:wday] = @sets[:wday].map { |wday| wday % 7 }.uniq
+
+      @any_day = fields[2] == '*'
+      @any_wday = fields[4] == '*'
+    end
+
+    # The first matching minute strictly after time
+    def next_after(time)
+      time = Time.at(time.to_i - time.sec + 60)
+      limit = time + HORIZON
+
+      while time < limit
+        if !@sets[:month].include?(time.month)
+          time = Time.local(time.year + (time.month == 12 ? 1 : 0), time.month % 12 + 1, 1)
+        elsif !day?(time)
+          # Via noon, so a 23 or 25 hour day (DST) still lands on tomorrow
+          tomorrow = Time.local(time.year, time.month, time.day, 12) + 86_400
+          time = Time.local(tomorrow.year, tomorrow.month, tomorrow.day)
+        elsif !@sets[:hour].include?(time.hour)
+          time = Time.at(time.to_i - time.min * 60 - time.sec + 3600)
+        elsif !@sets[:minute].include?(time.min)
+          time += 60
+        else
+          return time
+        end
+      end
+
+      raise ArgumentError, "cron expression never matches: #{expression.inspect}"
+    end
+
+    private
+
+    def day?(time)
+      day = @sets[:day].include?(time.day)
+      wday = @sets[:wday].include?(time.wday)
+
+      if @any_day || @any_wday
+        day && wday
+      else
+        day || wday
+      end
+    end
+
+    def parse(name, field)
+      range = FIELDS.fetch(name)
+
+      field.split(',').flat_map do |part|
+        match = part.match(%r{\A(\*|\d+(?:-\d+)?)(?:/(\d+))?\z})
+        raise ArgumentError, "invalid cron #{name}: #{field.inspect}" unless match
+
+        if match[1] == '*'
+          first, last = range.first, range.last
+        else
+          first, last = match[1].split('-').map { |value| Integer(value, 10) }
+          # "5/15" is 5, 20, 35, 50
+          last ||= match[2] ? range.last : first
+        end
+        step = Integer(match[2] || '1', 10)
+
+        unless range.cover?(first) && range.cover?(last) && first <= last && step > 0
+          raise ArgumentError, "invalid cron #{name}: #{field.inspect}"
+        end
+
+        (first..last).step(step).to_a
+      end.uniq
+    end
+  end
+end
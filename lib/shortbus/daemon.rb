@@ -0,0 +1,326 @@
+module Shortbus
+  # Daemon: long-running shortbus service
+  #
+  # Forks shortbus into the background, writes a PID file, and supervises the
+  # BlockQueue engine until told to stop:
+  #
+  #   - SIGTERM / SIGINT: graceful drain (stop engine, remove PID file, exit)
+  #   - SIGUSR1: reopen log files (for logrotate)
+  #
+  # While supervising it also reaps ephemeral topics, dead connections
+  # (publishing their last wills) and lapsed presence entries, archives
+  # aged-out messages (see Archiver) or deletes them (see Retention),
+  # compacts topics (see Compactor), publishes rolling stats (see
+  # Aggregates) and feeds shadow topics (see Mirrors). A read-only broker
+  # (SHORTBUS_READ_ONLY) only reaps connections and presence, and their
+  # last wills and events go unpublished.
+  #
+  # Example:
+  #   daemon = Shortbus.daemon
+  #   daemon.start!
+  #   daemon.status   # => { status: :running, pid: 1234, ... }
+  #   daemon.stop!
+  class Daemon
+    attr_reader :config, :process_manager
+
+    def initialize(config: Shortbus.config, process_manager: Shortbus.process_manager)
+      @config = config
+      @process_manager = process_manager
+      @stopping = false
+      @reopen_logs = false
+    end
+
+    # Fork to background and start supervising the engine
+    def start!
+      if running?
+        Shortbus.warn "shortbus daemon already running (pid: #{read_pidfile})"
+        return false
+      end
+
+      remove_pidfile! if pidfile_exists?
+      FileUtils.mkdir_p(config.logs_dir)
+
+      # Double fork so the daemon is re-parented to init and can't reacquire a tty
+      pid = fork do
+        Process.setsid
+        exit!(0) if fork
+
+        run!
+      end
+
+      Process.wait(pid)
+      wait_for_pidfile!
+
+      Shortbus.info "shortbus daemon started (pid: #{read_pidfile})"
+      true
+    end
+
+    # Stop the background daemon, waiting for it to drain
+    def stop!(timeout: config.drain_timeout)
+      pid = read_pidfile
+
+      unless pid && process_running?(pid)
+        Shortbus.warn "shortbus daemon not running"
+        remove_pidfile!
+        return false
+      end
+
+      Process.kill('TERM', pid)
+
+      deadline = Time.now + timeout
+      sleep 0.1 while process_running?(pid) && Time.now < deadline
+
+      if process_running?(pid)
+        Shortbus.warn "shortbus daemon did not drain within #{timeout}s, killing..."
+        Process.kill('KILL', pid)
+      end
+
+      remove_pidfile!
+      true
+    rescue Errno::ESRCH
+      remove_pidfile!
+      true
+    end
+
+    def restart!
+      stop! if running?
+      start!
+    end
+
+    def running?
+      process_running?(read_pidfile)
+    end
+
+    def status
+      if running?
+        {
+          status: :running,
+          pid: read_pidfile,
+          log: config.log_path.to_s,
+          read_only: (true if config.read_only?),
+          engine: process_manager.status
+        }.compact
+      else
+        {
+          status: :stopped
+        }
+      end
+    end
+
+    # Daemon body: runs inside the forked process
+    def run!
+      redirect_io!
+      Shortbus.log!
+      write_pidfile!
+      trap_signals!
+
+      Shortbus.info "shortbus daemon running (pid: #{Process.pid})"
+
+      process_manager.start! unless process_manager.running?
+      supervise!
+      drain!
+    ensure
+      remove_pidfile! if read_pidfile == Process.pid
+    end
+
+    private
+
+    # Signal handlers only flip flags; the loop does the work because Logger
+    # and friends aren't safe to call from trap context
+    def trap_signals!
+      trap('TERM') { @stopping = true }
+      trap('INT') { @stopping = true }
+      trap('USR1') { @reopen_logs = true }
+    end
+
+    def supervise!
+      until @stopping
+        if @reopen_logs
+          @reopen_logs = false
+          redirect_io!
+          Shortbus.info "Reopened logs"
+        end
+
+        unless process_manager.running?
+          Shortbus.warn "BlockQueue not responding, restarting..."
+          begin
+            process_manager.start!
+          rescue => e
+            Shortbus.error "Restart failed: #{e.message}"
+          end
+        end
+
+        reap_connections!
+        reap_presence!
+
+        # A read-only broker leaves the topics as it found them
+        unless config.read_only?
+          reap_topics!
+          collect_idle_topics!
+          archive_messages!
+          expire_messages!
+          compact_topics!
+          publish_stats!
+          mirror_topics!
+          prune_jobs!
+          run_schedules!
+          release_delayed!
+        end
+        sleep 1
+      end
+    end
+
+    def reap_topics!
+      Shortbus.topics.reap!.each { |topic| Shortbus.info "Reaped ephemeral topic: #{topic}" }
+    rescue => e
+      Shortbus.error "Ephemeral topic reaper failed: #{e.message}"
+    end
+
+    def collect_idle_topics!
+      return if @collected_at && Time.now - @collected_at < TopicGC::INTERVAL
+
+      @collected_at = Time.now
+      Shortbus.topic_gc.collect!.each { |topic| Shortbus.info "Collected idle topic: #{topic}" }
+    rescue => e
+      Shortbus.error "Idle topic collection failed: #{e.message}"
+    end
+
+    # Connections whose process died without shutting down leave their last
+    # will behind
+    def reap_connections!
+      Shortbus.connections.reap!.each { |id| Shortbus.info "Reaped dead connection: #{id}" }
+    rescue => e
+      Shortbus.error "Connection reaper failed: #{e.message}"
+    end
+
+    def reap_presence!
+      Shortbus.presence.reap!.each { |name| Shortbus.debug "Presence expired: #{name}" }
+    rescue => e
+      Shortbus.error "Presence reaper failed: #{e.message}"
+    end
+
+    def archive_messages!
+      return if @archived_at && Time.now - @archived_at < Archiver::ARCHIVE_INTERVAL
+
+      @archived_at = Time.now
+      Shortbus.archiver.archive!
+    rescue => e
+      Shortbus.error "Archiver failed: #{e.message}"
+    end
+
+    def expire_messages!
+      return if @expired_at && Time.now - @expired_at < Retention::INTERVAL
+
+      @expired_at = Time.now
+      Shortbus.retention.expire!
+    rescue => e
+      Shortbus.error "Retention failed: #{e.message}"
+    end
+
+    def compact_topics!
+      return if @compacted_at && Time.now - @compacted_at < Compactor::COMPACT_INTERVAL
+
+      @compacted_at = Time.now
+      Shortbus.compactor.compact!
+    rescue => e
+      Shortbus.error "Compactor failed: #{e.message}"
+    end
+
+    def publish_stats!
+      return if @stats_at && Time.now - @stats_at < Aggregates::INTERVAL
+
+      @stats_at = Time.now
+      Shortbus.aggregates.tick!
+    rescue => e
+      Shortbus.error "Stats aggregation failed: #{e.message}"
+    end
+
+    def mirror_topics!
+      Shortbus.mirrors.mirror!
+    rescue => e
+      Shortbus.error "Mirroring failed: #{e.message}"
+    end
+
+    def run_schedules!
+      Shortbus.schedules.tick!.each { |name, id| Shortbus.debug "Schedule #{name} published message #{id}" }
+    rescue => e
+      Shortbus.error "Scheduler failed: #{e.message}"
+    end
+
+    def release_delayed!
+      Shortbus.delays.release!.each { |id, message_id| Shortbus.debug "Delayed message #{id} published as #{message_id}" }
+    rescue => e
+      Shortbus.error "Delayed publishing failed: #{e.message}"
+    end
+
+    def prune_jobs!
+      return if @pruned_at && Time.now - @pruned_at < Jobs::PRUNE_INTERVAL
+
+      @pruned_at = Time.now
+      Shortbus.jobs.prune!
+    rescue => e
+      Shortbus.error "Job pruning failed: #{e.message}"
+    end
+
+    def drain!
+      Shortbus.info "Draining shortbus daemon..."
+      process_manager.stop! if process_manager.running?
+      Shortbus.info "shortbus daemon stopped"
+    end
+
+    def redirect_io!
+      $stdin.reopen(File::NULL)
+      $stdout.reopen(config.log_path.to_s, 'a')
+      $stderr.reopen(config.log_path.to_s, 'a')
+      $stdout.sync = true
+      $stderr.sync = true
+    end
+
+    def wait_for_pidfile!(timeout: 10)
+      deadline = Time.now + timeout
+
+      until running?
+        if Time.now > deadline
+          raise EngineError, "shortbus daemon failed to start within #{timeout} seconds (see #{config.log_path})"
+        end
+
+        sleep 0.1
+      end
+    end
+
+    def process_running?(pid)
+      return false unless pid
+
+      Process.kill(0, pid)
+      true
+    rescue Errno::ESRCH
+      false
+    rescue Errno::EPERM
+      true
+    end
+
+    # PID file operations
+    def pidfile_exists?
+      config.pid_file.exist?
+    end
+
+    def read_pidfile
+      return nil unless pidfile_exists?
+
+      pid = File.read(config.pid_file).strip.to_i
+      pid > 0 ? pid : nil
+    rescue
+      nil
+    end
+
+    def write_pidfile!
+      File.write(config.pid_file, Process.pid.to_s)
+    end
+
+    def remove_pidfile!
+      config.pid_file.delete if pidfile_exists?
+    rescue
+      # Ignore errors
+    end
+  end
+end
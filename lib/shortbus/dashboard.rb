@@ -0,0 +1,142 @@
+module Shortbus
+  # A Grafana dashboard and Prometheus alert rules for the metrics the HTTP
+  # gateway exports on GET /metrics (see Metrics#prometheus)
+  #
+  # Both are built from Metrics::EXPORTED, so they can't name a series the
+  # broker doesn't export. The dashboard is in Grafana's import format: it
+  # asks for a Prometheus data source on import, and has a topic variable
+  # filled from the topics seen. The rules are a Prometheus rule file; their
+  # thresholds are starting points, meant to be tuned.
+  #
+  # Example:
+  #   File.write('shortbus.json', JSON.pretty_generate(Dashboard.grafana))
+  #   File.write('shortbus-rules.yml', Dashboard.alert_rules_yaml(latency: 10))
+  module Dashboard
+    UID = 'shortbus'
+    WINDOW = '5m' # rate() window of every panel and rule
+
+    # Grafana dashboard JSON, ready to import
+    def grafana(title: 'shortbus')
+      {
+        __inputs: [{ name: 'DS_PROMETHEUS', label: 'Prometheus', type: 'datasource', pluginId: 'prometheus', pluginName: 'Prometheus' }],
+        uid: UID,
+        title: title,
+        tags: %w[shortbus],
+        timezone: 'browser',
+        schemaVersion: 39,
+        refresh: '30s',
+        time: { from: 'now-6h', to: 'now' },
+        templating: { list: [topic_variable] },
+        panels: panels.each_with_index.map { |panel, index| panel.merge(id: index + 1, datasource: datasource, gridPos: grid(index)) }
+      }
+    end
+
+    # Prometheus alert rules: delivery latency p99 over latency seconds, for
+    # the topic or any of its groups, and schema failures at all
+    def alert_rules(latency: 30)
+      rules = [
+        {
+          alert: 'ShortbusDeliveryLatencyHigh',
+          expr: "#{quantile(0.99, :latency, 'topic', filter: '')} > #{latency}",
+          for: '10m',
+          labels: { severity: 'warning' },
+          annotations: {
+            summary: 'shortbus topic {{ $labels.topic }} delivers slowly',
+            description: "p99 from publish to delivery has been over #{latency}s for 10 minutes: {{ $value | humanizeDuration }}"
+          }
+        },
+        {
+          alert: 'ShortbusGroupLatencyHigh',
+          expr: "#{quantile(0.99, :group_latency, 'topic, group', filter: '')} > #{latency}",
+          for: '10m',
+          labels: { severity: 'warning' },
+          annotations: {
+            summary: 'shortbus group {{ $labels.group }} is behind on {{ $labels.topic }}',
+            description: "p99 from publish to delivery to the group has been over #{latency}s for 10 minutes: {{ $value | humanizeDuration }}"
+          }
+        },
+        {
+          alert: 'ShortbusSchemaFailures',
+          expr: "sum by (topic) (rate(#{Metrics::EXPORTED[:schema_failures]}[#{WINDOW}])) > 0",
+          for: '5m',
+          labels: { severity: 'info' },
+          annotations: {
+            summary: "publishes to {{ $labels.topic }} fail its schema",
+            description: "a producer keeps sending messages the topic's schema refuses; `shortbus metrics {{ $labels.topic }}` shows the last error"
+          }
+        }
+      ]
+
+      { groups: [{ name: 'shortbus', rules: rules }] }
+    end
+
+    # alert_rules as a YAML rule file
+    def alert_rules_yaml(**options)
+      YAML.dump(JSON.parse(JSON.generate(alert_rules(**options))))
+    end
+
+    private
+
+    def panels
+      exported = Metrics::EXPORTED
+
+      [
+        timeseries('Publishes', 'ops', "sum by (topic) (rate(#{exported[:published]}#{topic_filter}[#{WINDOW}]))", '{{topic}}'),
+        timeseries('Published bytes', 'Bps', "sum by (topic) (rate(#{exported[:bytes]}#{topic_filter}[#{WINDOW}]))", '{{topic}}'),
+        timeseries('Delivery latency p50 / p99', 's',
+                   [quantile(0.5, :latency, 'topic'), '{{topic}} p50'],
+                   [quantile(0.99, :latency, 'topic'), '{{topic}} p99']),
+        timeseries('Group delivery latency p99', 's', quantile(0.99, :group_latency, 'topic, group'), '{{topic}} / {{group}}'),
+        timeseries('Payload size p99', 'bytes', quantile(0.99, :sizes, 'topic'), '{{topic}}'),
+        timeseries('Schema failures', 'ops', "sum by (topic) (rate(#{exported[:schema_failures]}#{topic_filter}[#{WINDOW}]))", '{{topic}}')
+      ]
+    end
+
+    # A panel of one query (expr, legend) or several ([expr, legend], ...)
+    def timeseries(title, unit, *queries)
+      queries = [queries] unless queries.first.is_a?(Array)
+
+      {
+        type: 'timeseries',
+        title: title,
+        fieldConfig: { defaults: { unit: unit }, overrides: [] },
+        targets: queries.each_with_index.map { |(expr, legend), index| { refId: ('A'.ord + index).chr, expr: expr, legendFormat: legend, datasource: datasource } }
+      }
+    end
+
+    # Two panels a row
+    def grid(index)
+      { h: 8, w: 12, x: (index % 2) * 12, y: (index / 2) * 8 }
+    end
+
+    # Panels filter on the dashboard's topic variable; rules don't
+    def quantile(q, name, by, filter: topic_filter)
+      "histogram_quantile(#{q}, sum by (#{by}, le) (rate(#{Metrics::EXPORTED.fetch(name)}_bucket#{filter}[#{WINDOW}])))"
+    end
+
+    def topic_filter
+      '{topic=~"$topic"}'
+    end
+
+    def datasource
+      { type: 'prometheus', uid: '${DS_PROMETHEUS}' }
+    end
+
+    def topic_variable
+      {
+        name: 'topic',
+        label: 'Topic',
+        type: 'query',
+        datasource: datasource,
+        query: { query: "label_values(#{Metrics::EXPORTED[:published]}, topic)", refId: 'topics' },
+        refresh: 2,
+        includeAll: true,
+        multi: true,
+        allValue: '.*',
+        current: { text: 'All', value: '$__all' }
+      }
+    end
+
+    extend self
+  end
+end
@@ -0,0 +1,122 @@
+module Shortbus
+  # Exclusive use of the data directory
+  #
+  # Two brokers on one rendezvous directory (a second `shortbus daemon start`
+  # with another SHORTBUS_ENGINE_PORT, a container restarted before the old
+  # one died) would run two engines on the same SQLite database and two
+  # archivers over the same topics, each deleting what the other archived.
+  # Before the engine starts ProcessManager takes an flock on data.lock,
+  # without waiting; a directory already held fails the start straight
+  # away, naming the holder:
+  #
+  #   data directory /var/lib/shortbus is in use by pid 4242 (since 2024-10-20T09:00:00Z)
+  #
+  # The engine inherits the lock's descriptor, so the directory stays held
+  # as long as either process lives, and the kernel lets it go with them;
+  # a stale data.lock left by a crash needs no cleanup.
+  #
+  # Each acquisition also takes the next fencing token, a count kept in
+  # data.lock:
+  #
+  #   { "token": 7, "pid": 4242, "acquired_at": "2024-10-20T09:00:00Z" }
+  #
+  # Writers that change the data outside the engine (the Archiver) check the
+  # token before committing and stamp it into the segments they record (see
+  # Tiers). A broker that has lost the directory without noticing (flock
+  # is advisory, and unreliable over NFS) finds a newer token there and
+  # stops rather than writing over its successor.
+  #
+  # Example:
+  #   Shortbus.data_lock.acquire!   # => 7, or raises EngineError
+  #   Shortbus.data_lock.fence!     # => 7, or raises EngineError once superseded
+  class DataLock
+    attr_reader :config, :token
+
+    def initialize(config: Shortbus.config)
+      @config = config
+      @file = nil
+      @token = nil
+    end
+
+    # Take the directory and the next token; raises EngineError while another
+    # broker holds it
+    def acquire!
+      return @token if held?
+
+      FileUtils.mkdir_p(path.dirname)
+      file = File.open(path, File::RDWR | File::CREAT, 0o644)
+
+      unless file.flock(File::LOCK_EX | File::LOCK_NB)
+        holder = parse(file.read)
+        file.close
+        raise EngineError, "data directory #{config.root_path} is in use by #{describe(holder)}"
+      end
+
+      holder = parse(file.read)
+      @token = holder[:token].to_i + 1
+      file.rewind
+      file.truncate(0)
+      file.write(JSON.generate(token: @token, pid: Process.pid, acquired_at: Time.now.utc.iso8601))
+      file.flush
+      file.fsync
+      @file = file
+      @token
+    rescue
+      file&.close unless @file.equal?(file)
+      raise
+    end
+
+    # Let go of the directory (the engine keeps it while it still runs)
+    def release!
+      @file&.close
+      @file = nil
+      @token = nil
+    end
+
+    def held?
+      !@file.nil? && !@file.closed?
+    end
+
+    # The descriptor a child process inherits to share the lock
+    def io
+      @file if held?
+    end
+
+    # The latest token handed out, by this process or any other
+    def current
+      path.exist? ? parse(path.read)[:token] : nil
+    rescue Errno::ENOENT
+      nil
+    end
+
+    # The token a write should carry. Raises EngineError if this process held
+    # the directory and a newer token has been handed out since; processes
+    # that don't hold it (`shortbus archive` next to the daemon) write under
+    # the current one.
+    def fence!
+      current = self.current
+      return current unless @token
+      return @token if current == @token
+
+      raise EngineError, "data directory #{config.root_path} was taken over (token #{current}, ours #{@token}); refusing to write"
+    end
+
+    def path
+      config.data_lock_path
+    end
+
+    private
+
+    def parse(json)
+      json.to_s.strip.empty? ? {} : JSON.parse(json, symbolize_names: true)
+    rescue JSON::ParserError
+      {}
+    end
+
+    def describe(holder)
+      return 'another broker' unless holder[:pid]
+
+      "pid #{holder[:pid]}#{" (since #{holder[:acquired_at]})" if holder[:acquired_at]}"
+    end
+  end
+end
@@ -0,0 +1,115 @@
+module Shortbus
+  # Processing deadlines
+  #
+  # A publish may say when its message stops being worth working on, either
+  # as a deadline (ISO8601 or epoch seconds) or as deadline_in (a duration
+  # from now). It is stored as metadata.deadline. Once that has passed the
+  # message is skipped rather than delivered, by subscriptions and group
+  # fetches alike, so workers burning down a backlog don't spend it on jobs
+  # nobody is waiting for any more.
+  #
+  # Skipped messages are counted per topic in deadlines/TOPIC.json:
+  #
+  #   { "expired": 12, "last_expired_at": 1729425600 }
+  #
+  # Example:
+  #   metadata = Shortbus.deadlines.stamp({}, deadline_in: '30s')
+  #   Shortbus.deadlines.live('jobs', messages)   # => the unexpired ones
+  #   Shortbus.deadlines.expired('jobs')          # => 12
+  class Deadlines
+    attr_reader :config
+
+    def initialize(config: Shortbus.config)
+      @config = config
+    end
+
+    # metadata with deadline set from either form (deadline wins)
+    def stamp(metadata, deadline: nil, deadline_in: nil, now: Time.now)
+      return metadata if deadline.nil? && deadline_in.nil?
+
+      at = deadline ? parse_time(deadline) : now + Shortbus.parse_duration(deadline_in)
+      metadata.merge(deadline: at.utc.iso8601(3))
+    end
+
+    def deadline(message)
+      value = message.dig(:metadata, :deadline)
+      value && parse_time(value)
+    rescue ArgumentError
+      nil
+    end
+
+    def expired?(message, now: Time.now)
+      at = deadline(message)
+      !at.nil? && at <= now
+    end
+
+    # True (and counted) when message should be skipped
+    def expire?(topic, message, now: Time.now)
+      return false unless expired?(message, now:)
+
+      count!(topic, 1)
+      true
+    end
+
+    # The messages still worth delivering, counting the rest
+    def live(topic, messages, now: Time.now)
+      live, expired = messages.partition { |message| !expired?(message, now:) }
+      count!(topic, expired.size) if expired.any?
+      live
+    end
+
+    # Messages skipped on topic so far
+    def expired(topic)
+      return 0 unless path(topic).exist?
+
+      parse(File.read(path(topic)))[:expired].to_i
+    end
+
+    private
+
+    def count!(topic, count)
+      Shortbus.debug "Skipping #{count} expired message(s) on #{topic}"
+
+      locked(topic) do |file|
+        counts = parse(file.read)
+        counts[:expired] = counts[:expired].to_i + count
+        counts[:last_expired_at] = Time.now.to_i
+
+        file.rewind
+        file.truncate(0)
+        file.write(JSON.generate(counts))
+        file.flush
+      end
+    end
+
+    def parse_time(value)
+      case value
+      when Time then value
+      when Numeric then Time.at(value)
+      when /\A\d+(\.\d+)?\z/ then Time.at(Float(value))
+      else Time.iso8601(value.to_s)
+      end
+    end
+
+    def path(topic)
+      raise ArgumentError, "Invalid topic name: #{topic.inspect}" unless topic.to_s =~ /\A[A-Za-z0-9_.\-]+\z/
+
+      config.deadlines_dir / "#{topic}.json"
+    end
+
+    def locked(topic)
+      FileUtils.mkdir_p(config.deadlines_dir)
+
+      File.open(path(topic), File::RDWR | File::CREAT, 0o644) do |file|
+        file.flock(File::LOCK_EX)
+        yield file
+      end
+    end
+
+    def parse(json)
+      json.to_s.strip.empty? ? {} : JSON.parse(json, symbolize_names: true)
+    rescue JSON::ParserError
+      {}
+    end
+  end
+end
@@ -0,0 +1,78 @@
+module Shortbus
+  # Publish deduplication
+  #
+  # A publish carrying a dedupe key is written at most once per topic within
+  # the dedupe window; repeats get the original message id back instead of a
+  # new message. Keys live in dedupe/TOPIC.json:
+  #
+  #   { "order-42": { "message_id": 81, "at": 1729425600 } }
+  #
+  # The check and the publish happen under one lock, so concurrent publishers
+  # racing on the same key still produce a single message.
+  class Dedupe
+    attr_reader :config
+
+    def initialize(config: Shortbus.config)
+      @config = config
+    end
+
+    # Yields to publish unless key was seen within the window. Returns the
+    # publish result, or { duplicate: true, message_id: ..., offset: ... } for
+    # a repeat.
+    def publish(topic, key, window: config.dedupe_window)
+      return yield if key.nil? || key.to_s.empty?
+
+      locked(topic) do |file|
+        now = Time.now.to_i
+        keys = parse(file.read).reject { |_, seen| now - seen[:at].to_i > window }
+
+        if (seen = keys[key.to_s.to_sym])
+          next { status: :ok, topic: topic, message_id: seen[:message_id], offset: seen[:offset], duplicate: true }.compact
+        end
+
+        result = yield
+        keys[key.to_s.to_sym] = { message_id: result[:message_id], offset: result[:offset], at: now }.compact
+        write(file, keys)
+
+        result
+      end
+    end
+
+    def seen?(topic, key, window: config.dedupe_window)
+      return false unless path(topic).exist?
+
+      seen = parse(File.read(path(topic)))[key.to_s.to_sym]
+      !seen.nil? && Time.now.to_i - seen[:at].to_i <= window
+    end
+
+    private
+
+    def path(topic)
+      raise ArgumentError, "Invalid topic name: #{topic.inspect}" unless topic.to_s =~ /\A[A-Za-z0-9_.\-]+\z/
+
+      config.dedupe_dir / "#{topic}.json"
+    end
+
+    def locked(topic)
+      FileUtils.mkdir_p(config.dedupe_dir)
+
+      File.open(path(topic), File::RDWR | File::CREAT, 0o644) do |file|
+        file.flock(File::LOCK_EX)
+        yield file
+      end
+    end
+
+    def parse(json)
+      json.to_s.strip.empty? ? {} : JSON.parse(json, symbolize_names: true)
+    rescue JSON::ParserError
+      {}
+    end
+
+    def write(file, keys)
+      file.rewind
+      file.truncate(0)
+      file.write(JSON.generate(keys))
+      file.flush
+    end
+  end
+end
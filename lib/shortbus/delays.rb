@@ -0,0 +1,90 @@
+module Shortbus
+  # Delayed publishes
+  #
+  # A publish with delay (a duration) or deliver_at (ISO8601 or epoch
+  # seconds) is held in delayed/ID.json instead of being written to the
+  # engine:
+  #
+  #   { "id": "9f2c...", "topic": "reminders", "payload": "...", "metadata": {...}, "due_at": 1729425600.5 }
+  #
+  # The daemon publishes held messages as they come due, so subscribers and
+  # fetches see them appear then, after whatever was published meanwhile. A
+  # held message is removed only once published: a crash in between
+  # publishes it again, unless it carries a dedupe key, which is checked at
+  # release rather than at hold time.
+  #
+  # Example:
+  #   Shortbus.delays.hold('reminders', 'ping', delay: '10m')   # => { id: "9f2c...", due_at: "..." }
+  #   Shortbus.delays.release!                                   # => { "9f2c..." => 42 } (the message ids)
+  class Delays
+    attr_reader :config
+
+    def initialize(config: Shortbus.config)
+      @config = config
+    end
+
+    # Hold a message until deliver_at, or for delay (deliver_at wins)
+    def hold(topic, payload, metadata: {}, delay: nil, deliver_at: nil, now: Time.now)
+      due_at = deliver_at ? parse_time(deliver_at) : now + Shortbus.parse_duration(delay)
+      id = SecureRandom.hex(8)
+
+      write(id, id: id, topic: topic.to_s, payload: payload.to_s, metadata: metadata, due_at: due_at.to_f)
+      { id: id, due_at: due_at.utc.iso8601(3) }
+    end
+
+    # Held messages, soonest first
+    def pending
+      held.sort_by { |message| message[:due_at] }
+    end
+
+    # Publish every held message that has come due; returns { id => message_id }
+    def release!(now: Time.now, engine: Shortbus.engine)
+      pending.each_with_object({}) do |message, released|
+        break released if message[:due_at] > now.to_f
+
+        metadata = message[:metadata] || {}
+        result = Shortbus.dedupe.publish(message[:topic], metadata[:dedupe_key]) do
+          Shortbus.routes.publish(message[:topic], message[:payload], metadata:, engine:)
+        end
+
+        FileUtils.rm_f(path(message[:id]))
+        released[message[:id]] = result[:message_id]
+      rescue => e
+        # Left held, so the next pass tries again
+        Shortbus.error "Delayed message #{message[:id]} failed: #{e.message}"
+      end
+    end
+
+    private
+
+    def held
+      config.delayed_dir.glob('*.json').filter_map do |path|
+        JSON.parse(File.read(path), symbolize_names: true)
+      rescue JSON::ParserError, Errno::ENOENT
+        nil
+      end
+    end
+
+    def parse_time(value)
+      case value
+      when Time then value
+      when Numeric then Time.at(value)
+      when /\A\d+(\.\d+)?\z/ then Time.at(Float(value))
+      else Time.iso8601(value.to_s)
+      end
+    end
+
+    def path(id)
+      config.delayed_dir / "#{id}.json"
+    end
+
+    def write(id, message)
+      FileUtils.mkdir_p(config.delayed_dir)
+
+      # Write-then-rename so the daemon never reads a half-written message
+      tmp = path(id).sub_ext(".json.#{Process.pid}.tmp")
+      File.write(tmp, JSON.generate(message))
+      File.rename(tmp, path(id))
+    end
+  end
+end
@@ -0,0 +1,97 @@
+module Shortbus
+  # Where a new subscription starts reading a retained topic
+  #
+  #   all                 from the beginning
+  #   last                the most recent message, then new ones
+  #   new                 only messages published after subscribing
+  #   by_start_sequence   from message id start_sequence
+  #   by_start_time       from the first message at or after start_time
+  #
+  # last, new, and by_start_time find their position by scanning the topic
+  # from the segment its time index (see Indexes) points at.
+  module DeliverPolicy
+    POLICIES = %w[all last new by_start_sequence by_start_time]
+    PAGE = 1000
+
+    # Returns the offset (next message id) to start delivering from
+    def start_offset(topic, policy, start_time: nil, start_sequence: nil, engine: Shortbus.engine, indexes: Shortbus.indexes)
+      case normalize(policy)
+      when 'all'
+        0
+      when 'last'
+        last = last_message(topic, engine:, indexes:)
+        last ? last[:id] : 0
+      when 'new'
+        last = last_message(topic, engine:, indexes:)
+        last ? last[:id] + 1 : 0
+      when 'by_start_sequence'
+        raise ArgumentError, "by_start_sequence needs start_sequence" unless start_sequence
+        Integer(start_sequence)
+      when 'by_start_time'
+        raise ArgumentError, "by_start_time needs start_time" unless start_time
+        offset_at(topic, parse_time(start_time), engine:, indexes:)
+      end
+    end
+
+    def normalize(policy)
+      policy = policy.to_s.tr('-', '_')
+      raise ArgumentError, "Unknown deliver policy: #{policy} (expected #{POLICIES.join(', ')})" unless POLICIES.include?(policy)
+
+      policy
+    end
+
+    # Accepts epoch seconds, ISO 8601, or a duration ago ("2h" => two hours ago)
+    def parse_time(value)
+      case value
+      when Time then value
+      when Numeric then Time.at(value)
+      when /\A\d+(\.\d+)?\z/ then Time.at(Float(value))
+      when /\A\d+(\.\d+)?\s*(ms|s|m|h|d)\z/ then Time.now - Shortbus.parse_duration(value)
+      else Time.parse(value.to_s)
+      end
+    end
+
+    # A message's timestamp as a Time (engines report epoch seconds or ISO 8601)
+    def message_time(message)
+      timestamp = message[:timestamp]
+      return nil unless timestamp
+
+      timestamp.is_a?(Numeric) ? Time.at(timestamp) : Time.parse(timestamp.to_s)
+    rescue ArgumentError
+      nil
+    end
+
+    private
+
+    def last_message(topic, engine:, indexes:)
+      last = nil
+      each_page(topic, engine:, from: indexes.tail(topic, engine:)) { |page| last = page.last }
+      last
+    end
+
+    def offset_at(topic, time, engine:, indexes:)
+      each_page(topic, engine:, from: indexes.seek(topic, time, engine:)) do |page|
+        found = page.find { |message| message_time(message) && message_time(message) >= time }
+        return found[:id] if found
+      end
+
+      last = last_message(topic, engine:, indexes:)
+      last ? last[:id] + 1 : 0
+    end
+
+    def each_page(topic, engine:, from: 0)
+      offset = from
+
+      loop do
+        page = engine.fetch_messages(topic, offset:, limit: PAGE)
+        break if page.empty?
+
+        yield page
+        offset = page.last[:id] + 1
+        break if page.size < PAGE
+      end
+    end
+
+    extend self
+  end
+end
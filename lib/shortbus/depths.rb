@@ -0,0 +1,83 @@
+module Shortbus
+  # Running message counts, for max_depth
+  #
+  # Counting a topic on every publish would read all of it each time, so
+  # depths/TOPIC.json keeps the count along with the offset counted to, and
+  # a check reads only what was published since the last. Deletions (purges,
+  # compaction, archival, retention; acks delete nothing) go unseen, so the
+  # count can only run high: a check that finds the topic full recounts it
+  # from the engine before refusing, and trusts that recount for RECOUNT
+  # seconds, so a full topic isn't recounted on every refused publish.
+  #
+  # Example:
+  #   Shortbus.depths.full?('jobs', 10_000)            # => false
+  #   Shortbus.depths.full?('jobs', 10_000, adding: 5) # a five-message commit
+  class Depths
+    BATCH = 1000
+    RECOUNT = 5
+
+    attr_reader :config
+
+    def initialize(config: Shortbus.config)
+      @config = config
+    end
+
+    # Whether adding more messages would take topic past max
+    def full?(topic, max, adding: 1, engine: Shortbus.engine, now: Time.now)
+      locked(topic) do |state|
+        count!(topic, state, engine, from: state[:offset])
+
+        if state[:count] + adding > max && (state[:recounted_at].nil? || now.to_f - state[:recounted_at] >= RECOUNT)
+          state[:count] = 0
+          count!(topic, state, engine, from: 0)
+          state[:recounted_at] = now.to_f
+        end
+
+        state[:count] + adding > max
+      end
+    end
+
+    def path(topic)
+      raise ArgumentError, "Invalid topic name: #{topic.inspect}" unless topic.to_s =~ /\A[A-Za-z0-9_.\-]+\z/
+
+      config.depths_dir / "#{topic}.json"
+    end
+
+    private
+
+    # Adds the retained messages from offset from on to the count
+    def count!(topic, state, engine, from:)
+      offset = from
+
+      loop do
+        page = engine.fetch_messages(topic, offset:, limit: BATCH, tiered: false)
+        break if page.empty?
+
+        state[:count] += page.size
+        offset = page.last[:id] + 1
+        break if page.size < BATCH
+      end
+
+      state[:offset] = [state[:offset], offset].max
+    end
+
+    def locked(topic)
+      FileUtils.mkdir_p(config.depths_dir)
+
+      File.open(path(topic), File::RDWR | File::CREAT, 0o644) do |file|
+        file.flock(File::LOCK_EX)
+        json = file.read
+        state = json.strip.empty? ? {} : JSON.parse(json, symbolize_names: true)
+        state = { count: state[:count] || 0, offset: state[:offset] || 0, recounted_at: state[:recounted_at] }
+
+        begin
+          yield state
+        ensure
+          file.rewind
+          file.truncate(0)
+          file.write(JSON.generate(state))
+        end
+      end
+    end
+  end
+end
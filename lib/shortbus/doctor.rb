@@ -0,0 +1,295 @@
+module Shortbus
+  # Rendezvous diagnostics
+  #
+  # `shortbus doctor` runs every check and prints what it found, each problem
+  # with the command or edit that fixes it:
+  #
+  #   rendezvous   the directory exists and is writable
+  #   config       shortbus.yml and topics.yml parse; topic settings are valid
+  #                and dlq/poison targets exist
+  #   state        JSON state files (connections, sessions, transactions,
+  #                dedupe keys, pending lists) and group offsets are readable
+  #   groups       consumer groups on topics that no longer exist; pending
+  #                messages held by consumers that died
+  #   storage      the engine's SQLite write-ahead log: header and frame
+  #                checksums, torn frames recovery will discard
+  #   engine       BlockQueue answers its health check
+  #
+  # Doctor only reads; nothing is repaired for you.
+  class Doctor
+    Finding = Struct.new(:check, :level, :message, :fix, keyword_init: true) do
+      def to_h
+        super.compact
+      end
+    end
+
+    WAL_MAGIC = [0x377f0682, 0x377f0683].freeze
+    WAL_HEADER = 32
+    WAL_FRAME_HEADER = 24
+
+    attr_reader :config, :findings
+
+    def initialize(config: Shortbus.config, engine: Shortbus.engine, topics: Shortbus.topics)
+      @config = config
+      @engine = engine
+      @topics = topics
+      @findings = []
+    end
+
+    def run
+      @findings = []
+
+      if check_rendezvous
+        check_config
+        check_state
+        check_groups
+        check_storage
+      end
+      check_engine
+
+      findings
+    end
+
+    def healthy?
+      findings.none? { |finding| finding.level == :error }
+    end
+
+    # { frames:, committed:, torn: } for a SQLite WAL file: frames is how many
+    # pass their checksums, committed how many of those recovery will keep,
+    # torn whether a frame from the current generation failed its checksum
+    def self.verify_wal(path)
+      data = File.binread(path)
+      return { frames: 0, committed: 0, torn: false } if data.bytesize < WAL_HEADER
+
+      magic, _version, page_size, _sequence, salt1, salt2, check1, check2 = data.unpack('N8')
+      raise ArgumentError, "not a WAL file (magic #{format('%#x', magic)})" unless WAL_MAGIC.include?(magic)
+
+      big_endian = magic == WAL_MAGIC.last
+      sums = wal_checksum(data.byteslice(0, 24), [0, 0], big_endian)
+      raise ArgumentError, "WAL header checksum mismatch" unless sums == [check1, check2]
+
+      frames = committed = 0
+      offset = WAL_HEADER
+      torn = false
+
+      while offset + WAL_FRAME_HEADER + page_size <= data.bytesize
+        _page, commit, frame_salt1, frame_salt2, frame_check1, frame_check2 = data.byteslice(offset, WAL_FRAME_HEADER).unpack('N6')
+
+        # Frames salted differently are left over from before the last reset
+        break unless [frame_salt1, frame_salt2] == [salt1, salt2]
+
+        sums = wal_checksum(data.byteslice(offset, 8), sums, big_endian)
+        sums = wal_checksum(data.byteslice(offset + WAL_FRAME_HEADER, page_size), sums, big_endian)
+
+        unless sums == [frame_check1, frame_check2]
+          torn = true
+          break
+        end
+
+        frames += 1
+        committed = frames unless commit.zero?
+        offset += WAL_FRAME_HEADER + page_size
+      end
+
+      { frames:, committed:, torn: }
+    end
+
+    # SQLite's cumulative WAL checksum over pairs of 32-bit words
+    def self.wal_checksum(bytes, (s0, s1), big_endian)
+      bytes.unpack(big_endian ? 'N*' : 'V*').each_slice(2) do |x0, x1|
+        s0 = (s0 + x0 + s1) & 0xffffffff
+        s1 = (s1 + x1 + s0) & 0xffffffff
+      end
+
+      [s0, s1]
+    end
+    private_class_method :wal_checksum
+
+    private
+
+    def report(check, level, message, fix: nil)
+      findings << Finding.new(check:, level:, message:, fix:)
+    end
+
+    def check_rendezvous
+      root = config.root_path
+
+      unless root.directory?
+        report(:rendezvous, :error, "rendezvous not found: #{root}", fix: "run 'shortbus run' here, or set SHORTBUS_ROOT")
+        return false
+      end
+
+      unless File.writable?(root)
+        report(:rendezvous, :error, "rendezvous is not writable: #{root}", fix: "chown/chmod #{root} for the user running shortbus")
+        return false
+      end
+
+      report(:rendezvous, :ok, "rendezvous at #{root}")
+      true
+    end
+
+    def check_config
+      [config.shortbus_yml, config.topics_yml, config.classes_yml, config.auto_create_yml, config.routes_yml, config.schedules_yml, config.keys_yml, config.auth_yml, config.users_yml].each do |path|
+        next unless path.exist?
+
+        YAML.safe_load(path.read)
+      rescue Psych::Exception => e
+        report(:config, :error, "#{path} does not parse: #{e.message}", fix: "fix the YAML in #{path}")
+        return
+      end
+
+      begin
+        @topics.classes
+      rescue TopicError => e
+        report(:config, :error, "#{config.classes_yml}: #{e.message}", fix: "fix the class in #{config.classes_yml}")
+        return
+      end
+
+      begin
+        Routes.new(config:).rules
+      rescue ConfigurationError => e
+        report(:config, :error, "#{config.routes_yml}: #{e.message}", fix: "fix the rule in #{config.routes_yml}")
+        return
+      end
+
+      configured = @topics.all
+      problems = 0
+
+      configured.each do |name, settings|
+        begin
+          @topics.normalize(settings)
+        rescue TopicError => e
+          problems += 1
+          report(:config, :error, "topic #{name}: #{e.message}", fix: "shortbus topic update #{name} --SETTING VALUE")
+        end
+
+        %i[dlq poison].each do |key|
+          target = settings[key]
+          next if target.nil? || configured.key?(target.to_s)
+
+          problems += 1
+          report(:config, :warn, "topic #{name}: #{key} #{target} is not a configured topic",
+                 fix: "shortbus topic create #{target}")
+        end
+      end
+
+      Schedules.new(config:).all.each do |name, definition|
+        next if Cron.valid?(definition[:cron])
+
+        problems += 1
+        report(:config, :error, "schedule #{name}: invalid cron #{definition[:cron].inspect}",
+               fix: "fix cron for #{name} in #{config.schedules_yml}")
+      end
+
+      report(:config, :ok, "#{configured.size} topic(s) configured") if problems.zero?
+    end
+
+    def check_state
+      files = [
+        config.connections_dir.glob('*.json'),
+        config.sessions_dir.glob('*.json'),
+        config.transactions_dir.glob('*.json'),
+        config.dedupe_dir.glob('*.json'),
+        config.tiers_dir.glob('*.json'),
+        config.groups_dir.glob('*/*.pending.json')
+      ].flatten
+
+      corrupt = files.reject { |path| readable_json?(path) }
+      corrupt += config.groups_dir.glob('*/*.offset').reject { |path| path.read.strip.match?(/\A\d*\z/) }
+
+      corrupt.each do |path|
+        report(:state, :error, "unreadable state file: #{path}", fix: "inspect and remove #{path}; its owner recreates it")
+      end
+
+      report(:state, :ok, "#{files.size} state file(s) readable") if corrupt.empty?
+    end
+
+    def check_groups
+      return unless config.groups_dir.exist?
+
+      known = @topics.all.keys.map(&:to_s)
+      engine_topics = engine_topic_names
+      known += engine_topics if engine_topics
+
+      problems = 0
+
+      config.groups_dir.children.select(&:directory?).each do |dir|
+        topic = dir.basename.to_s
+        groups = Shortbus.groups.groups(topic)
+
+        # Without the engine's list, a topic missing from topics.yml may
+        # still exist, so only call groups orphaned when both agree
+        if engine_topics && !known.include?(topic)
+          problems += 1
+          report(:groups, :warn, "#{groups.size} consumer group(s) on missing topic #{topic}", fix: "rm -r #{dir}")
+          next
+        end
+
+        dir.glob('*.pending.json').each do |path|
+          next unless readable_json?(path)
+
+          group = path.basename('.pending.json').to_s
+          dead = Shortbus.groups.pending(topic, group).reject { |entry| entry[:alive] }
+          next if dead.empty?
+
+          problems += 1
+          report(:groups, :warn, "#{dead.size} pending message(s) in #{topic}/#{group} held by dead consumers",
+                 fix: "a live member reclaims them with {\"op\": \"claim\", \"topic\": \"#{topic}\", \"group\": \"#{group}\"}")
+        end
+      end
+
+      report(:groups, :ok, "no orphaned groups or stranded messages") if problems.zero?
+    end
+
+    def check_storage
+      database = config.engine_database_path
+
+      unless database
+        report(:storage, :ok, "no engine database yet")
+        return
+      end
+
+      wal = Pathname.new("#{database}-wal")
+
+      unless wal.exist? && wal.size > 0
+        report(:storage, :ok, "#{database} (no write-ahead log pending)")
+        return
+      end
+
+      result = self.class.verify_wal(wal)
+
+      if result[:torn]
+        report(:storage, :warn,
+               "#{wal}: a frame after #{result[:frames]} good frame(s) failed its checksum; " \
+               "recovery will keep #{result[:committed]} committed frame(s)",
+               fix: "usually a crash mid-write; the lost frames were never committed. Back up the rendezvous if in doubt")
+      else
+        report(:storage, :ok, "#{wal}: #{result[:frames]} frame(s), checksums valid")
+      end
+    rescue ArgumentError => e
+      report(:storage, :error, "#{wal}: #{e.message}", fix: "stop shortbus and move #{wal} aside; SQLite rebuilds it")
+    end
+
+    def check_engine
+      if @engine.healthy?
+        report(:engine, :ok, "engine reachable")
+      else
+        report(:engine, :error, "engine not reachable on port #{config.engine_port}", fix: "shortbus run (or shortbus daemon start)")
+      end
+    end
+
+    def engine_topic_names
+      Array(@engine.list_topics).map { |topic| topic.is_a?(Hash) ? topic[:name].to_s : topic.to_s }
+    rescue ConnectionError, EngineError
+      nil
+    end
+
+    def readable_json?(path)
+      json = path.read
+      JSON.parse(json) unless json.strip.empty?
+      true
+    rescue JSON::ParserError, Errno::ENOENT
+      false
+    end
+  end
+end
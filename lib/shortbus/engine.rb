@@ -1,15 +1,22 @@
 module Shortbus
   # BlockQueue HTTP client
   # Simple wrapper around BlockQueue's REST API
+  #
+  # Every write to the topics comes through here, so a read-only broker
+  # refuses them however they arrive: pipe, http, kv, streams, the daemon.
   class Engine
     def initialize(base_url: nil, port: nil)
       @base_url = base_url || "http://localhost:#{port || Shortbus.config.engine_port}"
       @http_client = build_client
     end
 
-    # Publish a message to a topic
-    def publish(topic, payload, metadata: {}, trigger: true)
+    # Publish a message to a topic. The broker's annotations (see
+    # Annotations) ride along in metadata, plus any extra ones given.
+    def publish(topic, payload, metadata: {}, trigger: true, annotations: {})
+      Shortbus.writable!
+
       uri = URI("#{@base_url}/topics/#{topic}/messages")
+      metadata = Annotations.stamp(topic, metadata, annotations)
 
       request = Net::HTTP::Post.new(uri, 'Content-Type' => 'application/json')
       request.body = JSON.generate({
@@ -24,7 +31,8 @@ module Shortbus
         result = JSON.parse(response.body, symbolize_names: true)
         response_data = {
           status: :ok,
-          message_id: result[:id] || result[:message_id],
+          message_id: metadata[Annotations::KEY][:message_id],
+          offset: result[:id] || result[:message_id],
           topic: topic,
           timestamp: Time.now.to_i
         }
@@ -50,32 +58,68 @@ module Shortbus
     end
     alias_method :pub, :publish
 
-    # Fetch messages from a topic
-    def fetch_messages(topic, offset: 0, limit: 100)
+    # Fetch messages from a topic. Offsets that have aged out into archived
+    # segments are served from the archive first (see Tiers); tiered: false
+    # asks BlockQueue only.
+    def fetch_messages(topic, offset: 0, limit: 100, tiered: true)
+      archived = tiered ? Shortbus.tiers.fetch(topic, offset:, limit:) : []
+      return archived if archived.size >= limit
+
+      offset = archived.last[:id] + 1 if archived.any?
+      archived + fetch_live(topic, offset:, limit: limit - archived.size)
+    rescue ConnectionError
+      # The archive doesn't need the engine, so is served while it recovers
+      raise unless archived&.any? && Shortbus.recovery.recovering?
+
+      archived
+    end
+
+    # Delete every message in a topic
+    def purge(topic)
+      Shortbus.writable!
+
       uri = URI("#{@base_url}/topics/#{topic}/messages")
-      uri.query = URI.encode_www_form(offset: offset, limit: limit)
 
-      request = Net::HTTP::Get.new(uri)
+      request = Net::HTTP::Delete.new(uri)
+      response = @http_client.request(request)
+
+      case response
+      when Net::HTTPSuccess, Net::HTTPNotFound
+        Shortbus.tiers.forget(topic)
+        Shortbus.indexes.forget(topic)
+        { status: :ok, topic: topic }
+      else
+        raise EngineError, "Purge failed: #{response.code} #{response.body}"
+      end
+    rescue SocketError, Errno::ECONNREFUSED => e
+      raise ConnectionError, "Cannot connect to BlockQueue: #{e.message}"
+    end
+
+    # Delete a single message by ID
+    def delete_message(topic, id)
+      Shortbus.writable!
+
+      uri = URI("#{@base_url}/topics/#{topic}/messages/#{id}")
+
+      request = Net::HTTP::Delete.new(uri)
       response = @http_client.request(request)
 
       case response
       when Net::HTTPSuccess
-        result = JSON.parse(response.body, symbolize_names: true)
-        messages = result[:messages] || result[:data] || []
-        messages.map { |msg| normalize_message(msg, topic) }
+        { status: :ok, topic: topic, message_id: id }
       when Net::HTTPNotFound
-        []
+        raise EngineError, "Message not found: #{topic}/#{id}"
       else
-        raise EngineError, "Fetch failed: #{response.code} #{response.body}"
+        raise EngineError, "Delete message failed: #{response.code} #{response.body}"
       end
-    rescue JSON::ParserError => e
-      raise EngineError, "Invalid JSON response: #{e.message}"
     rescue SocketError, Errno::ECONNREFUSED => e
       raise ConnectionError, "Cannot connect to BlockQueue: #{e.message}"
     end
 
     # Create a topic
     def create_topic(name, subscribers: [])
+      Shortbus.writable!
+
       uri = URI("#{@base_url}/topics")
 
       request = Net::HTTP::Post.new(uri, 'Content-Type' => 'application/json')
@@ -88,6 +132,7 @@ module Shortbus
 
       case response
       when Net::HTTPSuccess, Net::HTTPCreated
+        TopicEvents.emit(:created, name, settings: Shortbus.topics.get(name), engine: self)
         { status: :ok, topic: name }
       else
         # Topic might already exist, that's okay
@@ -101,6 +146,29 @@ module Shortbus
       raise ConnectionError, "Cannot connect to BlockQueue: #{e.message}"
     end
 
+    # Delete a topic
+    # reason is passed on in the deleted event (see TopicGC)
+    def delete_topic(name, reason: nil)
+      Shortbus.writable!
+
+      uri = URI("#{@base_url}/topics/#{name}")
+
+      request = Net::HTTP::Delete.new(uri)
+      response = @http_client.request(request)
+
+      case response
+      when Net::HTTPSuccess, Net::HTTPNotFound
+        Shortbus.tiers.forget(name)
+        Shortbus.indexes.forget(name)
+        TopicEvents.emit(:deleted, name, reason:, engine: self) if response.is_a?(Net::HTTPSuccess)
+        { status: :ok, topic: name }
+      else
+        raise EngineError, "Delete topic failed: #{response.code} #{response.body}"
+      end
+    rescue SocketError, Errno::ECONNREFUSED => e
+      raise ConnectionError, "Cannot connect to BlockQueue: #{e.message}"
+    end
+
     # List topics
     def list_topics
       uri = URI("#{@base_url}/topics")
@@ -138,6 +206,29 @@ module Shortbus
 
     private
 
+    def fetch_live(topic, offset:, limit:)
+      uri = URI("#{@base_url}/topics/#{topic}/messages")
+      uri.query = URI.encode_www_form(offset: offset, limit: limit)
+
+      request = Net::HTTP::Get.new(uri)
+      response = @http_client.request(request)
+
+      case response
+      when Net::HTTPSuccess
+        result = JSON.parse(response.body, symbolize_names: true)
+        messages = result[:messages] || result[:data] || []
+        messages.map { |msg| normalize_message(msg, topic) }
+      when Net::HTTPNotFound
+        []
+      else
+        raise EngineError, "Fetch failed: #{response.code} #{response.body}"
+      end
+    rescue JSON::ParserError => e
+      raise EngineError, "Invalid JSON response: #{e.message}"
+    rescue SocketError, Errno::ECONNREFUSED => e
+      raise ConnectionError, "Cannot connect to BlockQueue: #{e.message}"
+    end
+
     def build_client
       uri = URI(@base_url)
       client = Net::HTTP.new(uri.host, uri.port)
@@ -147,14 +238,15 @@ module Shortbus
     end
 
     def normalize_message(msg, topic)
-      {
+      Annotations.split({
         id: msg[:id],
+        offset: msg[:id],
         topic: topic,
         payload: msg[:payload] || msg[:body],
         metadata: msg[:metadata] || {},
         timestamp: msg[:timestamp] || msg[:created_at],
-        sequence: msg[:sequence]
-      }
+        sequence: msg[:sequence] || msg[:id]
+      })
     end
   end
 
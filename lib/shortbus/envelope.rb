@@ -0,0 +1,99 @@
+module Shortbus
+  # End-to-end payload encryption, per namespace
+  #
+  # Clients holding a namespace's key seal the payloads they publish under it
+  # ("orders" covers "orders.eu") and open them on delivery, so brokers and
+  # bridges in between (the outbox relay, export and import, another
+  # rendezvous) route messages by topic and metadata without being able to
+  # read them. The wire format, shared with the Go client's WithNamespaceKey:
+  #
+  #   payload   base64(nonce + ciphertext + tag): AES-256-GCM, with the
+  #             namespace as associated data
+  #   metadata  { "sealed": { "ns": "orders", "kid": "66687aad", "alg": "A256GCM" } }
+  #
+  # kid is the first 4 bytes of the key's SHA-256, so a consumer holding
+  # several keys for a namespace while rotating them knows which one to use.
+  # The first key listed for a namespace seals.
+  #
+  # Example:
+  #   keys = { 'orders' => [SecureRandom.bytes(32)] }
+  #   payload, metadata = Shortbus::Envelope.seal('orders.eu', 'secret', {}, keys:)
+  #   Shortbus::Envelope.open(payload, metadata, keys:)   # => ["secret", {}]
+  module Envelope
+    ALGORITHM = 'A256GCM'
+    KEY = :sealed
+    NONCE_SIZE = 12
+    TAG_SIZE = 16
+
+    # The longest namespace in keys that topic falls under, or nil
+    def namespace(topic, keys)
+      keys.keys.map(&:to_s)
+          .select { |namespace| topic.to_s == namespace || topic.to_s.start_with?("#{namespace}.") }
+          .max_by(&:size)
+    end
+
+    # [payload, metadata] as published: sealed when topic is in a namespace
+    # with a key, otherwise as given
+    def seal(topic, payload, metadata = {}, keys:)
+      namespace = namespace(topic, keys)
+      return [payload, metadata] unless namespace
+
+      key = Array(keys[namespace] || keys[namespace.to_sym]).first
+      cipher = cipher(:encrypt, key)
+      nonce = cipher.random_iv
+      cipher.auth_data = namespace
+
+      sealed = nonce + cipher.update(payload.to_s) + cipher.final + cipher.auth_tag(TAG_SIZE)
+
+      [[sealed].pack('m0'), metadata.merge(KEY => { ns: namespace, kid: key_id(key), alg: ALGORITHM })]
+    end
+
+    # [payload, metadata] as the publisher sent them; raises Error when the
+    # message was sealed with a key not in keys, or has been tampered with
+    def open(payload, metadata, keys:)
+      metadata = (metadata || {}).transform_keys(&:to_sym)
+      sealed = metadata[KEY]
+      return [payload, metadata] unless sealed.is_a?(Hash)
+
+      sealed = sealed.transform_keys(&:to_sym)
+      raise Error, "Unknown sealing algorithm: #{sealed[:alg].inspect}" unless sealed[:alg] == ALGORITHM
+
+      namespace = sealed[:ns].to_s
+      key = Array(keys[namespace] || keys[namespace.to_sym]).find { |candidate| key_id(candidate) == sealed[:kid] }
+      raise Error, "No key #{sealed[:kid]} for namespace #{namespace}" unless key
+
+      data = payload.to_s.unpack1('m0')
+      raise Error, "Malformed sealed payload" if data.bytesize < NONCE_SIZE + TAG_SIZE
+
+      cipher = cipher(:decrypt, key)
+      cipher.iv = data.byteslice(0, NONCE_SIZE)
+      cipher.auth_tag = data.byteslice(-TAG_SIZE, TAG_SIZE)
+      cipher.auth_data = namespace
+
+      plaintext = cipher.update(data.byteslice(NONCE_SIZE...-TAG_SIZE)) + cipher.final
+      [plaintext.force_encoding(Encoding::UTF_8), metadata.except(KEY)]
+    rescue ArgumentError, OpenSSL::Cipher::CipherError
+      raise Error, "Sealed payload failed to open (wrong key or tampered with)"
+    end
+
+    def sealed?(metadata)
+      metadata.is_a?(Hash) && (metadata.key?(KEY) || metadata.key?(KEY.to_s))
+    end
+
+    def key_id(key)
+      OpenSSL::Digest::SHA256.digest(key.to_s).byteslice(0, 4).unpack1('H*')
+    end
+
+    private
+
+    def cipher(mode, key)
+      raise Error, "Namespace key must be 32 bytes, not #{key.to_s.bytesize}" unless key.to_s.bytesize == 32
+
+      cipher = OpenSSL::Cipher.new('aes-256-gcm').send(mode)
+      cipher.key = key
+      cipher
+    end
+
+    extend self
+  end
+end
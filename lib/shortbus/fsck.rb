@@ -0,0 +1,235 @@
+module Shortbus
+  # Storage integrity check and repair
+  #
+  # `shortbus fsck` scans everything persisted under the rendezvous and
+  # reports what is damaged; `shortbus fsck --repair` also fixes it:
+  #
+  #   engine database   PRAGMA integrity_check (via the sqlite3 CLI);
+  #                     repair rebuilds the indexes with REINDEX
+  #   write-ahead log   frames past the last good checksum are reported as
+  #                     dropped; SQLite discards them on its next open
+  #   pending lists     a truncated GROUP.pending.json is rebuilt from the
+  #                     message ids still legible in it, so those messages
+  #                     stay reclaimable; ids that can't be read are dropped
+  #   offsets           an unreadable GROUP.offset is moved aside, so the
+  #                     group restarts from the oldest retained message
+  #   time indexes      an unreadable or out-of-order replay index is
+  #                     rebuilt from its topic; with the engine stopped it
+  #                     is deleted, to be rebuilt on the next seek
+  #   other state       unreadable connection, session, transaction, dedupe,
+  #                     tier index, deadline count, job, and schedule state
+  #                     files are moved aside as FILE.corrupt
+  #   temp files        leftovers from a crash mid write-then-rename
+  #
+  # The engine must be stopped for the database checks; with it running they
+  # are skipped rather than racing its writes.
+  class Fsck
+    Problem = Struct.new(:path, :problem, :action, :repaired, :dropped, keyword_init: true) do
+      def to_h
+        super.compact
+      end
+    end
+
+    attr_reader :config, :problems
+
+    def initialize(config: Shortbus.config, repair: false, process_manager: Shortbus.process_manager)
+      @config = config
+      @repair = repair
+      @process_manager = process_manager
+      @problems = []
+    end
+
+    def repair?
+      @repair
+    end
+
+    def run
+      @problems = []
+      return problems unless config.root_path.directory?
+
+      check_database
+      check_pending
+      check_offsets
+      check_state
+      check_indexes
+      check_temp_files
+
+      problems
+    end
+
+    # Problems left unrepaired
+    def clean?
+      problems.all?(&:repaired)
+    end
+
+    private
+
+    def found(path, problem, action, dropped: nil)
+      repaired = repair? ? yield : false
+      problems << Problem.new(path: path.to_s, problem:, action:, repaired:, dropped:)
+    end
+
+    def check_database
+      database = config.engine_database_path
+      return unless database
+
+      if @process_manager.running?
+        problems << Problem.new(path: database.to_s, problem: 'engine is running; database not checked',
+                                action: 'shortbus stop, then fsck again', repaired: false)
+        return
+      end
+
+      check_wal(Pathname.new("#{database}-wal"))
+
+      unless sqlite3
+        problems << Problem.new(path: database.to_s, problem: 'sqlite3 CLI not found; integrity not checked',
+                                action: 'install sqlite3', repaired: false)
+        return
+      end
+
+      result = integrity_check(database)
+      return if result == 'ok'
+
+      found(database, "integrity_check: #{result}", 'REINDEX') do
+        system(sqlite3, database.to_s, 'REINDEX;', exception: false)
+        integrity_check(database) == 'ok'
+      end
+    end
+
+    # Torn frames can't be salvaged; they were never committed
+    def check_wal(wal)
+      return unless wal.exist? && wal.size > 0
+
+      result = Doctor.verify_wal(wal)
+      return unless result[:torn] || result[:committed] < result[:frames]
+
+      dropped = result[:frames] - result[:committed] + (result[:torn] ? 1 : 0)
+      problems << Problem.new(path: wal.to_s, problem: "#{dropped} frame(s) after the last commit are torn or uncommitted",
+                              action: 'none; SQLite drops them on open', repaired: true, dropped: dropped)
+    rescue ArgumentError => e
+      problems << Problem.new(path: wal.to_s, problem: e.message, action: "move #{wal} aside by hand", repaired: false)
+    end
+
+    def check_pending
+      config.groups_dir.glob('*/*.pending.json').each do |path|
+        json = path.read
+        next if readable?(json)
+
+        # Keys are message ids; a truncated file still shows most of them
+        ids = json.scan(/"(\d+)":\{/).flatten.uniq
+
+        found(path, 'truncated pending list', "rebuilt with #{ids.size} reclaimable message(s)") do
+          now = Time.now.to_f
+          entries = ids.to_h { |id| [id, { consumer: 'fsck', pid: nil, delivered_at: now, deliveries: 1 }] }
+          replace(path, JSON.generate(entries))
+        end
+      end
+    end
+
+    def check_offsets
+      config.groups_dir.glob('*/*.offset').each do |path|
+        next if path.read.strip.match?(/\A\d*\z/)
+
+        found(path, 'unreadable group offset', 'moved aside; the group restarts from the oldest retained message') do
+          quarantine(path)
+        end
+      end
+    end
+
+    def check_state
+      {
+        config.connections_dir => 'removed with the dead connection',
+        config.sessions_dir => 'moved aside; the durable client starts a fresh session',
+        config.transactions_dir => "moved aside; the transaction's messages are delivered as committed",
+        config.dedupe_dir => 'moved aside; repeats within the dedupe window may publish again',
+        config.streams_dir => "moved aside; the stream's version is recounted from its events",
+        config.heads_dir => "moved aside; the topic's head is recounted from its messages",
+        config.depths_dir => "moved aside; the topic's depth is recounted from its messages",
+        config.tiers_dir => 'moved aside; archived messages stay in the archive but no longer replay',
+        config.deadlines_dir => 'moved aside; the expired-message count starts again from zero',
+        config.metrics_dir => "moved aside; the topic's publish metrics start again from zero",
+        config.stats_dir => "moved aside; the topic's stats are recounted from its first message",
+        config.mirrors_dir => "moved aside; the topic's mirror starts again from its head",
+        config.jobs_dir => 'moved aside; awaiting the job reports it unknown',
+        config.schedules_dir => 'moved aside; the schedule next runs from now',
+        config.delayed_dir => 'moved aside; the delayed message is never published'
+      }.each do |dir, action|
+        dir.glob('*.json').each do |path|
+          next if readable?(path.read)
+
+          found(path, 'unreadable state file', action) { quarantine(path) }
+        end
+      end
+    end
+
+    def check_indexes
+      config.indexes_dir.glob('*.json').each do |path|
+        next if index?(path.read)
+
+        topic = path.basename('.json').to_s
+        running = @process_manager.running?
+        action = running ? 'rebuilt from the topic' : 'deleted; rebuilt from the topic on its next seek'
+
+        found(path, 'unreadable time index', action) do
+          path.delete
+          Indexes.new(config:).rebuild(topic) if running
+          true
+        end
+      end
+    end
+
+    def check_temp_files
+      stale = [config.connections_dir, config.sessions_dir, config.transactions_dir, config.jobs_dir, config.delayed_dir].flat_map { |dir| dir.glob('*.tmp') }
+
+      stale.each do |path|
+        # A writer renames its temp file within milliseconds; give it a minute
+        next if Time.now - path.mtime < 60
+
+        found(path, 'leftover temp file from an interrupted write', 'deleted') do
+          path.delete
+          true
+        end
+      end
+    end
+
+    def readable?(json)
+      JSON.parse(json) unless json.strip.empty?
+      true
+    rescue JSON::ParserError
+      false
+    end
+
+    def index?(json)
+      return true if json.strip.empty?
+
+      state = JSON.parse(json)
+      state.is_a?(Hash) && Indexes.valid?(state['entries'])
+    rescue JSON::ParserError
+      false
+    end
+
+    def quarantine(path)
+      File.rename(path, "#{path}.corrupt")
+      true
+    end
+
+    def replace(path, contents)
+      tmp = "#{path}.#{Process.pid}.tmp"
+      File.write(tmp, contents)
+      File.rename(tmp, path)
+      true
+    end
+
+    def integrity_check(database)
+      IO.popen([sqlite3, '-readonly', database.to_s, 'PRAGMA integrity_check;'], err: File::NULL, &:read).strip
+    end
+
+    def sqlite3
+      return @sqlite3 if defined?(@sqlite3)
+
+      @sqlite3 = ENV['PATH'].to_s.split(File::PATH_SEPARATOR)
+                            .map { |dir| File.join(dir, 'sqlite3') }
+                            .find { |path| File.executable?(path) }
+    end
+  end
+end
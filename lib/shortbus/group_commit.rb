@@ -0,0 +1,149 @@
+module Shortbus
+  # Sync policies and group commit for durable publishes
+  #
+  # BlockQueue acks a write once SQLite has it, leaving the flush to disk to
+  # the OS. A topic's sync setting (else SHORTBUS_DURABILITY) says how much
+  # more a publish waits for:
+  #
+  #   os        acked after enqueue; the OS flushes when it likes (default)
+  #   100ms     acked after enqueue; fsynced within 100ms by this process
+  #   always    acked after fsync of the engine database and write-ahead log
+  #
+  # Acks report which with acked_after: "fsync" or "enqueue".
+  #
+  # Each fsync is shared by every publish that landed before it began, across
+  # connections and processes: a publisher takes group_commit.lock, waits
+  # out the commit window (SHORTBUS_GROUP_COMMIT_MS, default 2) so
+  # concurrent publishes land too, fsyncs, and records when the fsync began;
+  # publishers queued behind it see that and return without syncing again.
+  # A burst costs one fsync per window rather than one each.
+  #
+  # Example:
+  #   result = Shortbus.engine.publish('orders', payload)
+  #   Shortbus.group_commit.commit!(['orders'])   # => "fsync" once on disk, else "enqueue"
+  class GroupCommit
+    POLICIES = %w[always os].freeze
+
+    attr_reader :config
+
+    # "always", "os", or an interval in milliseconds
+    def self.normalize(value)
+      case value
+      when Integer
+        raise ArgumentError, "sync interval must be positive" unless value.positive?
+        value
+      else
+        case value.to_s.strip.downcase
+        when '', 'os', 'none' then 'os'
+        when 'always', 'sync', 'fsync' then 'always'
+        when /\A(\d+(?:\.\d+)?)\s*(ms|s)\z/ then normalize((Float($1) * ($2 == 's' ? 1000 : 1)).ceil)
+        when /\A\d+\z/ then normalize(Integer(value.to_s.strip))
+        else raise ArgumentError, "sync must be one of: #{POLICIES.join(', ')}, or an interval like 100ms"
+        end
+      end
+    end
+
+    def self.now
+      Process.clock_gettime(Process::CLOCK_REALTIME)
+    end
+
+    def initialize(config: Shortbus.config, topics: Shortbus.topics)
+      @config = config
+      @topics = topics
+      @mutex = Mutex.new
+      @wake = ConditionVariable.new
+      @pending = nil
+      @due = nil
+      @flusher = nil
+    end
+
+    # The topic's sync policy
+    def policy(topic)
+      setting = @topics.get(topic)&.fetch(:sync, nil)
+      GroupCommit.normalize(setting.nil? ? config.durability : setting)
+    end
+
+    # Applies the strictest policy of topics to what was just written to
+    # them; "fsync" once it is on disk, "enqueue" if acked before
+    def commit!(topics, written_at = GroupCommit.now)
+      policies = Array(topics).uniq.map { |topic| policy(topic) }
+      return 'fsync' if policies.include?('always') && sync!(written_at)
+
+      interval = policies.grep(Integer).min
+      sync_later(interval / 1000.0, written_at) if interval
+      'enqueue'
+    end
+
+    # Returns once everything written before written_at is on disk; true if
+    # a sync covered it, false with no engine database to sync
+    def sync!(written_at = GroupCommit.now)
+      files = database_files
+      return false if files.empty?
+
+      FileUtils.mkdir_p(config.root_path)
+
+      File.open(path, File::RDWR | File::CREAT, 0o644) do |file|
+        file.flock(File::LOCK_EX)
+        return true if file.read.to_f >= written_at
+
+        sleep(window) if window.positive?
+        started = GroupCommit.now
+        files.each { |database| File.open(database, 'rb', &:fsync) }
+
+        file.rewind
+        file.truncate(0)
+        file.write(started.to_s)
+      end
+
+      true
+    end
+
+    # Writes waiting on an interval sync are synced now (e.g. before exit)
+    def flush!
+      written_at = @mutex.synchronize { @pending.tap { @pending = @due = nil } }
+      sync!(written_at) if written_at
+    end
+
+    # Seconds the syncing publisher waits for others to join its fsync
+    def window
+      config.group_commit_ms.to_i / 1000.0
+    end
+
+    def path
+      config.group_commit_path
+    end
+
+    private
+
+    # Has a background thread sync written_at within interval seconds,
+    # along with whatever else is written meanwhile
+    def sync_later(interval, written_at)
+      @mutex.synchronize do
+        @pending = [@pending, written_at].compact.max
+        @due = [@due, written_at + interval].compact.min
+        @flusher ||= Thread.new { flush_loop }
+        @wake.signal
+      end
+    end
+
+    def flush_loop
+      loop do
+        @mutex.synchronize do
+          @wake.wait(@mutex) until @due
+          @wake.wait(@mutex, @due - GroupCommit.now) while @due && @due > GroupCommit.now
+        end
+
+        flush!
+      rescue => e
+        Shortbus.warn "Interval sync failed: #{e.message}"
+      end
+    end
+
+    def database_files
+      database = config.engine_database_path
+      return [] unless database
+
+      [database, Pathname.new("#{database}-wal")].select(&:exist?)
+    end
+  end
+end
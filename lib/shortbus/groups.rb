@@ -0,0 +1,411 @@
+module Shortbus
+  # Consumer group positions
+  #
+  # A group's position on a topic is the next message id it will read, kept
+  # in groups/TOPIC/GROUP.offset. Claims hold an exclusive flock on that file
+  # while reading and advancing it, so members in different processes never
+  # receive the same message.
+  #
+  # Push subscribers that join with a group start at the position and move it
+  # with explicit commits, so a restarted consumer resumes where it left off.
+  #
+  # Keyed topics are split into partitions, each with its own position
+  # (GROUP.pN.offset). Live members register under GROUP.members/ and every
+  # member computes the same assignment from the sorted member list, so
+  # partitions rebalance on their own as members join and leave.
+  #
+  # Fetches that ask for acks also record each message in the group's
+  # pending list (GROUP.pending.json) until it is acked. Entries left behind
+  # by a consumer that died, or idle past a threshold, can be reclaimed by
+  # another member, so work isn't lost with the worker. A worker on a long
+  # job touches its messages to say it is still at it (idle counts from the
+  # latest touch), or extends them to hold off reclaims for a while.
+  #
+  # Operators can pause a whole group (GROUP.paused): no member gets new,
+  # redelivered, or reclaimed messages until it is resumed, in any process.
+  # Draining pauses it and waits for the messages already handed out to be
+  # acked, so a deploy can swap the workers without losing or doubling work.
+  #
+  # Example:
+  #   Shortbus.groups.claim('jobs', 'workers') do |offset|
+  #     Shortbus.engine.fetch_messages('jobs', offset:, limit: 10)
+  #   end
+  class Groups
+    MAX_ERRORS = 20
+
+    attr_reader :config
+
+    def initialize(config: Shortbus.config)
+      @config = config
+    end
+
+    def offset(topic, group, partition: nil)
+      path = offset_path(topic, group, partition:)
+      path.exist? ? File.read(path).to_i : 0
+    end
+
+    # Yields the group's offset; the block returns the messages it took and
+    # the offset moves past the last of them
+    def claim(topic, group)
+      return [] if paused?(topic, group)
+
+      locked(topic, group) do |file|
+        offset = file.read.to_i
+        messages = yield(offset)
+
+        last_id = messages.map { |message| message[:id] }.compact.max
+        write(file, last_id + 1) if last_id && last_id >= offset
+
+        messages
+      end
+    end
+
+    # Move the position to offset (the next id to read). Positions only move
+    # forward, so a stale commit can't rewind a group other members are
+    # still consuming; returns the resulting position.
+    def commit(topic, group, offset, partition: nil)
+      offset = Integer(offset)
+      raise ArgumentError, "offset must not be negative" if offset < 0
+
+      locked(topic, group, partition:) do |file|
+        current = file.read.to_i
+        write(file, offset) if offset > current
+        [offset, current].max
+      end
+    end
+
+    def groups(topic)
+      dir = config.groups_dir / topic.to_s
+      return [] unless dir.exist?
+
+      dir.glob('*.offset').map { |path| path.basename('.offset').to_s }.grep_v(/\.p\d+\z/)
+    end
+
+    # Pending (delivered, not yet acked) messages
+
+    # message_ids maps offsets to message ids, so acks may name either
+    def track(topic, group, ids, consumer:, pid: Process.pid, message_ids: {})
+      return if ids.empty?
+
+      pending_locked(topic, group) do |file, entries|
+        now = Time.now.to_f
+
+        ids.each do |id|
+          deliveries = entries.dig(id.to_s.to_sym, :deliveries).to_i
+          entries[id.to_s.to_sym] = { consumer: consumer, pid: pid, delivered_at: now, deliveries: deliveries + 1, message_id: message_ids[id] }.compact
+        end
+
+        write_pending(file, entries)
+      end
+    end
+
+    # Offsets for ids, with message ids of pending messages swapped for
+    # theirs; anything else is passed through as given
+    def resolve(topic, group, ids)
+      return ids unless ids.any? { |id| MessageId.valid?(id) }
+
+      pending_locked(topic, group) do |_file, entries|
+        offsets = entries.each_with_object({}) { |(id, entry), map| map[entry[:message_id]] = id.to_s.to_i if entry[:message_id] }
+        ids.map { |id| offsets.fetch(id, id) }
+      end
+    end
+
+    # Drop ids from the pending list, returning how many were pending
+    def ack(topic, group, ids)
+      pending_locked(topic, group) do |file, entries|
+        acked = ids.count { |id| entries.delete(id.to_s.to_sym) }
+        write_pending(file, entries) if acked > 0
+        acked
+      end
+    end
+
+    # Heartbeat consumer's pending messages: idle time restarts now, and with
+    # extend_by nobody may reclaim them for that many seconds (short of the
+    # consumer dying). Returns how many were touched.
+    def touch(topic, group, ids, consumer:, extend_by: nil)
+      pending_locked(topic, group) do |file, entries|
+        now = Time.now.to_f
+
+        touched = ids.count do |id|
+          entry = entries[id.to_s.to_sym]
+          next false unless entry && entry[:consumer] == consumer
+
+          entry = entry.merge(touched_at: now)
+          entry = entry.merge(visible_until: now + extend_by) if extend_by
+          entries[id.to_s.to_sym] = entry
+        end
+
+        write_pending(file, entries) if touched > 0
+        touched
+      end
+    end
+
+    # Give messages back for redelivery once delay_for.(attempts) seconds
+    # pass; returns how many were pending
+    #
+    # A nack with an error is a failure: it is added to the entry's error
+    # history (the latest MAX_ERRORS), which decides when it is poison.
+    def nack(topic, group, ids, delay_for:, error: nil)
+      pending_locked(topic, group) do |file, entries|
+        now = Time.now.to_f
+
+        nacked = ids.count do |id|
+          entry = entries[id.to_s.to_sym]
+          next false unless entry
+
+          if error
+            failure = { attempt: entry[:deliveries].to_i, error: error.to_s, at: Time.at(now).utc.iso8601 }
+            entry = entry.merge(errors: (entry[:errors].to_a + [failure]).last(MAX_ERRORS))
+          end
+
+          entries[id.to_s.to_sym] = entry.merge(consumer: nil, pid: nil, redeliver_at: now + delay_for.call(entry[:deliveries].to_i))
+        end
+
+        write_pending(file, entries) if nacked > 0
+        nacked
+      end
+    end
+
+    # Hand nacked messages whose backoff has elapsed to consumer, oldest
+    # first; returns their ids
+    def redeliver(topic, group, consumer:, max: 10, pid: Process.pid)
+      return [] if paused?(topic, group)
+
+      pending_locked(topic, group) do |file, entries|
+        now = Time.now.to_f
+
+        ids = entries.select { |_id, entry| entry[:redeliver_at] && entry[:redeliver_at] <= now }
+                     .keys.map { |id| id.to_s.to_i }.sort.first(max)
+
+        ids.each do |id|
+          entry = entries[id.to_s.to_sym].except(:redeliver_at, :touched_at, :visible_until)
+          entries[id.to_s.to_sym] = entry.merge(consumer: consumer, pid: pid, delivered_at: now, deliveries: entry[:deliveries].to_i + 1)
+        end
+
+        write_pending(file, entries) if ids.any?
+        ids
+      end
+    end
+
+    # Error history of a pending message, oldest first
+    def errors(topic, group, id)
+      pending_locked(topic, group) { |_file, entries| entries.dig(id.to_s.to_sym, :errors).to_a }
+    end
+
+    # Oldest first, with how long each has sat since delivery
+    def pending(topic, group)
+      pending_locked(topic, group) do |_file, entries|
+        now = Time.now.to_f
+
+        entries.map do |id, entry|
+          {
+            id: id.to_s.to_i,
+            consumer: entry[:consumer],
+            idle: (now - last_seen(entry)).round(3),
+            deliveries: entry[:deliveries],
+            alive: pid_alive?(entry[:pid]),
+            redeliver_at: entry[:redeliver_at] && Time.at(entry[:redeliver_at]).utc.iso8601(3),
+            visible_until: entry[:visible_until] && entry[:visible_until] > now ? Time.at(entry[:visible_until]).utc.iso8601(3) : nil,
+            failures: entry[:errors]&.size,
+            last_error: entry[:errors]&.last&.fetch(:error)
+          }.compact
+        end.sort_by { |entry| entry[:id] }
+      end
+    end
+
+    # Take over pending messages whose consumer has died, or (with min_idle)
+    # that have sat unacked for at least min_idle seconds; returns their ids
+    def reclaim(topic, group, consumer:, min_idle: nil, max: 10, pid: Process.pid)
+      return [] if paused?(topic, group)
+
+      pending_locked(topic, group) do |file, entries|
+        now = Time.now.to_f
+
+        ids = entries.select do |_id, entry|
+          next false if entry[:consumer] == consumer
+          next false if entry[:redeliver_at]  # Waiting out its backoff
+          next true unless pid_alive?(entry[:pid])
+          next false if entry[:visible_until] && entry[:visible_until] > now  # Extended by its consumer
+
+          min_idle && now - last_seen(entry) >= min_idle
+        end.keys.map { |id| id.to_s.to_i }.sort.first(max)
+
+        ids.each do |id|
+          entry = entries[id.to_s.to_sym].except(:touched_at, :visible_until)
+          entries[id.to_s.to_sym] = entry.merge(consumer: consumer, pid: pid, delivered_at: now, deliveries: entry[:deliveries].to_i + 1)
+        end
+
+        write_pending(file, entries) if ids.any?
+        ids
+      end
+    end
+
+    # Pausing (for operators)
+
+    def pause(topic, group, by: nil)
+      path = paused_path(topic, group)
+      FileUtils.mkdir_p(path.dirname)
+
+      state = { paused_at: Time.now.utc.iso8601, by: by }.compact
+      File.write(path, JSON.generate(state)) unless path.exist?
+      true
+    end
+
+    def resume(topic, group)
+      FileUtils.rm_f(paused_path(topic, group))
+
+      # Push subscribers were left waiting; have them fetch again
+      begin
+        Shortbus.file_watcher.trigger!(topic)
+      rescue => e
+        Shortbus.warn "Failed to trigger file watcher: #{e.message}"
+      end
+
+      true
+    end
+
+    def paused?(topic, group)
+      paused_path(topic, group).exist?
+    end
+
+    # Pause, then wait up to wait seconds for every handed-out message to be
+    # acked (nacked ones waiting out a backoff don't count: they go out again
+    # after resume). The group stays paused either way.
+    def drain(topic, group, wait:, stop: -> { false })
+      pause(topic, group, by: 'drain')
+      deadline = Time.now + wait
+
+      loop do
+        in_flight = pending(topic, group).count { |entry| entry[:consumer] }
+        return { drained: true, in_flight: 0 } if in_flight.zero?
+        return { drained: false, in_flight: } if Time.now >= deadline || stop.call
+
+        sleep 0.1
+      end
+    end
+
+    # Membership (for partitioned delivery)
+
+    def join(topic, group, connection_id)
+      dir = members_dir(topic, group)
+      FileUtils.mkdir_p(dir)
+      File.write(dir / connection_id.to_s, Process.pid.to_s)
+    end
+
+    def leave(topic, group, connection_id)
+      FileUtils.rm_f(members_dir(topic, group) / connection_id.to_s)
+    end
+
+    # Live member connection ids, sorted so every process agrees on order
+    def members(topic, group)
+      dir = members_dir(topic, group)
+      return [] unless dir.exist?
+
+      live, dead = dir.children.partition { |entry| alive?(entry) }
+      dead.each { |entry| FileUtils.rm_f(entry) }
+
+      live.map { |entry| entry.basename.to_s }.sort
+    end
+
+    # Partitions owned by connection_id: partition p goes to member p % n
+    def assignment(topic, group, connection_id, partitions)
+      members = members(topic, group)
+      index = members.index(connection_id.to_s)
+      return [] unless index
+
+      (0...partitions).select { |partition| partition % members.size == index }
+    end
+
+    # Same key, same partition; unkeyed messages spread by id
+    def self.partition_for(message, partitions)
+      key = message.dig(:metadata, :key)
+      hash = key ? Zlib.crc32(key.to_s) : message[:id].to_i
+      hash % partitions
+    end
+
+    private
+
+    def offset_path(topic, group, partition: nil)
+      validate!(group)
+      name = partition ? "#{group}.p#{Integer(partition)}" : group.to_s
+      config.groups_dir / topic.to_s / "#{name}.offset"
+    end
+
+    # When the consumer last showed signs of life: delivery or the latest touch
+    def last_seen(entry)
+      [entry[:delivered_at].to_f, entry[:touched_at].to_f].max
+    end
+
+    def paused_path(topic, group)
+      validate!(group)
+      config.groups_dir / topic.to_s / "#{group}.paused"
+    end
+
+    def pending_path(topic, group)
+      validate!(group)
+      config.groups_dir / topic.to_s / "#{group}.pending.json"
+    end
+
+    def pending_locked(topic, group)
+      path = pending_path(topic, group)
+      FileUtils.mkdir_p(path.dirname)
+
+      File.open(path, File::RDWR | File::CREAT, 0o644) do |file|
+        file.flock(File::LOCK_EX)
+        json = file.read
+        entries = json.strip.empty? ? {} : JSON.parse(json, symbolize_names: true)
+        yield file, entries
+      end
+    end
+
+    def write_pending(file, entries)
+      file.rewind
+      file.truncate(0)
+      file.write(JSON.generate(entries))
+      file.flush
+    end
+
+    def members_dir(topic, group)
+      validate!(group)
+      config.groups_dir / topic.to_s / "#{group}.members"
+    end
+
+    def validate!(group)
+      raise ArgumentError, "Invalid group name: #{group.inspect}" unless group.to_s =~ /\A[A-Za-z0-9_\-]+\z/
+    end
+
+    def locked(topic, group, partition: nil)
+      path = offset_path(topic, group, partition:)
+      FileUtils.mkdir_p(path.dirname)
+
+      File.open(path, File::RDWR | File::CREAT, 0o644) do |file|
+        file.flock(File::LOCK_EX)
+        yield file
+      end
+    end
+
+    def write(file, offset)
+      file.rewind
+      file.truncate(0)
+      file.write(offset.to_s)
+      file.flush
+    end
+
+    def alive?(entry)
+      pid_alive?(File.read(entry).strip)
+    rescue Errno::ENOENT
+      false
+    end
+
+    def pid_alive?(pid)
+      return false unless pid.to_i > 0
+
+      Process.kill(0, pid.to_i)
+      true
+    rescue Errno::ESRCH
+      false
+    rescue Errno::EPERM
+      true
+    end
+  end
+end
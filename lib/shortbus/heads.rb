@@ -0,0 +1,95 @@
+module Shortbus
+  # Compare-and-publish
+  #
+  # A publish carrying expected_last_sequence is written only if the topic's
+  # last message is still at that sequence (its offset; 0 for a topic with
+  # no messages), and fails with ConflictError otherwise. For state topics
+  # with several writers: read the head, decide, publish against it, and
+  # re-read on a conflict instead of writing over someone else's update.
+  #
+  # The check and the publish happen under a lock on heads/TOPIC.json, which
+  # holds the last sequence seen and the offset to read on from, so only
+  # messages published since the last check are scanned. Publishes without
+  # the option don't take the lock, but are still seen by the next check:
+  # a topic written by several writers should have them all use it.
+  #
+  # Example:
+  #   Shortbus.heads.publish('thermostat', 41) { Shortbus.engine.publish('thermostat', '21') }
+  #   # => { message_id: "...", offset: 42 }, or ConflictError (current: 43)
+  class Heads
+    BATCH = 500
+
+    attr_reader :config
+
+    def initialize(config: Shortbus.config)
+      @config = config
+    end
+
+    # Yields to publish if the topic's head is at expected; returns the
+    # publish result
+    def publish(topic, expected, engine: Shortbus.engine)
+      expected = Integer(expected)
+      raise ArgumentError, "expected_last_sequence must not be negative" if expected.negative?
+
+      locked(topic) do |state|
+        catch_up!(topic, state, engine)
+
+        if expected != state[:last]
+          raise ConflictError.new("#{topic} is at sequence #{state[:last]}, not #{expected}", current: state[:last])
+        end
+
+        result = yield
+        state[:last] = [state[:last], result[:offset].to_i].max
+        state[:offset] = state[:last] + 1
+        result
+      end
+    end
+
+    # The topic's last sequence, 0 if it has no messages
+    def last(topic, engine: Shortbus.engine)
+      locked(topic) do |state|
+        catch_up!(topic, state, engine)
+        state[:last]
+      end
+    end
+
+    def path(topic)
+      raise ArgumentError, "Invalid topic name: #{topic.inspect}" unless topic.to_s =~ /\A[A-Za-z0-9_.\-]+\z/
+
+      config.heads_dir / "#{topic}.json"
+    end
+
+    private
+
+    # Messages published since the last check
+    def catch_up!(topic, state, engine)
+      loop do
+        messages = engine.fetch_messages(topic, offset: state[:offset], limit: BATCH, tiered: false)
+        break if messages.empty?
+
+        state[:last] = [state[:last], messages.last[:id]].max
+        state[:offset] = messages.last[:id] + 1
+        break if messages.size < BATCH
+      end
+    end
+
+    def locked(topic)
+      FileUtils.mkdir_p(config.heads_dir)
+
+      File.open(path(topic), File::RDWR | File::CREAT, 0o644) do |file|
+        file.flock(File::LOCK_EX)
+        json = file.read
+        state = json.strip.empty? ? {} : JSON.parse(json, symbolize_names: true)
+        state = { last: state[:last] || 0, offset: state[:offset] || 0 }
+
+        begin
+          yield state
+        ensure
+          file.rewind
+          file.truncate(0)
+          file.write(JSON.generate(state))
+        end
+      end
+    end
+  end
+end
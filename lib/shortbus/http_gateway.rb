@@ -0,0 +1,424 @@
+module Shortbus
+  # HTTP long-poll gateway
+  #
+  # For environments where only HTTP is allowed. Consumers long-poll for the
+  # next message in a group and ack it with a follow-up POST; anything not
+  # acked within ack_wait is handed to the next poller, so delivery is
+  # at-least-once:
+  #
+  #   GET  /topics/{t}/next?group=g&wait=30s[&max=1][&ack_wait=30s]
+  #          200 {"topic": ..., "group": ..., "messages": [...]}
+  #          204 when nothing arrived within wait
+  #   POST /topics/{t}/ack   {"group": "g", "ids": [41]}
+  #   POST /topics/{t}/nack  {"group": "g", "ids": [41], "error": "...", "delay": "30s"}
+  #   POST /topics/{t}/messages  {"payload": "...", "metadata": {...}[, "deadline_in": "30s"][, "expected_last_sequence": 41]}
+  #          409 {"error": ..., "last_sequence": 43} when the topic's head has moved
+  #   GET  /metrics
+  #          200 every topic's metrics in the Prometheus text format (see Metrics#prometheus)
+  #   GET  /health
+  #          503 {"status": "recovering", "recovery": {"percent": 42.0, "eta": 31, ...}} while the engine starts (see Recovery)
+  #
+  # ROUTES drives both the router and the OpenAPI document (HttpGateway.openapi,
+  # `shortbus openapi`), so the published spec can't drift from the handlers.
+  #
+  # One thread per request, one request per connection. Binds to localhost
+  # unless told otherwise; there is no authentication.
+  class HttpGateway
+    MAX_WAIT = 300
+    DEFAULT_ACK_WAIT = 30
+
+    STATUSES = {
+      200 => 'OK',
+      204 => 'No Content',
+      400 => 'Bad Request',
+      403 => 'Forbidden',
+      404 => 'Not Found',
+      405 => 'Method Not Allowed',
+      409 => 'Conflict',
+      500 => 'Internal Server Error',
+      503 => 'Service Unavailable'
+    }.freeze
+
+    # query: name => [type, description, required]; body and responses name
+    # a SCHEMAS entry
+    Route = Struct.new(:method, :path, :action, :summary, :query, :body, :responses, keyword_init: true) do
+      def pattern
+        @pattern ||= Regexp.new("\\A#{path.gsub('{topic}', '([^/]+)')}\\z")
+      end
+    end
+
+    ROUTES = [
+      Route.new(
+        method: 'GET', path: '/health', action: :health,
+        summary: 'Liveness check',
+        responses: { 200 => ['Gateway is up', :Status], 503 => ['The engine is recovering its write-ahead log', :Recovering] }
+      ),
+      Route.new(
+        method: 'GET', path: '/metrics', action: :prometheus,
+        summary: 'Publish and delivery metrics in the Prometheus text format',
+        responses: { 200 => ['Prometheus text exposition (text/plain; version=0.0.4)', nil] }
+      ),
+      Route.new(
+        method: 'GET', path: '/topics/{topic}/next', action: :next_messages,
+        summary: 'Long-poll for the next messages in a consumer group; they stay pending until acked',
+        query: {
+          group: [:string, 'Consumer group', true],
+          wait: [:string, 'How long to wait for a message, e.g. 30s (max 300s)', false],
+          max: [:integer, 'Most messages to return (default 1)', false],
+          ack_wait: [:string, 'How long before an unacked message goes to another poller (default 30s)', false]
+        },
+        responses: { 200 => ['Messages', :Messages], 204 => ['Nothing arrived within wait', nil] }
+      ),
+      Route.new(
+        method: 'POST', path: '/topics/{topic}/ack', action: :ack,
+        summary: 'Mark messages from next as done',
+        body: :Ack,
+        responses: { 200 => ['Acked', :Acked] }
+      ),
+      Route.new(
+        method: 'POST', path: '/topics/{topic}/nack', action: :nack,
+        summary: "Give messages back for redelivery after the topic's backoff; with an error, quarantine repeat failures",
+        body: :Nack,
+        responses: { 200 => ['Nacked', :Nacked] }
+      ),
+      Route.new(
+        method: 'POST', path: '/topics/{topic}/messages', action: :publish,
+        summary: 'Publish a message',
+        body: :Publish,
+        responses: { 200 => ['Published', :Published], 409 => ["The topic's head is past expected_last_sequence", :Conflict] }
+      )
+    ].freeze
+
+    SCHEMAS = {
+      Status: {
+        type: 'object',
+        properties: { status: { type: 'string' }, read_only: { type: 'boolean', description: 'The broker refuses publishes (SHORTBUS_READ_ONLY)' } }
+      },
+      Recovering: {
+        type: 'object',
+        properties: {
+          status: { type: 'string', enum: %w[recovering] },
+          recovery: {
+            type: 'object',
+            properties: {
+              percent: { type: 'number', description: 'How much of the log the engine has read, where that can be seen' },
+              eta: { type: 'integer', description: 'Seconds left at the rate so far' },
+              wal_bytes: { type: 'integer' },
+              read_bytes: { type: 'integer' },
+              started_at: { type: 'string', format: 'date-time' }
+            }
+          }
+        }
+      },
+      Error: { type: 'object', properties: { error: { type: 'string' } }, required: %w[error] },
+      Conflict: {
+        type: 'object',
+        properties: { error: { type: 'string' }, last_sequence: { type: 'integer', description: "Sequence of the topic's last message" } },
+        required: %w[error last_sequence]
+      },
+      Message: {
+        type: 'object',
+        properties: {
+          id: { type: 'integer' },
+          message_id: { type: 'string', description: 'UUIDv7, unique across topics and kept when the message is moved' },
+          offset: { type: 'integer', description: "Position in the topic (same as id)" },
+          topic: { type: 'string' },
+          payload: { type: 'string' },
+          metadata: { type: 'object', additionalProperties: true },
+          timestamp: { type: 'integer' }
+        }
+      },
+      Messages: {
+        type: 'object',
+        properties: {
+          topic: { type: 'string' },
+          group: { type: 'string' },
+          messages: { type: 'array', items: { '$ref' => '#/components/schemas/Message' } }
+        }
+      },
+      Ack: {
+        type: 'object',
+        properties: { group: { type: 'string' }, ids: { type: 'array', items: { oneOf: [{ type: 'integer' }, { type: 'string' }] } } },
+        required: %w[group ids]
+      },
+      Acked: {
+        type: 'object',
+        properties: { status: { type: 'string' }, topic: { type: 'string' }, group: { type: 'string' }, acked: { type: 'integer' } }
+      },
+      Nack: {
+        type: 'object',
+        properties: {
+          group: { type: 'string' },
+          ids: { type: 'array', items: { oneOf: [{ type: 'integer' }, { type: 'string' }] } },
+          error: { type: 'string', description: 'Why the handler failed; counts toward max_failures' },
+          delay: { type: 'string', description: "Redeliver after this long instead of the topic's backoff" }
+        },
+        required: %w[group ids]
+      },
+      Nacked: {
+        type: 'object',
+        properties: {
+          status: { type: 'string' },
+          topic: { type: 'string' },
+          group: { type: 'string' },
+          nacked: { type: 'integer' },
+          poisoned: { type: 'array', items: { type: 'integer' } }
+        }
+      },
+      Publish: {
+        type: 'object',
+        properties: {
+          payload: { type: 'string' },
+          metadata: { type: 'object', additionalProperties: true },
+          deadline: { type: 'string', description: 'Skip delivery after this time (ISO8601 or epoch seconds)' },
+          deadline_in: { type: 'string', description: 'Skip delivery after this long, e.g. 30s' },
+          expected_last_sequence: { type: 'integer', description: "Publish only if the topic's last message is at this sequence (0: no messages)" }
+        },
+        required: %w[payload]
+      },
+      Published: {
+        type: 'object',
+        properties: {
+          status: { type: 'string' },
+          topic: { type: 'string' },
+          message_id: { type: 'string' },
+          offset: { type: 'integer' },
+          acked_after: { type: 'string', enum: %w[fsync enqueue], description: "fsync: on disk; enqueue: written, left to the topic's sync policy" }
+        }
+      }
+    }.freeze
+
+    # OpenAPI 3 description of ROUTES
+    def self.openapi(server: "http://127.0.0.1:#{Shortbus.config.port}")
+      paths = ROUTES.group_by(&:path).to_h do |path, routes|
+        [path, routes.to_h { |route| [route.method.downcase, operation(route)] }]
+      end
+
+      {
+        openapi: '3.0.3',
+        info: { title: 'shortbus HTTP gateway', version: Shortbus.version },
+        servers: [{ url: server }],
+        paths: paths,
+        components: { schemas: SCHEMAS }
+      }
+    end
+
+    def self.operation(route)
+      parameters = []
+      parameters << { name: 'topic', in: 'path', required: true, schema: { type: 'string' } } if route.path.include?('{topic}')
+
+      route.query.to_h.each do |name, (type, description, required)|
+        parameters << { name: name.to_s, in: 'query', required: required, description: description, schema: { type: type.to_s } }
+      end
+
+      responses = route.responses.to_h do |status, (description, schema)|
+        content = schema && { 'application/json' => { schema: { '$ref' => "#/components/schemas/#{schema}" } } }
+        [status.to_s, { description: description, content: content }.compact]
+      end
+
+      [400, 403, 500].each do |status|
+        responses[status.to_s] ||= {
+          description: STATUSES[status],
+          content: { 'application/json' => { schema: { '$ref' => '#/components/schemas/Error' } } }
+        }
+      end
+
+      body = route.body && {
+        required: true,
+        content: { 'application/json' => { schema: { '$ref' => "#/components/schemas/#{route.body}" } } }
+      }
+
+      {
+        operationId: route.action.to_s,
+        summary: route.summary,
+        parameters: parameters.empty? ? nil : parameters,
+        requestBody: body,
+        responses: responses
+      }.compact
+    end
+    private_class_method :operation
+
+    attr_reader :port, :bind
+
+    def initialize(port: Shortbus.config.port, bind: '127.0.0.1')
+      @port = Integer(port)
+      @bind = bind
+      @running = false
+    end
+
+    def run!
+      @server = TCPServer.new(bind, port)
+      @running = true
+
+      trap('TERM') { @running = false }
+      trap('INT') { @running = false }
+
+      Shortbus.info "shortbus http gateway listening on http://#{bind}:#{port}"
+
+      while @running
+        next unless IO.select([@server], nil, nil, 0.5)
+
+        client = @server.accept_nonblock(exception: false)
+        Thread.new(client) { |socket| serve(socket) } if client.is_a?(TCPSocket)
+      end
+    ensure
+      @server&.close
+      Shortbus.metrics.flush!
+    end
+
+    def stop!
+      @running = false
+    end
+
+    # Route one parsed request to [status, body]
+    def handle(method, path, query, body)
+      matches = ROUTES.filter_map { |route| (match = route.pattern.match(path)) && [route, match] }
+      return [404, { error: "Not found: #{path}" }] if matches.empty?
+
+      route, match = matches.find { |candidate, _| candidate.method == method }
+      return [405, { error: "#{path} expects #{matches.map { |candidate, _| candidate.method }.join(', ')}" }] unless route
+
+      topic = match[1] && URI.decode_www_form_component(match[1])
+      Inbox.authorize!(topic, nil) if topic
+
+      send(route.action, topic, query, body)
+    rescue ArgumentError, TopicError, JSON::ParserError => e
+      [400, { error: e.message }]
+    rescue AccessError => e
+      [403, { error: e.message }]
+    rescue ConflictError => e
+      [409, { error: e.message, last_sequence: e.current }]
+    rescue ConnectionError => e
+      [503, { error: e.message }]
+    rescue => e
+      [500, { error: e.message }]
+    end
+
+    private
+
+    def health(_topic, _query, _body)
+      recovery = Shortbus.recovery.status
+      return [503, { status: :recovering, recovery: recovery.except(:pid, :state) }] if recovery
+
+      [200, { status: :ok, read_only: (true if Shortbus.read_only?) }.compact]
+    end
+
+    def prometheus(_topic, _query, _body)
+      # This process's counts first, so its own publishes show up
+      Shortbus.metrics.flush!
+
+      [200, Shortbus.metrics.prometheus]
+    end
+
+    def next_messages(topic, query, _body)
+      group = query['group']
+      raise ArgumentError, "Missing group" unless group
+
+      max = Integer(query['max'] || 1)
+      wait = [Shortbus.parse_duration(query['wait'] || 0), MAX_WAIT].min
+      ack_wait = Shortbus.parse_duration(query['ack_wait'] || DEFAULT_ACK_WAIT)
+
+      # Every poll is its own consumer, so it may take over another poll's
+      # unacked messages once ack_wait has passed
+      messages = WorkQueue.fetch_acked(
+        topic,
+        group,
+        consumer: "http-#{SecureRandom.hex(4)}",
+        max:,
+        wait:,
+        min_idle: ack_wait,
+        stop: -> { !@running }
+      )
+
+      return [204, nil] if messages.empty?
+
+      [200, { topic:, group:, messages: messages.map { |msg| Shortbus.metrics.delivered(topic, msg, group:) } }]
+    end
+
+    def ack(topic, _query, body)
+      group, ids = group_and_ids(topic, body)
+      [200, { status: :ok, topic:, group:, acked: Shortbus.groups.ack(topic, group, ids) }]
+    end
+
+    def nack(topic, _query, body)
+      group, ids = group_and_ids(topic, body)
+      result = WorkQueue.nack(topic, group, ids, error: body[:error], delay: body[:delay])
+
+      [200, { status: :ok, topic:, group:, **result }]
+    end
+
+    def publish(topic, _query, body)
+      payload = body[:payload]
+      raise ArgumentError, "Missing payload" unless payload
+      Shortbus.writable!
+      TopicEvents.authorize!(topic)
+      Shortbus.topic_creation.check!(topic)
+
+      metadata = (body[:metadata] || {}).merge(published_by: 'http')
+      metadata = Shortbus.deadlines.stamp(metadata, deadline: body[:deadline], deadline_in: body[:deadline_in])
+      Schema.check!(topic, payload, metadata)
+      Shortbus.signatures.check!(topic, payload, metadata)
+
+      # max_depth is checked where the message is written (see Routes#publish)
+      result =
+        if body[:expected_last_sequence].nil?
+          Shortbus.routes.publish(topic, payload, metadata:)
+        else
+          Admin.check_depth!(topic)
+          Shortbus.heads.publish(topic, body[:expected_last_sequence]) { Shortbus.engine.publish(topic, payload, metadata:) }
+        end
+      acked_after = Shortbus.group_commit.commit!(Routes.written(topic, result))
+      Shortbus.metrics.record(topic, payload, metadata:)
+
+      [200, { status: :ok, topic:, message_id: result[:message_id], offset: result[:offset], moved_to: result[:moved_to], copied_to: result[:copied_to], acked_after: }.compact]
+    end
+
+    # ids may be offsets or message ids
+    def group_and_ids(topic, body)
+      group = body[:group]
+      ids = Array(body[:ids] || body[:id])
+
+      raise ArgumentError, "Missing group" unless group
+      raise ArgumentError, "Missing ids" if ids.empty?
+
+      [group, Shortbus.groups.resolve(topic, group, ids)]
+    end
+
+    def serve(socket)
+      method, target = socket.gets.to_s.split(' ', 3)
+      return unless method && target
+
+      headers = {}
+      while (line = socket.gets) && line != "\r\n"
+        name, value = line.split(':', 2)
+        headers[name.strip.downcase] = value.to_s.strip
+      end
+
+      length = headers['content-length'].to_i
+      raw = length > 0 ? socket.read(length) : ''
+      body = raw.empty? ? {} : JSON.parse(raw, symbolize_names: true)
+
+      path, query = target.split('?', 2)
+      status, response = handle(method, path, URI.decode_www_form(query.to_s).to_h, body)
+
+      respond(socket, status, response)
+    rescue JSON::ParserError => e
+      respond(socket, 400, { error: "Invalid JSON: #{e.message}" })
+    rescue => e
+      Shortbus.warn "HTTP request failed: #{e.message}"
+    ensure
+      socket.close unless socket.closed?
+    end
+
+    # A String body is sent as plain text, anything else as JSON
+    def respond(socket, status, body)
+      text = body.is_a?(String)
+      content = text ? body : (body ? JSON.generate(body) : '')
+
+      socket.write("HTTP/1.1 #{status} #{STATUSES.fetch(status, 'Unknown')}\r\n")
+      socket.write("Content-Type: #{text ? 'text/plain; version=0.0.4' : 'application/json'}\r\n") if body
+      socket.write("Content-Length: #{content.bytesize}\r\nConnection: close\r\n\r\n")
+      socket.write(content)
+    end
+  end
+end
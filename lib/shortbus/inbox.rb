@@ -0,0 +1,44 @@
+module Shortbus
+  # Reserved reply-inbox namespace
+  #
+  #   _INBOX.<connection_id>.<nonce>
+  #
+  # Inboxes are minted by the broker for one connection. Anyone may publish to
+  # an inbox (that's how replies get there), but only the owning connection may
+  # subscribe to, reconfigure, or delete it. Inboxes are ephemeral topics, so
+  # they disappear when their owner disconnects.
+  module Inbox
+    PREFIX = '_INBOX'
+
+    def generate(connection_id, topics: Shortbus.topics)
+      loop do
+        name = "#{PREFIX}.#{connection_id}.#{SecureRandom.hex(8)}"
+        return name unless topics.exists?(name)
+      end
+    end
+
+    def inbox?(topic)
+      topic.to_s.start_with?("#{PREFIX}.")
+    end
+
+    def owner(topic)
+      return nil unless inbox?(topic)
+
+      topic.to_s.split('.', 3)[1]
+    end
+
+    def owned_by?(topic, connection_id)
+      owner(topic) == connection_id.to_s
+    end
+
+    # Raise unless the connection may subscribe to / administer the topic
+    def authorize!(topic, connection_id)
+      return true unless inbox?(topic)
+      return true if owned_by?(topic, connection_id)
+
+      raise AccessError, "Inbox #{topic} belongs to another connection"
+    end
+
+    extend self
+  end
+end
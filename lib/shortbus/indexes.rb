@@ -0,0 +1,124 @@
+module Shortbus
+  # Sparse time indexes for replay
+  #
+  # Subscribing by_start_time (or last, or new) has to find a position in a
+  # retained topic. Instead of scanning from the first message every time,
+  # indexes/TOPIC.json records the id and publish time of the message
+  # opening each segment of SEGMENT ids:
+  #
+  #   { "entries": [[1, 1718000000.0], [1001, 1718003600.5], [2004, 1718007212.2]] }
+  #
+  # A seek starts at the segment holding the time, so only that segment is
+  # scanned. Catching the index up reads one message per new segment, not
+  # the messages in between. Publish times grow with the id; an index whose
+  # newest entry no longer matches the topic (purged, or deleted and
+  # recreated) is rebuilt.
+  #
+  # Example:
+  #   Shortbus.indexes.seek('events', Time.now - 7200)   # => 41001
+  class Indexes
+    SEGMENT = 1000
+
+    attr_reader :config
+
+    # Entries are [id, timestamp], both ascending
+    def self.valid?(entries)
+      entries.is_a?(Array) &&
+        entries.all? { |entry| entry.is_a?(Array) && entry.size == 2 && entry.all?(Numeric) } &&
+        entries.each_cons(2).all? { |(id, time), (next_id, next_time)| next_id > id && next_time >= time }
+    end
+
+    def initialize(config: Shortbus.config)
+      @config = config
+    end
+
+    # Id to scan from for the first message at or after time
+    def seek(topic, time, engine: Shortbus.engine)
+      time = time.to_f
+      entries = locked(topic) { |state| catch_up!(topic, state, engine) }
+      entry = entries.reverse.find { |_, timestamp| timestamp < time }
+      entry ? entry.first : 0
+    end
+
+    # Id opening the newest segment, to scan from for the last message
+    def tail(topic, engine: Shortbus.engine)
+      entries = locked(topic) { |state| catch_up!(topic, state, engine) }
+      entries.empty? ? 0 : entries.last.first
+    end
+
+    # Reindex topic from scratch; returns the number of segments
+    def rebuild(topic, engine: Shortbus.engine)
+      locked(topic) do |state|
+        state[:entries] = []
+        catch_up!(topic, state, engine).size
+      end
+    end
+
+    # Drop the index along with the topic's messages
+    def forget(topic)
+      FileUtils.rm_f(path(topic))
+    end
+
+    def path(topic)
+      raise ArgumentError, "Invalid topic name: #{topic.inspect}" unless topic.to_s =~ /\A[A-Za-z0-9_.\-]+\z/
+
+      config.indexes_dir / "#{topic}.json"
+    end
+
+    private
+
+    # Index segments opened since the last call
+    def catch_up!(topic, state, engine)
+      entries = state[:entries]
+
+      if (newest = entries.last)
+        current = first_message(topic, newest.first, engine)
+        entries.clear unless current && current[:id] == newest.first && timestamp(current) == newest.last
+      end
+
+      offset = entries.empty? ? 0 : entries.last.first + SEGMENT
+
+      while (message = first_message(topic, offset, engine))
+        entries << [message[:id], timestamp(message)] if timestamp(message)
+        offset = message[:id] + SEGMENT
+      end
+
+      entries
+    end
+
+    def first_message(topic, offset, engine)
+      engine.fetch_messages(topic, offset:, limit: 1).first
+    end
+
+    def timestamp(message)
+      DeliverPolicy.message_time(message)&.to_f
+    end
+
+    # An unreadable index is only slower; it is rebuilt as it is read
+    def read(file)
+      json = file.read
+      state = json.strip.empty? ? {} : JSON.parse(json, symbolize_names: true)
+      entries = state[:entries] if state.is_a?(Hash)
+      Indexes.valid?(entries) ? entries : []
+    rescue JSON::ParserError
+      []
+    end
+
+    def locked(topic)
+      FileUtils.mkdir_p(config.indexes_dir)
+
+      File.open(path(topic), File::RDWR | File::CREAT, 0o644) do |file|
+        file.flock(File::LOCK_EX)
+        state = { entries: read(file) }
+
+        begin
+          yield state
+        ensure
+          file.rewind
+          file.truncate(0)
+          file.write(JSON.generate(state))
+        end
+      end
+    end
+  end
+end
@@ -0,0 +1,145 @@
+module Shortbus
+  # Background jobs on top of plain topics
+  #
+  # Enqueue publishes the job to its topic like any message, stamped with
+  # metadata.job_id, and records the job under jobs/ID.json:
+  #
+  #   { "id": "9f2c...", "topic": "thumbnails", "message_id": "0192...", "state": "running",
+  #     "progress": 0.5, "enqueued_at": "...", "updated_at": "..." }
+  #
+  # Workers consume the topic however they like (subscribe, fetch) and report
+  # back by publishing to result.JOBID. The broker intercepts those rather
+  # than writing them to the engine:
+  #
+  #   metadata.progress  the job is running; progress is kept as given
+  #   metadata.error     the job failed with that error
+  #   otherwise          the job is done, and the payload is its result
+  #
+  # Producers await the job (or look it up) by id. Finished jobs are pruned
+  # after RETAIN.
+  #
+  # Example:
+  #   job = Shortbus.jobs.enqueue('thumbnails', '{"image": 7}')
+  #   Shortbus.jobs.report(job[:id], '{"url": "..."}')
+  #   Shortbus.jobs.await(job[:id], wait: 30)   # => { state: "done", result: '{"url": "..."}', ... }
+  class Jobs
+    STATES = %w[queued running done failed].freeze
+    FINISHED = %w[done failed].freeze
+    RESULT_PREFIX = 'result.'
+    RETAIN = 86_400
+    PRUNE_INTERVAL = 60
+
+    attr_reader :config
+
+    def initialize(config: Shortbus.config)
+      @config = config
+    end
+
+    # The job id a result.JOBID topic reports on, or nil for other topics
+    def self.result_for(topic)
+      topic.to_s.delete_prefix(RESULT_PREFIX) if topic.to_s.start_with?(RESULT_PREFIX)
+    end
+
+    def enqueue(topic, payload, metadata: {}, engine: Shortbus.engine)
+      id = SecureRandom.hex(8)
+      write(id, id: id, topic: topic.to_s, state: 'queued', enqueued_at: now)
+
+      result = engine.publish(topic, payload, metadata: metadata.merge(job_id: id))
+      update(id) { |job| job.merge(message_id: result[:message_id]) }
+    end
+
+    # A worker's progress, failure, or result
+    def report(id, payload, metadata: {})
+      update(id) do |job|
+        raise ArgumentError, "Job already #{job[:state]}: #{id}" if FINISHED.include?(job[:state])
+
+        if metadata[:error]
+          job.merge(state: 'failed', error: metadata[:error].to_s, finished_at: now)
+        elsif metadata.key?(:progress)
+          job.merge(state: 'running', progress: metadata[:progress])
+        else
+          job.merge(state: 'done', result: payload, finished_at: now)
+        end
+      end
+    end
+
+    def get(id)
+      read(id)
+    end
+
+    # The job once finished, or as it stands when wait runs out; stop cuts
+    # the wait short (e.g. on shutdown)
+    def await(id, wait:, stop: -> { false })
+      deadline = Time.now + wait
+
+      loop do
+        job = read(id)
+        raise ArgumentError, "Unknown job: #{id}" unless job
+
+        return job if FINISHED.include?(job[:state]) || Time.now >= deadline || stop.call
+
+        sleep 0.1
+      end
+    end
+
+    # Remove finished jobs older than retain seconds; returns their ids
+    def prune!(retain: RETAIN)
+      cutoff = Time.now - retain
+
+      config.jobs_dir.glob('*.json').filter_map do |path|
+        job = read(path.basename('.json').to_s)
+        next unless job && FINISHED.include?(job[:state])
+        next unless Time.iso8601(job[:finished_at]) < cutoff
+
+        FileUtils.rm_f([path, "#{path}.lock"])
+        job[:id]
+      end
+    end
+
+    private
+
+    def now
+      Time.now.utc.iso8601(3)
+    end
+
+    def path(id)
+      raise ArgumentError, "Invalid job id: #{id.inspect}" unless id.to_s =~ /\A[A-Za-z0-9_\-]+\z/
+
+      config.jobs_dir / "#{id}.json"
+    end
+
+    def read(id)
+      return nil unless path(id).exist?
+
+      JSON.parse(File.read(path(id)), symbolize_names: true)
+    rescue JSON::ParserError
+      nil
+    end
+
+    # Read-modify-write under a lock file, so reports racing each other (or
+    # the enqueue recording its message id) don't lose updates
+    def update(id)
+      FileUtils.mkdir_p(config.jobs_dir)
+
+      File.open("#{path(id)}.lock", File::RDWR | File::CREAT, 0o644) do |lock|
+        lock.flock(File::LOCK_EX)
+
+        job = read(id)
+        raise ArgumentError, "Unknown job: #{id}" unless job
+
+        write(id, yield(job).merge(updated_at: now))
+      end
+    end
+
+    def write(id, job)
+      FileUtils.mkdir_p(config.jobs_dir)
+
+      # Write-then-rename so awaiting readers never see a half-written job
+      tmp = path(id).sub_ext(".json.#{Process.pid}.tmp")
+      File.write(tmp, JSON.generate(job.compact))
+      File.rename(tmp, path(id))
+
+      job
+    end
+  end
+end
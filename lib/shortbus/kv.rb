@@ -0,0 +1,136 @@
+module Shortbus
+  # Key-value buckets
+  #
+  # Small bits of shared config and state, without a database: a bucket is
+  # the compacted topic kv.BUCKET (see Compactor), a put is a publish keyed
+  # by the entry's key, and a delete publishes a tombstone. An entry's
+  # revision is the offset of the publish that wrote it, so revisions only
+  # go up.
+  #
+  #   { "bucket": "config", "key": "billing.rate_limit", "value": "100", "revision": 42,
+  #     "operation": "put", "updated_at": "..." }
+  #
+  # Reads scan the bucket for each key's latest message; compaction keeps
+  # that down to about one message per key. To watch a bucket, subscribe to
+  # its topic from the beginning (deliver: all): the current entries come
+  # first, then every change as it is made, deletes as messages with
+  # metadata.tombstone.
+  #
+  # Example:
+  #   Shortbus.kv.put('config', 'billing.rate_limit', '100')   # => { ..., revision: 42 }
+  #   Shortbus.kv.get('config', 'billing.rate_limit')          # => { value: "100", revision: 42, ... }
+  #   Shortbus.kv.keys('config')                               # => ["billing.rate_limit"]
+  #   Shortbus.kv.delete('config', 'billing.rate_limit')
+  class KV
+    PREFIX = 'kv.'
+    BATCH = 500
+    BUCKET = /\A[A-Za-z0-9_\-]+\z/
+    KEY = /\A[A-Za-z0-9_\-\/=.]+\z/
+
+    attr_reader :config
+
+    def initialize(config: Shortbus.config)
+      @config = config
+    end
+
+    def topic(bucket)
+      raise ArgumentError, "Invalid bucket name: #{bucket.inspect}" unless bucket.to_s.match?(BUCKET)
+
+      "#{PREFIX}#{bucket}"
+    end
+
+    # Declare a bucket; the first put does so too. settings are topic
+    # settings, e.g. retention: '1d' to drop tombstones after a day.
+    def create(bucket, engine: Shortbus.engine, **settings)
+      topic = topic(bucket)
+
+      begin
+        Shortbus.topics.create(topic, **settings.merge(compact: true))
+      rescue TopicError
+        raise unless Shortbus.topics.exists?(topic)
+        raise TopicError, "Bucket #{bucket} is not compacted: #{topic} already exists" unless Shortbus.topics.compacted?(topic)
+      end
+
+      engine.create_topic(topic)
+      Shortbus.topics.get(topic)
+    end
+
+    def buckets
+      Shortbus.topics.all.filter_map do |name, settings|
+        name.delete_prefix(PREFIX) if name.start_with?(PREFIX) && settings[:compact]
+      end.sort
+    end
+
+    def put(bucket, key, value, metadata: {}, engine: Shortbus.engine)
+      write(bucket, key, value.to_s, metadata:, engine:)
+    end
+
+    # Returns the tombstone's entry, whether or not the key was set
+    def delete(bucket, key, metadata: {}, engine: Shortbus.engine)
+      write(bucket, key, '', metadata: metadata.merge(tombstone: true), engine:)
+    end
+
+    # The key's entry, or nil if it was never set or has been deleted
+    def get(bucket, key, engine: Shortbus.engine)
+      entries(bucket, engine:)[key.to_s]
+    end
+
+    def keys(bucket, engine: Shortbus.engine)
+      entries(bucket, engine:).keys.sort
+    end
+
+    # { key => entry } for every live key
+    def entries(bucket, engine: Shortbus.engine)
+      topic = topic(bucket)
+      latest = {}
+      offset = 0
+
+      loop do
+        messages = engine.fetch_messages(topic, offset:, limit: BATCH)
+        break if messages.empty?
+
+        messages.each do |message|
+          key = message.dig(:metadata, :key)
+          latest[key.to_s] = message if key
+        end
+
+        offset = messages.last[:id] + 1
+        break if messages.size < BATCH
+      end
+
+      latest.reject { |_key, message| message.dig(:metadata, :tombstone) }
+            .transform_values { |message| entry(bucket, message) }
+    end
+
+    # A bucket topic's message as an entry, e.g. for watchers
+    def entry(bucket, message)
+      metadata = message[:metadata] || {}
+
+      {
+        bucket: bucket.to_s,
+        key: metadata[:key].to_s,
+        value: metadata[:tombstone] ? nil : message[:payload].to_s,
+        revision: message[:offset] || message[:id],
+        operation: metadata[:tombstone] ? 'delete' : 'put',
+        updated_at: DeliverPolicy.message_time(message)&.utc&.iso8601(3)
+      }.compact
+    end
+
+    private
+
+    def write(bucket, key, value, metadata:, engine:)
+      topic = topic(bucket)
+      raise ArgumentError, "Invalid key: #{key.inspect}" unless key.to_s.match?(KEY)
+
+      create(bucket, engine:) unless Shortbus.topics.exists?(topic)
+
+      result = engine.publish(topic, value, metadata: metadata.merge(key: key.to_s))
+      entry(bucket, {
+        id: result[:offset],
+        payload: value,
+        metadata: metadata.merge(key: key.to_s),
+        timestamp: result[:timestamp]
+      })
+    end
+  end
+end
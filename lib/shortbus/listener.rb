@@ -0,0 +1,207 @@
+module Shortbus
+  # Pipe mode over a socket
+  #
+  # `shortbus listen` accepts connections on a unix socket (the rendezvous's
+  # shortbus.sock by default) or a TCP port, optionally over TLS, and gives
+  # each one its own `shortbus pipe` process, copying lines both ways. Every
+  # connection is still one pipe-mode process, so what the rendezvous knows
+  # about connections (liveness, pending messages, sessions) holds as is.
+  #
+  # A client may open with a connect line standing in for pipe's flags:
+  #
+  #   {"op": "connect", "name": "billing", "durable": "billing", "session_timeout": "60s"}
+  #   {"op": "connect", "name": "ticker", "outbound_buffer": "1MB", "slow_consumer": "drop"}
+  #
+  # Any other first line goes straight through as the first command. With
+  # auth providers (config/auth.yml, SHORTBUS_TOKEN, or --token; see Auth)
+  # the connection must authenticate, with credentials on the connect line
+  #
+  #   {"op": "connect", "name": "billing", "token": "..."}
+  #   {"op": "connect", "username": "alice", "password": "..."}
+  #
+  # or a client certificate (--tls-ca); anything else gets an error and the
+  # connection is closed. The pipe process is told who connected, and
+  # refuses what that identity isn't permitted.
+  #
+  # Example:
+  #   Shortbus::Listener.new.run!                                     # shortbus+unix://ROOT/shortbus.sock
+  #   Shortbus::Listener.new(port: 7070, tls_cert: 'cert.pem', tls_key: 'key.pem').run!
+  #   Shortbus::Listener.new(port: 7070, tls_cert: 'cert.pem', tls_key: 'key.pem', tls_ca: 'clients.pem').run!
+  class Listener
+    CONNECT_FLAGS = {
+      name: '--name',
+      durable: '--durable',
+      session_timeout: '--session-timeout',
+      outbound_buffer: '--outbound-buffer',
+      slow_consumer: '--slow-consumer'
+    }.freeze
+
+    attr_reader :socket, :port, :bind
+
+    def initialize(socket: nil, port: nil, bind: '127.0.0.1', tls_cert: nil, tls_key: nil, tls_ca: nil, token: nil, auth: nil, command: nil)
+      @port = port && Integer(port)
+      @socket = socket ? Pathname.new(socket.to_s) : (Shortbus.config.socket_path unless @port)
+      @bind = bind
+      @tls_cert = tls_cert
+      @tls_key = tls_key
+      @tls_ca = tls_ca
+      @providers = auth || Auth.providers
+      @providers = [Auth::TokenProvider.new(token:), *@providers] if token
+      @command = command || [RbConfig.ruby, File.expand_path($PROGRAM_NAME), 'pipe']
+      @running = false
+
+      raise ArgumentError, "Listen on a socket or a port, not both" if @socket && @port
+      raise ArgumentError, "TLS needs a port" if tls? && @socket
+      raise ArgumentError, "TLS needs both a certificate and a key" if (@tls_cert || @tls_key) && !tls?
+      raise ArgumentError, "Client certificates (--tls-ca) need TLS" if @tls_ca && !tls?
+    end
+
+    def tls?
+      !@tls_cert.nil? && !@tls_key.nil?
+    end
+
+    # The connection string clients Dial
+    def url
+      return "shortbus+unix://#{socket}" if socket
+
+      "shortbus://#{bind}:#{port}#{'?tls=1' if tls?}"
+    end
+
+    def run!
+      @server = listen
+      @running = true
+      tls_context if tls?
+
+      trap('TERM') { @running = false }
+      trap('INT') { @running = false }
+
+      Shortbus.info "shortbus listening on #{url}"
+
+      while @running
+        next unless IO.select([@server], nil, nil, 0.5)
+
+        client = @server.accept_nonblock(exception: false)
+        Thread.new(client) { |io| serve(io) } unless client == :wait_readable
+      end
+    ensure
+      @server&.close
+      FileUtils.rm_f(socket) if socket && @server
+    end
+
+    def stop!
+      @running = false
+    end
+
+    private
+
+    def listen
+      return TCPServer.new(bind, port) unless socket
+
+      FileUtils.mkdir_p(socket.dirname)
+      raise ArgumentError, "Another listener is already on #{socket}" if live_socket?
+
+      FileUtils.rm_f(socket)
+      UNIXServer.new(socket.to_s)
+    end
+
+    # A socket file left behind by a listener that died refuses connections
+    def live_socket?
+      return false unless socket.exist?
+
+      UNIXSocket.new(socket.to_s).close
+      true
+    rescue Errno::ECONNREFUSED, Errno::ENOENT
+      false
+    end
+
+    def serve(io)
+      io = tls_accept(io) if tls?
+      first = io.gets
+      return unless first
+
+      flags, first, principal = connect_flags(first, io.respond_to?(:peer_cert) ? io.peer_cert : nil)
+      return refuse(io) unless flags
+
+      env = { 'SHORTBUS_ROOT' => File.expand_path(Shortbus.root.to_s) }
+      env['SHORTBUS_IDENTITY'] = JSON.generate(principal.to_h) if principal
+
+      stdin, stdout, child = Open3.popen2(env, *@command, *flags)
+
+      # Broker logs go to the listener's stderr, which the child inherits
+      stdin.write(first) if first
+      stdin.flush
+
+      upstream = Thread.new do
+        IO.copy_stream(io, stdin)
+      rescue IOError, SystemCallError, OpenSSL::SSL::SSLError
+        nil
+      ensure
+        stdin.close unless stdin.closed?
+      end
+
+      IO.copy_stream(stdout, io)
+    rescue IOError, SystemCallError, OpenSSL::SSL::SSLError => e
+      Shortbus.debug "Connection closed: #{e.message}"
+    ensure
+      io.close unless io.closed?
+      upstream&.join(1)
+      child&.value
+    end
+
+    def tls_accept(io)
+      socket = OpenSSL::SSL::SSLSocket.new(io, tls_context)
+      socket.sync_close = true
+      socket.accept
+    end
+
+    # Built once, before the first connection
+    def tls_context
+      @tls_context ||= begin
+        context = OpenSSL::SSL::SSLContext.new
+        context.cert = OpenSSL::X509::Certificate.new(File.read(@tls_cert))
+        context.key = OpenSSL::PKey.read(File.read(@tls_key))
+
+        # Asked for, not required: clients without one can still use a token
+        if @tls_ca
+          context.cert_store = OpenSSL::X509::Store.new.tap { |store| store.add_file(@tls_ca) }
+          context.verify_mode = OpenSSL::SSL::VERIFY_PEER
+        end
+
+        context
+      end
+    end
+
+    # pipe flags from a connect line, the line to pass on (nil for a connect
+    # line, which pipe mode wouldn't understand), and who authenticated; no
+    # flags at all when the client didn't
+    def connect_flags(line, peer_cert = nil)
+      command = parse(line)
+      connect = command[:op] == 'connect'
+
+      unless @providers.empty?
+        credentials = (connect ? command.slice(:token, :username, :user, :password) : {})
+        credentials[:peer_cert] = peer_cert if peer_cert
+
+        principal = Auth.authenticate(credentials, @providers)
+        return [nil, nil, nil] unless principal
+      end
+
+      return [[], line, principal] unless connect
+
+      flags = CONNECT_FLAGS.flat_map { |key, flag| command[key] ? [flag, command[key].to_s] : [] }
+      [flags, nil, principal]
+    end
+
+    def refuse(io)
+      io.puts(JSON.generate(type: :error, error: 'Unauthorized: connect with valid credentials'))
+      io.flush
+    end
+
+    def parse(line)
+      command = JSON.parse(line, symbolize_names: true)
+      command.is_a?(Hash) ? command : {}
+    rescue JSON::ParserError
+      {}
+    end
+  end
+end
@@ -0,0 +1,143 @@
+module Shortbus
+  # Leases on named locks
+  #
+  # For fleets that need exactly one worker doing something: a lock is held
+  # by one owner at a time, for a TTL it must keep renewing; if the holder
+  # dies, the lock is free again once the TTL lapses. Leases live in
+  # locks.json inside the rendezvous, updated under a file lock:
+  #
+  #   { "locks": { "billing.reconcile": { "name": "billing.reconcile", "owner": "worker-3", "token": 7,
+  #                                       "connection_id": "9f1c...", "acquired_at": "...", "expires_at": "..." } },
+  #     "tokens": { "billing.reconcile": 7 } }
+  #
+  # Each acquisition gets the next token for its name: a fencing token, so
+  # whatever the holder writes to can refuse a stale holder's writes (one
+  # that paused past its TTL) by comparing tokens. Re-acquiring a lock the
+  # same owner holds extends it, keeping its token.
+  #
+  # Leader election is acquiring with a TTL and renewing at a fraction of
+  # it; whoever fails to acquire retries until the lock is released or
+  # lapses (the Go client's Campaign does both).
+  #
+  # Example:
+  #   lease = Shortbus.locks.acquire('billing.reconcile', owner: 'worker-3', ttl: '30s')  # nil if held
+  #   Shortbus.locks.renew('billing.reconcile', token: lease[:token], ttl: 30)           # nil if lost
+  #   Shortbus.locks.release('billing.reconcile', token: lease[:token])
+  class Locks
+    DEFAULT_TTL = 30
+
+    attr_reader :config
+
+    def initialize(config: Shortbus.config)
+      @config = config
+    end
+
+    # The new lease, or nil while someone else holds the lock
+    def acquire(name, owner:, ttl: DEFAULT_TTL, connection_id: nil)
+      name = name.to_s
+      ttl = ttl!(ttl)
+      raise ArgumentError, "Missing name" if name.empty?
+      raise ArgumentError, "Missing owner" if owner.to_s.empty?
+
+      now = Time.now
+
+      locked do |state|
+        held = state[:locks][name.to_sym]
+
+        if held.nil?
+          token = state[:tokens][name.to_sym].to_i + 1
+          state[:tokens][name.to_sym] = token
+          state[:locks][name.to_sym] = {
+            name: name,
+            owner: owner.to_s,
+            token: token,
+            connection_id: connection_id,
+            acquired_at: now.utc.iso8601(3),
+            expires_at: (now + ttl).utc.iso8601(3)
+          }.compact
+        elsif held[:owner] == owner.to_s && held[:connection_id] == connection_id
+          held[:expires_at] = (now + ttl).utc.iso8601(3)
+          held
+        end
+      end
+    end
+
+    # Extend a lease; nil if it has lapsed or the lock has changed hands
+    def renew(name, token:, ttl: DEFAULT_TTL)
+      ttl = ttl!(ttl)
+
+      locked do |state|
+        held = state[:locks][name.to_s.to_sym]
+        next nil unless held && held[:token] == Integer(token)
+
+        held[:expires_at] = (Time.now + ttl).utc.iso8601(3)
+        held
+      end
+    end
+
+    # Returns whether the lease still held the lock
+    def release(name, token:)
+      locked do |state|
+        held = state[:locks][name.to_s.to_sym]
+        next false unless held && held[:token] == Integer(token)
+
+        state[:locks].delete(name.to_s.to_sym)
+        true
+      end
+    end
+
+    # Release every lock a connection holds, e.g. when it closes; returns
+    # their names
+    def release_connection(connection_id)
+      locked do |state|
+        names = state[:locks].select { |_name, lease| lease[:connection_id] == connection_id }.keys
+        names.each { |name| state[:locks].delete(name) }
+        names.map(&:to_s)
+      end
+    end
+
+    # The lease holding name, if any
+    def get(name)
+      list.find { |lease| lease[:name] == name.to_s }
+    end
+
+    # Live leases, by name
+    def list
+      locked { |state| state[:locks].values }.sort_by { |lease| lease[:name] }
+    end
+
+    def path
+      config.locks_file
+    end
+
+    private
+
+    def ttl!(ttl)
+      ttl = Shortbus.parse_duration(ttl)
+      raise ArgumentError, "ttl must be positive" unless ttl.positive?
+
+      ttl
+    end
+
+    # Lapsed leases are dropped on the way in; tokens are kept for good
+    def locked
+      FileUtils.mkdir_p(path.dirname)
+
+      File.open(path, File::RDWR | File::CREAT, 0o644) do |file|
+        file.flock(File::LOCK_EX)
+        json = file.read
+        state = json.strip.empty? ? {} : JSON.parse(json, symbolize_names: true)
+        state = { locks: state[:locks] || {}, tokens: state[:tokens] || {} }
+
+        now = Time.now
+        state[:locks].reject! { |_name, lease| Time.iso8601(lease[:expires_at]) <= now }
+        result = yield state
+
+        file.rewind
+        file.truncate(0)
+        file.write(JSON.generate(state))
+        result
+      end
+    end
+  end
+end
@@ -0,0 +1,60 @@
+module Shortbus
+  # Broker-assigned message ids
+  #
+  # Every publish gets a UUIDv7 (RFC 9562): 48 bits of Unix milliseconds,
+  # then random bits, so ids are unique across topics, brokers and
+  # rendezvous, and sort by when they were published. Within one process ids
+  # from the same millisecond still sort in publish order: the 12 bits after
+  # the version count up from a random start.
+  #
+  # The id is stamped as an annotation when the broker accepts a publish and
+  # travels with the message from then on, through archives, imports and
+  # requeues; deliveries carry it as message_id. The engine's integer id
+  # remains the message's offset within its topic, which is what positions
+  # (commit, start_sequence, peek) are counted in.
+  #
+  # Example:
+  #   id = Shortbus::MessageId.generate   # => "01927c4e-8f3a-7d21-9c0e-5b7a2f1e4d3c"
+  #   Shortbus::MessageId.time(id)        # => 2024-10-11 15:59:36.25 UTC
+  module MessageId
+    PATTERN = /\A\h{8}-\h{4}-7\h{3}-[89ab]\h{3}-\h{12}\z/i
+
+    @mutex = Mutex.new
+    @last = [0, 0]
+
+    def generate(now = Time.now)
+      ms = (now.to_r * 1000).to_i
+
+      ms, counter = @mutex.synchronize do
+        last_ms, last_counter = @last
+        # Never step backwards, even if the clock does
+        @last =
+          if ms <= last_ms && last_counter < 0xfff
+            [last_ms, last_counter + 1]
+          elsif ms <= last_ms
+            [last_ms + 1, SecureRandom.random_number(0x800)]
+          else
+            [ms, SecureRandom.random_number(0x800)]
+          end
+      end
+
+      random = SecureRandom.random_bytes(8).unpack1('Q>')
+      hex = format('%012x%04x%016x', ms, 0x7000 | counter, (random & 0x3fff_ffff_ffff_ffff) | 0x8000_0000_0000_0000)
+
+      "#{hex[0, 8]}-#{hex[8, 4]}-#{hex[12, 4]}-#{hex[16, 4]}-#{hex[20, 12]}"
+    end
+
+    def valid?(id)
+      id.is_a?(String) && PATTERN.match?(id)
+    end
+
+    # When the message was published
+    def time(id)
+      raise ArgumentError, "Not a message id: #{id.inspect}" unless valid?(id)
+
+      Time.at(Rational(Integer(id.delete('-')[0, 12], 16), 1000)).utc
+    end
+
+    extend self
+  end
+end
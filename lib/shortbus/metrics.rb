@@ -0,0 +1,341 @@
+module Shortbus
+  # Per-topic publish metrics, for finding producers that abuse the bus
+  #
+  # Publishes through pipe mode and the HTTP gateway are counted in
+  # metrics/TOPIC.json:
+  #
+  #   { "published": 1200, "bytes": 96000, "max_size": 4096,
+  #     "sizes": { "256": 900, "1024": 280, "4096": 20 },
+  #     "producers": { "billing": { "published": 1000, "bytes": 80000 } },
+  #     "schema_failures": 3, "last_schema_error": "payload missing: amount",
+  #     "metadata_values": { "region": ["9f2c...", ...] } }
+  #
+  # Deliveries are measured too: each message the broker hands out (pushed to
+  # a subscriber, fetched, or polled over HTTP) is stamped with an
+  # annotations.delivered_at, and the time since its received_at goes into
+  # an end-to-end latency histogram for the topic and one per consumer group:
+  #
+  #     "latency": { "count": 40, "sum_ms": 912, "buckets": { "8": 31, "64": 9 } },
+  #     "group_latency": { "workers": { "count": 25, ... } }
+  #
+  # Latency buckets double from 1ms (LATENCY_BUCKETS), so a few dozen cover
+  # everything from a hot path to a backlog hours deep; redeliveries count
+  # again, from the original publish.
+  #
+  # sizes is a payload size histogram keyed by each bucket's upper bound in
+  # bytes ("inf" past the last). Metadata values are kept as short digests,
+  # at most CARDINALITY_CAP per key, and reported as a count per key: a key
+  # at the cap (a request id where a region was meant, say) stands out.
+  #
+  # Counts are buffered in each process and merged into the file at most
+  # once per FLUSH_INTERVAL, so a publish doesn't pay for a locked write.
+  #
+  # prometheus renders every topic's metrics in the Prometheus text format,
+  # as the HTTP gateway serves them on GET /metrics, under the EXPORTED
+  # names; Dashboard builds its Grafana panels and alert rules from those.
+  #
+  # Example:
+  #   Shortbus.metrics.record('orders', payload, metadata: { published_by: 'billing' })
+  #   Shortbus.metrics.flush!
+  #   Shortbus.metrics.get('orders')  # => { published: 1, sizes: { "256": 1 }, metadata_keys: {}, ... }
+  #
+  #   msg = Shortbus.metrics.delivered('orders', msg, group: 'workers')
+  #   Shortbus.metrics.percentile(Shortbus.metrics.get('orders')[:latency], 0.99)  # => 64 (ms, a bucket bound)
+  class Metrics
+    SIZE_BUCKETS = [256, 1024, 4096, 16_384, 65_536, 262_144, 1_048_576].freeze
+    LATENCY_BUCKETS = (0..24).map { |power| 2**power }.freeze # ms, up to ~4.7h
+    CARDINALITY_CAP = 1000
+    MAX_KEYS = 100
+    FLUSH_INTERVAL = 1
+
+    # What prometheus exports each count as: counters, and histograms (with
+    # _bucket, _sum and _count series) for payload sizes and latencies
+    EXPORTED = {
+      published: 'shortbus_published_total',
+      bytes: 'shortbus_published_bytes_total',
+      schema_failures: 'shortbus_schema_failures_total',
+      sizes: 'shortbus_payload_size_bytes',
+      latency: 'shortbus_delivery_latency_seconds',
+      group_latency: 'shortbus_group_delivery_latency_seconds'
+    }.freeze
+
+    # Stamped by the broker or unique by design, so they say nothing about
+    # how producers use metadata
+    BROKER_KEYS = %i[_annotations published_by deadline priority transient signal job_id dedupe_key].freeze
+
+    attr_reader :config
+
+    def initialize(config: Shortbus.config)
+      @config = config
+      @pending = {}
+      @mutex = Mutex.new
+      @flushed_at = Time.now
+    end
+
+    # Count a publish
+    def record(topic, payload, metadata: {})
+      size = payload.to_s.bytesize
+      producer = (metadata[:published_by] || 'anonymous').to_s.to_sym
+
+      @mutex.synchronize do
+        counts = pending(topic)
+        counts[:published] += 1
+        counts[:bytes] += size
+        counts[:max_size] = [counts[:max_size], size].max
+        counts[:sizes][bucket(size)] += 1
+
+        usage = counts[:producers][producer] ||= { published: 0, bytes: 0 }
+        usage[:published] += 1
+        usage[:bytes] += size
+
+        metadata.each do |key, value|
+          next if BROKER_KEYS.include?(key.to_sym)
+
+          (counts[:metadata_values][key.to_sym] ||= []) << digest(value)
+        end
+      end
+
+      flush! if Time.now - @flushed_at >= FLUSH_INTERVAL
+    end
+
+    # Count a publish refused by the topic's schema
+    def schema_failure(topic, error)
+      @mutex.synchronize do
+        counts = pending(topic)
+        counts[:schema_failures] += 1
+        counts[:last_schema_error] = error
+      end
+
+      flush! if Time.now - @flushed_at >= FLUSH_INTERVAL
+    end
+
+    # msg stamped with when it was handed out, its latency since the broker
+    # received it counted for the topic and, given one, the consumer group
+    def delivered(topic, msg, group: nil, now: Time.now)
+      received_at = received_time(msg)
+      msg = Annotations.annotate(msg, delivered_at: now.utc.iso8601(3))
+      return msg unless received_at
+
+      latency = [((now - received_at) * 1000).round, 0].max
+
+      @mutex.synchronize do
+        counts = pending(topic)
+        observe(counts[:latency], latency)
+        observe(counts[:group_latency][group.to_s.to_sym] ||= histogram, latency) if group
+      end
+
+      flush! if Time.now - @flushed_at >= FLUSH_INTERVAL
+      msg
+    end
+
+    # Upper bound in ms of the bucket holding the q quantile (0-1) of a
+    # latency histogram, nil for an empty one. Past the last bucket it is
+    # the last bound.
+    def percentile(latency, q)
+      return nil unless latency && latency[:count].to_i.positive?
+
+      rank = (latency[:count] * q).ceil.clamp(1, latency[:count])
+      seen = 0
+      buckets = latency[:buckets].sort_by { |bound, _| bound.to_s == 'inf' ? Float::INFINITY : bound.to_s.to_i }
+
+      buckets.each do |bound, count|
+        seen += count
+        return bound.to_s == 'inf' ? LATENCY_BUCKETS.last : bound.to_s.to_i if seen >= rank
+      end
+
+      LATENCY_BUCKETS.last
+    end
+
+    # Merge buffered counts into metrics/; safe from any process
+    def flush!
+      pending = @mutex.synchronize do
+        @flushed_at = Time.now
+        @pending.tap { @pending = {} }
+      end
+
+      pending.each do |topic, counts|
+        locked(topic) { |stored| merge(stored, counts) }
+      rescue => e
+        Shortbus.warn "Failed to record metrics for #{topic}: #{e.message}"
+      end
+    end
+
+    # A topic's metrics as flushed so far, with metadata cardinality
+    def get(topic)
+      stored = read(topic)
+      values = stored.delete(:metadata_values) || {}
+
+      { topic: topic.to_s, published: 0, bytes: 0, max_size: 0, sizes: {}, producers: {}, schema_failures: 0,
+        latency: histogram, group_latency: {} }
+        .merge(stored)
+        .merge(metadata_keys: values.transform_values(&:size))
+    end
+
+    # Every topic with metrics
+    def all
+      config.metrics_dir.glob('*.json').map { |path| get(path.basename('.json').to_s) }
+    end
+
+    def reset!(topic)
+      FileUtils.rm_f(path(topic))
+    end
+
+    # metrics (every topic's, by default) in the Prometheus text format
+    def prometheus(metrics = all)
+      lines = []
+
+      counter(lines, :published, 'Messages published', metrics) { |metric| metric[:published] }
+      counter(lines, :bytes, 'Payload bytes published', metrics) { |metric| metric[:bytes] }
+      counter(lines, :schema_failures, "Publishes refused by the topic's schema", metrics) { |metric| metric[:schema_failures] }
+
+      family(lines, :sizes, 'histogram', 'Payload size of publishes')
+      metrics.each do |metric|
+        buckets(lines, :sizes, { topic: metric[:topic] }, metric[:sizes], SIZE_BUCKETS, count: metric[:published], sum: metric[:bytes])
+      end
+
+      family(lines, :latency, 'histogram', 'Time from the broker receiving a message to handing it out')
+      metrics.each do |metric|
+        latency(lines, :latency, { topic: metric[:topic] }, metric[:latency])
+      end
+
+      family(lines, :group_latency, 'histogram', 'Time from the broker receiving a message to handing it to a consumer group')
+      metrics.each do |metric|
+        metric[:group_latency].each { |group, histogram| latency(lines, :group_latency, { topic: metric[:topic], group: group }, histogram) }
+      end
+
+      lines.join("\n") + "\n"
+    end
+
+    private
+
+    def pending(topic)
+      @pending[topic.to_s] ||= {
+        published: 0, bytes: 0, max_size: 0, sizes: Hash.new(0), producers: {},
+        metadata_values: {}, schema_failures: 0, last_schema_error: nil,
+        latency: histogram, group_latency: {}
+      }
+    end
+
+    def family(lines, name, type, help)
+      lines << "# HELP #{EXPORTED.fetch(name)} #{help}" << "# TYPE #{EXPORTED.fetch(name)} #{type}"
+    end
+
+    def counter(lines, name, help, metrics)
+      family(lines, name, 'counter', help)
+      metrics.each { |metric| lines << "#{EXPORTED.fetch(name)}#{labels(topic: metric[:topic])} #{yield metric}" }
+    end
+
+    def latency(lines, name, series, histogram)
+      buckets(lines, name, series, histogram[:buckets], LATENCY_BUCKETS, count: histogram[:count], sum: histogram[:sum_ms] / 1000.0, scale: 1000.0)
+    end
+
+    # Cumulative _bucket series from counts keyed by upper bound, each bound
+    # divided by scale (ms into seconds)
+    def buckets(lines, name, series, counts, bounds, count:, sum:, scale: 1)
+      base = EXPORTED.fetch(name)
+      seen = 0
+
+      bounds.each do |bound|
+        seen += counts.to_h[bound.to_s.to_sym].to_i
+        lines << "#{base}_bucket#{labels(**series, le: bound / scale)} #{seen}"
+      end
+      lines << "#{base}_bucket#{labels(**series, le: '+Inf')} #{count}"
+      lines << "#{base}_sum#{labels(**series)} #{sum}" << "#{base}_count#{labels(**series)} #{count}"
+    end
+
+    def labels(**labels)
+      pairs = labels.map { |key, value| %(#{key}="#{value.to_s.gsub(/[\\"\n]/) { |char| char == "\n" ? '\n' : "\\#{char}" }}") }
+      "{#{pairs.join(',')}}"
+    end
+
+    def received_time(msg)
+      at = msg.dig(:annotations, :received_at)
+      at && Time.iso8601(at)
+    rescue ArgumentError
+      nil
+    end
+
+    def histogram
+      { count: 0, sum_ms: 0, buckets: Hash.new(0) }
+    end
+
+    def observe(histogram, latency)
+      histogram[:count] += 1
+      histogram[:sum_ms] += latency
+      histogram[:buckets][(LATENCY_BUCKETS.find { |bound| latency <= bound } || 'inf').to_s.to_sym] += 1
+    end
+
+    def add_histograms(was, now)
+      was ||= {}
+      { count: was[:count].to_i + now[:count], sum_ms: was[:sum_ms].to_i + now[:sum_ms], buckets: add(was[:buckets], now[:buckets]) }
+    end
+
+    def bucket(size)
+      (SIZE_BUCKETS.find { |bound| size <= bound } || 'inf').to_s.to_sym
+    end
+
+    def digest(value)
+      OpenSSL::Digest::SHA256.hexdigest(JSON.generate(value))[0, 12]
+    end
+
+    def merge(stored, counts)
+      stored = stored.merge(
+        published: stored[:published].to_i + counts[:published],
+        bytes: stored[:bytes].to_i + counts[:bytes],
+        max_size: [stored[:max_size].to_i, counts[:max_size]].max,
+        sizes: add(stored[:sizes], counts[:sizes]),
+        producers: (stored[:producers] || {}).merge(counts[:producers]) { |_, was, now| add(was, now) },
+        schema_failures: stored[:schema_failures].to_i + counts[:schema_failures],
+        latency: add_histograms(stored[:latency], counts[:latency]),
+        group_latency: (stored[:group_latency] || {}).merge(counts[:group_latency]) { |_, was, now| add_histograms(was, now) }
+      )
+      stored[:last_schema_error] = counts[:last_schema_error] if counts[:last_schema_error]
+
+      values = stored[:metadata_values] || {}
+      counts[:metadata_values].each do |key, digests|
+        next unless values.key?(key) || values.size < MAX_KEYS
+
+        values[key] = (Array(values[key]) | digests).first(CARDINALITY_CAP)
+      end
+
+      stored.merge(metadata_values: values)
+    end
+
+    def add(was, now)
+      (was || {}).merge(now) { |_, a, b| a.to_i + b.to_i }
+    end
+
+    def path(topic)
+      raise ArgumentError, "Invalid topic name: #{topic.inspect}" unless topic.to_s =~ /\A[A-Za-z0-9_.\-]+\z/
+
+      config.metrics_dir / "#{topic}.json"
+    end
+
+    def read(topic)
+      return {} unless path(topic).exist?
+
+      parse(File.read(path(topic)))
+    end
+
+    # The block gets the stored metrics and returns the new ones
+    def locked(topic)
+      FileUtils.mkdir_p(config.metrics_dir)
+
+      File.open(path(topic), File::RDWR | File::CREAT, 0o644) do |file|
+        file.flock(File::LOCK_EX)
+        metrics = yield parse(file.read)
+
+        file.rewind
+        file.truncate(0)
+        file.write(JSON.generate(metrics))
+        file.flush
+      end
+    end
+
+    def parse(json)
+      json.to_s.strip.empty? ? {} : JSON.parse(json, symbolize_names: true)
+    rescue JSON::ParserError
+      {}
+    end
+  end
+end
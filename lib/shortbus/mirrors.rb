@@ -0,0 +1,104 @@
+module Shortbus
+  # Shadow topics: a copy of a topic's traffic for canary consumers
+  #
+  # A topic with mirror set has the daemon copy what is published to it into
+  # the shadow topic, all of it or a mirror_sample fraction, so a new version
+  # of a consumer can run against real traffic in its own group on the shadow
+  # while production consumers, their groups and offsets, never see it:
+  #
+  #   shortbus topic update orders --mirror orders.canary                      # everything
+  #   shortbus topic update orders --mirror orders.canary --mirror-sample 10%
+  #
+  # Copies keep their payload, metadata and message_id, and carry
+  # mirrored_from and original_id in metadata. Sampling is by the message's
+  # ordering key when it has one, else its message_id, so a keyed stream is
+  # mirrored whole or not at all. The daemon reads each mirrored topic from
+  # where its last pass stopped, kept in mirrors/TOPIC.json; a new mirror
+  # starts at the topic's head rather than copying its backlog.
+  class Mirrors
+    BATCH = 500
+    BUCKETS = 10_000
+
+    attr_reader :config
+
+    def initialize(config: Shortbus.config, engine: Shortbus.engine, topics: Shortbus.topics)
+      @config = config
+      @engine = engine
+      @topics = topics
+    end
+
+    # Copy what each mirrored topic (or just topic) has gained; returns
+    # { topic => copies made }
+    def mirror!(topic = nil)
+      names = topic ? [topic.to_s] : @topics.all.keys
+
+      names.each_with_object({}) do |name, copied|
+        settings = @topics.get(name) || {}
+        shadow = settings[:mirror]
+        next unless shadow
+        next if shadow == name
+
+        copied[name] = locked(name) { |state| copy!(name, shadow, settings.fetch(:mirror_sample, 1.0), state) }
+      end
+    end
+
+    # Whether msg is one of the sample fraction that is mirrored; the same
+    # message (or key) always gets the same answer
+    def self.sampled?(msg, sample)
+      return true if sample >= 1
+      return false if sample <= 0
+
+      key = msg.dig(:metadata, :key) || msg[:message_id] || msg[:id]
+      Zlib.crc32(key.to_s) % BUCKETS < sample * BUCKETS
+    end
+
+    def path(topic)
+      config.mirrors_dir / "#{topic}.json"
+    end
+
+    private
+
+    def copy!(name, shadow, sample, state)
+      state[:offset] ||= DeliverPolicy.start_offset(name, 'new', engine: @engine)
+      copied = 0
+
+      loop do
+        messages = @engine.fetch_messages(name, offset: state[:offset], limit: BATCH, tiered: false)
+        break if messages.empty?
+
+        messages.each do |msg|
+          next unless Mirrors.sampled?(msg, sample)
+
+          metadata = (msg[:metadata] || {}).merge(mirrored_from: name, original_id: msg[:id])
+          annotations = msg[:message_id] ? { message_id: msg[:message_id] } : {}
+          @engine.publish(shadow, msg[:payload], metadata:, annotations:)
+          copied += 1
+        end
+
+        # Kept even when a publish fails, so a retry repeats at most a batch
+        state[:offset] = messages.last[:id] + 1
+        break if messages.size < BATCH
+      end
+
+      copied
+    end
+
+    def locked(topic)
+      FileUtils.mkdir_p(config.mirrors_dir)
+
+      File.open(path(topic), File::RDWR | File::CREAT, 0o644) do |file|
+        file.flock(File::LOCK_EX)
+        json = file.read
+        state = json.strip.empty? ? {} : JSON.parse(json, symbolize_names: true)
+
+        begin
+          yield state
+        ensure
+          file.rewind
+          file.truncate(0)
+          file.write(JSON.generate(state))
+        end
+      end
+    end
+  end
+end
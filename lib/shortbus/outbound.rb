@@ -0,0 +1,172 @@
+module Shortbus
+  # Outbound frames of one pipe-mode connection
+  #
+  # Every response pipe mode sends is a line on stdout. Frames queue here and
+  # a writer thread sends them on, whatever has queued since its last write
+  # going out together in one writev. A chatty topic would otherwise cost a
+  # write (and, through `shortbus listen`, a socket send) per message. With
+  # SHORTBUS_WRITE_COALESCE_MS set, the writer also waits that long for more:
+  #
+  #   SHORTBUS_WRITE_COALESCE_MS=2    # a frame waits at most 2ms
+  #
+  # A queue reaching MAX_BATCH bytes goes out without waiting out the
+  # interval, and close writes whatever is left.
+  #
+  # The queue holds at most SHORTBUS_OUTBOUND_BUFFER bytes (default 8MB; the
+  # connect line's outbound_buffer, or pipe's --outbound-buffer, per
+  # connection). A consumer reading slower than its frames arrive fills it,
+  # and SHORTBUS_SLOW_CONSUMER (or slow_consumer) says what happens then:
+  #
+  #   block         senders wait for room, slowing deliveries to its pace (default)
+  #   drop          deliveries that don't fit are dropped; replies still queue
+  #   disconnect    the connection is closed, so its subscriptions' messages
+  #                 wait in the engine, or go to other group members
+  #
+  # high_watermark is the fullest the queue has been, reported with the
+  # connection (see PipeMode) so the buffer can be sized from what bursts
+  # actually need.
+  #
+  # Example:
+  #   outbound = Shortbus::Outbound.new($stdout, buffer: 1 << 20, policy: 'drop')
+  #   outbound.<<(JSON.generate(type: :message, topic: 'ticks', payload: '1'), delivery: true)
+  #   outbound.close
+  class Outbound
+    MAX_BATCH = 64 * 1024  # bytes queued before writing early
+    MAX_IOV = 512  # frames per writev; Linux allows 1024
+    POLICIES = %w[block drop disconnect].freeze
+
+    attr_reader :interval, :buffer, :policy, :frames, :writes, :dropped, :high_watermark
+
+    def self.normalize(value)
+      case value.to_s.strip.downcase
+      when '', 'block' then 'block'
+      when 'drop' then 'drop'
+      when 'disconnect', 'close' then 'disconnect'
+      else raise ArgumentError, "slow_consumer must be one of: #{POLICIES.join(', ')}"
+      end
+    end
+
+    # on_slow is called, on the sending thread, each time a frame finds the
+    # buffer full
+    def initialize(io, interval_ms: Shortbus.config.write_coalesce_ms, buffer: Shortbus.config.outbound_buffer,
+                   policy: Shortbus.config.slow_consumer, on_slow: nil)
+      @io = io
+      @interval = interval_ms.to_i / 1000.0
+      @buffer = Shortbus.parse_size(buffer)
+      @policy = Outbound.normalize(policy)
+      @on_slow = on_slow
+      @queue = []
+      @queued = 0  # bytes in @queue
+      @buffered = 0  # those plus the batch being written
+      @high_watermark = 0
+      @frames = 0  # written so far
+      @writes = 0  # write calls they took
+      @dropped = 0
+      @closed = false
+      @error = nil  # why the writer stopped, raised to the next sender
+      @mutex = Mutex.new
+      @wake = ConditionVariable.new  # frames to write
+      @room = ConditionVariable.new  # a batch was written
+      @write_lock = Mutex.new  # keeps batches in order
+      @writer = nil
+    end
+
+    # Queue line, a frame without its newline. Deliveries are the frames
+    # drop may discard; false when one is.
+    def <<(line, delivery: false)
+      frame = "#{line}\n"
+
+      full = @mutex.synchronize do
+        raise @error if @error
+
+        overflowing = @buffered.positive? && @buffered + frame.bytesize > @buffer
+        if overflowing && @policy == 'block' && !@closed
+          @room.wait(@mutex) while @buffered.positive? && @buffered + frame.bytesize > @buffer && !@error && !@closed
+          raise @error if @error
+        end
+
+        if overflowing && @policy == 'drop' && delivery
+          @dropped += 1
+        else
+          @queue << frame
+          @queued += frame.bytesize
+          @buffered += frame.bytesize
+          @high_watermark = @buffered if @buffered > @high_watermark
+          @writer ||= Thread.new { write_loop } unless @closed
+          @wake.signal if @queue.size == 1 || @queued >= MAX_BATCH
+        end
+        overflowing
+      end
+
+      @on_slow&.call(self) if full
+      flush! if @closed
+      !(full && @policy == 'drop' && delivery)
+    end
+
+    # Bytes queued or being written
+    def buffered
+      @mutex.synchronize { @buffered }
+    end
+
+    # Write whatever is queued now
+    def flush!
+      @write_lock.synchronize do
+        batch = @mutex.synchronize do
+          queued, @queue, @queued = @queue, [], 0
+          queued
+        end
+        next if batch.empty?
+
+        begin
+          write(batch)
+        ensure
+          @mutex.synchronize do
+            @buffered -= batch.sum(&:bytesize)
+            @room.broadcast
+          end
+        end
+      end
+    end
+
+    # Write what's queued and stop the writer; later frames go straight out
+    def close
+      writer = @mutex.synchronize do
+        @closed = true
+        @wake.signal
+        @room.broadcast
+        @writer
+      end
+      writer&.join
+      flush!
+    end
+
+    private
+
+    def write_loop
+      loop do
+        @mutex.synchronize do
+          @wake.wait(@mutex) while @queue.empty? && !@closed
+          return if @queue.empty?
+
+          # Give the rest of the interval's frames a chance to join
+          @wake.wait(@mutex, @interval) if @interval.positive? && !@closed && @queued < MAX_BATCH
+        end
+        flush!
+      end
+    rescue IOError, SystemCallError => e
+      @mutex.synchronize do
+        @error = e
+        @room.broadcast
+      end
+    end
+
+    def write(batch)
+      batch.each_slice(MAX_IOV) do |slice|
+        @io.write(*slice)
+        @writes += 1
+      end
+      @io.flush
+      @frames += batch.size
+    end
+  end
+end
@@ -0,0 +1,139 @@
+require_relative '../shortbus'
+
+module Shortbus
+  # Transactional outbox relay
+  #
+  # Services that must commit database state and events together write the
+  # event to an outbox table in the same database transaction, and let this
+  # relay publish it afterwards:
+  #
+  #   CREATE TABLE outbox (
+  #     id           BIGSERIAL PRIMARY KEY,   -- INTEGER PRIMARY KEY AUTOINCREMENT on SQLite
+  #     topic        TEXT NOT NULL,
+  #     payload      TEXT NOT NULL,
+  #     metadata     TEXT,                    -- JSON object, optional
+  #     dedupe_key   TEXT,                    -- defaults to outbox:<table>:<id>
+  #     published_at TIMESTAMP
+  #   );
+  #
+  # Rows are published in id order and marked published_at afterwards. Each
+  # publish carries the row's dedupe key, so a relay that crashes between
+  # publishing and marking (or two relays racing on the same row) doesn't
+  # produce a second message as long as the retry lands inside the dedupe
+  # window (SHORTBUS_DEDUPE_WINDOW).
+  #
+  # Example:
+  #   require 'shortbus/outbox'
+  #
+  #   outbox = Shortbus::Outbox.new(PG.connect(ENV['DATABASE_URL']))
+  #   outbox.run!                  # relay forever
+  #   outbox.relay!(limit: 100)    # or one batch, returning the count
+  #
+  # The connection may be a PG::Connection, Mysql2::Client, or
+  # SQLite3::Database; anything else can be wrapped in a callable taking
+  # (sql, params) and returning rows as hashes.
+  class Outbox
+    DIALECTS = %i[postgres mysql sqlite].freeze
+
+    attr_reader :table, :dialect
+
+    def initialize(connection, table: 'outbox', dialect: nil, engine: Shortbus.engine, dedupe: Shortbus::Dedupe.new)
+      raise ArgumentError, "Invalid table name: #{table.inspect}" unless table.to_s =~ /\A[A-Za-z_][A-Za-z0-9_.]*\z/
+
+      @connection = connection
+      @table = table.to_s
+      @dialect = (dialect || detect_dialect(connection)).to_sym
+      @engine = engine
+      @dedupe = dedupe
+      @running = false
+
+      raise ArgumentError, "Unknown dialect: #{@dialect} (expected one of #{DIALECTS.join(', ')})" unless DIALECTS.include?(@dialect)
+    end
+
+    # Publish up to limit unpublished rows, returning how many went out. Stops
+    # at the first failure so rows are never published out of order.
+    def relay!(limit: 100)
+      rows = query("SELECT id, topic, payload, metadata, dedupe_key FROM #{table} " \
+                   "WHERE published_at IS NULL ORDER BY id LIMIT #{Integer(limit)}")
+
+      rows.each do |row|
+        publish(row)
+        query("UPDATE #{table} SET published_at = CURRENT_TIMESTAMP WHERE id = #{placeholder(1)}", [row['id']])
+      end
+
+      rows.size
+    end
+
+    # Relay until stopped, sleeping interval seconds whenever the table is empty
+    def run!(interval: 1, limit: 100)
+      @running = true
+
+      while @running
+        begin
+          sleep interval if relay!(limit:).zero?
+        rescue => e
+          Shortbus.error "Outbox relay failed: #{e.message}"
+          sleep interval
+        end
+      end
+    end
+
+    def stop!
+      @running = false
+    end
+
+    private
+
+    def publish(row)
+      row = row.transform_keys(&:to_s)
+      topic = row['topic']
+      key = row['dedupe_key'] || "outbox:#{table}:#{row['id']}"
+
+      metadata = row['metadata'].to_s.empty? ? {} : JSON.parse(row['metadata'])
+      metadata = metadata.merge('dedupe_key' => key, 'outbox_id' => row['id'])
+
+      @dedupe.publish(topic, key) do
+        @engine.publish(topic, row['payload'], metadata: metadata, annotations: { origin: "outbox:#{table}" })
+      end
+    end
+
+    def query(sql, params = [])
+      rows =
+        if @connection.respond_to?(:call)
+          @connection.call(sql, params)
+        else
+          case dialect
+          when :postgres then @connection.exec_params(sql, params).to_a
+          when :mysql then @connection.prepare(sql).execute(*params)&.to_a
+          when :sqlite then sqlite_query(sql, params)
+          end
+        end
+
+      rows.to_a.map { |row| row.transform_keys(&:to_s) }
+    end
+
+    # SQLite returns arrays unless results_as_hash is set; don't depend on it
+    def sqlite_query(sql, params)
+      statement = @connection.prepare(sql)
+      rows = statement.execute(*params).to_a
+      columns = statement.columns
+      statement.close
+
+      rows.map { |row| row.is_a?(Hash) ? row : columns.zip(row).to_h }
+    end
+
+    def placeholder(n)
+      dialect == :postgres ? "$#{n}" : '?'
+    end
+
+    def detect_dialect(connection)
+      case connection.class.name
+      when /\APG::/ then :postgres
+      when /\AMysql2::/ then :mysql
+      when /\ASQLite3::/ then :sqlite
+      else
+        raise ArgumentError, "Cannot detect SQL dialect for #{connection.class}; pass dialect:"
+      end
+    end
+  end
+end
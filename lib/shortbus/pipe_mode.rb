@@ -21,7 +21,20 @@ module Shortbus
   #   stdout, _ := cmd.StdoutPipe()
   #   ...
   class PipeMode
-    def initialize
+    # Version of the protocol, announced in ready; each has its captures in
+    # conformance/ (see Conformance), and the broker keeps passing them all
+    PROTOCOL = 1
+
+    # Seconds a client should wait before reconnecting after server_shutdown
+    RECONNECT_AFTER = 1
+
+    # Ops a read-only broker refuses before they reach the engine
+    READ_ONLY_REFUSED = (Auth::PUBLISH_OPS + %w[purge delete_message requeue create_topic update_topic delete_topic inbox new_inbox append append_to_stream acquire lock]).freeze
+    # Ops that write only for some actions: op => those actions
+    READ_ONLY_ACTIONS = { 'kv' => %w[put delete create], '$sys.schedules' => %w[add remove], 'schedules' => %w[add remove] }.freeze
+
+    def initialize(name: ENV['SHORTBUS_CLIENT_NAME'], durable: nil, session_timeout: nil, principal: Auth::Identity.from_env,
+                   outbound_buffer: nil, slow_consumer: nil)
       @running = false
       @subscribers = Hash.new { |h, k| h[k] = [] }
       @stdin = $stdin
@@ -29,32 +42,133 @@ module Shortbus
       @stderr = $stderr
       @file_watcher_started = false
       @offsets = Hash.new(0)  # Track message offsets per topic
+      @delivered = Hash.new(0)  # Messages delivered per topic since subscribing
+      @limits = {}  # Auto-unsubscribe after N deliveries, per topic
+      @paused = {}  # Topics whose delivery is on hold (messages left unfetched)
+      @windows = {}  # max_in_flight per topic: unacked deliveries allowed at once
+      @in_flight = Hash.new { |h, k| h[k] = [] }  # Delivered, unacked ids per windowed topic
+      @in_flight_ids = Hash.new { |h, k| h[k] = {} }  # Their message_ids => ids, so acks may use either
+      @credits = {}  # Deliveries the client has granted, per credit-mode topic
+      @partitioned = {}  # Keyed group subscriptions: topic => { group:, partitions:, owned: }
+      @groups = {}  # Group each group subscription belongs to, for operator pauses
+      @queues = {}  # Queue group subscriptions: topic => { group:, ack: }
+      @filters = {}  # Metadata filter per topic: only matching messages are delivered
+      @sequences = {}  # gaps: true topics => { read:, delivered: } offsets, for gap reports
+      @delivery = Monitor.new  # Guards the above: watchers, the input thread and the reaper all deliver
+      @connection_id = SecureRandom.hex(8)
+      @principal = principal  # Who the listener authenticated (see Auth), nil when unchecked
+      @name = name || principal&.name
+      @limiter = Auth::RateLimit.new(principal&.limits)
+      @durable = durable  # Durable session name, if resuming across reconnects
+      @session_timeout = session_timeout ? Shortbus.parse_duration(session_timeout) : Shortbus.config.session_timeout
+      @restored = []  # Session topics held until the client re-subscribes
+      @transactions = {}  # Transaction id => staged messages, until commit
+      @will = nil  # Published if the client goes away without saying goodbye
+      @announced = false  # Registered in Presence, so leaves it on the way out
+      @leased = false  # Has acquired locks, released on the way out
+      @workers = []  # In-flight request threads (fetch), finished before exit
+      @draining = false
+      @shutdown = false
+      @outbound = Outbound.new(@stdout, buffer: outbound_buffer || Shortbus.config.outbound_buffer,
+                                        policy: slow_consumer || Shortbus.config.slow_consumer,
+                                        on_slow: method(:slow_consumer!))  # Responses come from several threads
+      @reported_watermark = 0  # Outbound high watermark last written to the connection's entry
+      @slow_at = nil  # When a full buffer was last logged
+      @slow_disconnect = false  # Closing under the disconnect policy
     end
 
     def run!
       @running = true
 
+      # stdout carries the protocol, so broker logs go to stderr where the
+      # client can capture them. Warnings and errors are always on.
+      Shortbus.log!(@stderr)
+      Shortbus.logger.level = Logger::WARN unless Shortbus.config.log? || Shortbus.debug?
+
       # Start file watcher for reactive notifications
       start_file_watcher!
 
+      Shortbus.connections.register(@connection_id, name: @name)
+      report_outbound!
+
       # Send ready signal
-      send_response(status: :ready, version: Shortbus.version)
+      send_response({
+        status: :ready,
+        protocol: PROTOCOL,
+        version: Shortbus.version,
+        connection_id: @connection_id,
+        name: @name,
+        durable: @durable,
+        expires_at: @principal&.expires_at
+      }.compact)
+
+      restore_session! if @durable
+
+      # SIGTERM drains and hands clients off instead of dropping them
+      trap_signals!
+
+      # Reap ephemeral topics once their grace period lapses
+      start_reaper!
 
       # Start input processor thread
       input_thread = Thread.new { process_input }
 
       # Keep alive
       input_thread.join
+      shutdown!
     rescue Interrupt
       shutdown!
     rescue => e
       send_error("Fatal error: #{e.message}")
+      @outbound.close
       raise
     end
 
-    def shutdown!
+    # Graceful handoff: refuse new publishes, let in-flight requests finish,
+    # persist session state, tell the client when to reconnect, then exit
+    def drain!(reason: :sigterm, timeout: Shortbus.config.drain_timeout)
+      return if @draining || @shutdown
+      @draining = true
+
+      deadline = Time.now + timeout
+      @workers.each { |worker| worker.join([deadline - Time.now, 0].max) }
+
+      save_session!
+
+      send_response({
+        type: :server_shutdown,
+        reason: reason,
+        reconnect_after: RECONNECT_AFTER,
+        durable: @durable
+      }.compact)
+
+      shutdown!
+    end
+
+    # goodbye: the client asked to close, so its last will is dropped; a
+    # drain hands the client off rather than losing it, so drops it too
+    def shutdown!(request_id: nil, goodbye: false)
+      return if @shutdown
+      @shutdown = true
       @running = false
 
+      # Gone without a goodbye (stdin closed, broker error): publish the will
+      if @will && !goodbye && !@draining
+        Shortbus.connections.publish_will({ id: @connection_id, name: @name, will: @will })
+      end
+
+      # Durable sessions keep their state for the session timeout
+      Shortbus.sessions.release(@durable, session_state) if @durable
+
+      # Leave every topic so ephemeral ones can be reaped
+      @subscribers.keys.each { |topic| leave_topic(topic) }
+      reap_topics!
+      Shortbus.connections.unregister(@connection_id)
+      Shortbus.presence.disconnect(@connection_id) if @announced
+      Shortbus.locks.release_connection(@connection_id) if @leased
+      Shortbus.metrics.flush!
+      Shortbus.group_commit.flush!
+
       # Stop file watcher
       begin
         Shortbus.file_watcher.stop! if @file_watcher_started
@@ -62,11 +176,27 @@ module Shortbus
         # Ignore shutdown errors
       end
 
-      send_response(status: :shutdown)
+      send_response({ status: :shutdown, request_id: request_id }.compact)
+      @outbound.close
     end
 
     private
 
+    # Handlers only flip a flag; Logger and Mutex aren't usable in trap context
+    def trap_signals!
+      @term_requested = false
+      trap('TERM') { @term_requested = true }
+
+      Thread.new do
+        sleep 0.1 until @term_requested || @shutdown
+
+        if @term_requested
+          drain!
+          Thread.main.raise(Interrupt)
+        end
+      end
+    end
+
     def process_input
       @stdin.each_line do |line|
         line = line.strip
@@ -88,25 +218,165 @@ module Shortbus
 
     def handle_command(cmd)
       op = cmd[:op] || cmd[:command]
+      return unless op == 'refresh_token' || authorized?(op, cmd)
+      return if read_only_refused?(op, cmd)
 
       case op
       when 'publish', 'pub'
         handle_publish(cmd)
 
+      when 'signal'
+        handle_signal(cmd)
+
       when 'subscribe', 'sub'
         handle_subscribe(cmd)
 
       when 'unsubscribe', 'unsub'
         handle_unsubscribe(cmd)
 
+      when 'auto_unsubscribe'
+        handle_auto_unsubscribe(cmd)
+
+      when 'fetch', 'pull'
+        handle_fetch(cmd)
+
+      when 'enqueue'
+        handle_enqueue(cmd)
+
+      when 'await'
+        handle_await(cmd)
+
+      when 'job'
+        handle_job(cmd)
+
+      when 'begin', 'begin_transaction'
+        handle_begin(cmd)
+
+      when 'commit_transaction'
+        handle_commit_transaction(cmd)
+
+      when 'rollback', 'rollback_transaction'
+        handle_rollback(cmd)
+
+      when 'commit'
+        cmd[:txn] ? handle_commit_transaction(cmd) : handle_commit(cmd)
+
+      when 'ack'
+        handle_ack(cmd)
+
+      when 'touch', 'extend'
+        handle_touch(cmd)
+
+      when 'nack'
+        handle_nack(cmd)
+
+      when 'pending'
+        handle_pending(cmd)
+
+      when 'claim'
+        handle_claim(cmd)
+
+      when 'credit'
+        handle_credit(cmd)
+
+      when 'pause_group'
+        handle_pause_group(cmd)
+
+      when 'resume_group'
+        handle_resume_group(cmd)
+
+      when 'drain_group'
+        handle_drain_group(cmd)
+
+      when 'pause'
+        handle_pause(cmd)
+
+      when 'resume'
+        handle_resume(cmd)
+
+      when 'peek', 'browse'
+        handle_peek(cmd)
+
+      when 'purge'
+        handle_purge(cmd)
+
+      when 'delete_message'
+        handle_delete_message(cmd)
+
+      when 'requeue'
+        handle_requeue(cmd)
+
       when 'list_topics', 'topics'
         handle_list_topics(cmd)
 
+      when 'describe_topics', 'discover'
+        handle_describe_topics(cmd)
+
+      when 'metrics'
+        handle_metrics(cmd)
+
+      when 'create_topic'
+        handle_create_topic(cmd)
+
+      when 'update_topic'
+        handle_update_topic(cmd)
+
+      when 'delete_topic'
+        handle_delete_topic(cmd)
+
+      when 'get_topic', 'topic'
+        handle_get_topic(cmd)
+
+      when 'inbox', 'new_inbox'
+        handle_new_inbox(cmd)
+
+      when 'hello', 'identify'
+        handle_hello(cmd)
+
+      when 'announce', 'heartbeat'
+        handle_announce(cmd)
+
+      when 'leave'
+        handle_leave(cmd)
+
+      when 'presence'
+        handle_presence(cmd)
+
+      when 'acquire', 'lock'
+        handle_acquire(cmd)
+
+      when 'renew'
+        handle_renew(cmd)
+
+      when 'release', 'unlock'
+        handle_release(cmd)
+
+      when 'locks'
+        handle_locks(cmd)
+
+      when '$sys.schedules', 'schedules'
+        handle_schedules(cmd)
+
+      when 'kv'
+        handle_kv(cmd)
+
+      when 'append', 'append_to_stream'
+        handle_append(cmd)
+
+      when 'read_stream'
+        handle_read_stream(cmd)
+
+      when 'connections'
+        handle_connections(cmd)
+
       when 'ping'
         handle_ping(cmd)
 
+      when 'refresh_token'
+        handle_refresh_token(cmd)
+
       when 'shutdown', 'quit', 'exit'
-        shutdown!
+        shutdown!(request_id: cmd[:request_id], goodbye: true)
 
       else
         send_error("Unknown operation: #{op}", command: cmd)
@@ -122,25 +392,221 @@ module Shortbus
 
       raise ArgumentError, "Missing topic" unless topic
       raise ArgumentError, "Missing payload" unless payload
+      TopicEvents.authorize!(topic)
+      Shortbus.topic_creation.check!(topic)
+      refuse_while_draining!
 
-      result = Shortbus.engine.publish(topic, payload, metadata: metadata)
+      # Stamped by the broker (overriding any client-supplied value) so it can
+      # be trusted for auditing
+      metadata = metadata.merge(published_by: identity)
 
-      send_response(
+      # Ordering key: same key, same partition, same consumer, in order
+      metadata = metadata.merge(key: cmd[:key].to_s) if cmd[:key]
+
+      # Past this, subscribers and fetches skip the message; ttl is the same
+      # thing measured from now
+      metadata = Shortbus.deadlines.stamp(metadata, deadline: cmd[:deadline], deadline_in: cmd[:deadline_in] || cmd[:ttl])
+
+      # Group fetches hand out higher priorities first
+      metadata = metadata.merge(priority: Integer(cmd[:priority])) if cmd[:priority]
+
+      # persist: false messages are dropped at retention rather than archived
+      metadata = metadata.merge(transient: true) if cmd[:persist] == false
+
+      # Refused unless it fits the topic's schema; refusals count as schema
+      # failures, and publishes count only once written
+      Schema.check!(topic, payload, metadata)
+      Shortbus.signatures.check!(topic, payload, metadata)
+
+      # max_depth is checked where the message is written: at the route's
+      # destination (see Routes#publish), at the topic itself for a
+      # compare-and-publish or delay, and for a transaction at commit
+
+      # Compare-and-publish: refused unless the topic's last message is still
+      # at this sequence; staged and delayed publishes have no head to check
+      expected = cmd[:expected_last_sequence]
+      if !expected.nil? && (cmd[:txn] || cmd[:delay] || cmd[:deliver_at])
+        raise ArgumentError, "expected_last_sequence can't be used with txn or delay"
+      end
+
+      return stage(cmd, topic, payload, metadata) if cmd[:txn]
+      return report_job(cmd, topic, payload, metadata) if Jobs.result_for(topic)
+
+      # A repeated dedupe key gets the original message id back
+      metadata = metadata.merge(dedupe_key: cmd[:dedupe_key].to_s) if cmd[:dedupe_key]
+
+      return hold(cmd, topic, payload, metadata) if cmd[:delay] || cmd[:deliver_at]
+
+      result = Shortbus.dedupe.publish(topic, cmd[:dedupe_key]) do
+        if expected.nil?
+          Shortbus.routes.publish(topic, payload, metadata: metadata)
+        else
+          Admin.check_depth!(topic)
+          Shortbus.heads.publish(topic, expected) { Shortbus.engine.publish(topic, payload, metadata: metadata) }
+        end
+      end
+      acked_after = Shortbus.group_commit.commit!(Routes.written(topic, result))
+      Shortbus.metrics.record(topic, payload, metadata:)
+
+      send_response({
         status: :ok,
         op: :published,
         topic: topic,
         message_id: result[:message_id],
+        offset: result[:offset],
+        moved_to: result[:moved_to],
+        copied_to: result[:copied_to],
+        duplicate: result[:duplicate],
+        acked_after: acked_after,
         request_id: cmd[:request_id]
-      )
+      }.compact)
 
+    rescue ConflictError => e
+      send_error("Publish failed: #{e.message}", command: cmd, conflict: true, last_sequence: e.current)
     rescue => e
       send_error("Publish failed: #{e.message}", command: cmd)
     end
 
+    # Delayed publishes are held for the daemon to publish once due (see
+    # Delays); there is no message id until then
+    def hold(cmd, topic, payload, metadata)
+      Admin.check_depth!(topic)
+      held = Shortbus.delays.hold(topic, payload, metadata:, delay: cmd[:delay], deliver_at: cmd[:deliver_at])
+      Shortbus.metrics.record(topic, payload, metadata:)
+
+      send_response(status: :ok, op: :delayed, topic: topic, delayed_id: held[:id], due_at: held[:due_at], request_id: cmd[:request_id])
+    end
+
+    # Workers publish to result.JOBID; the broker records it on the job
+    # instead of writing a message
+    def report_job(cmd, topic, payload, metadata)
+      id = Jobs.result_for(topic)
+      job = Shortbus.jobs.report(id, payload, metadata:)
+      Shortbus.metrics.record(topic, payload, metadata:)
+
+      send_response(status: :ok, op: :reported, job_id: id, state: job[:state], request_id: cmd[:request_id])
+    end
+
+    # Headers-only publish: no payload on the wire in either direction
+    def handle_signal(cmd)
+      topic = cmd[:topic] || cmd[:t]
+      metadata = cmd[:metadata] || cmd[:meta] || {}
+
+      raise ArgumentError, "Missing topic" unless topic
+      TopicEvents.authorize!(topic)
+      Shortbus.topic_creation.check!(topic)
+      refuse_while_draining!
+
+      metadata = metadata.merge(published_by: identity, signal: true)
+      Schema.check!(topic, '', metadata)
+      Shortbus.signatures.check!(topic, '', metadata)
+
+      result = Shortbus.routes.publish(topic, '', metadata: metadata)
+      acked_after = Shortbus.group_commit.commit!(Routes.written(topic, result))
+      Shortbus.metrics.record(topic, '', metadata:)
+
+      send_response({
+        status: :ok,
+        op: :signaled,
+        topic: topic,
+        message_id: result[:message_id],
+        offset: result[:offset],
+        moved_to: result[:moved_to],
+        copied_to: result[:copied_to],
+        acked_after: acked_after,
+        request_id: cmd[:request_id]
+      }.compact)
+    rescue => e
+      send_error("Signal failed: #{e.message}", command: cmd)
+    end
+
+    # Transactions: publishes carrying a txn id are held here until commit
+
+    def handle_begin(cmd)
+      refuse_while_draining!
+
+      txn = SecureRandom.hex(8)
+      @transactions[txn] = []
+
+      send_response(status: :ok, op: :begun, txn: txn, request_id: cmd[:request_id])
+    rescue => e
+      send_error("Begin failed: #{e.message}", command: cmd)
+    end
+
+    def stage(cmd, topic, payload, metadata)
+      staged = @transactions[cmd[:txn]]
+      raise ArgumentError, "Unknown transaction: #{cmd[:txn]}" unless staged
+
+      # Counted at commit: a rolled back or abandoned one was never published
+      staged << { topic: topic, payload: payload, metadata: metadata }
+
+      send_response(
+        status: :ok,
+        op: :staged,
+        topic: topic,
+        txn: cmd[:txn],
+        staged: staged.size,
+        request_id: cmd[:request_id]
+      )
+    end
+
+    def handle_commit_transaction(cmd)
+      txn = cmd[:txn]
+      raise ArgumentError, "Missing txn" unless txn
+      refuse_while_draining!
+
+      staged = @transactions.delete(txn)
+      raise ArgumentError, "Unknown transaction: #{txn}" unless staged
+
+      # All or nothing: refused if any topic can't take its share
+      staged.map { |message| message[:topic] }.tally.each { |topic, count| Admin.check_depth!(topic, adding: count) }
+
+      results = Shortbus.transactions.commit(txn, staged)
+      acked_after = Shortbus.group_commit.commit!(staged.map { |message| message[:topic] })
+      staged.each { |message| Shortbus.metrics.record(message[:topic], message[:payload], metadata: message[:metadata]) }
+
+      send_response(
+        status: :ok,
+        op: :committed,
+        txn: txn,
+        message_ids: results.map { |result| result[:message_id] },
+        offsets: results.map { |result| result[:offset] },
+        acked_after: acked_after,
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Commit failed: #{e.message}", command: cmd)
+    end
+
+    def handle_rollback(cmd)
+      txn = cmd[:txn]
+      raise ArgumentError, "Missing txn" unless txn
+
+      staged = @transactions.delete(txn)
+      raise ArgumentError, "Unknown transaction: #{txn}" unless staged
+
+      send_response(status: :ok, op: :rolled_back, txn: txn, discarded: staged.size, request_id: cmd[:request_id])
+    rescue => e
+      send_error("Rollback failed: #{e.message}", command: cmd)
+    end
+
+    def refuse_while_draining!
+      raise EngineError, "Broker shutting down, retry after reconnecting" if @draining
+    end
+
     def handle_subscribe(cmd)
       topic = cmd[:topic] || cmd[:t]
       raise ArgumentError, "Missing topic" unless topic
 
+      Inbox.authorize!(topic, @connection_id)
+      validate_subscribe!(cmd)
+
+      # Subscribing with ephemeral: true declares a throwaway topic that is
+      # deleted once its last subscriber leaves
+      if cmd[:ephemeral] && !Shortbus.topics.exists?(topic)
+        Shortbus.topics.create(topic, ephemeral: true, grace_period: cmd[:grace_period])
+      end
+
       # Create topic if doesn't exist
       begin
         Shortbus.engine.create_topic(topic)
@@ -148,18 +614,85 @@ module Shortbus
         # Ignore if already exists
       end
 
-      # Add to subscribers
-      @subscribers[topic] << {
-        request_id: cmd[:request_id],
-        offset: cmd[:offset] || 0
-      }
+      Shortbus.subscribers.add(topic, @connection_id)
+      Shortbus.connections.update(@connection_id, subscriptions: @subscribers.keys | [topic])
 
-      send_response(
+      # Start position: an explicit offset, a deliver policy, else the
+      # group's committed one
+      @delivery.synchronize do
+        if cmd[:offset]
+          @offsets[topic] = Integer(cmd[:offset])
+        elsif cmd[:deliver]
+          @offsets[topic] = DeliverPolicy.start_offset(
+            topic,
+            cmd[:deliver],
+            start_time: cmd[:start_time],
+            start_sequence: cmd[:start_sequence]
+          )
+        elsif cmd[:group]
+          @offsets[topic] = Shortbus.groups.offset(topic, cmd[:group])
+        end
+        @groups[topic] = cmd[:group].to_s if cmd[:group]
+
+        # queue_group: members share the topic, each message going to just one
+        # of them; with manual_ack it stays pending until acked
+        if cmd[:queue_group]
+          @queues[topic] = { group: cmd[:queue_group].to_s, ack: cmd[:manual_ack] == true }
+          @groups[topic] = cmd[:queue_group].to_s
+        end
+
+        @filters[topic] = cmd[:filter] if cmd[:filter]
+
+        # gaps: true reports messages the topic lost before this subscription
+        # read them, and stamps deliveries with the one sent before
+        @sequences[topic] ||= { read: nil, delivered: nil } if cmd[:gaps]
+
+        # Group members on a keyed topic share partitions instead of each
+        # reading everything
+        if cmd[:group] && (cmd[:partitioned] || Shortbus.topics.keyed?(topic))
+          @partitioned[topic] = { group: cmd[:group].to_s, partitions: Shortbus.topics.partitions(topic), owned: [] }
+          Shortbus.groups.join(topic, cmd[:group], @connection_id)
+        end
+
+        # Re-subscribing to a resumed session topic releases its hold
+        @paused.delete(topic) if @restored.delete(topic) && !cmd[:paused]
+
+        # Add to subscribers
+        @delivered[topic] = 0 unless subscribed?(topic)
+        @subscribers[topic] << {
+          request_id: cmd[:request_id],
+          offset: cmd[:offset] || 0
+        }
+
+        # max: N tears the subscription down after N deliveries
+        @limits[topic] = Integer(cmd[:max]) if cmd[:max]
+
+        # max_in_flight: N holds delivery while N messages are unacked
+        if (window = cmd[:max_in_flight] || cmd[:prefetch])
+          window = Integer(window)
+          raise ArgumentError, "max_in_flight must be positive" unless window > 0
+          @windows[topic] = window
+        end
+
+        # credits: N switches to credit flow control; the client grants more
+        # with the credit op as it catches up
+        @credits[topic] = Integer(cmd[:credits]) if cmd[:credits]
+      end
+
+      send_response({
         status: :ok,
         op: :subscribed,
         topic: topic,
+        max_in_flight: @windows[topic],
+        credits: @credits[topic],
+        queue_group: @queues.dig(topic, :group),
+        manual_ack: cmd[:manual_ack] == true || nil,
+        filter: @filters[topic],
+        gaps: @sequences.key?(topic) || nil,
         request_id: cmd[:request_id]
-      )
+      }.compact)
+
+      save_session!
 
       # Start watching for messages
       start_message_watcher(topic)
@@ -168,11 +701,24 @@ module Shortbus
       send_error("Subscribe failed: #{e.message}", command: cmd)
     end
 
+    def validate_subscribe!(cmd)
+      raise ArgumentError, "queue_group can't be combined with group" if cmd[:queue_group] && cmd[:group]
+      raise ArgumentError, "gaps needs a subscription that reads the whole topic" if cmd[:gaps] && (cmd[:queue_group] || cmd[:partitioned])
+      raise ArgumentError, "gaps can't be tracked on a compacted topic" if cmd[:gaps] && Shortbus.topics.compacted?(cmd[:topic] || cmd[:t])
+      raise ArgumentError, "filter must be an object" if cmd[:filter] && !cmd[:filter].is_a?(Hash)
+
+      if cmd[:manual_ack] && !cmd[:queue_group] && !(cmd[:max_in_flight] || cmd[:prefetch])
+        raise ArgumentError, "manual_ack needs queue_group or max_in_flight"
+      end
+    end
+
     def handle_unsubscribe(cmd)
       topic = cmd[:topic] || cmd[:t]
       raise ArgumentError, "Missing topic" unless topic
 
-      @subscribers.delete(topic)
+      leave_topic(topic)
+      reap_topics!
+      save_session!
 
       send_response(
         status: :ok,
@@ -182,110 +728,1439 @@ module Shortbus
       )
     end
 
-    def handle_list_topics(cmd)
-      topics = Shortbus.engine.list_topics
+    # Limit counts every delivery since subscribing, so a limit at or below
+    # what has already been delivered unsubscribes immediately
+    def handle_auto_unsubscribe(cmd)
+      topic = cmd[:topic] || cmd[:t]
+      max = cmd[:max]
 
-      send_response(
-        status: :ok,
-        op: :topics,
-        topics: topics,
-        request_id: cmd[:request_id]
-      )
+      raise ArgumentError, "Missing topic" unless topic
+      raise ArgumentError, "Missing max" unless max
+      raise ArgumentError, "Not subscribed to #{topic}" unless subscribed?(topic)
+
+      @delivery.synchronize do
+        @limits[topic] = Integer(max)
+
+        send_response(
+          status: :ok,
+          op: :auto_unsubscribe,
+          topic: topic,
+          max: @limits[topic],
+          delivered: @delivered[topic],
+          request_id: cmd[:request_id]
+        )
+
+        enforce_limit(topic)
+      end
     rescue => e
-      send_error("List topics failed: #{e.message}", command: cmd)
+      send_error("Auto-unsubscribe failed: #{e.message}", command: cmd)
     end
 
-    def handle_ping(cmd)
-      result = Shortbus.engine.ping
+    # Pull consumption: up to max messages for the group, waiting up to wait
+    # for at least one. Runs on its own thread so a long wait doesn't block
+    # the input loop.
+    def handle_fetch(cmd)
+      topic = cmd[:topic] || cmd[:t]
+      group = cmd[:group] || cmd[:g]
+
+      raise ArgumentError, "Missing topic" unless topic
+      raise ArgumentError, "Missing group" unless group
+
+      Inbox.authorize!(topic, @connection_id)
+
+      max = Integer(cmd[:max] || 1)
+      wait = Shortbus.parse_duration(cmd[:wait] || 0)
+
+      @workers.select!(&:alive?)
+      @workers << Thread.new do
+        stop = -> { !@running || @draining }
+        messages =
+          if cmd[:ack]
+            WorkQueue.fetch_acked(topic, group, consumer: @connection_id, max:, wait:, stop:)
+          else
+            WorkQueue.fetch(topic, group, max:, wait:, stop:)
+          end
+        messages = messages.map { |msg| Shortbus.metrics.delivered(topic, msg, group:) }
+
+        send_response(
+          status: :ok,
+          op: :fetched,
+          topic: topic,
+          group: group,
+          messages: messages,
+          request_id: cmd[:request_id]
+        )
+      rescue => e
+        send_error("Fetch failed: #{e.message}", command: cmd)
+      end
+    rescue => e
+      send_error("Fetch failed: #{e.message}", command: cmd)
+    end
+
+    # Jobs: a publish whose outcome the producer can await
+
+    def handle_enqueue(cmd)
+      topic = cmd[:topic] || cmd[:t]
+      payload = cmd[:payload] || cmd[:message] || cmd[:msg]
+      metadata = cmd[:metadata] || cmd[:meta] || {}
+
+      raise ArgumentError, "Missing topic" unless topic
+      raise ArgumentError, "Missing payload" unless payload
+      TopicEvents.authorize!(topic)
+      Shortbus.topic_creation.check!(topic)
+      refuse_while_draining!
+
+      metadata = metadata.merge(published_by: identity)
+      metadata = Shortbus.deadlines.stamp(metadata, deadline: cmd[:deadline], deadline_in: cmd[:deadline_in])
+      Schema.check!(topic, payload, metadata)
+      Shortbus.signatures.check!(topic, payload, metadata)
+      Admin.check_depth!(topic)
+
+      job = Shortbus.jobs.enqueue(topic, payload, metadata:)
+      Shortbus.metrics.record(topic, payload, metadata:)
 
       send_response(
         status: :ok,
-        op: :pong,
-        engine_status: result[:status],
+        op: :enqueued,
+        topic: topic,
+        job_id: job[:id],
+        message_id: job[:message_id],
         request_id: cmd[:request_id]
       )
     rescue => e
-      send_error("Ping failed: #{e.message}", command: cmd)
+      send_error("Enqueue failed: #{e.message}", command: cmd)
     end
 
-    def start_file_watcher!
-      return if @file_watcher_started
+    # Waits (on a worker thread, like fetch) for the job to finish
+    def handle_await(cmd)
+      id = cmd[:job_id] || cmd[:id]
+      raise ArgumentError, "Missing job_id" unless id
 
-      begin
-        Shortbus.file_watcher.start!
-        @file_watcher_started = true
+      wait = Shortbus.parse_duration(cmd[:wait] || 0)
+
+      @workers.select!(&:alive?)
+      @workers << Thread.new do
+        job = Shortbus.jobs.await(id, wait:, stop: -> { !@running || @draining })
+
+        send_response(status: :ok, op: :job, job_id: id, job: job, request_id: cmd[:request_id])
       rescue => e
-        Shortbus.warn "Failed to start file watcher: #{e.message}"
-        # Continue without file watcher (will use polling fallback)
+        send_error("Await failed: #{e.message}", command: cmd)
       end
+    rescue => e
+      send_error("Await failed: #{e.message}", command: cmd)
     end
 
-    def start_message_watcher(topic)
-      # Register file watcher callback for reactive notifications
-      if @file_watcher_started
-        Shortbus.file_watcher.on_change(topic) do |event|
-          fetch_and_send_messages(topic) if @running && @subscribers[topic].any?
-        end
-      end
+    def handle_job(cmd)
+      id = cmd[:job_id] || cmd[:id]
+      raise ArgumentError, "Missing job_id" unless id
 
-      # Initial fetch of existing messages
-      fetch_and_send_messages(topic)
+      job = Shortbus.jobs.get(id)
+      raise ArgumentError, "Unknown job: #{id}" unless job
 
-      # Fallback polling thread if file watcher isn't available
-      unless @file_watcher_started
-        Thread.new do
-          while @running && @subscribers[topic].any?
-            begin
-              fetch_and_send_messages(topic)
-              sleep 0.1  # Poll interval
-            rescue => e
-              send_error("Watcher error: #{e.message}", topic: topic)
-              break
-            end
-          end
-        end
-      end
+      send_response(status: :ok, op: :job, job_id: id, job: job, request_id: cmd[:request_id])
+    rescue => e
+      send_error("Job failed: #{e.message}", command: cmd)
     end
 
-    def fetch_and_send_messages(topic)
-      offset = @offsets[topic]
+    # Give messages back for redelivery after the topic's backoff (or an
+    # explicit delay)
+    def handle_nack(cmd)
+      topic = cmd[:topic] || cmd[:t]
+      group = cmd[:group] || cmd[:g]
+      ids = Array(cmd[:ids] || cmd[:id])
 
-      begin
-        messages = Shortbus.engine.fetch_messages(topic, offset: offset)
+      raise ArgumentError, "Missing topic" unless topic
+      raise ArgumentError, "Missing group" unless group
+      raise ArgumentError, "Missing ids" if ids.empty?
 
-        messages.each do |msg|
-          send_message(msg)
-          @offsets[topic] = [offset, msg[:id] + 1].max if msg[:id]
-        end
-      rescue => e
-        send_error("Fetch error: #{e.message}", topic: topic)
-      end
+      ids = resolve_ids(topic, group, ids)
+      result = WorkQueue.nack(topic, group, ids, error: cmd[:error], delay: cmd[:delay])
+
+      send_response({
+        status: :ok,
+        op: :nacked,
+        topic: topic,
+        group: group,
+        nacked: result[:nacked],
+        poisoned: result[:poisoned].any? ? result[:poisoned] : nil,
+        request_id: cmd[:request_id]
+      }.compact)
+    rescue => e
+      send_error("Nack failed: #{e.message}", command: cmd)
     end
 
-    def send_message(msg)
-      send_response(
+    # Free window slots and deliver whatever was waiting on them; returns how
+    # many of ids were in flight
+    def release_in_flight(topic, ids)
+      @delivery.synchronize do
+        return 0 unless @windows[topic]
+
+        in_flight = @in_flight[topic]
+        released = ids.count { |id| id.to_s.match?(/\A\d+\z/) && in_flight.delete(Integer(id)) }
+        @in_flight_ids[topic].select! { |_, id| in_flight.include?(id) } if released > 0
+        fetch_and_send_messages(topic) if released > 0
+
+        released
+      end
+    end
+
+    # ids as offsets: message_ids of pending group messages, or of
+    # deliveries in a push window, become the offsets they went out at
+    def resolve_ids(topic, group, ids)
+      ids = Shortbus.groups.resolve(topic, group, ids) if group
+      @delivery.synchronize { ids.map { |id| MessageId.valid?(id) ? @in_flight_ids[topic].fetch(id, id) : id } }
+    end
+
+    def window_full?(topic)
+      window = @windows[topic]
+      !window.nil? && @in_flight[topic].size >= window
+    end
+
+    # Grant more deliveries to a credit-mode subscription
+    def handle_credit(cmd)
+      topic = cmd[:topic] || cmd[:t]
+      credits = Integer(cmd[:credits] || cmd[:n] || 0)
+
+      raise ArgumentError, "Missing topic" unless topic
+      raise ArgumentError, "credits must be positive" unless credits > 0
+      granted = @delivery.synchronize do
+        raise ArgumentError, "Not subscribed to #{topic} with credits" unless subscribed?(topic) && @credits.key?(topic)
+
+        @credits[topic] += credits
+        fetch_and_send_messages(topic)
+        @credits[topic]
+      end
+
+      send_response(status: :ok, op: :credited, topic: topic, credits: granted, request_id: cmd[:request_id])
+    rescue => e
+      send_error("Credit failed: #{e.message}", command: cmd)
+    end
+
+    # Delivery stops when the client's window is full or its credits run out
+    def throttled?(topic)
+      window_full?(topic) || (@credits.key?(topic) && @credits[topic] <= 0)
+    end
+
+    def handle_commit(cmd)
+      topic = cmd[:topic] || cmd[:t]
+      group = cmd[:group] || cmd[:g]
+      offset = cmd[:offset]
+
+      raise ArgumentError, "Missing topic" unless topic
+      raise ArgumentError, "Missing group" unless group
+      raise ArgumentError, "Missing offset" unless offset
+
+      position = Shortbus.groups.commit(topic, group, offset)
+
+      send_response(
+        status: :ok,
+        op: :committed,
+        topic: topic,
+        group: group,
+        offset: position,
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Commit failed: #{e.message}", command: cmd)
+    end
+
+    # Acks pending group messages, and frees max_in_flight window slots on
+    # a push subscription
+    def handle_ack(cmd)
+      topic = cmd[:topic] || cmd[:t]
+      group = cmd[:group] || cmd[:g]
+      ids = Array(cmd[:ids] || cmd[:id])
+
+      raise ArgumentError, "Missing topic" unless topic
+      raise ArgumentError, "Missing group" unless group || @windows[topic]
+      raise ArgumentError, "Missing ids" if ids.empty?
+
+      ids = resolve_ids(topic, group, ids)
+      acked = group ? Shortbus.groups.ack(topic, group, ids) : 0
+      acked = [acked, release_in_flight(topic, ids)].max
+
+      send_response({
+        status: :ok,
+        op: :acked,
+        topic: topic,
+        group: group,
+        acked: acked,
+        request_id: cmd[:request_id]
+      }.compact)
+    rescue => e
+      send_error("Ack failed: #{e.message}", command: cmd)
+    end
+
+    # Keep this connection's claimed messages from being reclaimed while a
+    # long job is still being worked on
+    def handle_touch(cmd)
+      topic = cmd[:topic] || cmd[:t]
+      group = cmd[:group] || cmd[:g]
+      ids = Array(cmd[:ids] || cmd[:id])
+
+      raise ArgumentError, "Missing topic" unless topic
+      raise ArgumentError, "Missing group" unless group
+      raise ArgumentError, "Missing ids" if ids.empty?
+
+      ids = resolve_ids(topic, group, ids)
+      extend_by = cmd[:extend] && Shortbus.parse_duration(cmd[:extend])
+      touched = Shortbus.groups.touch(topic, group, ids, consumer: @connection_id, extend_by:)
+
+      send_response({
+        status: :ok,
+        op: :touched,
+        topic: topic,
+        group: group,
+        touched: touched,
+        visible_until: extend_by && (Time.now + extend_by).utc.iso8601(3),
+        request_id: cmd[:request_id]
+      }.compact)
+    rescue => e
+      send_error("Touch failed: #{e.message}", command: cmd)
+    end
+
+    # Operator pauses apply to every member of the group, in every process
+
+    def handle_pause_group(cmd)
+      topic, group = topic_and_group(cmd)
+      Shortbus.groups.pause(topic, group, by: identity)
+      audit(:pause_group, topic:, group:)
+
+      send_response(status: :ok, op: :group_paused, topic: topic, group: group, request_id: cmd[:request_id])
+    rescue => e
+      send_error("Pause group failed: #{e.message}", command: cmd)
+    end
+
+    def handle_resume_group(cmd)
+      topic, group = topic_and_group(cmd)
+      Shortbus.groups.resume(topic, group)
+      audit(:resume_group, topic:, group:)
+
+      send_response(status: :ok, op: :group_resumed, topic: topic, group: group, request_id: cmd[:request_id])
+    rescue => e
+      send_error("Resume group failed: #{e.message}", command: cmd)
+    end
+
+    # Waits (on a worker thread, like fetch) for in-flight messages to be acked
+    def handle_drain_group(cmd)
+      topic, group = topic_and_group(cmd)
+      wait = Shortbus.parse_duration(cmd[:wait] || 0)
+
+      @workers.select!(&:alive?)
+      audit(:drain_group, topic:, group:, wait:)
+      @workers << Thread.new do
+        result = Shortbus.groups.drain(topic, group, wait:, stop: -> { !@running || @draining })
+
+        send_response(status: :ok, op: :group_drained, topic: topic, group: group, **result, request_id: cmd[:request_id])
+      rescue => e
+        send_error("Drain group failed: #{e.message}", command: cmd)
+      end
+    rescue => e
+      send_error("Drain group failed: #{e.message}", command: cmd)
+    end
+
+    def topic_and_group(cmd)
+      topic = cmd[:topic] || cmd[:t]
+      group = cmd[:group] || cmd[:g]
+
+      raise ArgumentError, "Missing topic" unless topic
+      raise ArgumentError, "Missing group" unless group
+
+      [topic, group]
+    end
+
+    def handle_pending(cmd)
+      topic = cmd[:topic] || cmd[:t]
+      group = cmd[:group] || cmd[:g]
+
+      raise ArgumentError, "Missing topic" unless topic
+      raise ArgumentError, "Missing group" unless group
+
+      Inbox.authorize!(topic, @connection_id)
+
+      send_response(
+        status: :ok,
+        op: :pending,
+        topic: topic,
+        group: group,
+        pending: Shortbus.groups.pending(topic, group),
+        paused: Shortbus.groups.paused?(topic, group),
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Pending failed: #{e.message}", command: cmd)
+    end
+
+    # Take over unacked messages from dead (or, with min_idle, slow) members
+    def handle_claim(cmd)
+      topic = cmd[:topic] || cmd[:t]
+      group = cmd[:group] || cmd[:g]
+
+      raise ArgumentError, "Missing topic" unless topic
+      raise ArgumentError, "Missing group" unless group
+
+      Inbox.authorize!(topic, @connection_id)
+
+      min_idle = Shortbus.parse_duration(cmd[:min_idle]) if cmd[:min_idle]
+      max = Integer(cmd[:max] || 10)
+
+      ids = Shortbus.groups.reclaim(topic, group, consumer: @connection_id, min_idle:, max:)
+      messages = WorkQueue.with_attempts(topic, group, WorkQueue.messages_by_id(topic, group, ids))
+      messages = messages.map { |msg| Shortbus.metrics.delivered(topic, msg, group:) }
+
+      send_response(
+        status: :ok,
+        op: :claimed,
+        topic: topic,
+        group: group,
+        messages: messages,
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Claim failed: #{e.message}", command: cmd)
+    end
+
+    # Paused subscriptions stay registered but fetch nothing, so messages
+    # wait in the engine rather than piling up in memory
+    def handle_pause(cmd)
+      topic = cmd[:topic] || cmd[:t]
+      raise ArgumentError, "Missing topic" unless topic
+      raise ArgumentError, "Not subscribed to #{topic}" unless subscribed?(topic)
+
+      @delivery.synchronize { @paused[topic] = true }
+      save_session!
+
+      send_response(
+        status: :ok,
+        op: :paused,
+        topic: topic,
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Pause failed: #{e.message}", command: cmd)
+    end
+
+    def handle_resume(cmd)
+      topic = cmd[:topic] || cmd[:t]
+      raise ArgumentError, "Missing topic" unless topic
+      raise ArgumentError, "Not subscribed to #{topic}" unless subscribed?(topic)
+
+      @delivery.synchronize do
+        @paused.delete(topic)
+        @restored.delete(topic)
+      end
+      save_session!
+
+      send_response(
+        status: :ok,
+        op: :resumed,
+        topic: topic,
+        request_id: cmd[:request_id]
+      )
+
+      # Catch up on whatever arrived while paused
+      fetch_and_send_messages(topic)
+    rescue => e
+      send_error("Resume failed: #{e.message}", command: cmd)
+    end
+
+    def enforce_limit(topic)
+      max = @limits[topic]
+      return unless max && @delivered[topic] >= max
+
+      @limits.delete(topic)
+      leave_topic(topic)
+      reap_topics!
+
+      # Unsolicited: tells the client the broker ended the subscription
+      send_response(
+        type: :unsubscribed,
+        topic: topic,
+        reason: :max_reached,
+        delivered: @delivered[topic]
+      )
+    end
+
+    def subscribed?(topic)
+      @subscribers.fetch(topic, []).any?
+    end
+
+    def leave_topic(topic)
+      @delivery.synchronize do
+        @subscribers.delete(topic)
+        @limits.delete(topic)
+        @paused.delete(topic)
+        @windows.delete(topic)
+        @in_flight.delete(topic)
+        @in_flight_ids.delete(topic)
+        @credits.delete(topic)
+        @groups.delete(topic)
+        @queues.delete(topic)
+        @filters.delete(topic)
+        @sequences.delete(topic)
+
+        if (partitioned = @partitioned.delete(topic))
+          Shortbus.groups.leave(topic, partitioned[:group], @connection_id)
+          notify_rebalance(topic, partitioned[:group], revoked: partitioned[:owned], assigned: [])
+        end
+      end
+
+      Shortbus.subscribers.remove(topic, @connection_id)
+      Shortbus.connections.update(@connection_id, subscriptions: @subscribers.keys)
+    rescue => e
+      Shortbus.warn "Failed to deregister from #{topic}: #{e.message}"
+    end
+
+    def start_reaper!
+      Thread.new do
+        while @running
+          sleep 1
+          reap_topics!
+          check_rebalances!
+        end
+      end
+    end
+
+    def reap_topics!
+      Shortbus.topics.reap!.each do |topic|
+        Shortbus.debug "Reaped ephemeral topic: #{topic}"
+      end
+    rescue => e
+      Shortbus.warn "Ephemeral topic reaper failed: #{e.message}"
+    end
+
+    # Browse a topic without consuming: subscription offsets are untouched
+    def handle_peek(cmd)
+      topic = cmd[:topic] || cmd[:t]
+      raise ArgumentError, "Missing topic" unless topic
+
+      Inbox.authorize!(topic, @connection_id)
+
+      messages = Shortbus.engine.fetch_messages(
+        topic,
+        offset: Integer(cmd[:offset] || 0),
+        limit: Integer(cmd[:limit] || cmd[:n] || 10)
+      )
+
+      send_response(
+        status: :ok,
+        op: :peek,
+        topic: topic,
+        messages: messages,
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Peek failed: #{e.message}", command: cmd)
+    end
+
+    def handle_purge(cmd)
+      topic = cmd[:topic] || cmd[:t]
+      raise ArgumentError, "Missing topic" unless topic
+
+      Inbox.authorize!(topic, @connection_id)
+      Admin.purge(topic)
+      audit(:purge, topic:)
+
+      send_response(
+        status: :ok,
+        op: :purged,
+        topic: topic,
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Purge failed: #{e.message}", command: cmd)
+    end
+
+    def handle_delete_message(cmd)
+      topic = cmd[:topic] || cmd[:t]
+      id = cmd[:id] || cmd[:message_id]
+
+      raise ArgumentError, "Missing topic" unless topic
+      raise ArgumentError, "Missing id" unless id
+
+      Inbox.authorize!(topic, @connection_id)
+      Admin.delete_message(topic, id)
+      audit(:delete_message, topic:, id:)
+
+      send_response(
+        status: :ok,
+        op: :message_deleted,
+        topic: topic,
+        message_id: id,
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Delete message failed: #{e.message}", command: cmd)
+    end
+
+    def handle_requeue(cmd)
+      topic = cmd[:topic] || cmd[:t]
+      raise ArgumentError, "Missing topic" unless topic
+
+      Inbox.authorize!(topic, @connection_id)
+      result = Admin.requeue(topic, to: cmd[:to], limit: Integer(cmd[:limit] || 1000))
+      audit(:requeue, topic:, to: cmd[:to], requeued: result[:requeued])
+
+      send_response(
+        status: :ok,
+        op: :requeued,
+        topic: topic,
+        requeued: result[:requeued],
+        destinations: result[:destinations],
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Requeue failed: #{e.message}", command: cmd)
+    end
+
+    def handle_list_topics(cmd)
+      topics = Shortbus.engine.list_topics
+
+      send_response(
+        status: :ok,
+        op: :topics,
+        topics: topics,
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("List topics failed: #{e.message}", command: cmd)
+    end
+
+    # Discovery: topics matching a glob, with depth, subscribers, settings
+    def handle_describe_topics(cmd)
+      send_response(
+        status: :ok,
+        op: :described_topics,
+        topics: Admin.describe_topics(cmd[:pattern]),
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Describe topics failed: #{e.message}", command: cmd)
+    end
+
+    # Publish metrics for one topic, or every topic with some
+    def handle_metrics(cmd)
+      topic = cmd[:topic] || cmd[:t]
+
+      # This process's counts first, so its own publishes show up
+      Shortbus.metrics.flush!
+
+      send_response(
+        status: :ok,
+        op: :metrics,
+        metrics: topic ? [Shortbus.metrics.get(topic)] : Shortbus.metrics.all,
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Metrics failed: #{e.message}", command: cmd)
+    end
+
+    def handle_create_topic(cmd)
+      topic = cmd[:topic] || cmd[:t]
+      raise ArgumentError, "Missing topic" unless topic
+
+      if Inbox.inbox?(topic)
+        raise AccessError, "#{Inbox::PREFIX}.* is reserved, use the inbox op"
+      end
+
+      settings = Shortbus.topics.create(topic, **topic_settings(cmd))
+      result = Shortbus.engine.create_topic(topic)
+      audit(:create_topic, topic:, settings:)
+
+      # The engine only reports topics it creates; one that already held
+      # messages has just gained settings
+      TopicEvents.emit(:updated, topic, settings:) if result[:note]
+
+      send_response(
+        status: :ok,
+        op: :topic_created,
+        topic: topic,
+        settings: settings,
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Create topic failed: #{e.message}", command: cmd)
+    end
+
+    def handle_update_topic(cmd)
+      topic = cmd[:topic] || cmd[:t]
+      raise ArgumentError, "Missing topic" unless topic
+
+      Inbox.authorize!(topic, @connection_id)
+
+      settings = Shortbus.topics.update(topic, **topic_settings(cmd))
+      TopicEvents.emit(:updated, topic, settings:)
+      audit(:update_topic, topic:, settings:)
+
+      send_response(
+        status: :ok,
+        op: :topic_updated,
+        topic: topic,
+        settings: settings,
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Update topic failed: #{e.message}", command: cmd)
+    end
+
+    def handle_delete_topic(cmd)
+      topic = cmd[:topic] || cmd[:t]
+      raise ArgumentError, "Missing topic" unless topic
+
+      Inbox.authorize!(topic, @connection_id)
+
+      Shortbus.topics.delete(topic)
+      Shortbus.engine.delete_topic(topic)
+      audit(:delete_topic, topic:)
+
+      send_response(
+        status: :ok,
+        op: :topic_deleted,
+        topic: topic,
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Delete topic failed: #{e.message}", command: cmd)
+    end
+
+    def handle_get_topic(cmd)
+      topic = cmd[:topic] || cmd[:t]
+      raise ArgumentError, "Missing topic" unless topic
+
+      settings = Shortbus.topics.get(topic)
+      raise TopicError, "Topic not found: #{topic}" unless settings
+
+      send_response(
+        status: :ok,
+        op: :topic,
+        topic: topic,
+        settings: settings,
+        expired: Shortbus.deadlines.expired(topic),
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Get topic failed: #{e.message}", command: cmd)
+    end
+
+    # Broker-managed schedules: list (default), add, or remove
+    def handle_schedules(cmd)
+      case cmd[:action] || 'list'
+      when 'list'
+        nil
+      when 'add'
+        definition = cmd[:schedule] || cmd.slice(*Schedules::SETTINGS)
+        Shortbus.schedules.add(cmd[:name], **definition.transform_keys(&:to_sym))
+        audit(:add_schedule, name: cmd[:name], schedule: definition)
+      when 'remove'
+        Shortbus.schedules.remove(cmd[:name])
+        audit(:remove_schedule, name: cmd[:name])
+      else
+        raise ArgumentError, "Unknown schedules action: #{cmd[:action]} (list, add, remove)"
+      end
+
+      send_response(
+        status: :ok,
+        op: :schedules,
+        schedules: Shortbus.schedules.status,
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Schedules failed: #{e.message}", command: cmd)
+    end
+
+    # Key-value buckets (see KV), e.g.
+    #
+    #   {"op": "kv", "action": "put", "bucket": "config", "key": "billing.rate_limit", "value": "100"}
+    #
+    # Reads need subscribe permission on the bucket's topic and writes
+    # publish permission (a first put creates the bucket); creating one
+    # explicitly, with topic settings, is an admin op.
+    # Watchers subscribe to the topic (kv.BUCKET) with deliver: all.
+    def handle_kv(cmd)
+      action = cmd[:action] || 'get'
+      bucket = cmd[:bucket]
+      raise ArgumentError, "Missing bucket" unless bucket || action == 'buckets'
+
+      topic = Shortbus.kv.topic(bucket) if bucket
+      response = { status: :ok, op: :kv, action:, bucket:, request_id: cmd[:request_id] }
+
+      case action
+      when 'put'
+        raise ArgumentError, "Missing value" unless cmd.key?(:value)
+        @principal&.authorize!('publish', topic)
+        refuse_while_draining!
+        response[:entry] = Shortbus.kv.put(bucket, cmd[:key], cmd[:value], metadata: { published_by: identity })
+      when 'delete'
+        @principal&.authorize!('publish', topic)
+        refuse_while_draining!
+        response[:entry] = Shortbus.kv.delete(bucket, cmd[:key], metadata: { published_by: identity })
+      when 'get'
+        @principal&.authorize!('fetch', topic)
+        response[:entry] = Shortbus.kv.get(bucket, cmd[:key])
+      when 'keys'
+        @principal&.authorize!('fetch', topic)
+        response[:keys] = Shortbus.kv.keys(bucket)
+      when 'buckets'
+        response[:buckets] = Shortbus.kv.buckets
+      when 'create'
+        @principal&.authorize!('create_topic', topic)
+        settings = topic_settings(cmd)
+        response[:settings] = Shortbus.kv.create(bucket, **settings)
+        audit(:create_topic, topic:, settings:)
+      else
+        raise ArgumentError, "Unknown kv action: #{action} (get, put, delete, keys, buckets, create)"
+      end
+
+      send_response(response.compact)
+    rescue => e
+      send_error("KV #{action} failed: #{e.message}", command: cmd)
+    end
+
+    # Append events to a stream (see Streams), e.g.
+    #
+    #   {"op": "append", "stream": "order-42", "expected_version": 0,
+    #    "events": [{"type": "placed", "payload": "{\"total\": 30}"}]}
+    #
+    # A stream that has moved past expected_version is refused with
+    # conflict: true and its current version.
+    def handle_append(cmd)
+      stream = cmd[:stream]
+      raise ArgumentError, "Missing stream" unless stream
+
+      topic = Shortbus.streams.topic(stream)
+      @principal&.authorize!('publish', topic)
+      refuse_while_draining!
+
+      result = Shortbus.streams.append(stream, cmd[:events], expected_version: cmd[:expected_version], metadata: { published_by: identity })
+
+      send_response(
+        status: :ok,
+        op: :appended,
+        stream: result[:stream],
+        version: result[:version],
+        message_ids: result[:events].map { |event| event[:message_id] },
+        offsets: result[:events].map { |event| event[:offset] },
+        request_id: cmd[:request_id]
+      )
+    rescue ConflictError => e
+      send_error("Append failed: #{e.message}", command: cmd, conflict: true, version: e.current)
+    rescue => e
+      send_error("Append failed: #{e.message}", command: cmd)
+    end
+
+    def handle_read_stream(cmd)
+      stream = cmd[:stream]
+      raise ArgumentError, "Missing stream" unless stream
+
+      @principal&.authorize!('fetch', Shortbus.streams.topic(stream))
+      events = Shortbus.streams.read(stream, from: cmd[:from] || 1, limit: cmd[:limit] && Integer(cmd[:limit]))
+
+      send_response(
+        status: :ok,
+        op: :stream,
+        stream: stream.to_s,
+        version: Shortbus.streams.version(stream),
+        messages: events,
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Read stream failed: #{e.message}", command: cmd)
+    end
+
+    # Settings may be nested under "settings" or given inline on the command
+    def topic_settings(cmd)
+      settings = cmd[:settings] || cmd.slice(*Topics::SETTINGS)
+      settings.transform_keys(&:to_sym)
+    end
+
+    # Name (or rename) this connection after connecting, and/or register its
+    # last will: a publish the broker makes for it if it disconnects without
+    # a shutdown op, e.g.
+    #
+    #   {"op": "hello", "name": "billing", "will": {"topic": "presence.billing", "payload": "offline"}}
+    #
+    # "will": null clears it.
+    def handle_hello(cmd)
+      name = cmd[:name] || cmd[:client]
+      raise ArgumentError, "Missing name" unless name || cmd.key?(:will)
+
+      @name = name.to_s if name
+      @will = last_will(cmd[:will]) if cmd.key?(:will)
+      Shortbus.connections.update(@connection_id, name: @name, will: @will)
+
+      send_response({
+        status: :ok,
+        op: :hello,
+        connection_id: @connection_id,
+        name: @name,
+        will: @will && @will[:topic],
+        request_id: cmd[:request_id]
+      }.compact)
+    rescue => e
+      send_error("Hello failed: #{e.message}", command: cmd)
+    end
+
+    # Register in (or heartbeat) the presence registry, under the given name
+    # or the connection's; entries this connection made go when it closes
+    def handle_announce(cmd)
+      name = cmd[:name] || @name
+      raise ArgumentError, "Missing name" unless name
+      raise ArgumentError, "info must be an object" if cmd[:info] && !cmd[:info].is_a?(Hash)
+
+      entry = Shortbus.presence.announce(name, ttl: cmd[:ttl] || Presence::DEFAULT_TTL, info: cmd[:info] || {}, connection_id: @connection_id)
+      @announced = true
+
+      send_response(
+        status: :ok,
+        op: :announced,
+        name: entry[:name],
+        present_until: entry[:expires_at],
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Announce failed: #{e.message}", command: cmd)
+    end
+
+    def handle_leave(cmd)
+      name = cmd[:name] || @name
+      raise ArgumentError, "Missing name" unless name
+
+      send_response(
+        status: :ok,
+        op: :left,
+        name: name.to_s,
+        left: Shortbus.presence.leave(name),
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Leave failed: #{e.message}", command: cmd)
+    end
+
+    def handle_presence(cmd)
+      send_response(
+        status: :ok,
+        op: :presence,
+        members: Shortbus.presence.list(cmd[:pattern]),
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Presence failed: #{e.message}", command: cmd)
+    end
+
+    # Take a lock (see Locks) for this connection, owned by the given owner or
+    # the connection's name. A lock held elsewhere is not an error: the
+    # response says acquired: false and who holds it. Locks still held when
+    # the connection closes are released.
+    def handle_acquire(cmd)
+      raise ArgumentError, "Missing name" unless cmd[:name]
+
+      lease = Shortbus.locks.acquire(cmd[:name], owner: cmd[:owner] || identity, ttl: cmd[:ttl] || Locks::DEFAULT_TTL, connection_id: @connection_id)
+      @leased ||= !lease.nil?
+
+      send_response(
+        status: :ok,
+        op: :acquired,
+        name: cmd[:name].to_s,
+        acquired: !lease.nil?,
+        lease: lease || Shortbus.locks.get(cmd[:name])&.except(:token, :connection_id),
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Acquire failed: #{e.message}", command: cmd)
+    end
+
+    def handle_renew(cmd)
+      raise ArgumentError, "Missing name" unless cmd[:name]
+      raise ArgumentError, "Missing token" unless cmd[:token]
+
+      lease = Shortbus.locks.renew(cmd[:name], token: cmd[:token], ttl: cmd[:ttl] || Locks::DEFAULT_TTL)
+
+      send_response({
+        status: :ok,
+        op: :renewed,
+        name: cmd[:name].to_s,
+        renewed: !lease.nil?,
+        lease: lease,
+        request_id: cmd[:request_id]
+      }.compact)
+    rescue => e
+      send_error("Renew failed: #{e.message}", command: cmd)
+    end
+
+    def handle_release(cmd)
+      raise ArgumentError, "Missing name" unless cmd[:name]
+      raise ArgumentError, "Missing token" unless cmd[:token]
+
+      send_response(
+        status: :ok,
+        op: :released,
+        name: cmd[:name].to_s,
+        released: Shortbus.locks.release(cmd[:name], token: cmd[:token]),
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Release failed: #{e.message}", command: cmd)
+    end
+
+    def handle_locks(cmd)
+      send_response(
+        status: :ok,
+        op: :locks,
+        locks: Shortbus.locks.list.map { |lease| lease.except(:token, :connection_id) },
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("List locks failed: #{e.message}", command: cmd)
+    end
+
+    def last_will(will)
+      return nil if will.nil?
+      raise ArgumentError, "will must be an object with a topic" unless will.is_a?(Hash) && will[:topic]
+      raise ArgumentError, "will metadata must be an object" if will[:metadata] && !will[:metadata].is_a?(Hash)
+
+      topic = will[:topic].to_s
+      TopicEvents.authorize!(topic)
+      @principal&.authorize!('publish', topic)
+
+      { topic:, payload: will[:payload].to_s, metadata: will[:metadata] }.compact
+    end
+
+    def handle_connections(cmd)
+      send_response(
+        status: :ok,
+        op: :connections,
+        connections: Shortbus.connections.list,
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("List connections failed: #{e.message}", command: cmd)
+    end
+
+    # How this connection is identified to other clients
+    def identity
+      @name || @connection_id
+    end
+
+    # Ops the authenticated identity isn't permitted, or that would exceed
+    # its rate limits, are refused
+    def authorized?(op, cmd)
+      return true unless @principal
+
+      @principal.authorize!(op, cmd[:topic] || cmd[:t])
+      action = Auth.action(op)
+      @limiter.take!(action) if action
+      true
+    rescue AccessError => e
+      audit(op, outcome: :denied, topic: cmd[:topic] || cmd[:t], error: e.message) if Auth.action(op) == :admin
+
+      # Rate limits say when to try again, for clients to back off by
+      backoff = e.is_a?(LimitError) ? { retry_after: e.retry_after, pressure: e.pressure } : {}
+      send_error("Unauthorized: #{e.message}", command: cmd, **backoff)
+      false
+    end
+
+    # A read-only broker (SHORTBUS_READ_ONLY) refuses writes up front, before
+    # any side effect (an inbox's topics.yml entry, a lock, a schedule);
+    # transactions fail in the engine with the same error
+    def read_only_refused?(op, cmd)
+      writes = READ_ONLY_REFUSED.include?(op) || READ_ONLY_ACTIONS.fetch(op, []).include?(cmd[:action].to_s)
+      return false unless writes
+
+      Shortbus.writable!
+      false
+    rescue ReadOnlyError => e
+      send_error(e.message, command: cmd, read_only: true)
+      true
+    end
+
+    # Admin actions go in the audit log under this connection's name
+    def audit(action, **params)
+      Shortbus.audit.record(action, by: identity, via: :pipe, connection_id: @connection_id, **params)
+    end
+
+    def handle_new_inbox(cmd)
+      inbox = Inbox.generate(@connection_id)
+
+      Shortbus.topics.create(inbox, ephemeral: true, grace_period: cmd[:grace_period])
+      Shortbus.engine.create_topic(inbox)
+
+      send_response(
+        status: :ok,
+        op: :inbox,
+        topic: inbox,
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Inbox failed: #{e.message}", command: cmd)
+    end
+
+    # A fresh token for the identity the connection authenticated as, so
+    # it can outlive the first token's expiry without reconnecting
+    def handle_refresh_token(cmd)
+      raise AccessError, "Connection isn't authenticated" unless @principal
+
+      principal = Auth.authenticate({ token: cmd[:token] }, Auth.providers)
+      raise AccessError, "Token refused" unless principal
+      raise AccessError, "Token is for #{principal.name}, not #{@principal.name}" unless principal.name == @principal.name
+
+      @principal = principal
+      @limiter = Auth::RateLimit.new(principal.limits)
+
+      send_response(
+        status: :ok,
+        op: :token_refreshed,
+        expires_at: principal.expires_at,
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Token refresh failed: #{e.message}", command: cmd)
+    end
+
+    def handle_ping(cmd)
+      result = Shortbus.engine.ping
+
+      send_response(
+        status: :ok,
+        op: :pong,
+        engine_status: result[:status],
+        request_id: cmd[:request_id]
+      )
+    rescue => e
+      send_error("Ping failed: #{e.message}", command: cmd)
+    end
+
+    def start_file_watcher!
+      return if @file_watcher_started
+
+      begin
+        Shortbus.file_watcher.start!
+        @file_watcher_started = true
+      rescue => e
+        Shortbus.warn "Failed to start file watcher: #{e.message}"
+        # Continue without file watcher (will use polling fallback)
+      end
+    end
+
+    def start_message_watcher(topic)
+      # Register file watcher callback for reactive notifications
+      if @file_watcher_started
+        Shortbus.file_watcher.on_change(topic) do |event|
+          fetch_and_send_messages(topic) if @running && subscribed?(topic)
+        end
+      end
+
+      # Initial fetch of existing messages
+      fetch_and_send_messages(topic)
+
+      # Fallback polling thread if file watcher isn't available
+      unless @file_watcher_started
+        Thread.new do
+          while @running && subscribed?(topic)
+            begin
+              fetch_and_send_messages(topic)
+              sleep 0.1  # Poll interval
+            rescue => e
+              send_error("Watcher error: #{e.message}", topic: topic)
+              break
+            end
+          end
+        end
+      end
+    end
+
+    def fetch_and_send_messages(topic)
+      @delivery.synchronize do
+        return if @paused[topic]
+        return if @groups[topic] && Shortbus.groups.paused?(topic, @groups[topic])
+        return fetch_and_send_partitioned(topic) if @partitioned[topic]
+        return fetch_and_send_queued(topic) if @queues[topic]
+
+        offset = @offsets[topic]
+
+        begin
+          messages = Shortbus.engine.fetch_messages(topic, offset: offset)
+
+          messages.each do |msg|
+            break unless subscribed?(topic) && !@paused[topic]
+            break if throttled?(topic)
+
+            # Hold at an uncommitted transaction; step over an aborted one
+            visibility = Shortbus.transactions.visibility(msg)
+            break if visibility == :pending
+
+            msg = sequenced(topic, msg) if @sequences.key?(topic) && msg[:id]
+            deliver(topic, msg) if visibility == :visible && matches_filter?(topic, msg) && !Shortbus.deadlines.expire?(topic, msg)
+            @offsets[topic] = [offset, msg[:id] + 1].max if msg[:id]
+          end
+
+          save_session! if messages.any?
+        rescue => e
+          send_error("Fetch error: #{e.message}", topic: topic)
+        end
+      end
+    end
+
+    # Reads are checked for offsets the topic no longer has (retention or a
+    # purge got there first), which go out as a gap. msg comes back with
+    # prev_sequence, the sequence last delivered, so the client can tell
+    # messages lost on its side from ones it was never meant to get
+    # (filtered, expired) in between.
+    def sequenced(topic, msg)
+      sequence = @sequences[topic]
+      read = sequence[:read]
+
+      if read && msg[:id] > read + 1
+        send_response(type: :gap, topic: topic, from: read + 1, to: msg[:id] - 1, missed: msg[:id] - read - 1)
+      end
+      sequence[:read] = msg[:id]
+
+      msg.merge(prev_sequence: sequence[:delivered])
+    end
+
+    # Deliver only this member's partitions, reading from the furthest-behind
+    # one and advancing each partition's group position as messages go out
+    def fetch_and_send_partitioned(topic)
+      group = @partitioned[topic][:group]
+      partitions = @partitioned[topic][:partitions]
+
+      owned = rebalance(topic)
+      return if owned.empty?
+
+      offsets = owned.to_h { |partition| [partition, Shortbus.groups.offset(topic, group, partition:)] }
+      messages = Shortbus.engine.fetch_messages(topic, offset: offsets.values.min)
+
+      messages.each do |msg|
+        break unless subscribed?(topic) && !@paused[topic]
+        break if throttled?(topic)
+
+        partition = Groups.partition_for(msg, partitions)
+        next unless offsets.key?(partition) && msg[:id] >= offsets[partition]
+
+        visibility = Shortbus.transactions.visibility(msg)
+        break if visibility == :pending
+
+        deliver(topic, msg) if visibility == :visible && matches_filter?(topic, msg) && !Shortbus.deadlines.expire?(topic, msg)
+        offsets[partition] = Shortbus.groups.commit(topic, group, msg[:id] + 1, partition:)
+      end
+    rescue => e
+      send_error("Fetch error: #{e.message}", topic: topic)
+    end
+
+    # Take messages from the queue group's shared position, never more than
+    # the client can take right now: claimed messages a member doesn't get
+    # are gone for the whole group (or, with acks, stuck pending)
+    def fetch_and_send_queued(topic)
+      queue = @queues[topic]
+
+      until !subscribed?(topic) || @paused[topic] || throttled?(topic)
+        max = queue_room(topic)
+        messages =
+          if queue[:ack]
+            WorkQueue.fetch_acked(topic, queue[:group], consumer: @connection_id, max:, wait: 0)
+          else
+            WorkQueue.fetch(topic, queue[:group], max:, wait: 0)
+          end
+        break if messages.empty?
+
+        messages.each do |msg|
+          if matches_filter?(topic, msg)
+            deliver(topic, msg)
+          elsif queue[:ack]
+            Shortbus.groups.ack(topic, queue[:group], [msg[:id]])
+          end
+        end
+      end
+    rescue => e
+      send_error("Fetch error: #{e.message}", topic: topic)
+    end
+
+    def queue_room(topic)
+      room = [100]
+      room << @windows[topic] - @in_flight[topic].size if @windows[topic]
+      room << @credits[topic] if @credits.key?(topic)
+      room << @limits[topic] - @delivered[topic] if @limits[topic]
+      room.min
+    end
+
+    # filter: { key => value } passes messages whose metadata has each key
+    # set to its value, or to one of them when the value is a list
+    def matches_filter?(topic, msg)
+      filter = @filters[topic]
+      return true unless filter
+
+      metadata = msg[:metadata].is_a?(Hash) ? msg[:metadata] : {}
+      filter.all? { |key, value| Array(value).include?(metadata[key.to_sym]) }
+    end
+
+    # Recompute this member's partitions, telling the client about any change
+    # before delivering under the new assignment
+    def rebalance(topic)
+      partitioned = @partitioned[topic]
+      return [] unless partitioned
+
+      owned = Shortbus.groups.assignment(topic, partitioned[:group], @connection_id, partitioned[:partitions])
+      previous = partitioned[:owned]
+
+      if owned != previous
+        partitioned[:owned] = owned
+        notify_rebalance(topic, partitioned[:group], revoked: previous - owned, assigned: owned - previous)
+      end
+
+      owned
+    end
+
+    # Revocations go first so the client can checkpoint what it is losing
+    def notify_rebalance(topic, group, revoked:, assigned:)
+      send_response(type: :revoked, topic: topic, group: group, partitions: revoked) if revoked.any?
+      send_response(type: :assigned, topic: topic, group: group, partitions: assigned) if assigned.any?
+    end
+
+    # Membership changes don't publish anything, so poll for them; a newly
+    # gained partition may have a backlog waiting
+    def check_rebalances!
+      @partitioned.keys.each do |topic|
+        @delivery.synchronize do
+          before = @partitioned[topic]&.fetch(:owned)
+          owned = rebalance(topic)
+          fetch_and_send_messages(topic) if owned != before && (owned - before.to_a).any?
+        end
+      end
+    rescue => e
+      Shortbus.warn "Rebalance check failed: #{e.message}"
+    end
+
+    # Durable sessions
+
+    # Pick up a previous connection's subscriptions. They come back paused
+    # (the new client has no handlers yet) until subscribed to again.
+    def restore_session!
+      subscriptions = Shortbus.sessions.claim(@durable, timeout: @session_timeout)
+      return send_response(type: :session, session: @durable, resumed: false) unless subscriptions&.any?
+
+      @delivery.synchronize do
+        subscriptions.each do |topic, state|
+          topic = topic.to_s
+          @subscribers[topic] << { restored: true }
+          @offsets[topic] = state[:offset].to_i
+          @delivered[topic] = state[:delivered].to_i
+          @limits[topic] = state[:max] if state[:max]
+          @windows[topic] = state[:max_in_flight] if state[:max_in_flight]
+          @sequences[topic] = state[:gaps] if state[:gaps]
+          @paused[topic] = true
+          @restored << topic unless state[:paused]
+          Shortbus.subscribers.add(topic, @connection_id)
+          start_message_watcher(topic)
+        end
+      end
+
+      Shortbus.connections.update(@connection_id, subscriptions: @subscribers.keys)
+
+      send_response(type: :session, session: @durable, resumed: true, subscriptions: subscriptions.keys.map(&:to_s))
+    rescue => e
+      send_error("Session resume failed: #{e.message}", session: @durable)
+      @durable = nil
+    end
+
+    def session_state
+      @delivery.synchronize do
+        @subscribers.keys.select { |topic| subscribed?(topic) }.to_h do |topic|
+          [topic, {
+            offset: @offsets[topic],
+            delivered: @delivered[topic],
+            max: @limits[topic],
+            max_in_flight: @windows[topic],
+            gaps: @sequences[topic],
+            paused: @paused[topic] && !@restored.include?(topic)
+          }.compact]
+        end
+      end
+    end
+
+    def save_session!
+      Shortbus.sessions.save(@durable, session_state) if @durable
+    rescue => e
+      Shortbus.warn "Failed to save session #{@durable}: #{e.message}"
+    end
+
+    def deliver(topic, msg)
+      msg = Shortbus.metrics.delivered(topic, msg, group: @queues.dig(topic, :group))
+
+      # Dropped by a full outbound buffer: a gap, as far as the client knows
+      return unless send_message(msg)
+
+      @sequences[topic][:delivered] = msg[:sequence] || msg[:id] if @sequences.key?(topic)
+      if @windows[topic]
+        @in_flight[topic] << msg[:id]
+        @in_flight_ids[topic][msg[:message_id]] = msg[:id] if msg[:message_id]
+      end
+      @credits[topic] -= 1 if @credits.key?(topic)
+      @delivered[topic] += 1
+      enforce_limit(topic)
+    end
+
+    def send_message(msg)
+      signal = msg[:metadata].is_a?(Hash) && msg[:metadata][:signal]
+
+      send_response({
         type: :message,
         topic: msg[:topic],
         id: msg[:id],
-        payload: msg[:payload],
+        message_id: msg[:message_id],
+        offset: msg[:id],
+        payload: (msg[:payload] unless signal),
         metadata: msg[:metadata],
+        annotations: msg[:annotations],
         timestamp: msg[:timestamp],
-        sequence: msg[:sequence]
-      )
+        sequence: msg[:sequence],
+        prev_sequence: msg[:prev_sequence]
+      }.compact, delivery: true)
+    end
+
+    # false when the outbound buffer dropped a delivery
+    def send_response(data, delivery: false)
+      sent = @outbound.<<(JSON.generate(data), delivery:)
+      report_outbound! if @outbound.high_watermark >= [@reported_watermark * 2, Outbound::MAX_BATCH].max
+      sent
+    end
+
+    # Outbound buffer use in the connection's entry, for `shortbus connections`
+    def report_outbound!
+      @reported_watermark = @outbound.high_watermark
+      Shortbus.connections.update(@connection_id, outbound: {
+        buffer: @outbound.buffer,
+        policy: @outbound.policy,
+        high_watermark: @outbound.high_watermark,
+        dropped: @outbound.dropped
+      })
     end
 
-    def send_response(data)
-      line = JSON.generate(data)
-      @stdout.puts(line)
-      @stdout.flush
+    # The client isn't reading as fast as its frames come: logged at most
+    # once a second, and closed under the disconnect policy
+    def slow_consumer!(outbound)
+      if @slow_at.nil? || Time.now - @slow_at >= 1
+        @slow_at = Time.now
+        Shortbus.warn "Slow consumer #{@name || @connection_id}: #{outbound.buffered} of #{outbound.buffer} bytes buffered (#{outbound.policy})"
+        report_outbound!
+      end
+      return unless outbound.policy == 'disconnect' && !@slow_disconnect
+
+      # Reading stdin stops with IOError, which shuts the connection down
+      @slow_disconnect = true
+      send_error("Slow consumer: outbound buffer of #{outbound.buffer} bytes is full", slow_consumer: true)
+      @stdin.close
     end
 
     def send_error(message, **context)
-      send_response(
+      command = context[:command]
+      request_id = command[:request_id] if command.is_a?(Hash)
+
+      # Echo request_id so clients waiting on the command see the failure
+      send_response({
         type: :error,
         error: message,
+        request_id: request_id,
         **context
-      )
+      }.compact)
     end
   end
 
@@ -0,0 +1,150 @@
+module Shortbus
+  # Presence registry
+  #
+  # Clients announce themselves under a name (a service instance, say
+  # "billing/7f3a") with a TTL, and keep announcing as a heartbeat; an
+  # entry whose TTL lapses without one is gone. Entries live in
+  # presence.json inside the rendezvous, updated under a lock:
+  #
+  #   { "billing/7f3a": { "name": "billing/7f3a", "info": { "version": "2.1" }, "ttl": 30,
+  #                       "connection_id": "9f1c...", "joined_at": "...", "expires_at": "..." } }
+  #
+  # Joins and leaves are published to $sys.presence, so services can watch
+  # each other come and go instead of polling:
+  #
+  #   { "event": "joined", "name": "billing/7f3a", "info": {...}, "at": "..." }
+  #   { "event": "left", "name": "billing/7f3a", "reason": "expired", "at": "..." }
+  #
+  # reason is "left" (the client said so), "disconnected" (its connection
+  # closed) or "expired". Expired entries are noticed by whoever reads the
+  # registry next, or by the daemon.
+  #
+  # Example:
+  #   Shortbus.presence.announce('billing/7f3a', ttl: 30, info: { version: '2.1' })
+  #   Shortbus.presence.list('billing/*')   # => [{ name: "billing/7f3a", ... }]
+  #   Shortbus.presence.leave('billing/7f3a')
+  class Presence
+    TOPIC = '$sys.presence'
+    DEFAULT_TTL = 30
+
+    attr_reader :config
+
+    def initialize(config: Shortbus.config)
+      @config = config
+    end
+
+    # Register name, or refresh it; only a new entry is announced as a join
+    def announce(name, ttl: DEFAULT_TTL, info: {}, connection_id: nil, engine: Shortbus.engine)
+      name = name.to_s
+      ttl = Shortbus.parse_duration(ttl)
+      raise ArgumentError, "Missing name" if name.empty?
+      raise ArgumentError, "ttl must be positive" unless ttl.positive?
+
+      now = Time.now
+      joined, expired = nil
+
+      entry = locked do |entries|
+        expired = expire!(entries, now)
+        previous = entries[name.to_sym]
+        joined = previous.nil?
+
+        entries[name.to_sym] = {
+          name: name,
+          info: info || {},
+          ttl: ttl,
+          connection_id: connection_id,
+          joined_at: previous ? previous[:joined_at] : now.utc.iso8601(3),
+          expires_at: (now + ttl).utc.iso8601(3)
+        }.compact
+      end
+
+      expired.each { |gone| emit(:left, gone, reason: :expired, engine:) }
+      emit(:joined, entry, engine:) if joined
+      entry
+    end
+
+    # Remove name; returns whether it was registered
+    def leave(name, reason: :left, engine: Shortbus.engine)
+      entry = locked { |entries| entries.delete(name.to_s.to_sym) }
+      emit(:left, entry, reason:, engine:) if entry
+      !entry.nil?
+    end
+
+    # Remove every name a connection registered, e.g. when it closes
+    def disconnect(connection_id, engine: Shortbus.engine)
+      gone = locked do |entries|
+        names = entries.select { |_name, entry| entry[:connection_id] == connection_id }.keys
+        names.map { |name| entries.delete(name) }
+      end
+
+      gone.each { |entry| emit(:left, entry, reason: :disconnected, engine:) }
+      gone.map { |entry| entry[:name] }
+    end
+
+    # Live entries whose names match pattern (a glob), by name
+    def list(pattern = nil, engine: Shortbus.engine)
+      expired = nil
+      entries = locked do |all|
+        expired = expire!(all, Time.now)
+        all.values
+      end
+
+      expired.each { |gone| emit(:left, gone, reason: :expired, engine:) }
+      entries = entries.select { |entry| File.fnmatch?(pattern.to_s, entry[:name]) } if pattern
+      entries.sort_by { |entry| entry[:name] }
+    end
+
+    def get(name, engine: Shortbus.engine)
+      list(engine:).find { |entry| entry[:name] == name.to_s }
+    end
+
+    # Drop entries whose TTL has lapsed; returns their names
+    def reap!(engine: Shortbus.engine)
+      expired = locked { |entries| expire!(entries, Time.now) }
+      expired.each { |gone| emit(:left, gone, reason: :expired, engine:) }
+      expired.map { |entry| entry[:name] }
+    end
+
+    def path
+      config.presence_file
+    end
+
+    private
+
+    def expire!(entries, now)
+      names = entries.select { |_name, entry| Time.iso8601(entry[:expires_at]) <= now }.keys
+      names.map { |name| entries.delete(name) }
+    end
+
+    def locked
+      FileUtils.mkdir_p(path.dirname)
+
+      File.open(path, File::RDWR | File::CREAT, 0o644) do |file|
+        file.flock(File::LOCK_EX)
+        json = file.read
+        entries = json.strip.empty? ? {} : JSON.parse(json, symbolize_names: true)
+        result = yield entries
+
+        file.rewind
+        file.truncate(0)
+        file.write(JSON.generate(entries))
+        result
+      end
+    end
+
+    # Best effort, as with topic events
+    def emit(event, entry, reason: nil, engine: Shortbus.engine)
+      payload = {
+        event: event.to_s,
+        name: entry[:name],
+        info: entry[:info],
+        reason: reason&.to_s,
+        at: Time.now.utc.iso8601(3)
+      }.compact
+
+      engine.publish(TOPIC, JSON.generate(payload), metadata: { event: event.to_s, name: entry[:name] })
+    rescue Shortbus::Error => e
+      Shortbus.warn "Failed to publish #{event} presence event for #{entry[:name]}: #{e.message}"
+    end
+  end
+end
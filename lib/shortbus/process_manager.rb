@@ -1,9 +1,10 @@
 module Shortbus
   class ProcessManager
-    attr_reader :pid, :config
+    attr_reader :pid, :config, :data_lock
 
-    def initialize(config: Shortbus.config)
+    def initialize(config: Shortbus.config, data_lock: Shortbus.data_lock)
       @config = config
+      @data_lock = data_lock
       @pid = nil
       @process = nil
     end
@@ -22,6 +23,10 @@ module Shortbus
       # Remove stale PID file if exists
       remove_pidfile! if pidfile_exists? && !process_running?(read_pidfile)
 
+      # Fails fast if another broker has this directory (see DataLock)
+      token = data_lock.acquire!
+      Shortbus.debug "Data directory locked (token: #{token})"
+
       Shortbus.info "Starting BlockQueue on port #{config.engine_port}..."
 
       @pid = spawn_blockqueue
@@ -34,7 +39,7 @@ module Shortbus
       true
     rescue => e
       Shortbus.error "Failed to start BlockQueue: #{e.message}"
-      cleanup!
+      cleanup! if data_lock.held?  # else the pid file may well be the other broker's
       raise EngineError, "Failed to start BlockQueue: #{e.message}"
     end
 
@@ -100,6 +105,12 @@ module Shortbus
           port: config.engine_port,
           url: "http://localhost:#{config.engine_port}"
         }
+      elsif (recovery = Shortbus.recovery.status)
+        {
+          status: :recovering,
+          pid: recovery[:pid],
+          recovery:
+        }
       else
         {
           status: :stopped
@@ -125,26 +136,37 @@ module Shortbus
         out: log,
         err: log,
         pgroup: true,  # Create new process group
-        chdir: workdir  # Run from rendezvous directory
+        chdir: workdir,  # Run from rendezvous directory
+        data_lock.io => data_lock.io  # Engine holds the data directory lock too
       )
 
       Process.detach(pid)  # Don't wait for child process
       pid
     end
 
-    # Wait for engine to be ready (respond to HTTP)
+    # Wait for engine to be ready (respond to HTTP). A large write-ahead log
+    # takes a while to replay, so the timeout only counts time without
+    # progress (see Recovery)
     def wait_for_ready!(timeout: 10)
-      start_time = Time.now
+      recovery = Shortbus.recovery
+      recovery.start!(@pid)
+      progress_at = Time.now
 
       loop do
-        return true if engine_responding?
+        if engine_responding?
+          recovery.finish!
+          return true
+        end
 
-        if Time.now - start_time > timeout
+        progress_at = Time.now if recovery.progress!
+        if Time.now - progress_at > timeout
           raise EngineError, "BlockQueue failed to start within #{timeout} seconds"
         end
 
         sleep 0.5
       end
+    ensure
+      recovery&.finish!(recovered: false)
     end
 
     # Check if engine responds to HTTP requests
@@ -303,6 +325,7 @@ module Shortbus
     def cleanup!
       @pid = nil
       remove_pidfile!
+      data_lock.release!
     end
   end
 end
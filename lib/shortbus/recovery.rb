@@ -0,0 +1,139 @@
+module Shortbus
+  # Engine recovery progress at startup
+  #
+  # BlockQueue keeps every topic in one SQLite database, and after a crash or
+  # a write-heavy stretch the database's write-ahead log can be large. The
+  # engine reads all of it before it answers, which for a big log takes
+  # minutes. While ProcessManager waits, it measures how far the engine has
+  # read (its read bytes in /proc/PID/io, against the log's size), logs that
+  # every REPORT_INTERVAL seconds, and keeps recovery.json current:
+  #
+  #   { "state": "recovering", "pid": 4242, "percent": 42.0, "eta": 31,
+  #     "wal_bytes": 2147483648, "read_bytes": 901943132, "started_at": "..." }
+  #
+  # The HTTP gateway's /health answers 503 with it until the engine is up,
+  # and `shortbus daemon status` shows it. The startup timeout only counts
+  # time without progress, so a large log isn't mistaken for a hung engine.
+  # Without /proc there are no percent and eta, and the engine gets as long
+  # as reading the log at MIN_RATE would take.
+  #
+  # The engine recovers its database as a whole, so no topic is readable
+  # from it before the rest. Messages that have aged out into the archive
+  # (see Tiers) don't need the engine, though: fetches are served from there
+  # while it recovers, as far as the archive goes.
+  #
+  # Example:
+  #   Shortbus.recovery.status      # => { state: "recovering", percent: 42.0, ... }, nil once up
+  #   Shortbus.recovery.recovering? # => true
+  class Recovery
+    REPORT_INTERVAL = 5
+    MIN_RATE = 10 * 1024 * 1024  # bytes a second, assumed where progress can't be seen
+
+    attr_reader :config
+
+    def initialize(config: Shortbus.config)
+      @config = config
+      @reported_at = nil
+    end
+
+    # The engine process pid has started; nothing to report without a log
+    # to replay
+    def start!(pid)
+      wal = config.engine_wal_path
+      wal_bytes = wal&.file? ? wal.size : 0
+      return nil unless wal_bytes.positive?
+
+      @reported_at = nil
+      write(state: 'recovering', pid:, wal_bytes:, read_bytes: 0, started_at: Time.now.utc.iso8601(3))
+    end
+
+    # Update progress from the engine's reads; true while it is getting
+    # somewhere (it read more since the last call or, without /proc, still
+    # has time left at MIN_RATE)
+    def progress!
+      status = self.status
+      return false unless status
+
+      elapsed = Time.now - Time.parse(status[:started_at])
+      read_bytes = read_bytes(status[:pid])
+      return elapsed < status[:wal_bytes].to_f / MIN_RATE unless read_bytes
+
+      advanced = read_bytes > status[:read_bytes].to_i
+      percent = [read_bytes * 100.0 / status[:wal_bytes], 99.9].min.round(1)
+      rate = read_bytes / [elapsed, 0.001].max
+      eta = rate.positive? ? ([status[:wal_bytes] - read_bytes, 0].max / rate).ceil : nil
+
+      status = write(**status, read_bytes:, percent:, eta:)
+      report(status)
+      advanced
+    end
+
+    # The engine answered (recovered), or was given up on: clear recovery.json
+    def finish!(recovered: true)
+      if recovered && (status = self.status)
+        Shortbus.info "Engine recovered #{format_bytes(status[:wal_bytes])} of write-ahead log in #{(Time.now - Time.parse(status[:started_at])).round(1)}s"
+      end
+      FileUtils.rm_f(path)
+    end
+
+    # Progress while the engine recovers, nil when it isn't
+    def status
+      return nil unless path.exist?
+
+      status = JSON.parse(path.read, symbolize_names: true)
+      alive?(status[:pid]) ? status : nil
+    rescue JSON::ParserError, Errno::ENOENT
+      nil
+    end
+
+    def recovering?
+      !status.nil?
+    end
+
+    def path
+      config.recovery_path
+    end
+
+    private
+
+    def write(**status)
+      FileUtils.mkdir_p(path.dirname)
+      tmp = path.sub_ext(".#{Process.pid}.tmp")
+      tmp.write(JSON.generate(status.compact))
+      File.rename(tmp, path)
+      status
+    end
+
+    # Bytes the process has read, nil where /proc doesn't say
+    def read_bytes(pid)
+      File.read("/proc/#{pid}/io")[/^rchar:\s*(\d+)/, 1]&.to_i
+    rescue SystemCallError
+      nil
+    end
+
+    def report(status)
+      return if @reported_at && Time.now - @reported_at < REPORT_INTERVAL
+
+      @reported_at = Time.now
+      progress = status[:percent] ? "#{status[:percent]}% of #{format_bytes(status[:wal_bytes])}" : format_bytes(status[:wal_bytes])
+      Shortbus.info "Engine recovering write-ahead log: #{progress}#{", ETA #{status[:eta]}s" if status[:eta]}"
+    end
+
+    def format_bytes(bytes)
+      units = %w[B KB MB GB TB]
+      exponent = bytes.positive? ? [Math.log(bytes, 1024).floor, units.size - 1].min : 0
+      exponent.zero? ? "#{bytes}B" : format('%.1f%s', bytes.to_f / (1024**exponent), units[exponent])
+    end
+
+    def alive?(pid)
+      return false unless pid.to_i.positive?
+
+      Process.kill(0, pid.to_i)
+      true
+    rescue Errno::ESRCH
+      false
+    rescue Errno::EPERM
+      true
+    end
+  end
+end
@@ -0,0 +1,169 @@
+module Shortbus
+  # Interactive shell for poking at a running bus
+  #
+  #   ~> shortbus repl
+  #   shortbus> topics
+  #   shortbus> publish jobs {"id": 42}
+  #   shortbus> peek jobs 5
+  #
+  # Tab completes commands and topic names (from topics.yml and the engine).
+  # History is kept in the rendezvous at .repl_history, so it is shared by
+  # everyone working in the same directory.
+  class Repl
+    PROMPT = 'shortbus> '.freeze
+    HISTORY_SIZE = 1000
+
+    COMMANDS = {
+      'help' => 'list commands',
+      'topics' => 'list topics with their settings',
+      'show' => 'show TOPIC settings',
+      'publish' => 'publish TOPIC PAYLOAD',
+      'peek' => 'peek TOPIC [LIMIT] [OFFSET] without consuming',
+      'purge' => 'purge TOPIC backlog',
+      'requeue' => 'requeue DLQ_TOPIC [TO]',
+      'pending' => 'pending TOPIC GROUP unacked messages',
+      'connections' => 'list connected clients',
+      'exit' => 'leave (or ctrl-d)'
+    }.freeze
+
+    attr_reader :config, :output
+
+    def initialize(config: Shortbus.config, engine: Shortbus.engine, output: $stdout)
+      @config = config
+      @engine = engine
+      @output = output
+    end
+
+    def run!
+      require 'reline'
+
+      load_history!
+      Reline.completion_proc = method(:complete)
+      output.puts "shortbus v#{Shortbus.version} @ #{config.root_path} (type 'help' for commands)"
+
+      while (line = Reline.readline(PROMPT, true))
+        line = line.strip
+        next if line.empty?
+        break if %w[exit quit].include?(line)
+
+        execute(line)
+      end
+    ensure
+      save_history! if defined?(Reline)
+    end
+
+    # Run one command line, printing the result or the error
+    def execute(line)
+      command, *args = line.split(' ')
+
+      case command
+      when 'help'
+        COMMANDS.each { |name, description| output.puts format('  %-12s %s', name, description) }
+      when 'topics'
+        Shortbus.topics.all.each { |name, settings| print_settings(name, settings) }
+      when 'show'
+        topic = required(args, 0, 'show TOPIC')
+        print_settings(topic, Shortbus.topics.get(topic) || {})
+      when 'publish'
+        topic = required(args, 0, 'publish TOPIC PAYLOAD')
+        payload = line.split(' ', 3)[2]
+        raise ArgumentError, "usage: publish TOPIC PAYLOAD" unless payload
+
+        result = @engine.publish(topic, payload, metadata: { published_by: 'repl' })
+        output.puts "published #{topic}/#{result[:message_id]}"
+      when 'peek'
+        topic = required(args, 0, 'peek TOPIC [LIMIT] [OFFSET]')
+        messages = @engine.fetch_messages(topic, offset: Integer(args[2] || 0), limit: Integer(args[1] || 10))
+        output.puts "(no messages)" if messages.empty?
+        messages.each { |message| print_message(message) }
+      when 'purge'
+        topic = required(args, 0, 'purge TOPIC')
+        Admin.purge(topic, engine: @engine)
+        Shortbus.audit.record(:purge, by: ENV['USER'] || 'repl', via: :repl, engine: @engine, topic:)
+        output.puts "purged #{topic}"
+      when 'requeue'
+        topic = required(args, 0, 'requeue DLQ_TOPIC [TO]')
+        result = Admin.requeue(topic, to: args[1], engine: @engine)
+        Shortbus.audit.record(:requeue, by: ENV['USER'] || 'repl', via: :repl, engine: @engine, topic:, to: args[1], requeued: result[:requeued])
+        output.puts "requeued #{result[:requeued]} message(s) from #{topic}"
+      when 'pending'
+        topic = required(args, 0, 'pending TOPIC GROUP')
+        group = required(args, 1, 'pending TOPIC GROUP')
+        Shortbus.groups.pending(topic, group).each do |entry|
+          output.puts "  #{entry[:id]} #{entry[:consumer]} idle=#{entry[:idle]}s deliveries=#{entry[:deliveries]}"
+        end
+      when 'connections'
+        Shortbus.connections.list.each do |connection|
+          output.puts "  #{connection[:name] || '(anonymous)'} #{connection[:id]} pid=#{connection[:pid]}"
+        end
+      else
+        output.puts "unknown command: #{command} (type 'help')"
+      end
+    rescue ArgumentError, Error => e
+      output.puts "error: #{e.message}"
+    end
+
+    # Reline completion: the first word is a command, the rest are topics
+    def complete(word, preposing = '', _postposing = '')
+      candidates = preposing.strip.empty? ? COMMANDS.keys : topic_names
+      candidates.select { |candidate| candidate.start_with?(word) }
+    end
+
+    def topic_names
+      names = Shortbus.topics.all.keys.map(&:to_s)
+
+      begin
+        names += Array(@engine.list_topics).map { |topic| topic.is_a?(Hash) ? topic[:name].to_s : topic.to_s }
+      rescue ConnectionError, EngineError
+        # engine down; configured topics still complete
+      end
+
+      names.uniq.sort
+    end
+
+    private
+
+    def required(args, index, usage)
+      raise ArgumentError, "usage: #{usage}" unless args[index]
+
+      args[index]
+    end
+
+    def print_settings(name, settings)
+      output.puts name
+      settings.each { |key, value| output.puts "  #{key}: #{value}" }
+    end
+
+    # Header line, then the payload pretty-printed when it is JSON
+    def print_message(message)
+      metadata = message[:metadata] || {}
+      at = message[:timestamp] && Time.at(message[:timestamp].to_i).utc.iso8601
+
+      output.puts "##{message[:id]} #{message[:topic]} #{at}".strip
+      output.puts "  metadata: #{JSON.generate(metadata)}" unless metadata.empty?
+      output.puts pretty(message[:payload]).gsub(/^/, '  ')
+    end
+
+    def pretty(payload)
+      JSON.pretty_generate(JSON.parse(payload.to_s))
+    rescue JSON::ParserError
+      payload.to_s
+    end
+
+    def history_path
+      config.root_path / '.repl_history'
+    end
+
+    def load_history!
+      return unless history_path.exist?
+
+      history_path.read.lines.last(HISTORY_SIZE).each { |line| Reline::HISTORY << line.chomp }
+    end
+
+    def save_history!
+      return unless config.root_path.exist?
+
+      history_path.write(Reline::HISTORY.to_a.last(HISTORY_SIZE).join("\n") + "\n")
+    end
+  end
+end
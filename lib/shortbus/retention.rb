@@ -0,0 +1,58 @@
+module Shortbus
+  # Retention for topics that don't archive
+  #
+  # Topics with retention but no archive have messages older than retention
+  # deleted from the engine:
+  #
+  #   shortbus topic update events --retention 7d
+  #
+  # With archive set the Archiver moves them out instead, and on compacted
+  # topics retention only ages out tombstones (see Compactor), so neither is
+  # touched here. The daemon runs a pass every INTERVAL. As with archival,
+  # aged-out messages are always the oldest, so each pass reads the head
+  # only, and a message without a timestamp stops it.
+  class Retention
+    BATCH = 500
+    INTERVAL = 60
+
+    def initialize(engine: Shortbus.engine, topics: Shortbus.topics)
+      @engine = engine
+      @topics = topics
+    end
+
+    # One pass over every such topic (or just topic); returns
+    # { topic => messages deleted }
+    def expire!(topic = nil, now: Time.now)
+      names = topic ? [topic.to_s] : @topics.all.keys
+
+      names.each_with_object({}) do |name, expired|
+        settings = @topics.get(name) || {}
+        next unless settings[:retention]
+        next if settings[:archive] || settings[:compact]
+
+        expired[name] = expire_topic(name, cutoff: now - settings[:retention])
+      end
+    end
+
+    private
+
+    def expire_topic(name, cutoff:)
+      deleted = 0
+
+      loop do
+        expired = @engine.fetch_messages(name, offset: 0, limit: BATCH, tiered: false).take_while do |message|
+          time = DeliverPolicy.message_time(message)
+          time && time < cutoff
+        end
+        break if expired.empty?
+
+        expired.each { |message| @engine.delete_message(name, message[:id]) }
+        deleted += expired.size
+        break if expired.size < BATCH
+      end
+
+      Shortbus.info "Expired #{deleted} message(s) from #{name}" if deleted > 0
+      deleted
+    end
+  end
+end
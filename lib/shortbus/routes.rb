@@ -0,0 +1,133 @@
+module Shortbus
+  # Routing rules: copy or move publishes by topic and metadata
+  #
+  # config/routes.yml is a list of rules, each tried against every publish,
+  # so fan-out and forks need no consumer in between:
+  #
+  #   - match: "orders.*"          # topic glob, or a list of them
+  #     where:                     # metadata predicates; all must hold
+  #       region: eu               # equal (a string may be a glob, "eu-*")
+  #       tier: [gold, platinum]   # any of
+  #       test: ~                  # absent
+  #     to: orders.eu
+  #   - match: payments
+  #     where: { priority: high }
+  #     to: payments.urgent
+  #     action: move               # copy (the default) or move
+  #
+  # A copy rule publishes the message to its destination as well; a move
+  # rule publishes it there instead of where it was addressed, and the first
+  # matching move wins. Routed messages carry routed_from in metadata and
+  # aren't routed again, so rules can't loop. A publish is checked against
+  # the schema and signers of the topic it was addressed to, and against the
+  # max_depth of each topic it is written to. Copies are best effort: one
+  # that fails, or finds its topic full, is logged, and the publish still
+  # succeeds.
+  # Compare-and-publish (expected_last_sequence) and transactional publishes
+  # aren't routed, since their sequence and atomicity are the addressed
+  # topic's.
+  #
+  # Example:
+  #   Shortbus.routes.resolve('orders.eu', { region: 'eu' })  # => { topic: 'orders.eu', copies: ['orders.audit'] }
+  #   Shortbus.routes.publish('orders.eu', payload, metadata:) # => engine result, plus moved_to/copied_to
+  class Routes
+    ACTIONS = %w[copy move].freeze
+
+    attr_reader :config
+
+    # Rules as read from YAML, checked: [{ match: [globs], where: {}, to:, action: }]
+    def self.normalize(rules)
+      raise ConfigurationError, "routes must be a list of rules" unless rules.is_a?(Array)
+
+      rules.each_with_index.map do |rule, index|
+        raise ConfigurationError, "route #{index + 1} must be a mapping" unless rule.is_a?(Hash)
+
+        rule = rule.transform_keys(&:to_sym)
+        match = Array(rule[:match]).map(&:to_s)
+        to = rule[:to].to_s
+        action = (rule[:action] || 'copy').to_s
+        where = rule[:where] || {}
+
+        raise ConfigurationError, "route #{index + 1} has no match" if match.empty?
+        raise ConfigurationError, "route #{index + 1} has no valid to: #{rule[:to].inspect}" unless to =~ /\A[A-Za-z0-9_.\-]+\z/
+        raise ConfigurationError, "route #{index + 1}: action must be one of: #{ACTIONS.join(', ')}" unless ACTIONS.include?(action)
+        raise ConfigurationError, "route #{index + 1}: where must be a mapping" unless where.is_a?(Hash)
+
+        { match:, where: where.transform_keys(&:to_sym), to:, action: }
+      end
+    end
+
+    # Every topic a publish's result says it wrote to, for group commit
+    def self.written(topic, result)
+      [result[:moved_to] || topic.to_s, *result[:copied_to]]
+    end
+
+    def initialize(config: Shortbus.config, engine: Shortbus.engine)
+      @config = config
+      @engine = engine
+    end
+
+    def rules
+      return [] unless path.exist?
+
+      Routes.normalize(YAML.safe_load(File.read(path)) || [])
+    end
+
+    # Where a publish to topic with metadata goes: the topic written (topic
+    # itself unless a move rule matched) and the copies
+    def resolve(topic, metadata = {})
+      topic = topic.to_s
+      metadata = (metadata || {}).transform_keys(&:to_sym)
+      return { topic:, copies: [] } if metadata.key?(:routed_from) || Inbox.inbox?(topic)
+
+      matched = rules.select { |rule| matches?(rule, topic, metadata) }
+      move = matched.find { |rule| rule[:action] == 'move' }
+      destination = move ? move[:to] : topic
+      copies = matched.select { |rule| rule[:action] == 'copy' }.map { |rule| rule[:to] }.uniq - [destination, topic]
+
+      { topic: destination, copies: }
+    end
+
+    # Publish as the routes say; returns the engine's result for the message
+    # as written, with moved_to and copied_to when routing changed anything
+    def publish(topic, payload, metadata: {}, engine: @engine)
+      route = resolve(topic, metadata)
+      moved = route[:topic] != topic.to_s
+      routed = (metadata || {}).merge(routed_from: topic.to_s)
+
+      Admin.check_depth!(route[:topic], engine:)
+      result = engine.publish(route[:topic], payload, metadata: moved ? routed : metadata)
+
+      copied = route[:copies].select do |copy|
+        Admin.check_depth!(copy, engine:)
+        engine.publish(copy, payload, metadata: routed)
+        true
+      rescue Shortbus::Error => e
+        Shortbus.warn "Failed to route #{topic} message to #{copy}: #{e.message}"
+        false
+      end
+
+      result.merge(moved_to: (route[:topic] if moved), copied_to: (copied unless copied.empty?)).compact
+    end
+
+    def path
+      config.routes_yml
+    end
+
+    private
+
+    def matches?(rule, topic, metadata)
+      rule[:match].any? { |pattern| File.fnmatch?(pattern, topic) } &&
+        rule[:where].all? { |key, expected| satisfies?(metadata, key, expected) }
+    end
+
+    def satisfies?(metadata, key, expected)
+      return !metadata.key?(key) || metadata[key].nil? if expected.nil?
+      return expected.any? { |candidate| satisfies?(metadata, key, candidate) } if expected.is_a?(Array)
+      return false unless metadata.key?(key)
+
+      actual = metadata[key]
+      expected.is_a?(String) ? File.fnmatch?(expected, actual.to_s) : actual == expected
+    end
+  end
+end
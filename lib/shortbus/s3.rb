@@ -0,0 +1,110 @@
+module Shortbus
+  # Minimal S3-compatible object store client
+  #
+  # Just enough of the S3 API for archives: signed (SigV4) path-style
+  # requests over Net::HTTP, so it works against AWS, MinIO, R2, and friends
+  # without an SDK. Credentials come from the usual environment:
+  #
+  #   AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN (optional)
+  #   AWS_REGION (default us-east-1)
+  #   SHORTBUS_S3_ENDPOINT for non-AWS stores, e.g. http://localhost:9000
+  #
+  # Example:
+  #   s3, prefix = Shortbus::S3.from_url('s3://archives/shortbus')
+  #   s3.put("#{prefix}/jobs/part-1.ndjson.gz", body)
+  #   s3.get("#{prefix}/jobs/part-1.ndjson.gz")
+  class S3
+    UNRESERVED = /[^A-Za-z0-9\-_.~]/
+
+    attr_reader :bucket, :region, :endpoint
+
+    # s3://bucket/prefix => [client, prefix]
+    def self.from_url(url, **options)
+      uri = URI(url)
+      raise ConfigurationError, "Not an s3:// URL: #{url}" unless uri.scheme == 's3' && uri.host
+
+      [new(bucket: uri.host, **options), uri.path.sub(%r{\A/}, '').chomp('/')]
+    end
+
+    def initialize(bucket:, region: ENV['AWS_REGION'] || 'us-east-1', endpoint: ENV['SHORTBUS_S3_ENDPOINT'],
+                   access_key_id: ENV['AWS_ACCESS_KEY_ID'], secret_access_key: ENV['AWS_SECRET_ACCESS_KEY'],
+                   session_token: ENV['AWS_SESSION_TOKEN'])
+      raise ConfigurationError, "S3 credentials missing (AWS_ACCESS_KEY_ID / AWS_SECRET_ACCESS_KEY)" unless access_key_id && secret_access_key
+
+      @bucket = bucket
+      @region = region
+      @endpoint = URI(endpoint || "https://s3.#{region}.amazonaws.com")
+      @access_key_id = access_key_id
+      @secret_access_key = secret_access_key
+      @session_token = session_token
+    end
+
+    def put(key, body)
+      request('PUT', key, body: body)
+      true
+    end
+
+    def get(key)
+      request('GET', key).body
+    end
+
+    private
+
+    def request(method, key, body: '', query: {})
+      path = "/#{escape(bucket)}/#{key.to_s.split('/').map { |segment| escape(segment) }.join('/')}"
+      query_string = query.sort.map { |name, value| "#{escape(name)}=#{escape(value)}" }.join('&')
+
+      uri = endpoint.dup
+      uri.path = path
+      uri.query = query_string unless query_string.empty?
+
+      headers = sign(method, path, query_string, body)
+      http = Net::HTTP.new(uri.host, uri.port)
+      http.use_ssl = uri.scheme == 'https'
+      http.open_timeout = 5
+      http.read_timeout = 60
+
+      response = http.send_request(method, uri.request_uri, body, headers)
+      raise EngineError, "S3 #{method} #{key} failed: #{response.code} #{response.body}" unless response.is_a?(Net::HTTPSuccess)
+
+      response
+    rescue SocketError, SystemCallError, Net::OpenTimeout => e
+      raise ConnectionError, "Cannot reach S3 at #{endpoint}: #{e.message}"
+    end
+
+    # AWS Signature Version 4 headers for one request
+    def sign(method, path, query_string, body)
+      now = Time.now.utc
+      amz_date = now.strftime('%Y%m%dT%H%M%SZ')
+      date = now.strftime('%Y%m%d')
+      payload_hash = OpenSSL::Digest::SHA256.hexdigest(body.to_s)
+
+      host = endpoint.host
+      host = "#{host}:#{endpoint.port}" unless endpoint.port == endpoint.default_port
+
+      headers = { 'host' => host, 'x-amz-content-sha256' => payload_hash, 'x-amz-date' => amz_date }
+      headers['x-amz-security-token'] = @session_token if @session_token
+
+      signed_headers = headers.keys.sort.join(';')
+      canonical_headers = headers.sort.map { |name, value| "#{name}:#{value}\n" }.join
+      canonical_request = [method, path, query_string, canonical_headers, signed_headers, payload_hash].join("\n")
+
+      scope = "#{date}/#{region}/s3/aws4_request"
+      string_to_sign = ['AWS4-HMAC-SHA256', amz_date, scope, OpenSSL::Digest::SHA256.hexdigest(canonical_request)].join("\n")
+
+      key = ["AWS4#{@secret_access_key}", date, region, 's3', 'aws4_request'].reduce do |secret, part|
+        OpenSSL::HMAC.digest('sha256', secret, part)
+      end
+      signature = OpenSSL::HMAC.hexdigest('sha256', key, string_to_sign)
+
+      headers.merge(
+        'authorization' => "AWS4-HMAC-SHA256 Credential=#{@access_key_id}/#{scope}, " \
+                           "SignedHeaders=#{signed_headers}, Signature=#{signature}"
+      ).except('host')
+    end
+
+    def escape(value)
+      value.to_s.gsub(UNRESERVED) { |char| char.bytes.map { |byte| format('%%%02X', byte) }.join }
+    end
+  end
+end
@@ -0,0 +1,197 @@
+module Shortbus
+  # Broker-managed scheduled publishes
+  #
+  # Schedules live in config/schedules.yml inside the rendezvous, so they can
+  # be edited by hand or managed through the $sys.schedules op and
+  # `shortbus schedule`:
+  #
+  #   heartbeat:
+  #     cron: "*/5 * * * *"
+  #     topic: heartbeat
+  #     payload: tick
+  #   nightly-report:
+  #     cron: "0 2 * * *"
+  #     topic: jobs
+  #     payload: '{"job": "report"}'
+  #     metadata: { priority: low }
+  #
+  # The daemon checks them every second (see Cron for the syntax) and
+  # publishes each one when it comes due, stamped with metadata.schedule.
+  # When a schedule last ran is kept in schedules/NAME.json, so a restart
+  # neither repeats a run nor forgets one: runs missed while the daemon was
+  # down are caught up with a single publish, not one per missed slot.
+  #
+  # Example:
+  #   Shortbus.schedules.add('heartbeat', cron: '*/5 * * * *', topic: 'heartbeat', payload: 'tick')
+  #   Shortbus.schedules.tick!    # => { "heartbeat" => 42 } (the message ids published)
+  class Schedules
+    SETTINGS = %i[cron topic payload metadata].freeze
+
+    attr_reader :config
+
+    def initialize(config: Shortbus.config)
+      @config = config
+    end
+
+    # { name => definition }
+    def all
+      read.transform_values { |definition| symbolize(definition) }
+    end
+
+    def get(name)
+      definition = read[name.to_s]
+      definition && symbolize(definition)
+    end
+
+    def add(name, **definition)
+      validate_name!(name)
+      definition = normalize(definition)
+
+      transaction do |schedules|
+        raise ArgumentError, "Schedule already exists: #{name}" if schedules.key?(name.to_s)
+        schedules[name.to_s] = stringify(definition)
+      end
+
+      # Due from now on, not from the epoch
+      record(name, last_run_at: Time.now.to_i, runs: 0)
+      definition
+    end
+
+    def remove(name)
+      transaction do |schedules|
+        raise ArgumentError, "Schedule not found: #{name}" unless schedules.key?(name.to_s)
+        schedules.delete(name.to_s)
+      end
+
+      FileUtils.rm_f(state_path(name))
+      true
+    end
+
+    # Definitions with their run state and next run, for listing
+    def status(now: Time.now)
+      all.map do |name, definition|
+        state = state(name)
+        next_run = next_run(definition, state, now)
+
+        { name: name, **definition, **state, next_run_at: next_run&.utc&.iso8601 }
+      end
+    end
+
+    # Publish every schedule that has come due; returns { name => message_id }
+    def tick!(now: Time.now, engine: Shortbus.engine)
+      all.each_with_object({}) do |(name, definition), published|
+        locked(name) do |state|
+          # First sight of a hand-written schedule: due from now on
+          state[:last_run_at] ||= now.to_i
+          next state if Cron.new(definition[:cron]).next_after(Time.at(state[:last_run_at])) > now
+
+          metadata = (definition[:metadata] || {}).transform_keys(&:to_sym).merge(schedule: name)
+          result = engine.publish(definition[:topic], definition[:payload].to_s, metadata:)
+          published[name] = result[:message_id]
+
+          state.merge(last_run_at: now.to_i, runs: state[:runs].to_i + 1, last_message_id: result[:message_id]).except(:last_error)
+        rescue => e
+          # Left due, so the next tick tries again
+          Shortbus.error "Schedule #{name} failed: #{e.message}"
+          state.merge(last_error: e.message)
+        end
+      end
+    end
+
+    def path
+      config.schedules_yml
+    end
+
+    private
+
+    # nil for a hand-written expression that doesn't parse
+    def next_run(definition, state, now)
+      Cron.new(definition[:cron]).next_after(Time.at(state[:last_run_at] || now.to_i))
+    rescue ArgumentError
+      nil
+    end
+
+    def normalize(definition)
+      definition = definition.transform_keys(&:to_sym).compact
+
+      unknown = definition.keys - SETTINGS
+      raise ArgumentError, "Unknown schedule setting(s): #{unknown.join(', ')}" if unknown.any?
+      raise ArgumentError, "Schedule needs a cron expression" unless definition[:cron]
+      raise ArgumentError, "Schedule needs a topic" unless definition[:topic]
+
+      Cron.new(definition[:cron])
+      definition[:metadata] = definition[:metadata].transform_keys(&:to_s) if definition[:metadata].is_a?(Hash)
+      definition.merge(cron: definition[:cron].to_s, topic: definition[:topic].to_s, payload: definition[:payload].to_s)
+    end
+
+    def validate_name!(name)
+      raise ArgumentError, "Invalid schedule name: #{name.inspect}" unless name.to_s =~ /\A[A-Za-z0-9_.\-]+\z/
+    end
+
+    def state(name)
+      return {} unless state_path(name).exist?
+
+      parse(File.read(state_path(name)))
+    end
+
+    def record(name, **state)
+      locked(name) { |current| current.merge(state) }
+    end
+
+    def state_path(name)
+      validate_name!(name)
+      config.schedules_dir / "#{name}.json"
+    end
+
+    # The block gets the schedule's state and returns the new state
+    def locked(name)
+      FileUtils.mkdir_p(config.schedules_dir)
+
+      File.open(state_path(name), File::RDWR | File::CREAT, 0o644) do |file|
+        file.flock(File::LOCK_EX)
+        state = yield parse(file.read)
+
+        file.rewind
+        file.truncate(0)
+        file.write(JSON.generate(state))
+        file.flush
+      end
+    end
+
+    def parse(json)
+      json.to_s.strip.empty? ? {} : JSON.parse(json, symbolize_names: true)
+    rescue JSON::ParserError
+      {}
+    end
+
+    def read
+      return {} unless path.exist?
+
+      YAML.safe_load(File.read(path)) || {}
+    end
+
+    def transaction
+      FileUtils.mkdir_p(path.dirname)
+
+      File.open(path, File::RDWR | File::CREAT, 0o644) do |file|
+        file.flock(File::LOCK_EX)
+
+        schedules = YAML.safe_load(file.read) || {}
+        yield schedules
+
+        file.rewind
+        file.truncate(0)
+        file.write(schedules.to_yaml)
+        file.flush
+      end
+    end
+
+    def symbolize(definition)
+      definition.transform_keys(&:to_sym)
+    end
+
+    def stringify(definition)
+      definition.transform_keys(&:to_s)
+    end
+  end
+end
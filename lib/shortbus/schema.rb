@@ -0,0 +1,65 @@
+module Shortbus
+  # Per-topic publish schemas
+  #
+  # A topic's schema setting says what its publishes must look like:
+  #
+  #   schema: json                                   # payload parses as JSON
+  #   schema: { required: [order_id, amount] }       # a JSON object with these keys
+  #   schema: { metadata: [tenant] }                 # these metadata keys set
+  #
+  # Publishes that don't fit are refused, and counted in Metrics so the
+  # producers sending them can be found. Schemas are stored normalized, with
+  # string keys, so they round-trip through topics.yml.
+  module Schema
+    module_function
+
+    def normalize(value)
+      case value
+      when 'json', :json
+        { 'payload' => 'json' }
+      when Hash
+        schema = value.transform_keys(&:to_s)
+        unknown = schema.keys - %w[payload required metadata]
+        raise ArgumentError, "unknown schema field(s): #{unknown.join(', ')}" if unknown.any?
+
+        required = Array(schema['required']).map(&:to_s)
+        metadata = Array(schema['metadata']).map(&:to_s)
+        payload = required.any? ? 'json' : schema['payload']&.to_s
+        raise ArgumentError, "schema payload must be json" unless payload.nil? || payload == 'json'
+
+        { 'payload' => payload, 'required' => required, 'metadata' => metadata }.reject { |_, v| v.nil? || v.empty? }
+      else
+        raise ArgumentError, "invalid schema: #{value.inspect}"
+      end
+    end
+
+    # Raise, counting the failure, unless a publish fits topic's schema
+    def check!(topic, payload, metadata = {}, topics: Shortbus.topics, metrics: Shortbus.metrics)
+      error = violation(topics.get(topic)&.fetch(:schema, nil), payload, metadata)
+      return true unless error
+
+      metrics.schema_failure(topic, error)
+      raise TopicError, "Schema check failed for #{topic}: #{error}"
+    end
+
+    # Why payload and metadata don't fit schema, or nil when they do
+    def violation(schema, payload, metadata = {})
+      return nil unless schema
+
+      schema = schema.transform_keys(&:to_s)
+      missing = Array(schema['metadata']).reject { |key| metadata.key?(key.to_sym) || metadata.key?(key) }
+      return "missing metadata: #{missing.join(', ')}" if missing.any?
+      return nil unless schema['payload'] == 'json'
+
+      document = JSON.parse(payload.to_s)
+      required = Array(schema['required'])
+      return nil if required.empty?
+      return "payload is not a JSON object" unless document.is_a?(Hash)
+
+      missing = required - document.keys
+      "payload missing: #{missing.join(', ')}" if missing.any?
+    rescue JSON::ParserError
+      "payload is not JSON"
+    end
+  end
+end
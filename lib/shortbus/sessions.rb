@@ -0,0 +1,104 @@
+module Shortbus
+  # Durable client sessions
+  #
+  # A client that connects with a durable name gets its subscription state
+  # (topics, positions, limits, pause state) saved under sessions/NAME.json.
+  # Reconnecting with the same name within the session timeout picks that
+  # state back up instead of starting as a brand-new subscriber.
+  #
+  # Only one live connection may hold a session at a time.
+  class Sessions
+    attr_reader :config
+
+    def initialize(config: Shortbus.config)
+      @config = config
+    end
+
+    # Take ownership of the session, returning its saved subscriptions (or
+    # nil if it is new or expired)
+    def claim(name, timeout: config.session_timeout)
+      locked(name) do |file|
+        state = parse(file.read)
+
+        if state && state[:pid] != Process.pid && alive?(state[:pid]) && !state[:disconnected_at]
+          raise AccessError, "Durable session #{name} is in use by pid #{state[:pid]}"
+        end
+
+        state = nil if state && expired?(state, timeout)
+        write(file, { name: name.to_s, pid: Process.pid, subscriptions: state&.fetch(:subscriptions, {}) || {} })
+
+        state && state[:subscriptions]
+      end
+    end
+
+    def save(name, subscriptions)
+      locked(name) do |file|
+        write(file, { name: name.to_s, pid: Process.pid, subscriptions: subscriptions })
+      end
+    end
+
+    # Mark the session disconnected; the timeout starts now
+    def release(name, subscriptions)
+      locked(name) do |file|
+        write(file, {
+          name: name.to_s,
+          pid: Process.pid,
+          subscriptions: subscriptions,
+          disconnected_at: Time.now.utc.iso8601
+        })
+      end
+    end
+
+    def delete(name)
+      FileUtils.rm_f(path(name))
+    end
+
+    private
+
+    def path(name)
+      raise ArgumentError, "Invalid session name: #{name.inspect}" unless name.to_s =~ /\A[A-Za-z0-9_.\-]+\z/
+
+      config.sessions_dir / "#{name}.json"
+    end
+
+    def locked(name)
+      FileUtils.mkdir_p(config.sessions_dir)
+
+      File.open(path(name), File::RDWR | File::CREAT, 0o644) do |file|
+        file.flock(File::LOCK_EX)
+        yield file
+      end
+    end
+
+    def parse(json)
+      json.to_s.strip.empty? ? nil : JSON.parse(json, symbolize_names: true)
+    rescue JSON::ParserError
+      nil
+    end
+
+    def write(file, state)
+      file.rewind
+      file.truncate(0)
+      file.write(JSON.generate(state))
+      file.flush
+      state
+    end
+
+    def expired?(state, timeout)
+      return false unless state[:disconnected_at]
+
+      Time.now - Time.parse(state[:disconnected_at]) > timeout
+    end
+
+    def alive?(pid)
+      return false unless pid.to_i > 0
+
+      Process.kill(0, pid.to_i)
+      true
+    rescue Errno::ESRCH
+      false
+    rescue Errno::EPERM
+      true
+    end
+  end
+end
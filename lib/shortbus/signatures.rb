@@ -0,0 +1,123 @@
+module Shortbus
+  # Message signatures
+  #
+  # A publisher signs a payload with an HMAC secret or an Ed25519 key and
+  # sends the signature in metadata:
+  #
+  #   { "signature": { "alg": "HS256", "kid": "billing", "sig": "base64..." } }
+  #
+  # alg is HS256 (HMAC-SHA256) or Ed25519; kid names the key. Only the
+  # payload is signed, since brokers add to metadata on the way. A sealed
+  # payload (see Envelope) is signed as sealed, so it can be checked without
+  # being read.
+  #
+  # Topics whose signers setting lists key ids refuse publishes not signed by
+  # one of them. The broker's copies of the keys live in config/keys.yml
+  # inside the rendezvous, base64 encoded:
+  #
+  #   billing:
+  #     alg: HS256
+  #     secret: c2VjcmV0...
+  #   pos-1:
+  #     alg: Ed25519
+  #     public_key: MCowBQYDK2VwAyEA...   # raw 32 bytes, DER, or PEM
+  #
+  # Example:
+  #   metadata = { signature: Shortbus::Signatures.sign(payload, kid: 'billing', alg: 'HS256', key: secret) }
+  #   Shortbus.signatures.verify(payload, metadata)   # => "billing"
+  class Signatures
+    ALGORITHMS = %w[HS256 Ed25519].freeze
+
+    # ASN.1 wrappers for raw Ed25519 keys, which OpenSSL only reads as DER
+    ED25519_PUBLIC_PREFIX = ['302a300506032b6570032100'].pack('H*')
+    ED25519_PRIVATE_PREFIX = ['302e020100300506032b657004220420'].pack('H*')
+
+    attr_reader :config
+
+    def initialize(config: Shortbus.config)
+      @config = config
+    end
+
+    # The metadata.signature for payload; key is the HMAC secret, or the
+    # Ed25519 private key (a 32-byte seed, DER, PEM, or OpenSSL::PKey)
+    def self.sign(payload, kid:, alg:, key:)
+      sig =
+        case alg.to_s
+        when 'HS256'
+          OpenSSL::HMAC.digest('SHA256', key.to_s, payload.to_s)
+        when 'Ed25519'
+          ed25519(key, ED25519_PRIVATE_PREFIX).sign(nil, payload.to_s)
+        else
+          raise ArgumentError, "Signature alg must be one of: #{ALGORITHMS.join(', ')}"
+        end
+
+      { alg: alg.to_s, kid: kid.to_s, sig: [sig].pack('m0') }
+    end
+
+    def self.ed25519(key, prefix)
+      return key if key.is_a?(OpenSSL::PKey::PKey)
+
+      key = key.to_s
+      key = prefix + key if key.bytesize == 32
+      OpenSSL::PKey.read(key)
+    end
+
+    # { kid => { alg:, secret: | public_key: } }, decoded
+    def keys
+      return {} unless path.exist?
+
+      (YAML.safe_load(File.read(path)) || {}).to_h do |kid, key|
+        key = key.transform_keys(&:to_sym)
+        [kid.to_s, key.merge(key.slice(:secret, :public_key).transform_values { |value| decode(value) })]
+      end
+    end
+
+    # The key id that signed payload, or nil when the signature is missing,
+    # unknown, or wrong
+    def verify(payload, metadata, signers: nil)
+      signature = (metadata || {}).transform_keys(&:to_sym)[:signature]
+      return nil unless signature.is_a?(Hash)
+
+      signature = signature.transform_keys(&:to_sym)
+      kid = signature[:kid].to_s
+      return nil if signers && !signers.include?(kid)
+
+      key = keys[kid]
+      return nil unless key && key[:alg] == signature[:alg]
+
+      sig = signature[:sig].to_s.unpack1('m0')
+      valid =
+        case key[:alg]
+        when 'HS256'
+          OpenSSL.secure_compare(OpenSSL::HMAC.digest('SHA256', key[:secret].to_s, payload.to_s), sig)
+        when 'Ed25519'
+          self.class.ed25519(key[:public_key], ED25519_PUBLIC_PREFIX).verify(nil, sig, payload.to_s)
+        end
+
+      valid ? kid : nil
+    rescue ArgumentError, OpenSSL::PKey::PKeyError
+      nil
+    end
+
+    # Raise unless topic takes unsigned publishes or payload is signed by
+    # one of its signers
+    def check!(topic, payload, metadata, topics: Shortbus.topics)
+      signers = topics.get(topic)&.fetch(:signers, nil)
+      return true if signers.nil? || signers.empty?
+      return true if verify(payload, metadata, signers:)
+
+      raise AccessError, "#{topic} requires a valid signature from: #{signers.join(', ')}"
+    end
+
+    def path
+      config.keys_yml
+    end
+
+    private
+
+    def decode(value)
+      value = value.to_s
+      value.include?('-----BEGIN') ? value : value.unpack1('m')
+    end
+  end
+end
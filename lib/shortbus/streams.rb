@@ -0,0 +1,142 @@
+module Shortbus
+  # Event streams, one per aggregate
+  #
+  # For event sourcing: a stream (order-42, say) is the retained topic
+  # stream.order-42, and each event appended to it gets the next version,
+  # 1 for the first, stamped as metadata.version (with metadata.event_type
+  # when given). Appends name the version they expect the stream to be at,
+  # and fail with ConflictError if another writer got there first:
+  #
+  #   nil      any version
+  #   0        the stream must not exist yet
+  #   N        the stream's last event must be version N
+  #
+  # The check and the publishes happen under a lock on streams/NAME.json,
+  # which holds the stream's version and the offset after its last event;
+  # events from an append interrupted by a crash are found on the next one
+  # and counted. Messages published to a stream topic directly have no
+  # version and aren't part of the stream.
+  #
+  # Example:
+  #   Shortbus.streams.append('order-42', [{ type: 'placed', payload: '{"total": 30}' }], expected_version: 0)
+  #   # => { stream: "order-42", version: 1, events: [{ version: 1, message_id: "...", offset: 1 }] }
+  #   Shortbus.streams.read('order-42', from: 1)   # => [{ payload: ..., metadata: { version: 1, ... } }, ...]
+  class Streams
+    PREFIX = 'stream.'
+    NAME = /\A[A-Za-z0-9_\-.]+\z/
+    BATCH = 500
+
+    attr_reader :config
+
+    def initialize(config: Shortbus.config)
+      @config = config
+    end
+
+    def topic(stream)
+      raise ArgumentError, "Invalid stream name: #{stream.inspect}" unless stream.to_s.match?(NAME)
+
+      "#{PREFIX}#{stream}"
+    end
+
+    # events are { payload:, type:, metadata: } hashes
+    def append(stream, events, expected_version: nil, metadata: {}, engine: Shortbus.engine)
+      topic = topic(stream)
+      raise ArgumentError, "events must be a non-empty list" unless events.is_a?(Array) && events.any?
+      raise ArgumentError, "events need a payload" unless events.all? { |event| event.is_a?(Hash) && event.key?(:payload) }
+
+      locked(stream) do |state|
+        catch_up!(topic, state, engine)
+
+        expected = Integer(expected_version) unless expected_version.nil?
+        if expected && expected != state[:version]
+          raise ConflictError.new("Stream #{stream} is at version #{state[:version]}, not #{expected}", current: state[:version])
+        end
+
+        appended = events.map do |event|
+          version = state[:version] + 1
+          stamped = (event[:metadata] || {}).merge(metadata).merge(stream: stream.to_s, version:, event_type: event[:type]&.to_s).compact
+          result = engine.publish(topic, event[:payload].to_s, metadata: stamped)
+
+          state[:version] = version
+          state[:offset] = result[:offset] + 1
+          { version:, message_id: result[:message_id], offset: result[:offset] }
+        end
+
+        { stream: stream.to_s, version: state[:version], events: appended }
+      end
+    end
+
+    # Events from version from on, oldest first
+    def read(stream, from: 1, limit: nil, engine: Shortbus.engine)
+      topic = topic(stream)
+      from = Integer(from)
+      events = []
+      offset = 0
+
+      loop do
+        messages = engine.fetch_messages(topic, offset:, limit: BATCH)
+        break if messages.empty?
+
+        events.concat(messages.select { |message| message.dig(:metadata, :version).to_i >= from })
+        break if limit && events.size >= limit
+
+        offset = messages.last[:id] + 1
+        break if messages.size < BATCH
+      end
+
+      limit ? events.first(limit) : events
+    end
+
+    # 0 for a stream with no events
+    def version(stream)
+      topic(stream)
+      read_state(stream)[:version]
+    end
+
+    def path(stream)
+      config.streams_dir / "#{stream}.json"
+    end
+
+    private
+
+    # Events published after the state was last written
+    def catch_up!(topic, state, engine)
+      loop do
+        messages = engine.fetch_messages(topic, offset: state[:offset], limit: BATCH, tiered: false)
+        break if messages.empty?
+
+        versions = messages.map { |message| message.dig(:metadata, :version).to_i }
+        state[:version] = [state[:version], *versions].max
+        state[:offset] = messages.last[:id] + 1
+        break if messages.size < BATCH
+      end
+    end
+
+    def read_state(stream)
+      return { version: 0, offset: 0 } unless path(stream).exist?
+
+      state = JSON.parse(File.read(path(stream)), symbolize_names: true)
+      { version: state[:version] || 0, offset: state[:offset] || 0 }
+    end
+
+    def locked(stream)
+      FileUtils.mkdir_p(config.streams_dir)
+
+      File.open(path(stream), File::RDWR | File::CREAT, 0o644) do |file|
+        file.flock(File::LOCK_EX)
+        json = file.read
+        state = json.strip.empty? ? {} : JSON.parse(json, symbolize_names: true)
+        state = { version: state[:version] || 0, offset: state[:offset] || 0 }
+
+        begin
+          yield state
+        ensure
+          # Even a failed append may have published some of its events
+          file.rewind
+          file.truncate(0)
+          file.write(JSON.generate(state))
+        end
+      end
+    end
+  end
+end
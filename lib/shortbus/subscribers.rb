@@ -0,0 +1,93 @@
+module Shortbus
+  # Cross-process subscriber registry
+  #
+  # Each pipe process is its own connection, so "how many subscribers does this
+  # topic have?" has to be answered through the rendezvous:
+  #
+  #   subscribers/TOPIC/CONNECTION_ID   # contents: pid of the owning process
+  #   subscribers/TOPIC/.idle           # touched when the last subscriber leaves
+  #
+  # Entries whose process has died are pruned on read, so a crashed client
+  # doesn't keep a topic alive forever.
+  class Subscribers
+    IDLE = '.idle'
+
+    attr_reader :config
+
+    def initialize(config: Shortbus.config)
+      @config = config
+    end
+
+    def add(topic, connection_id)
+      dir = topic_dir(topic)
+      FileUtils.mkdir_p(dir)
+      File.write(dir / connection_id.to_s, Process.pid.to_s)
+      FileUtils.rm_f(dir / IDLE)
+      true
+    end
+
+    # Returns the number of subscribers left on the topic
+    def remove(topic, connection_id)
+      FileUtils.rm_f(topic_dir(topic) / connection_id.to_s)
+      count(topic)
+    end
+
+    def count(topic)
+      list(topic).size
+    end
+
+    # Live connection ids subscribed to the topic
+    def list(topic)
+      dir = topic_dir(topic)
+      return [] unless dir.exist?
+
+      live, dead = entries(dir).partition { |entry| alive?(entry) }
+      dead.each { |entry| FileUtils.rm_f(entry) }
+
+      touch_idle!(dir) if live.empty?
+      live.map { |entry| entry.basename.to_s }
+    rescue Errno::ENOENT
+      []
+    end
+
+    # When the topic last lost its final subscriber (nil if it has any)
+    def idle_since(topic)
+      return nil if count(topic) > 0
+
+      idle = topic_dir(topic) / IDLE
+      idle.exist? ? idle.mtime : nil
+    end
+
+    # Forget a topic entirely (after it has been deleted)
+    def clear(topic)
+      FileUtils.rm_rf(topic_dir(topic))
+    end
+
+    private
+
+    def topic_dir(topic)
+      config.subscribers_dir / topic.to_s
+    end
+
+    def entries(dir)
+      dir.children.reject { |entry| entry.basename.to_s.start_with?('.') }
+    end
+
+    def touch_idle!(dir)
+      idle = dir / IDLE
+      FileUtils.touch(idle) unless idle.exist?
+    end
+
+    def alive?(entry)
+      pid = File.read(entry).strip.to_i
+      return false unless pid > 0
+
+      Process.kill(0, pid)
+      true
+    rescue Errno::ESRCH, Errno::ENOENT
+      false
+    rescue Errno::EPERM
+      true
+    end
+  end
+end
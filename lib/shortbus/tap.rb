@@ -0,0 +1,100 @@
+module Shortbus
+  # Sampled copies of live traffic, for debugging
+  #
+  # A tap follows every topic matching a glob pattern from its head, reading
+  # through the engine as peek does: it holds no subscription, consumer
+  # group, or stored position, so consumers never see it and nothing they
+  # get changes. Each new message is kept with probability sample (0..1);
+  # kept ones are yielded, or copied to a tap topic (to:) with the topic they
+  # came from in metadata.tapped_from. Topics that start matching later are
+  # picked up every RESCAN seconds, from their first message.
+  #
+  # Example:
+  #   Tap.new('orders.*', sample: Tap.parse_sample('1%')).run { |msg| puts JSON.generate(msg) }
+  #   Tap.new('orders.*', sample: 0.1, to: 'debug.orders').run(stop: -> { done })
+  class Tap
+    POLL = 0.25
+    RESCAN = 5
+    PAGE = 100
+
+    attr_reader :pattern, :sample, :to
+
+    # "1%", "0.5%" or a fraction ("0.01"); nil is everything
+    def self.parse_sample(value)
+      return 1.0 if value.nil?
+
+      sample = value.to_s.end_with?('%') ? Float(value.to_s.delete_suffix('%')) / 100 : Float(value)
+      raise ArgumentError, "Sample must be between 0 and 100%, not #{value}" unless (0..1).cover?(sample)
+
+      sample
+    rescue TypeError
+      raise ArgumentError, "Invalid sample: #{value.inspect}"
+    end
+
+    def initialize(pattern, sample: 1.0, to: nil, engine: Shortbus.engine, random: Random.new)
+      raise ArgumentError, "Sample must be between 0 and 1, not #{sample}" unless (0..1).cover?(sample)
+      raise ArgumentError, "A tap can't copy into a topic it reads (#{to} matches #{pattern})" if to && File.fnmatch?(pattern, to)
+
+      @pattern = pattern
+      @sample = sample
+      @to = to
+      @engine = engine
+      @random = random
+      @offsets = nil # topic => next id to read; nil until the first scan
+    end
+
+    # Follow the matching topics until stop returns true, yielding each kept
+    # message (or copying it to the tap topic)
+    def run(stop: -> { false }, &block)
+      scanned_at = nil
+
+      until stop.call
+        if scanned_at.nil? || Time.now - scanned_at >= RESCAN
+          scan!
+          scanned_at = Time.now
+        end
+
+        sleep POLL if poll(&block).zero?
+      end
+    end
+
+    # Topics matching the pattern; those already there start at their head
+    def scan!
+      first = @offsets.nil?
+      @offsets ||= {}
+
+      topics.each do |topic|
+        @offsets[topic] ||= first ? DeliverPolicy.start_offset(topic, 'new', engine: @engine) : 0
+      end
+    end
+
+    # Read what every topic has gained; returns how many messages that was
+    def poll(&block)
+      scan! if @offsets.nil?
+
+      @offsets.sum do |topic, offset|
+        messages = @engine.fetch_messages(topic, offset:, limit: PAGE, tiered: false)
+        next 0 if messages.empty?
+
+        @offsets[topic] = messages.last[:id] + 1
+        messages.each { |msg| keep(topic, msg, &block) if @random.rand < @sample }
+        messages.size
+      end
+    end
+
+    private
+
+    def topics
+      names = @engine.list_topics.map { |topic| topic.is_a?(Hash) ? topic[:name].to_s : topic.to_s }
+      names.select { |name| File.fnmatch?(pattern, name) && !Inbox.inbox?(name) && name != to }
+    end
+
+    def keep(topic, msg)
+      if to
+        @engine.publish(to, msg[:payload], metadata: (msg[:metadata] || {}).merge(tapped_from: topic))
+      else
+        yield msg
+      end
+    end
+  end
+end
@@ -0,0 +1,111 @@
+module Shortbus
+  # Tiered storage: reading archived segments back
+  #
+  # Every file the Archiver writes is recorded as a segment in
+  # tiers/TOPIC.json (its id range, where it went, and the fencing token of
+  # the broker that wrote it; see DataLock):
+  #
+  #   [{ "first": 41, "last": 97, "destination": "s3://bucket/shortbus", "key": "topic=jobs/...", "format": "ndjson", "token": 7 }]
+  #
+  # Engine#fetch_messages consults the index before asking BlockQueue, so a
+  # subscriber replaying from an offset that has aged out of the engine gets
+  # the archived messages first and then carries on into live ones, without
+  # knowing the difference. Local disk only holds what is inside retention;
+  # the rest lives wherever archive points, typically S3.
+  #
+  # Recently read segments are cached in memory, since a replay reads each
+  # one a page at a time.
+  class Tiers
+    CACHED_SEGMENTS = 8
+
+    attr_reader :config
+
+    def initialize(config: Shortbus.config, archiver: nil)
+      @config = config
+      @archiver = archiver
+      @cache = {}
+      @mutex = Mutex.new
+    end
+
+    def record(topic, first:, last:, destination:, key:, format:, token: nil)
+      locked(topic) do |segments|
+        segments << { first: first, last: last, destination: destination, key: key, format: format, token: token }.compact
+        segments.sort_by! { |segment| segment[:first] }
+      end
+    end
+
+    def segments(topic)
+      return [] unless path(topic).exist?
+
+      parse(File.read(path(topic)))
+    end
+
+    # Up to limit archived messages with id >= offset, oldest first
+    def fetch(topic, offset:, limit:)
+      return [] unless path(topic).exist?
+
+      messages = []
+
+      segments(topic).each do |segment|
+        next if segment[:last] < offset
+        break if messages.size >= limit
+
+        messages.concat(read(topic, segment).select { |message| message[:id] >= offset }.first(limit - messages.size))
+      end
+
+      messages
+    end
+
+    # Drop the index (the archive files themselves are kept for offline use)
+    def forget(topic)
+      FileUtils.rm_f(path(topic))
+      @mutex.synchronize { @cache.delete_if { |key, _| key.first == topic.to_s } }
+    end
+
+    private
+
+    def archiver
+      @archiver ||= Shortbus.archiver
+    end
+
+    def read(topic, segment)
+      cache_key = [topic.to_s, segment[:destination], segment[:key]]
+
+      @mutex.synchronize do
+        return @cache[cache_key] if @cache.key?(cache_key)
+      end
+
+      messages = archiver.load(archiver.sink(segment[:destination]), segment[:key], segment[:format])
+
+      @mutex.synchronize do
+        @cache.delete(@cache.keys.first) if @cache.size >= CACHED_SEGMENTS
+        @cache[cache_key] = messages
+      end
+    end
+
+    def path(topic)
+      raise ArgumentError, "Invalid topic name: #{topic.inspect}" unless topic.to_s =~ /\A[A-Za-z0-9_.\-]+\z/
+
+      config.tiers_dir / "#{topic}.json"
+    end
+
+    def locked(topic)
+      FileUtils.mkdir_p(config.tiers_dir)
+
+      File.open(path(topic), File::RDWR | File::CREAT, 0o644) do |file|
+        file.flock(File::LOCK_EX)
+        segments = parse(file.read)
+        yield segments
+
+        file.rewind
+        file.truncate(0)
+        file.write(JSON.generate(segments))
+        file.flush
+      end
+    end
+
+    def parse(json)
+      json.to_s.strip.empty? ? [] : JSON.parse(json, symbolize_names: true)
+    end
+  end
+end
@@ -0,0 +1,80 @@
+module Shortbus
+  # Topic creation on publish
+  #
+  # By default a publish to a topic nobody created simply creates it. In
+  # strict mode it is refused instead, so a typo'd topic name fails loudly
+  # rather than quietly collecting messages no one will read:
+  #
+  #   SHORTBUS_AUTO_CREATE=false    # strict everywhere
+  #
+  # config/auto_create.yml overrides that per namespace (a topic name up to
+  # one of its dots), the longest matching namespace winning:
+  #
+  #   orders: strict
+  #   orders.scratch: auto
+  #
+  # A topic is known once it is in topics.yml, in a topic class, or in the
+  # engine. Inboxes and job results are made on the fly, so always allowed.
+  #
+  # Example:
+  #   Shortbus.topic_creation.mode('orders.eu')     # => "strict"
+  #   Shortbus.topic_creation.check!('oders.eu')    # TopicError unless it exists
+  class TopicCreation
+    MODES = %w[auto strict].freeze
+
+    attr_reader :config
+
+    def self.normalize(value)
+      case value.to_s.strip.downcase
+      when '', 'auto', 'true', '1', 'yes' then 'auto'
+      when 'strict', 'false', '0', 'no' then 'strict'
+      else raise ArgumentError, "topic creation must be one of: #{MODES.join(', ')}"
+      end
+    end
+
+    def initialize(config: Shortbus.config, engine: Shortbus.engine, topics: Shortbus.topics)
+      @config = config
+      @engine = engine
+      @topics = topics
+      @known = {}
+    end
+
+    # "auto" or "strict" for publishes to topic
+    def mode(topic)
+      namespace = overrides.keys.select { |ns| topic.to_s == ns || topic.to_s.start_with?("#{ns}.") }.max_by(&:length)
+      namespace ? overrides[namespace] : TopicCreation.normalize(config.auto_create)
+    end
+
+    # Raise TopicError for a publish strict mode refuses
+    def check!(topic)
+      topic = topic.to_s
+      return true if Inbox.inbox?(topic) || topic.start_with?(Jobs::RESULT_PREFIX)
+      return true if @known[topic] || mode(topic) == 'auto'
+
+      unless @topics.get(topic) || engine_topics.include?(topic)
+        raise TopicError, "Unknown topic: #{topic} (topic creation is strict here; shortbus topic create #{topic})"
+      end
+
+      # Topics aren't unknown again short of a delete, which strict mode
+      # can live with missing
+      @known[topic] = true
+      true
+    end
+
+    def path
+      config.auto_create_yml
+    end
+
+    private
+
+    def overrides
+      return {} unless path.exist?
+
+      (YAML.safe_load(File.read(path)) || {}).to_h { |namespace, value| [namespace.to_s, TopicCreation.normalize(value)] }
+    end
+
+    def engine_topics
+      @engine.list_topics.map { |topic| topic.is_a?(Hash) ? topic[:name].to_s : topic.to_s }
+    end
+  end
+end
@@ -0,0 +1,57 @@
+module Shortbus
+  # Topic lifecycle events on $sys.topics
+  #
+  # The broker publishes one message to $sys.topics whenever a topic is
+  # created or deleted in the engine, or its settings change, so consumers
+  # can attach to new topics as they appear without polling:
+  #
+  #   { "event": "created", "topic": "orders.eu", "settings": { "retention": 604800 }, "at": "..." }
+  #
+  # A deletion the broker made itself says why, e.g. "reason": "idle" (see
+  # TopicGC).
+  #
+  # metadata carries event and topic too, so subscribers can filter on them.
+  # $sys.* topics are written by the broker only, and inboxes are private to
+  # their connection, so neither produces events.
+  #
+  # Example:
+  #   Shortbus::TopicEvents.emit(:updated, 'jobs', settings: { retention: 86400 })
+  module TopicEvents
+    PREFIX = '$sys'
+    TOPIC = "#{PREFIX}.topics"
+    EVENTS = %i[created updated deleted].freeze
+
+    def reserved?(topic)
+      topic.to_s.start_with?("#{PREFIX}.")
+    end
+
+    # Raise unless clients may publish to the topic
+    def authorize!(topic)
+      return true unless reserved?(topic)
+
+      raise AccessError, "#{PREFIX}.* topics are written by the broker"
+    end
+
+    # Publish a lifecycle event; a failure is logged rather than failing the
+    # change it reports on
+    def emit(event, topic, settings: nil, reason: nil, engine: Shortbus.engine)
+      raise ArgumentError, "Unknown topic event: #{event}" unless EVENTS.include?(event.to_sym)
+      return nil if reserved?(topic) || Inbox.inbox?(topic)
+
+      payload = {
+        event: event.to_s,
+        topic: topic.to_s,
+        settings: settings || {},
+        reason: reason&.to_s,
+        at: Time.now.utc.iso8601(3)
+      }.compact
+
+      engine.publish(TOPIC, JSON.generate(payload), metadata: { event: event.to_s, topic: topic.to_s })
+    rescue Shortbus::Error => e
+      Shortbus.warn "Failed to publish #{event} event for #{topic}: #{e.message}"
+      nil
+    end
+
+    extend self
+  end
+end
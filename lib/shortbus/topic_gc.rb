@@ -0,0 +1,106 @@
+module Shortbus
+  # Idle topic collection
+  #
+  # Topics are created by publishing to them, so a long-running broker
+  # collects topics nobody uses any more: one per request id, per test run,
+  # per customer long gone. With SHORTBUS_IDLE_TOPIC_TTL set, the daemon
+  # deletes a topic once it has had no subscribers and no messages (archived
+  # ones included) for that long:
+  #
+  #   SHORTBUS_IDLE_TOPIC_TTL=7d
+  #
+  # Topics in topics.yml are deliberate, so are only collected with an
+  # idle_ttl setting of their own, which also overrides the default for
+  # topics in a class. $sys.* topics are never collected.
+  #
+  # A topic becomes a candidate the first pass it is seen idle; idle_topics.json
+  # records since when. A subscriber or a message before the ttl is up clears
+  # that, so traffic restarts the clock. Deletion goes through the engine, so
+  # $sys.topics gets a deleted event, with reason "idle". A publish after
+  # that simply creates the topic again.
+  #
+  # Example:
+  #   Shortbus.topic_gc.collect!   # => ["scratch.1234"]
+  class TopicGC
+    INTERVAL = 60  # seconds between daemon passes
+
+    attr_reader :config
+
+    def initialize(config: Shortbus.config, topics: Shortbus.topics, subscribers: Shortbus.subscribers)
+      @config = config
+      @topics = topics
+      @subscribers = subscribers
+    end
+
+    # Seconds the topic may stay idle, nil if it is never collected
+    def ttl(topic)
+      return nil if TopicEvents.reserved?(topic)
+
+      settings = @topics.get(topic)
+      return Shortbus.parse_duration(settings[:idle_ttl]) if settings&.key?(:idle_ttl)
+      return nil if @topics.exists?(topic) || config.idle_topic_ttl.to_s.empty?
+
+      Shortbus.parse_duration(config.idle_topic_ttl)
+    end
+
+    # Delete topics idle past their ttl; returns their names
+    def collect!(engine: Shortbus.engine, now: Time.now)
+      collected = []
+
+      locked do |candidates|
+        names = engine.list_topics.map { |topic| topic.is_a?(Hash) ? topic[:name].to_s : topic.to_s }
+        candidates.select! { |name, _| names.include?(name) }
+
+        names.each do |name|
+          ttl = ttl(name)
+          unless ttl && idle?(name, engine)
+            candidates.delete(name)
+            next
+          end
+
+          since = Time.at(candidates[name] ||= now.to_f)
+          next if now - since < ttl
+
+          engine.delete_topic(name, reason: 'idle')
+          @topics.delete(name) if @topics.exists?(name)
+          @subscribers.clear(name)
+          candidates.delete(name)
+          collected << name
+        rescue Shortbus::Error => e
+          Shortbus.warn "Failed to collect idle topic #{name}: #{e.message}"
+        end
+      end
+
+      collected
+    end
+
+    def path
+      config.idle_topics_path
+    end
+
+    private
+
+    # No subscribers, and nothing retained, live or archived
+    def idle?(name, engine)
+      @subscribers.count(name).zero? && engine.fetch_messages(name, offset: 0, limit: 1).empty?
+    end
+
+    def locked
+      FileUtils.mkdir_p(path.dirname)
+
+      File.open(path, File::RDWR | File::CREAT, 0o644) do |file|
+        file.flock(File::LOCK_EX)
+        json = file.read
+        candidates = json.strip.empty? ? {} : JSON.parse(json)
+
+        begin
+          yield candidates
+        ensure
+          file.rewind
+          file.truncate(0)
+          file.write(JSON.generate(candidates))
+        end
+      end
+    end
+  end
+end
@@ -0,0 +1,313 @@
+module Shortbus
+  # Per-topic settings (retention, max depth, DLQ target, ordering mode,
+  # ephemeral auto-delete, redelivery backoff, priority aging, poison
+  # quarantine, archival, compaction, rolling stats, mirroring, publish
+  # schema, required signers, sync policy, idle collection)
+  #
+  # Settings live in config/topics.yml inside the rendezvous so every pipe
+  # process, the daemon, and the CLI share the same policies. Writes take an
+  # exclusive flock on the file, so concurrent admins can't clobber each other.
+  # max_depth is checked on publish (Admin.check_depth!) and ordering by
+  # group fetches (WorkQueue.ordered) and subscriptions (keyed partitions).
+  #
+  # Topic classes in config/classes.yml give whole families of topics their
+  # defaults by name pattern, so new ones need no setup:
+  #
+  #   metrics:
+  #     match: "metrics.*"
+  #     retention: 1h
+  #   jobs:
+  #     match: ["jobs.*", "*.jobs"]
+  #     max_failures: 5
+  #     dlq: jobs.dlq
+  #
+  # A topic gets the class with the longest pattern matching its name, and
+  # its own settings override the class's. Daemon passes (archival,
+  # compaction, stats, mirrors) only visit topics in topics.yml.
+  #
+  # Example:
+  #   Shortbus.topics.create('jobs', retention: '7d', max_depth: 10_000, dlq: 'jobs.dlq')
+  #   Shortbus.topics.update('jobs', ordering: 'fifo')
+  #   Shortbus.topics.get('jobs')  # => { retention: 604800, max_depth: 10000, ... }
+  #   Shortbus.topics.delete('jobs')
+  class Topics
+    SETTINGS = %i[retention max_depth dlq ordering partitions ephemeral grace_period backoff priority_aging max_failures poison archive archive_format compact stats mirror mirror_sample schema signers sync idle_ttl]
+    DEFAULT_MAX_FAILURES = 5
+    ORDERINGS = %w[none fifo keyed]
+    DEFAULT_PARTITIONS = 16
+
+    attr_reader :config
+
+    def initialize(config: Shortbus.config)
+      @config = config
+    end
+
+    # All configured topics, with their class defaults: { name => settings }
+    def all
+      classes = self.classes
+      read.to_h { |name, settings| [name, defaults(name, classes).merge(symbolize(settings))] }
+    end
+
+    # nil for a topic that is neither configured nor in a class
+    def get(name)
+      settings = read[name.to_s]
+      classes = self.classes
+      return nil unless settings || class_for(name, classes)
+
+      defaults(name, classes).merge(settings ? symbolize(settings) : {})
+    end
+
+    def exists?(name)
+      read.key?(name.to_s)
+    end
+
+    def create(name, **settings)
+      validate_name!(name)
+      settings = normalize(settings)
+
+      transaction do |topics|
+        raise TopicError, "Topic already exists: #{name}" if topics.key?(name.to_s)
+        topics[name.to_s] = stamp_ephemeral(stringify(settings))
+      end
+
+      settings
+    end
+
+    def update(name, **settings)
+      settings = normalize(settings)
+
+      transaction do |topics|
+        raise TopicError, "Topic not found: #{name}" unless topics.key?(name.to_s)
+        topics[name.to_s] = stamp_ephemeral(topics[name.to_s].merge(stringify(settings)))
+        settings = symbolize(topics[name.to_s])
+      end
+
+      settings
+    end
+
+    def delete(name)
+      transaction do |topics|
+        raise TopicError, "Topic not found: #{name}" unless topics.key?(name.to_s)
+        topics.delete(name.to_s)
+      end
+
+      true
+    end
+
+    # Keyed topics deliver to consumer groups by partition, preserving
+    # per-key order
+    def keyed?(name)
+      get(name)&.fetch(:ordering, nil) == 'keyed'
+    end
+
+    # fifo topics hand group fetches out in publish order, ignoring priority
+    def fifo?(name)
+      get(name)&.fetch(:ordering, nil) == 'fifo'
+    end
+
+    # Publishes are refused once the topic holds this many (see Admin.check_depth!)
+    def max_depth(name)
+      get(name)&.fetch(:max_depth, nil)
+    end
+
+    def partitions(name)
+      get(name)&.fetch(:partitions, nil) || DEFAULT_PARTITIONS
+    end
+
+    # Redelivery policy for nacked messages (see Backoff)
+    def backoff(name)
+      get(name)&.fetch(:backoff, nil) || Backoff::DEFAULT
+    end
+
+    # nil when priorities don't age
+    def priority_aging(name)
+      get(name)&.fetch(:priority_aging, nil)
+    end
+
+    # Failed (nacked with an error) deliveries before a message is quarantined
+    def max_failures(name)
+      get(name)&.fetch(:max_failures, nil) || DEFAULT_MAX_FAILURES
+    end
+
+    # Where quarantined messages go: poison:, else dlq:, else TOPIC.poison
+    def poison_topic(name)
+      settings = get(name) || {}
+      settings[:poison] || settings[:dlq] || "#{name}.poison"
+    end
+
+    def ephemeral?(name)
+      !!get(name)&.fetch(:ephemeral, false)
+    end
+
+    # Compacted topics keep only the latest message per key (see Compactor)
+    def compacted?(name)
+      !!get(name)&.fetch(:compact, false)
+    end
+
+    # Delete ephemeral topics whose last subscriber left more than
+    # grace_period seconds ago. Safe to call from any process, any time.
+    def reap!(subscribers: Shortbus.subscribers, engine: Shortbus.engine)
+      reaped = []
+
+      all.each do |name, settings|
+        next unless settings[:ephemeral]
+
+        # One nobody ever subscribed to has been idle since it was made
+        idle_since = subscribers.idle_since(name)
+        idle_since ||= Time.at(settings[:created_at]) if settings[:created_at] && subscribers.count(name).zero?
+        next unless idle_since
+        next if Time.now - idle_since < settings.fetch(:grace_period, 0)
+
+        delete(name)
+        subscribers.clear(name)
+        reaped << name
+
+        begin
+          engine.delete_topic(name)
+        rescue Shortbus::Error => e
+          Shortbus.warn "Failed to delete ephemeral topic #{name} from engine: #{e.message}"
+        end
+      rescue TopicError
+        # Another process reaped it first
+      end
+
+      reaped
+    end
+
+    # Validate and coerce user-supplied settings
+    def normalize(settings)
+      settings = settings.transform_keys(&:to_sym)
+
+      unknown = settings.keys - SETTINGS
+      raise TopicError, "Unknown topic setting(s): #{unknown.join(', ')}" if unknown.any?
+
+      settings.each_with_object({}) do |(key, value), normalized|
+        normalized[key] = normalize_setting(key, value) unless value.nil?
+      end
+    rescue ArgumentError, TypeError => e
+      raise TopicError, "Invalid topic setting: #{e.message}"
+    end
+
+    def path
+      config.topics_yml
+    end
+
+    # { class => { match: [patterns], settings: {...} } }, from classes.yml
+    def classes
+      return {} unless config.classes_yml.exist?
+
+      (YAML.safe_load(File.read(config.classes_yml)) || {}).to_h do |name, definition|
+        definition = symbolize(definition || {})
+        patterns = Array(definition.delete(:match)).map(&:to_s)
+        raise TopicError, "Topic class #{name} has no match patterns" if patterns.empty?
+
+        [name.to_s, { match: patterns, settings: normalize(definition) }]
+      end
+    end
+
+    # The class with the longest pattern matching name, nil if none
+    def class_for(name, classes = self.classes)
+      matches = classes.filter_map do |class_name, definition|
+        pattern = definition[:match].select { |candidate| File.fnmatch?(candidate, name.to_s) }.max_by(&:length)
+        [class_name, pattern.length] if pattern
+      end
+
+      matches.max_by { |_, length| length }&.first
+    end
+
+    private
+
+    def defaults(name, classes = self.classes)
+      class_name = class_for(name, classes)
+      class_name ? classes[class_name][:settings] : {}
+    end
+
+    def validate_name!(name)
+      unless name.to_s =~ /\A[A-Za-z0-9_.\-]+\z/
+        raise TopicError, "Invalid topic name: #{name.inspect}"
+      end
+    end
+
+    def normalize_setting(key, value)
+      case key
+      when :retention, :grace_period, :idle_ttl
+        Shortbus.parse_duration(value)
+      when :max_depth, :partitions, :max_failures
+        count = Integer(value)
+        raise TopicError, "#{key} must be positive" unless count > 0
+        count
+      when :dlq, :poison
+        value.to_s
+      when :mirror
+        validate_name!(value)
+        value.to_s
+      when :mirror_sample
+        # "10%" or a fraction
+        Tap.parse_sample(value)
+      when :ordering
+        ordering = value.to_s
+        raise TopicError, "ordering must be one of: #{ORDERINGS.join(', ')}" unless ORDERINGS.include?(ordering)
+        ordering
+      when :ephemeral, :compact
+        value == true || value.to_s.match?(/\A(true|1|yes)\z/i)
+      when :backoff
+        Backoff.normalize(value)
+      when :priority_aging
+        Aging.normalize(value)
+      when :sync
+        GroupCommit.normalize(value)
+      when :schema
+        Schema.normalize(value)
+      when :stats
+        Aggregates.normalize(value)
+      when :signers
+        # Key ids from config/keys.yml; "a,b" from the CLI
+        (value.is_a?(String) ? value.split(',') : Array(value)).map { |kid| kid.to_s.strip }.reject(&:empty?)
+      when :archive
+        # true archives to rendezvous/archive; anything else is a directory or s3:// URL
+        value == true || value.to_s.match?(/\A(true|1|yes)\z/i) ? true : value.to_s
+      when :archive_format
+        format = value.to_s
+        raise TopicError, "archive_format must be one of: #{Archiver::FORMATS.join(', ')}" unless Archiver::FORMATS.include?(format)
+        format
+      end
+    end
+
+    def read
+      return {} unless path.exist?
+
+      YAML.safe_load(File.read(path)) || {}
+    end
+
+    def transaction
+      FileUtils.mkdir_p(path.dirname)
+
+      File.open(path, File::RDWR | File::CREAT, 0o644) do |file|
+        file.flock(File::LOCK_EX)
+
+        topics = YAML.safe_load(file.read) || {}
+        yield topics
+
+        file.rewind
+        file.truncate(0)
+        file.write(topics.to_yaml)
+        file.flush
+      end
+    end
+
+    # Ephemeral topics remember when they were made (or made ephemeral), for
+    # reap! to go by until someone subscribes
+    def stamp_ephemeral(stored)
+      stored['created_at'] ||= Time.now.to_i if stored['ephemeral']
+      stored
+    end
+
+    def symbolize(settings)
+      settings.transform_keys(&:to_sym)
+    end
+
+    def stringify(settings)
+      settings.transform_keys(&:to_s)
+    end
+  end
+end
@@ -0,0 +1,137 @@
+module Shortbus
+  # Transactional publish
+  #
+  # A transaction's messages are staged by the broker and only written to the
+  # engine on commit. Each one is stamped with metadata.txn, and a marker under
+  # transactions/ID.json records how the commit went:
+  #
+  #   committing  messages are being written; readers hold at the first one
+  #   committed   all messages are visible
+  #   aborted     the commit failed part way; readers skip its messages
+  #
+  # A committing marker whose process has died counts as aborted, so a broker
+  # crash mid-commit can't wedge subscribers. Rollback never touches the
+  # engine, so it needs no marker.
+  class Transactions
+    STATES = %w[committing committed aborted].freeze
+
+    attr_reader :config
+
+    def initialize(config: Shortbus.config)
+      @config = config
+      @settled = {}  # Final states never change, so cache them
+    end
+
+    # Write every staged message ({topic:, payload:, metadata:}), returning
+    # the engine results in order
+    def commit(id, messages, engine: Shortbus.engine)
+      write(id, state: :committing, topics: messages.map { |message| message[:topic] }.uniq)
+
+      results = messages.map do |message|
+        metadata = (message[:metadata] || {}).merge(txn: id)
+        engine.publish(message[:topic], message[:payload], metadata: metadata, trigger: false)
+      end
+
+      write(id, state: :committed, topics: messages.map { |message| message[:topic] }.uniq)
+
+      # Wake subscribers only once everything is visible
+      messages.map { |message| message[:topic] }.uniq.each do |topic|
+        Shortbus.file_watcher.trigger!(topic)
+      rescue => e
+        Shortbus.warn "Failed to trigger file watcher: #{e.message}"
+      end
+
+      results
+    rescue
+      abort!(id)
+      raise
+    end
+
+    # :visible, :pending, or :aborted. Messages outside a transaction, and
+    # ones whose marker has been cleaned up, are visible.
+    def visibility(message)
+      id = message.dig(:metadata, :txn)
+      return :visible unless id
+
+      case state(id)
+      when 'committed', nil then :visible
+      when 'aborted' then :aborted
+      else :pending
+      end
+    end
+
+    # The deliverable prefix of messages: stops at the first pending one and
+    # drops aborted ones
+    def visible(messages)
+      messages.each_with_object([]) do |message, visible|
+        case visibility(message)
+        when :pending then break visible
+        when :visible then visible << message
+        end
+      end
+    end
+
+    def state(id)
+      return @settled[id] if @settled.key?(id)
+
+      marker = read(id)
+      return nil unless marker
+
+      state = marker[:state]
+      state = 'aborted' if state == 'committing' && !alive?(marker[:pid])
+      @settled[id] = state unless state == 'committing'
+
+      state
+    end
+
+    private
+
+    def abort!(id)
+      write(id, state: :aborted)
+    rescue => e
+      Shortbus.warn "Failed to mark transaction #{id} aborted: #{e.message}"
+    end
+
+    def path(id)
+      raise ArgumentError, "Invalid transaction id: #{id.inspect}" unless id.to_s =~ /\A[A-Za-z0-9_\-]+\z/
+
+      config.transactions_dir / "#{id}.json"
+    end
+
+    def read(id)
+      JSON.parse(File.read(path(id)), symbolize_names: true)
+    rescue JSON::ParserError, Errno::ENOENT
+      nil
+    end
+
+    def write(id, state:, topics: nil)
+      FileUtils.mkdir_p(config.transactions_dir)
+
+      marker = {
+        id: id,
+        state: state.to_s,
+        pid: Process.pid,
+        topics: topics,
+        updated_at: Time.now.utc.iso8601
+      }.compact
+
+      # Write-then-rename so readers never see a half-written marker
+      tmp = path(id).sub_ext(".json.#{Process.pid}.tmp")
+      File.write(tmp, JSON.generate(marker))
+      File.rename(tmp, path(id))
+
+      marker
+    end
+
+    def alive?(pid)
+      return false unless pid.to_i > 0
+
+      Process.kill(0, pid.to_i)
+      true
+    rescue Errno::ESRCH
+      false
+    rescue Errno::EPERM
+      true
+    end
+  end
+end
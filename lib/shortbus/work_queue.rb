@@ -0,0 +1,138 @@
+module Shortbus
+  # Consumer-group pull delivery
+  #
+  # Shared by pipe mode's fetch/claim ops and the HTTP gateway so both hand
+  # out work the same way: each message to one member of the group, held as
+  # pending until acked when the consumer asks for acks.
+  #
+  # Example:
+  #   Shortbus::WorkQueue.fetch('jobs', 'workers', max: 10, wait: 30)
+  #   Shortbus::WorkQueue.fetch_acked('jobs', 'workers', consumer: 'conn1', max: 10, wait: 30)
+  module WorkQueue
+    # Up to max messages, waiting up to wait seconds for at least one; stop
+    # cuts the wait short (e.g. on shutdown)
+    def fetch(topic, group, max:, wait:, stop: -> { false })
+      deadline = Time.now + wait
+
+      loop do
+        messages = Shortbus.groups.claim(topic, group) do |offset|
+          Shortbus.transactions.visible(Shortbus.engine.fetch_messages(topic, offset:, limit: max))
+        end
+
+        # Claimed either way, so expired messages are skipped exactly once
+        messages = ordered(topic, Shortbus.deadlines.live(topic, messages))
+
+        return messages if messages.any? || Time.now >= deadline || stop.call
+
+        sleep 0.1
+      end
+    end
+
+    # Nacked messages whose backoff has elapsed go out before new ones, then
+    # (with min_idle) ones left unacked that long. Either way they are held
+    # as pending for consumer until acked, and carry their attempt number,
+    # when a nack would bring them back, and the error of the last nack that
+    # had one.
+    def fetch_acked(topic, group, consumer:, max:, wait:, min_idle: nil, stop: -> { false })
+      ids = Shortbus.groups.redeliver(topic, group, consumer:, max:)
+      ids = Shortbus.groups.reclaim(topic, group, consumer:, min_idle:, max:) if ids.empty? && min_idle
+      messages = live_by_id(topic, group, ids)
+
+      if messages.empty?
+        messages = fetch(topic, group, max:, wait:, stop:)
+        Shortbus.groups.track(topic, group, messages.map { |msg| msg[:id] }, consumer:, message_ids: messages.to_h { |msg| [msg[:id], msg[:message_id]] }.compact)
+      end
+
+      with_attempts(topic, group, messages)
+    end
+
+    # Give messages back for redelivery after the topic's backoff (or an
+    # explicit delay). A nack with an error counts as a failure, and messages
+    # that have failed max_failures times go to the poison topic instead.
+    def nack(topic, group, ids, error: nil, delay: nil)
+      policy = Shortbus.topics.backoff(topic)
+      delay = Shortbus.parse_duration(delay) if delay
+
+      nacked = Shortbus.groups.nack(topic, group, ids, error:, delay_for: ->(attempt) { delay || Backoff.delay(policy, attempt) })
+      poisoned = error ? quarantine_poison(topic, group, ids) : []
+
+      { nacked:, poisoned: }
+    end
+
+    # Returns the ids quarantined
+    def quarantine_poison(topic, group, ids)
+      threshold = Shortbus.topics.max_failures(topic)
+
+      poisoned = ids.select { |id| Shortbus.groups.errors(topic, group, id).size >= threshold }
+      return [] if poisoned.empty?
+
+      messages_by_id(topic, group, poisoned).map do |msg|
+        errors = Shortbus.groups.errors(topic, group, msg[:id])
+        Admin.quarantine(topic, msg, errors:)
+        Shortbus.groups.ack(topic, group, [msg[:id]])
+        msg[:id]
+      end
+    end
+
+    # Re-read specific pending messages; ones deleted since delivery are acked
+    # away since there is nothing left to work on
+    def messages_by_id(topic, group, ids)
+      messages = ids.filter_map do |id|
+        Shortbus.engine.fetch_messages(topic, offset: id, limit: 1).find { |msg| msg[:id] == id }
+      end
+
+      gone = ids - messages.map { |msg| msg[:id] }
+      Shortbus.groups.ack(topic, group, gone) if gone.any?
+
+      messages
+    end
+
+    # Pending messages whose deadline passed while they waited for a retry
+    # are acked away rather than handed out again
+    def live_by_id(topic, group, ids)
+      messages = messages_by_id(topic, group, ids)
+      live = Shortbus.deadlines.live(topic, messages)
+
+      expired = messages.map { |msg| msg[:id] } - live.map { |msg| msg[:id] }
+      Shortbus.groups.ack(topic, group, expired) if expired.any?
+
+      live
+    end
+
+    # A batch in the order the topic hands it out: publish order on fifo
+    # topics, by priority otherwise
+    def ordered(topic, messages, topics: Shortbus.topics)
+      return messages if topics.fifo?(topic)
+
+      by_priority(messages, aging: topics.priority_aging(topic))
+    end
+
+    # Highest metadata.priority first, publish order among equals; with an
+    # aging policy, priorities count up the longer messages have waited. This
+    # orders a batch; it never holds a message back for a later one.
+    def by_priority(messages, aging: nil, now: Time.now)
+      messages.each_with_index.sort_by do |msg, index|
+        waited = aging ? now - (DeliverPolicy.message_time(msg) || now) : 0
+        [-(msg.dig(:metadata, :priority).to_i + Aging.boost(aging, waited)), index]
+      end.map(&:first)
+    end
+
+    def with_attempts(topic, group, messages)
+      return messages if messages.empty?
+
+      pending = Shortbus.groups.pending(topic, group).to_h { |entry| [entry[:id], entry] }
+      policy = Shortbus.topics.backoff(topic)
+
+      messages.map do |msg|
+        attempt = pending.dig(msg[:id], :deliveries) || 1
+        next_attempt_at = Time.now + Backoff.delay(policy, attempt)
+        stamps = { attempt: attempt, next_attempt_at: next_attempt_at.utc.iso8601, last_error: pending.dig(msg[:id], :last_error) }
+
+        msg = msg.merge(metadata: msg[:metadata].merge(stamps.compact))
+        Annotations.annotate(msg, redelivery_count: attempt - 1)
+      end
+    end
+
+    extend self
+  end
+end
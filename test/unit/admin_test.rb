@@ -0,0 +1,89 @@
+require_relative '../test_helper'
+
+class AdminTest < ShortbusTest
+  class FakeEngine
+    def initialize(messages)
+      @messages = messages
+    end
+
+    def list_topics
+      @messages.keys
+    end
+
+    def fetch_messages(topic, offset: 0, limit: 100, tiered: true)
+      @messages.fetch(topic, []).select { |message| message[:id] >= offset }.first(limit)
+    end
+  end
+
+  class FakeSubscribers
+    def count(topic)
+      topic == 'orders.eu' ? 2 : 0
+    end
+  end
+
+  def engine
+    FakeEngine.new(
+      'orders.eu' => (1..3).map { |id| { id: id, payload: "order #{id}" } },
+      'orders.us' => [],
+      'events' => [{ id: 1, payload: 'hello' }],
+      '_INBOX.conn1.abc' => [{ id: 1, payload: 'reply' }]
+    )
+  end
+
+  def describe(pattern = nil)
+    Shortbus::Admin.describe_topics(pattern, engine:, subscribers: FakeSubscribers.new)
+  end
+
+  def test_describe_topics_matches_glob
+    Shortbus.topics.create('orders.eu', retention: '7d')
+
+    eu, us = describe('orders.*')
+
+    assert_equal %w[orders.eu orders.us], [eu[:name], us[:name]]
+    assert_equal 3, eu[:depth]
+    assert_equal 2, eu[:subscribers]
+    assert_equal 604_800, eu[:retention]
+    assert_equal({}, us[:settings])
+  end
+
+  def test_describe_topics_includes_configured_but_never_inboxes
+    Shortbus.topics.create('audit')
+
+    assert_equal %w[audit events orders.eu orders.us], describe.map { |topic| topic[:name] }
+  end
+
+  def test_depth_pages_through_the_topic
+    messages = (1..2500).map { |id| { id: id } }
+
+    assert_equal 2500, Shortbus::Admin.depth('big', engine: FakeEngine.new('big' => messages))
+  end
+
+  def test_publishes_stop_at_max_depth
+    topics = Shortbus::Topics.new(config: Shortbus.config)
+    topics.create('big', max_depth: 3)
+    engine = FakeEngine.new('big' => (1..2).map { |id| { id: id } })
+
+    assert_nil Shortbus::Admin.check_depth!('big', engine:, topics:)
+    engine = FakeEngine.new('big' => (1..3).map { |id| { id: id } })
+    error = assert_raises(Shortbus::TopicError) { Shortbus::Admin.check_depth!('big', engine:, topics:) }
+    assert_match(/max_depth is 3/, error.message)
+    assert_nil Shortbus::Admin.check_depth!('unlimited', engine:, topics:)
+  end
+
+  def test_depth_is_counted_running_and_recounted_when_full
+    messages = (1..3).map { |id| { id: id } }
+    engine = FakeEngine.new('big' => messages)
+    depths = Shortbus::Depths.new(config: Shortbus.config)
+    now = Time.now
+
+    refute depths.full?('big', 4, engine:, now:)
+    messages << { id: 4 }
+    assert depths.full?('big', 4, engine:, now:)
+    assert depths.full?('big', 4, adding: 2, engine:, now:)
+
+    # Deletions aren't seen until a full topic is recounted
+    messages.shift(2)
+    assert depths.full?('big', 4, engine:, now: now + 1)
+    refute depths.full?('big', 4, engine:, now: now + Shortbus::Depths::RECOUNT)
+  end
+end
@@ -0,0 +1,72 @@
+require_relative '../test_helper'
+
+class AggregatesTest < ShortbusTest
+  class FakeEngine
+    attr_reader :messages, :published
+
+    def initialize(messages)
+      @messages = messages
+      @published = []
+    end
+
+    def fetch_messages(topic, offset: 0, limit: 100, tiered: true)
+      @messages.select { |message| message[:topic] == topic && message[:id] >= offset }.first(limit)
+    end
+
+    def publish(topic, payload, metadata: {})
+      @published << { topic:, payload: JSON.parse(payload, symbolize_names: true), metadata: }
+      { status: :ok, offset: @published.size }
+    end
+  end
+
+  def now
+    @now ||= Time.utc(2024, 10, 20, 12)
+  end
+
+  def message(id, age, payload = 'xxxx', topic: 'orders')
+    { id:, topic:, payload:, metadata: {}, timestamp: (now - age).to_i }
+  end
+
+  def test_counts_over_each_window_and_publishes
+    Shortbus.topics.create('orders', stats: '1m,1h')
+    engine = FakeEngine.new([message(1, 7200), message(2, 1800), message(3, 30), message(4, 10), message(5, 5, topic: 'events')])
+
+    summary = Shortbus::Aggregates.new(engine:).tick!(now:)['orders']
+    assert_equal 4, summary[:total]
+    assert_equal({ window: 60, count: 2, bytes: 8, rate: 0.033 }, summary[:windows]['1m'])
+    assert_equal 3, summary[:windows]['1h'][:count]
+
+    assert_equal ['stats.orders'], engine.published.map { |published| published[:topic] }
+    assert_equal 2, engine.published.first[:payload][:windows][:'1m'][:count]
+  end
+
+  def test_later_passes_count_only_new_messages_and_slide
+    Shortbus.topics.create('orders', stats: '1m')
+    engine = FakeEngine.new([message(1, 30)])
+    aggregates = Shortbus::Aggregates.new(engine:)
+    aggregates.tick!(now:)
+
+    engine.messages << message(2, 0)
+    assert_equal 2, aggregates.tick!(now:)['orders'][:windows]['1m'][:count]
+
+    later = aggregates.tick!(now: now + 45)['orders']
+    assert_equal 1, later[:windows]['1m'][:count]
+    assert_equal 2, later[:total]
+  end
+
+  def test_topics_without_stats_are_left_alone
+    Shortbus.topics.create('orders')
+    Shortbus.topics.create('stats.orders', stats: true)
+    engine = FakeEngine.new([message(1, 5)])
+
+    assert_empty Shortbus::Aggregates.new(engine:).tick!(now:)
+    assert_empty engine.published
+  end
+
+  def test_stats_setting
+    assert_equal [60, 3600], Shortbus::Aggregates.normalize(true)
+    assert_equal [10, 300], Shortbus::Aggregates.normalize('5m, 10s')
+    assert_raises(Shortbus::TopicError) { Shortbus.topics.create('orders', stats: '0s') }
+    assert_equal %w[10s 5m 1h 1d], [10, 300, 3600, 86_400].map { |seconds| Shortbus::Aggregates.label(seconds) }
+  end
+end
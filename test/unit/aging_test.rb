@@ -0,0 +1,48 @@
+require_relative '../test_helper'
+
+class AgingTest < ShortbusTest
+  def boosts(policy, ages)
+    ages.map { |age| Shortbus::Aging.boost(Shortbus::Aging.normalize(policy), age) }
+  end
+
+  def test_linear
+    assert_equal [0, 0, 1, 2, 10], boosts('1m', [0, 59, 60, 150, 600])
+  end
+
+  def test_linear_is_capped
+    assert_equal [1, 3, 3], boosts({ every: '1m', max: 3 }, [60, 180, 3600])
+  end
+
+  def test_schedule
+    assert_equal [0, 1, 2, 3, 3], boosts('30s,2m,10m', [10, 30, 300, 600, 86_400])
+    assert_equal [1, 2], boosts(%w[2m 30s], [60, 120])
+  end
+
+  def test_invalid_policies_raise
+    assert_raises(ArgumentError) { Shortbus::Aging.normalize({ strategy: 'random' }) }
+    assert_raises(ArgumentError) { Shortbus::Aging.normalize([]) }
+    assert_raises(ArgumentError) { Shortbus::Aging.normalize(0) }
+  end
+
+  def test_old_messages_overtake_newer_priorities
+    now = Time.at(1_000_000)
+    messages = [
+      { id: 1, timestamp: now.to_i - 300, metadata: { priority: 0 } },
+      { id: 2, timestamp: now.to_i, metadata: { priority: 3 } },
+      { id: 3, timestamp: now.to_i - 30, metadata: { priority: 2 } }
+    ]
+
+    assert_equal [2, 3, 1], Shortbus::WorkQueue.by_priority(messages, now:).map { |msg| msg[:id] }
+
+    aging = Shortbus::Aging.normalize('1m')
+    assert_equal [1, 2, 3], Shortbus::WorkQueue.by_priority(messages, aging:, now:).map { |msg| msg[:id] }
+  end
+
+  def test_topic_setting_round_trips
+    topics = Shortbus::Topics.new(config: Shortbus.config)
+    topics.create('jobs', priority_aging: { every: '1m', max: 5 })
+
+    assert_equal({ 'strategy' => 'linear', 'every' => 60, 'max' => 5 }, topics.priority_aging('jobs'))
+    assert_nil topics.priority_aging('other')
+  end
+end
@@ -0,0 +1,51 @@
+require_relative '../test_helper'
+
+class AnnotationsTest < ShortbusTest
+  def teardown
+    Shortbus::Annotations.unregister(:region)
+    Shortbus::Annotations.unregister(:broken)
+    super
+  end
+
+  def test_stamp_and_split_round_trip
+    metadata = Shortbus::Annotations.stamp('jobs', { 'priority' => 1 }, { origin: 'outbox:outbox' })
+    message = Shortbus::Annotations.split({ id: 1, metadata: JSON.parse(JSON.generate(metadata), symbolize_names: true) })
+
+    assert_equal({ priority: 1 }, message[:metadata])
+    assert_equal Shortbus.config.node_id, message[:annotations][:node_id]
+    assert_equal 'outbox:outbox', message[:annotations][:origin]
+    assert Time.iso8601(message[:annotations][:received_at])
+    assert Shortbus::MessageId.valid?(message[:message_id])
+    assert_equal message[:annotations][:message_id], message[:message_id]
+  end
+
+  def test_moved_messages_keep_their_message_id
+    id = Shortbus::MessageId.generate
+    metadata = Shortbus::Annotations.stamp('jobs.dlq', {}, { message_id: id })
+
+    assert_equal id, Shortbus::Annotations.split({ id: 9, metadata: })[:message_id]
+  end
+
+  def test_clients_cannot_forge_annotations
+    metadata = Shortbus::Annotations.stamp('jobs', { _annotations: { node_id: 'forged' } })
+
+    refute_equal 'forged', metadata[:_annotations][:node_id]
+  end
+
+  def test_hooks_add_annotations_and_failures_are_skipped
+    Shortbus::Annotations.register(:region) { |topic, _metadata| "us-east/#{topic}" }
+    Shortbus::Annotations.register(:broken) { |_topic, _metadata| raise 'nope' }
+
+    annotations = Shortbus::Annotations.stamp('jobs', {})[:_annotations]
+
+    assert_equal 'us-east/jobs', annotations[:region]
+    refute annotations.key?(:broken)
+  end
+
+  def test_annotate_and_messages_without_annotations
+    message = Shortbus::Annotations.split({ id: 1, metadata: {} })
+    assert_equal({}, message[:annotations])
+
+    assert_equal({ redelivery_count: 2 }, Shortbus::Annotations.annotate(message, redelivery_count: 2)[:annotations])
+  end
+end
@@ -0,0 +1,57 @@
+require_relative '../test_helper'
+
+class ArchiveTest < ShortbusTest
+  class FakeEngine
+    attr_reader :published
+
+    def initialize
+      @published = []
+    end
+
+    def publish(topic, payload, metadata: {}, trigger: true, annotations: {})
+      @published << { id: @published.size + 100, topic: topic, payload: payload, metadata: metadata, timestamp: 1_729_425_600 }
+      { status: :ok, message_id: @published.last[:id], topic: topic }
+    end
+
+    def fetch_messages(topic, offset: 0, limit: 100)
+      @published.select { |message| message[:topic] == topic }.drop(offset).first(limit)
+    end
+  end
+
+  def test_round_trip_preserves_ids_timestamps_and_metadata
+    source = FakeEngine.new
+    3.times { |n| source.publish('jobs', "job #{n}", metadata: { priority: n }) }
+
+    path = rendezvous_path('jobs.ndjson.gz')
+    assert_equal 3, Shortbus::Archive.export('jobs', path, engine: source)
+
+    target = FakeEngine.new
+    target.publish('other', 'filler')
+    result = Shortbus::Archive.import(path, engine: target)
+
+    assert_equal({ imported: 3, duplicates: 0, topics: { 'jobs' => 3 } }, result)
+
+    imported = target.fetch_messages('jobs')
+    assert_equal ['job 0', 'job 1', 'job 2'], imported.map { |message| message[:payload] }
+    assert_equal [100, 101, 102], imported.map { |message| message[:metadata][:original_id] }
+    assert_equal [0, 1, 2], imported.map { |message| message[:metadata][:priority] }
+    assert_equal 1_729_425_600, imported.first[:metadata][:original_timestamp]
+  end
+
+  def test_reimport_is_deduplicated
+    source = FakeEngine.new
+    2.times { |n| source.publish('jobs', "job #{n}") }
+
+    path = rendezvous_path('jobs.ndjson')
+    Shortbus::Archive.export('jobs', path, engine: source)
+    assert_equal 2, File.readlines(path).size
+
+    target = FakeEngine.new
+    Shortbus::Archive.import(path, engine: target, to: 'replay')
+    result = Shortbus::Archive.import(path, engine: target, to: 'replay')
+
+    assert_equal 0, result[:imported]
+    assert_equal 2, result[:duplicates]
+    assert_equal 2, target.published.size
+  end
+end
@@ -0,0 +1,98 @@
+require_relative '../test_helper'
+
+class ArchiverTest < ShortbusTest
+  class FakeEngine
+    attr_reader :messages
+
+    def initialize(messages)
+      @messages = messages
+    end
+
+    def fetch_messages(topic, offset: 0, limit: 100, tiered: true)
+      @messages.select { |message| message[:topic] == topic && message[:id] >= offset }.first(limit)
+    end
+
+    def delete_message(topic, id)
+      @messages.reject! { |message| message[:topic] == topic && message[:id] == id }
+    end
+  end
+
+  def day
+    86_400
+  end
+
+  def now
+    @now ||= Time.utc(2024, 10, 20, 12)
+  end
+
+  def engine
+    @engine ||= FakeEngine.new([
+      { id: 1, topic: 'jobs', payload: 'old', metadata: {}, timestamp: (now - 9 * day).to_i },
+      { id: 2, topic: 'jobs', payload: 'older than a week', metadata: {}, timestamp: (now - 8 * day).to_i },
+      { id: 3, topic: 'jobs', payload: 'fresh', metadata: {}, timestamp: (now - 60).to_i },
+      { id: 4, topic: 'events', payload: 'kept', metadata: {}, timestamp: (now - 30 * day).to_i },
+    ])
+  end
+
+  def archiver
+    Shortbus::Archiver.new(engine:)
+  end
+
+  def test_archives_and_deletes_aged_out_messages
+    Shortbus.topics.create('jobs', retention: '7d', archive: true)
+    Shortbus.topics.create('events', retention: '7d')
+
+    assert_equal({ 'jobs' => 2 }, archiver.archive!(now:))
+    assert_equal [3, 4], engine.messages.map { |message| message[:id] }
+
+    files = Shortbus.config.archive_dir.glob('**/*.ndjson.gz').map { |path| path.relative_path_from(Shortbus.config.archive_dir).to_s }
+    assert_equal %w[topic=jobs/date=2024-10-11/jobs-1-1.ndjson.gz topic=jobs/date=2024-10-12/jobs-2-2.ndjson.gz], files.sort
+
+    lines = Zlib.gunzip(File.binread(Shortbus.config.archive_dir / files.min)).lines
+    assert_equal 'old', JSON.parse(lines.first)['payload']
+  end
+
+  def test_archived_segments_read_back_through_tiers
+    Shortbus.topics.create('jobs', retention: '7d', archive: true)
+    archiver.archive!(now:)
+
+    tiers = Shortbus::Tiers.new(archiver:)
+
+    assert_equal [1, 2], tiers.segments('jobs').map { |segment| segment[:first] }
+    assert_equal %w[old], tiers.fetch('jobs', offset: 0, limit: 1).map { |message| message[:payload] }
+    assert_equal [2], tiers.fetch('jobs', offset: 2, limit: 10).map { |message| message[:id] }
+    assert_empty tiers.fetch('jobs', offset: 3, limit: 10)
+
+    tiers.forget('jobs')
+    assert_empty tiers.fetch('jobs', offset: 0, limit: 10)
+  end
+
+  def test_local_segments_read_the_same_mapped_or_not
+    Shortbus.topics.create('jobs', retention: '7d', archive: true)
+    archiver.archive!(now:)
+
+    sink = archiver.sink(true)
+    key = Shortbus.config.archive_dir.glob('**/*-1-1.ndjson.gz').first.relative_path_from(Shortbus.config.archive_dir).to_s
+    decoded = archiver.decode(sink.read(key), 'ndjson')
+
+    assert_equal %w[old], decoded.map { |message| message[:payload] }
+    assert_equal decoded, archiver.load(sink, key, 'ndjson')
+
+    sink.define_singleton_method(:map) { |_file| nil } # no mmap here
+    assert_equal decoded, archiver.load(sink, key, 'ndjson')
+  end
+
+  def test_transient_messages_are_dropped_not_archived
+    engine.messages.first[:metadata] = { transient: true }
+    Shortbus.topics.create('jobs', retention: '7d', archive: true)
+
+    assert_equal({ 'jobs' => 1 }, archiver.archive!(now:))
+    assert_equal [3, 4], engine.messages.map { |message| message[:id] }
+    assert_equal [2], Shortbus::Tiers.new(archiver:).segments('jobs').map { |segment| segment[:first] }
+  end
+
+  def test_archive_settings_are_validated
+    assert_raises(Shortbus::TopicError) { Shortbus.topics.create('jobs', archive_format: 'csv') }
+    assert_equal 's3://bucket/prefix', Shortbus.topics.create('jobs', archive: 's3://bucket/prefix')[:archive]
+  end
+end
@@ -0,0 +1,61 @@
+require_relative '../test_helper'
+
+class AuditTest < ShortbusTest
+  class FakeEngine
+    attr_reader :published
+
+    def initialize(fail: false)
+      @fail = fail
+      @published = []
+    end
+
+    def publish(topic, payload, metadata: {})
+      raise Shortbus::ConnectionError, 'engine down' if @fail
+
+      @published << { topic: topic, payload: payload, metadata: metadata }
+      { status: :ok, message_id: @published.size }
+    end
+  end
+
+  def audit
+    @audit ||= Shortbus::Audit.new(config: Shortbus.config)
+  end
+
+  def test_record_appends_and_publishes
+    engine = FakeEngine.new
+    audit.record(:purge, by: 'billing', via: :pipe, engine:, topic: 'jobs')
+    audit.record(:delete_topic, by: 'ops', via: :cli, engine:, topic: 'old', missing: nil)
+
+    lines = File.readlines(Shortbus.config.audit_log).map { |line| JSON.parse(line, symbolize_names: true) }
+    assert_equal %w[purge delete_topic], lines.map { |entry| entry[:action] }
+    assert_equal({ topic: 'jobs' }, lines.first[:params])
+    assert_equal({ topic: 'old' }, lines.last[:params])
+    assert_equal 'ok', lines.first[:outcome]
+    assert Time.iso8601(lines.first[:at])
+
+    assert_equal ['$sys.audit'] * 2, engine.published.map { |message| message[:topic] }
+    assert_equal({ action: 'purge', by: 'billing' }, engine.published.first[:metadata])
+  end
+
+  def test_engine_down_still_writes_the_file
+    entry = audit.record(:purge, by: 'ops', via: :cli, engine: FakeEngine.new(fail: true), topic: 'jobs')
+
+    assert_equal [entry], audit.entries
+  end
+
+  def test_entries_filter
+    engine = FakeEngine.new
+    audit.record(:purge, by: 'ops', via: :cli, engine:, topic: 'a')
+    audit.record(:requeue, by: 'billing', via: :pipe, engine:, topic: 'a.dlq')
+    audit.record(:purge, by: 'billing', via: :pipe, outcome: :denied, engine:, topic: 'b')
+
+    assert_equal %w[a b], audit.entries(action: 'purge').map { |entry| entry[:params][:topic] }
+    assert_equal %w[a.dlq b], audit.entries(by: 'billing').map { |entry| entry[:params][:topic] }
+    assert_equal ['denied'], audit.entries(limit: 1).map { |entry| entry[:outcome] }
+    assert_empty audit.entries(since: Time.now + 60)
+  end
+
+  def test_sys_audit_is_reserved
+    assert_raises(Shortbus::AccessError) { Shortbus::TopicEvents.authorize!(Shortbus::Audit::TOPIC) }
+  end
+end
@@ -0,0 +1,156 @@
+require_relative '../test_helper'
+
+class AuthTest < ShortbusTest
+  SECRET = 'jwt-secret'
+
+  def base64url(data)
+    [data].pack('m0').tr('+/', '-_').delete('=')
+  end
+
+  def jwt(claims, alg: 'HS256', key: SECRET)
+    input = [{ alg:, typ: 'JWT' }, claims].map { |part| base64url(JSON.generate(part)) }.join('.')
+    signature = alg == 'HS256' ? OpenSSL::HMAC.digest('SHA256', key, input) : key.sign(nil, input)
+    "#{input}.#{base64url(signature)}"
+  end
+
+  def test_identity_permissions
+    identity = Shortbus::Auth::Identity.new(name: 'pos-1', permissions: Shortbus::Auth.permissions(publish: ['sales.*'], subscribe: 'sales.eu'))
+
+    assert identity.authorize!('publish', 'sales.eu')
+    assert identity.authorize!('subscribe', 'sales.eu')
+    assert identity.authorize!('ping')
+    assert identity.authorize!('subscribe', Shortbus::Inbox.generate('c1'))
+    assert_raises(Shortbus::AccessError) { identity.authorize!('publish', 'orders') }
+    assert_raises(Shortbus::AccessError) { identity.authorize!('subscribe', 'sales.us') }
+    assert_raises(Shortbus::AccessError) { identity.authorize!('purge', 'sales.eu') }
+
+    assert Shortbus::Auth::Identity.new(name: 'root').authorize!('purge', 'anything')
+    assert_raises(Shortbus::AccessError) { Shortbus::Auth::Identity.new(name: 'old', expires_at: Time.now.to_i - 1).authorize!('ping') }
+  end
+
+  def test_identity_round_trips_through_the_environment
+    identity = Shortbus::Auth::Identity.new(name: 'alice', provider: 'password', permissions: Shortbus::Auth.permissions(subscribe: ['*']))
+    env = { 'SHORTBUS_IDENTITY' => JSON.generate(identity.to_h) }
+
+    assert_equal identity, Shortbus::Auth::Identity.from_env(env)
+    assert_nil Shortbus::Auth::Identity.from_env({})
+  end
+
+  def test_password_provider
+    File.write(Shortbus.config.users_yml, {
+      'alice' => { 'password' => Shortbus::Auth::PasswordProvider.digest('hunter2', iterations: 1000), 'permissions' => { 'subscribe' => ['*'] } }
+    }.to_yaml)
+    provider = Shortbus::Auth::PasswordProvider.new
+
+    identity = provider.authenticate(username: 'alice', password: 'hunter2')
+    assert_equal 'alice', identity.name
+    assert_equal ['*'], identity.permissions[:subscribe]
+
+    assert_nil provider.authenticate(username: 'alice', password: 'guess')
+    assert_nil provider.authenticate(username: 'bob', password: 'hunter2')
+    assert_nil provider.authenticate(token: 'hunter2')
+  end
+
+  def test_jwt_claims_map_to_permissions
+    provider = Shortbus::Auth::JwtProvider.new(secret: SECRET, issuer: 'sso', claims: { name: 'email', publish: 'bus_publish' })
+
+    identity = provider.authenticate(token: jwt({ iss: 'sso', email: 'a@example.com', bus_publish: ['orders.*'], exp: Time.now.to_i + 60 }))
+    assert_equal 'a@example.com', identity.name
+    assert_equal ['orders.*'], identity.permissions[:publish]
+    assert_empty identity.permissions[:subscribe]
+
+    assert_nil provider.authenticate(token: jwt({ iss: 'sso' }, key: 'guess'))
+    assert_nil provider.authenticate(token: jwt({ iss: 'elsewhere' }))
+    assert_nil provider.authenticate(token: jwt({ iss: 'sso', exp: Time.now.to_i - 120 }))
+    assert_nil provider.authenticate(token: 'not-a-jwt')
+  end
+
+  def test_jwt_roles_and_eddsa
+    key = OpenSSL::PKey.generate_key('ED25519')
+    roles = { 'ops' => { 'subscribe' => ['*'], 'admin' => true }, 'pos' => { 'publish' => ['sales.*'] } }
+    provider = Shortbus::Auth::JwtProvider.new(public_key: key.public_to_pem, role_claim: 'groups', roles:)
+
+    identity = provider.authenticate(token: jwt({ sub: 'carol', groups: %w[ops pos] }, alg: 'EdDSA', key:))
+    assert_equal({ publish: ['sales.*'], subscribe: ['*'], admin: true }, identity.permissions)
+
+    # No HMAC secret configured, so an HS256 token can't pass
+    assert_nil provider.authenticate(token: jwt({ sub: 'carol', groups: %w[ops] }))
+  end
+
+  def test_jwt_rate_limit_claim
+    provider = Shortbus::Auth::JwtProvider.new(secret: SECRET)
+
+    identity = provider.authenticate(token: jwt({ sub: 'erin', rate_limit: { publish: '120/m', subscribe: 5 } }))
+    assert_equal({ publish: 2.0, subscribe: 5.0 }, identity.limits)
+    assert_equal({ publish: 10.0 }, provider.authenticate(token: jwt({ sub: 'erin', rate_limit: 10 })).limits)
+    assert_nil provider.authenticate(token: jwt({ sub: 'erin' })).limits
+  end
+
+  def test_rate_limit_refills_over_time
+    now = 0.0
+    limit = Shortbus::Auth::RateLimit.new({ publish: 2.0 }, clock: -> { now })
+
+    2.times { assert limit.take!(:publish) }
+    assert_raises(Shortbus::AccessError) { limit.take!(:publish) }
+    assert limit.take!(:subscribe)
+
+    now += 0.5
+    assert limit.take!(:publish)
+    assert_raises(Shortbus::AccessError) { limit.take!(:publish) }
+  end
+
+  def test_rate_limit_says_when_to_retry
+    now = 0.0
+    limit = Shortbus::Auth::RateLimit.new({ publish: 2.0 }, clock: -> { now })
+
+    2.times { limit.take!(:publish) }
+    error = assert_raises(Shortbus::LimitError) { limit.take!(:publish) }
+    assert_in_delta 0.5, error.retry_after
+    assert_in_delta 0.33, error.pressure
+
+    error = assert_raises(Shortbus::LimitError) { limit.take!(:publish) }
+    assert_in_delta 0.5, error.pressure
+
+    now += 0.25
+    error = assert_raises(Shortbus::LimitError) { limit.take!(:publish) }
+    assert_in_delta 0.25, error.retry_after
+
+    now += 1.0
+    assert limit.take!(:publish)
+  end
+
+  def test_providers_come_from_auth_yml
+    assert_empty Shortbus::Auth.providers
+
+    File.write(Shortbus.config.auth_yml, { 'providers' => [{ 'type' => 'token', 'token' => 's3cret', 'name' => 'ci' }] }.to_yaml)
+    providers = Shortbus::Auth.providers
+
+    assert_equal 'ci', Shortbus::Auth.authenticate({ token: 's3cret' }, providers).name
+    assert_nil Shortbus::Auth.authenticate({ token: 'guess' }, providers)
+
+    File.write(Shortbus.config.auth_yml, { 'providers' => [{ 'type' => 'ldap' }] }.to_yaml)
+    assert_raises(Shortbus::ConfigurationError) { Shortbus::Auth.providers }
+  end
+
+  def test_listener_hands_the_identity_to_pipe
+    File.write(Shortbus.config.auth_yml, { 'providers' => [{ 'type' => 'jwt', 'secret' => SECRET }] }.to_yaml)
+    command = ['sh', '-c', 'echo "$SHORTBUS_IDENTITY"; cat', 'pipe']
+
+    client, server = UNIXSocket.pair
+    serving = Thread.new { Shortbus::Listener.new(command:).send(:serve, server) }
+
+    client.puts JSON.generate(op: 'connect', token: jwt({ sub: 'dave', publish: ['orders'] }))
+
+    assert_equal 'dave', JSON.parse(client.gets)['name']
+    client.close_write
+    serving.join(5)
+
+    client, server = UNIXSocket.pair
+    serving = Thread.new { Shortbus::Listener.new(command:).send(:serve, server) }
+
+    client.puts '{"op": "ping"}'
+
+    assert_match(/Unauthorized/, JSON.parse(client.gets)['error'])
+    serving.join(5)
+  end
+end
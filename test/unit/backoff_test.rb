@@ -0,0 +1,37 @@
+require_relative '../test_helper'
+
+class BackoffTest < ShortbusTest
+  def delays(policy, attempts = 1..5)
+    attempts.map { |attempt| Shortbus::Backoff.delay(Shortbus::Backoff.normalize(policy), attempt) }
+  end
+
+  def test_fixed
+    assert_equal [30, 30, 30, 30, 30], delays('30s')
+  end
+
+  def test_exponential_is_capped
+    assert_equal [1, 2, 4, 8, 10], delays({ strategy: 'exponential', initial: '1s', max: '10s' })
+  end
+
+  def test_schedule_repeats_last_delay
+    assert_equal [1, 10, 60, 60, 60], delays('1s,10s,1m')
+    assert_equal [1, 10, 60, 60, 60], delays(%w[1s 10s 1m])
+  end
+
+  def test_default_policy
+    assert_equal [1, 2, 4, 8, 16], delays(Shortbus::Backoff::DEFAULT)
+  end
+
+  def test_invalid_policies_raise
+    assert_raises(ArgumentError) { Shortbus::Backoff.normalize({ strategy: 'random' }) }
+    assert_raises(ArgumentError) { Shortbus::Backoff.normalize([]) }
+  end
+
+  def test_topic_setting_round_trips
+    topics = Shortbus::Topics.new(config: Shortbus.config)
+    topics.create('jobs', backoff: [1, '1m'])
+
+    assert_equal({ 'strategy' => 'schedule', 'delays' => [1, 60] }, topics.backoff('jobs'))
+    assert_equal Shortbus::Backoff::DEFAULT, topics.backoff('other')
+  end
+end
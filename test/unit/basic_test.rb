@@ -30,6 +30,11 @@ class BasicTest < ShortbusTest
     assert_equal Pathname.new(expected), Shortbus.config.pid_file
   end
 
+  def test_log_path
+    expected = File.join(@tmpdir, 'logs', 'shortbus.log')
+    assert_equal Pathname.new(expected), Shortbus.config.log_path
+  end
+
   def test_socket_path
     expected = File.join(@tmpdir, 'shortbus.sock')
     assert_equal Pathname.new(expected), Shortbus.config.socket_path
@@ -0,0 +1,72 @@
+require_relative '../test_helper'
+
+class CompactorTest < ShortbusTest
+  class FakeEngine
+    attr_reader :messages
+
+    def initialize(messages)
+      @messages = messages
+    end
+
+    def fetch_messages(topic, offset: 0, limit: 100, tiered: true)
+      @messages.select { |message| message[:topic] == topic && message[:id] >= offset }.first(limit)
+    end
+
+    def delete_message(topic, id)
+      raise Shortbus::EngineError, "Message not found: #{topic}/#{id}" unless @messages.any? { |message| message[:id] == id }
+
+      @messages.reject! { |message| message[:topic] == topic && message[:id] == id }
+    end
+  end
+
+  def now
+    @now ||= Time.utc(2024, 10, 20, 12)
+  end
+
+  def message(id, key, payload = 'v', topic: 'prices', age: 60, **metadata)
+    { id:, topic:, payload:, metadata: { key: }.compact.merge(metadata), timestamp: (now - age).to_i }
+  end
+
+  def test_keeps_the_latest_message_per_key
+    Shortbus.topics.create('prices', compact: true)
+    engine = FakeEngine.new([
+      message(1, 'eur', '1.08'),
+      message(2, 'gbp', '1.27'),
+      message(3, nil, 'no key'),
+      message(4, 'eur', '1.09'),
+      message(5, 'eur', '1.10'),
+      message(6, 'gbp', '1.26', topic: 'events'),
+    ])
+
+    assert_equal({ 'prices' => 2 }, Shortbus::Compactor.new(engine:).compact!(now:))
+    assert_equal [2, 3, 5, 6], engine.messages.map { |kept| kept[:id] }
+  end
+
+  def test_tombstones_go_after_retention
+    Shortbus.topics.create('prices', compact: true, retention: '1h')
+    engine = FakeEngine.new([
+      message(1, 'eur', age: 7200),
+      message(2, 'eur', '', age: 7200, tombstone: true),
+      message(3, 'gbp', age: 7200),
+      message(4, 'gbp', '', tombstone: true),
+    ])
+
+    Shortbus::Compactor.new(engine:).compact!(now:)
+    assert_equal [4], engine.messages.map { |kept| kept[:id] }
+  end
+
+  def test_uncompacted_topics_are_left_alone
+    Shortbus.topics.create('prices')
+    engine = FakeEngine.new([message(1, 'eur'), message(2, 'eur')])
+
+    assert_empty Shortbus::Compactor.new(engine:).compact!(now:)
+    assert_equal 2, engine.messages.size
+  end
+
+  def test_compact_setting
+    Shortbus.topics.create('prices', compact: 'true')
+
+    assert Shortbus.topics.compacted?('prices')
+    refute Shortbus.topics.compacted?('events')
+  end
+end
@@ -0,0 +1,82 @@
+require_relative '../test_helper'
+require 'open3'
+
+class ConformanceTest < ShortbusTest
+  def captures
+    Shortbus::Conformance.captures
+  end
+
+  def test_every_version_up_to_the_current_one_has_captures
+    versions = captures.map(&:version).uniq.sort
+
+    assert_equal (1..Shortbus::PipeMode::PROTOCOL).to_a, versions
+    captures.each do |capture|
+      side, frames = capture.steps.first
+      assert_equal :broker, side, "#{capture.id} should start with ready"
+      assert_equal({ 'status' => 'ready', 'protocol' => capture.version }, frames.first.slice('status', 'protocol'))
+    end
+  end
+
+  def test_captures_play_against_themselves
+    captures.each do |capture|
+      to_broker_r, to_broker_w = IO.pipe
+      to_client_r, to_client_w = IO.pipe
+
+      broker = Thread.new { Shortbus::Conformance.play(capture, side: :broker, reader: to_broker_r, writer: to_client_w, timeout: 1) }
+      client = Shortbus::Conformance.play(capture, side: :client, reader: to_client_r, writer: to_broker_w, timeout: 1)
+
+      assert client[:passed], "#{capture.id}: #{client[:failures].join('; ')}"
+      assert broker.value[:passed], "#{capture.id}: #{broker.value[:failures].join('; ')}"
+    ensure
+      [to_broker_r, to_broker_w, to_client_r, to_client_w].each(&:close)
+    end
+  end
+
+  def test_added_fields_pass_and_changed_ones_fail
+    conformance = Shortbus::Conformance
+    expected = { 'op' => 'published', 'offset' => '$offset', 'request_id' => '$r1' }
+    samples = { '$offset' => 1, '$r1' => 1 }
+
+    bound = conformance.match(expected, { 'op' => 'published', 'offset' => 41, 'request_id' => 1, 'acked_after' => 'fsync' }, {}, samples)
+    assert_equal({ '$offset' => 41, '$r1' => 1 }, bound)
+
+    assert_nil conformance.match(expected, { 'op' => 'published', 'request_id' => 1 }, {}, samples)
+    assert_nil conformance.match(expected, { 'op' => 'published', 'offset' => '41', 'request_id' => 1 }, {}, samples)
+    assert_nil conformance.match(expected, { 'op' => 'published', 'offset' => 41, 'request_id' => 2 }, { '$r1' => 1 }, samples)
+  end
+
+  # A driver that plays the client's side from the capture it is told about
+  SELF_DRIVER = <<~RUBY
+    capture = Shortbus::Conformance.parse(ENV.fetch('SHORTBUS_CONFORMANCE_CAPTURE'))
+    result = Shortbus::Conformance.play(capture, side: :client, reader: $stdin, writer: $stdout, timeout: 1)
+    exit(result[:passed] ? 0 : 1)
+  RUBY
+
+  def test_check_runs_a_target_per_capture
+    results = Shortbus::Conformance.check([RbConfig.ruby, '-I', LIB_DIR, '-rshortbus', '-e', SELF_DRIVER], side: :client, timeout: 2)
+
+    assert_equal captures.map(&:id), results.map { |result| result[:id] }
+    results.each { |result| assert result[:passed], "#{result[:id]}: #{result[:failures].join('; ')}" }
+  end
+
+  def test_check_fails_targets_that_go_away
+    results = Shortbus::Conformance.check([RbConfig.ruby, '-e', 'exit 3'], side: :client, captures: captures.first(1), timeout: 1)
+
+    refute results.first[:passed]
+    assert_match(/connection closed/, results.first[:failures].join)
+
+    results = Shortbus::Conformance.check(['/nonexistent/driver'], side: :client, captures: captures.first(1))
+    assert_match(/couldn't run/, results.first[:failures].join)
+  end
+
+  def test_the_broker_speaks_every_version
+    skip 'needs a running engine' unless Shortbus.engine.healthy?
+
+    captures.each do |capture|
+      Open3.popen2({ 'SHORTBUS_ROOT' => @tmpdir }, File.expand_path('../../bin/shortbus', __dir__), 'pipe') do |stdin, stdout, _|
+        result = Shortbus::Conformance.play(capture, side: :client, reader: stdout, writer: stdin)
+        assert result[:passed], "#{capture.id}: #{result[:failures].join('; ')}"
+      end
+    end
+  end
+end
@@ -0,0 +1,50 @@
+require_relative '../test_helper'
+
+class ConnectionsTest < ShortbusTest
+  class FakeEngine
+    attr_reader :published
+
+    def initialize
+      @published = []
+    end
+
+    def publish(topic, payload, metadata: {})
+      @published << { topic: topic, payload: payload, metadata: metadata }
+      { status: :ok, message_id: @published.size }
+    end
+  end
+
+  def connections
+    @connections ||= Shortbus::Connections.new(config: Shortbus.config)
+  end
+
+  def dead_pid
+    dead = Process.spawn('true')
+    Process.wait(dead)
+    dead
+  end
+
+  def test_dead_connections_leave_their_will_once
+    engine = FakeEngine.new
+    connections.register('live', name: 'api')
+    connections.register('dead', name: 'billing', pid: dead_pid)
+    connections.update('dead', will: { topic: 'presence.billing', payload: 'offline' })
+
+    assert_equal ['dead'], connections.reap!(engine:)
+    assert_empty connections.reap!(engine:)
+    assert_equal ['live'], connections.list.map { |connection| connection[:id] }
+
+    assert_equal 1, engine.published.size
+    will = engine.published.first
+    assert_equal ['presence.billing', 'offline'], [will[:topic], will[:payload]]
+    assert_equal({ will: true, connection_id: 'dead', published_by: 'billing' }, will[:metadata])
+  end
+
+  def test_dead_connections_without_a_will
+    engine = FakeEngine.new
+    connections.register('dead', pid: dead_pid)
+
+    assert_equal ['dead'], connections.reap!(engine:)
+    assert_empty engine.published
+  end
+end
@@ -0,0 +1,40 @@
+require_relative '../test_helper'
+
+class CronTest < ShortbusTest
+  def next_after(expression, time)
+    Shortbus::Cron.new(expression).next_after(time)
+  end
+
+  def test_every_five_minutes
+    assert_equal Time.local(2024, 10, 20, 12, 5), next_after('*/5 * * * *', Time.local(2024, 10, 20, 12, 0, 30))
+    assert_equal Time.local(2024, 10, 20, 12, 10), next_after('*/5 * * * *', Time.local(2024, 10, 20, 12, 5))
+  end
+
+  def test_hours_ranges_and_weekdays
+    # 2024-10-19 is a Saturday
+    assert_equal Time.local(2024, 10, 21, 9), next_after('0 9-17 * * 1-5', Time.local(2024, 10, 19, 10))
+    assert_equal Time.local(2024, 10, 21, 14), next_after('0 9-17 * * 1-5', Time.local(2024, 10, 21, 13, 15))
+  end
+
+  def test_lists_and_month_rollover
+    assert_equal Time.local(2025, 1, 1, 2, 30), next_after('30 2 1,15 * *', Time.local(2024, 12, 15, 3))
+    assert_equal Time.local(2025, 1, 1), next_after('@yearly', Time.local(2024, 6, 1))
+  end
+
+  def test_either_day_field_matches_when_both_are_restricted
+    # The 1st, or any Sunday (2024-10-20)
+    assert_equal Time.local(2024, 10, 20), next_after('0 0 1 * 0', Time.local(2024, 10, 19, 1))
+  end
+
+  def test_sunday_is_zero_or_seven
+    assert_equal next_after('0 0 * * 0', Time.local(2024, 10, 16)), next_after('0 0 * * 7', Time.local(2024, 10, 16))
+  end
+
+  def test_invalid_expressions
+    refute Shortbus::Cron.valid?('* * * *')
+    refute Shortbus::Cron.valid?('60 * * * *')
+    refute Shortbus::Cron.valid?('*/0 * * * *')
+    assert Shortbus::Cron.valid?('5/15 * * * *')
+    assert_raises(ArgumentError) { next_after('0 0 31 2 *', Time.local(2024, 1, 1)) }
+  end
+end
@@ -0,0 +1,34 @@
+require_relative '../test_helper'
+
+class DashboardTest < ShortbusTest
+  def exported
+    Shortbus::Metrics::EXPORTED.values
+  end
+
+  # Every series a query names, without _bucket/_sum/_count
+  def series(expr)
+    expr.scan(/shortbus_\w+/).map { |name| name.sub(/_(bucket|sum|count)\z/, '') }
+  end
+
+  def test_panels_only_query_exported_series
+    dashboard = Shortbus::Dashboard.grafana
+
+    assert_equal 'shortbus', dashboard[:uid]
+    exprs = dashboard[:panels].flat_map { |panel| panel[:targets].map { |target| target[:expr] } }
+    refute_empty exprs
+    exprs.each { |expr| assert_empty series(expr) - exported, expr }
+    assert_equal dashboard[:panels].size, dashboard[:panels].map { |panel| panel[:gridPos] }.uniq.size
+  end
+
+  def test_alert_rules_are_a_rule_file
+    rules = YAML.safe_load(Shortbus::Dashboard.alert_rules_yaml(latency: 10))
+
+    alerts = rules['groups'].first['rules']
+    assert_includes alerts.map { |rule| rule['alert'] }, 'ShortbusDeliveryLatencyHigh'
+    alerts.each do |rule|
+      assert_empty series(rule['expr']) - exported, rule['expr']
+      refute_includes rule['expr'], '$topic', 'rules have no dashboard variables'
+    end
+    assert_match(/> 10\z/, alerts.first['expr'])
+  end
+end
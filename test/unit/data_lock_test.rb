@@ -0,0 +1,56 @@
+require_relative '../test_helper'
+
+class DataLockTest < ShortbusTest
+  def lock
+    config = Shortbus::Config.new
+    config.root = @tmpdir
+    Shortbus::DataLock.new(config:)
+  end
+
+  def test_a_held_directory_fails_fast
+    first = lock
+    second = lock
+
+    assert_equal 1, first.acquire!
+    error = assert_raises(Shortbus::EngineError) { second.acquire! }
+    assert_match(/in use by pid #{Process.pid}/, error.message)
+    refute second.held?
+
+    first.release!
+    assert_equal 2, second.acquire!
+    second.release!
+  end
+
+  def test_each_acquisition_takes_the_next_token
+    first = lock
+    assert_equal 1, first.acquire!
+    assert_equal 1, first.acquire!
+    first.release!
+
+    second = lock
+    assert_equal 2, second.acquire!
+    assert_equal 2, second.current
+    second.release!
+  end
+
+  def test_a_superseded_holder_is_fenced_off
+    first = lock
+    first.acquire!
+    assert_equal 1, first.fence!
+
+    # flock doesn't hold over some filesystems; the token still does
+    File.write(first.path, JSON.generate(token: 2, pid: 1))
+    assert_raises(Shortbus::EngineError) { first.fence! }
+    assert_equal 2, lock.fence!
+    first.release!
+  end
+
+  def test_archived_segments_carry_the_token
+    Shortbus.data_lock.acquire!
+    Shortbus::Tiers.new.record('jobs', first: 1, last: 2, destination: true, key: 'k', format: 'ndjson',
+                                       token: Shortbus.data_lock.fence!)
+    assert_equal [1], Shortbus::Tiers.new.segments('jobs').map { |segment| segment[:token] }
+  ensure
+    Shortbus.data_lock.release!
+  end
+end
@@ -0,0 +1,41 @@
+require_relative '../test_helper'
+
+class DeadlinesTest < ShortbusTest
+  def deadlines
+    @deadlines ||= Shortbus::Deadlines.new(config: Shortbus.config)
+  end
+
+  def message(id, deadline)
+    { id: id, payload: "job #{id}", metadata: { deadline: deadline }.compact }
+  end
+
+  def test_stamp_accepts_absolute_and_relative
+    now = Time.utc(2024, 10, 20, 12)
+
+    assert_equal '2024-10-20T12:00:30.000Z', deadlines.stamp({}, deadline_in: '30s', now:)[:deadline]
+    assert_equal '2024-10-20T13:00:00.000Z', deadlines.stamp({}, deadline: '2024-10-20T13:00:00Z', now:)[:deadline]
+    assert_equal '2024-10-20T12:00:00.000Z', deadlines.stamp({}, deadline: now.to_i, now:)[:deadline]
+    assert_equal({ key: 'k' }, deadlines.stamp({ key: 'k' }))
+  end
+
+  def test_live_skips_and_counts_expired
+    now = Time.now
+    messages = [
+      message(1, (now - 60).utc.iso8601),
+      message(2, (now + 60).utc.iso8601),
+      message(3, nil)
+    ]
+
+    assert_equal [2, 3], deadlines.live('jobs', messages, now:).map { |msg| msg[:id] }
+    assert_equal 1, deadlines.expired('jobs')
+
+    assert deadlines.expire?('jobs', messages.first, now:)
+    refute deadlines.expire?('jobs', messages.last, now:)
+    assert_equal 2, deadlines.expired('jobs')
+    assert_equal 0, deadlines.expired('audit')
+  end
+
+  def test_unparseable_deadline_is_ignored
+    refute deadlines.expired?(message(1, 'soon'))
+  end
+end
@@ -0,0 +1,32 @@
+require_relative '../test_helper'
+
+class DedupeTest < ShortbusTest
+  def dedupe
+    @dedupe ||= Shortbus::Dedupe.new(config: Shortbus.config)
+  end
+
+  def test_repeat_key_returns_original
+    first = dedupe.publish('orders', 'k1') { { status: :ok, message_id: 7 } }
+    again = dedupe.publish('orders', 'k1') { flunk 'published twice' }
+
+    assert_equal 7, first[:message_id]
+    assert_equal 7, again[:message_id]
+    assert again[:duplicate]
+    assert dedupe.seen?('orders', 'k1')
+    refute dedupe.seen?('audit', 'k1')
+  end
+
+  def test_keys_expire_after_window
+    dedupe.publish('orders', 'k1') { { message_id: 1 } }
+    result = dedupe.publish('orders', 'k1', window: -1) { { message_id: 2 } }
+
+    assert_equal 2, result[:message_id]
+  end
+
+  def test_no_key_always_publishes
+    calls = 0
+    2.times { dedupe.publish('orders', nil) { calls += 1; { message_id: calls } } }
+
+    assert_equal 2, calls
+  end
+end
@@ -0,0 +1,45 @@
+require_relative '../test_helper'
+
+class DelaysTest < ShortbusTest
+  class FakeEngine
+    attr_reader :published
+
+    def initialize
+      @published = []
+    end
+
+    def publish(topic, payload, metadata: {})
+      @published << { topic:, payload:, metadata: }
+      { status: :ok, message_id: @published.size }
+    end
+  end
+
+  def delays
+    @delays ||= Shortbus::Delays.new(config: Shortbus.config)
+  end
+
+  def test_held_messages_publish_once_due
+    now = Time.now
+    soon = delays.hold('reminders', 'soon', delay: '10s', now:)
+    later = delays.hold('reminders', 'later', deliver_at: (now + 3600).to_i, now:)
+    engine = FakeEngine.new
+
+    assert_equal({}, delays.release!(now:, engine:))
+    assert_equal [soon[:id], later[:id]], delays.pending.map { |message| message[:id] }
+
+    assert_equal({ soon[:id] => 1 }, delays.release!(now: now + 10, engine:))
+    assert_equal %w[soon], engine.published.map { |message| message[:payload] }
+    assert_equal [later[:id]], delays.pending.map { |message| message[:id] }
+  end
+
+  def test_dedupe_key_is_checked_at_release
+    engine = FakeEngine.new
+    2.times { delays.hold('orders', 'order', metadata: { dedupe_key: 'order-42' }, delay: 0) }
+
+    released = delays.release!(engine:)
+
+    assert_equal [1, 1], released.values
+    assert_equal 1, engine.published.size
+    assert_empty delays.pending
+  end
+end
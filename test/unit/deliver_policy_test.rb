@@ -0,0 +1,38 @@
+require_relative '../test_helper'
+
+class DeliverPolicyTest < ShortbusTest
+  class FakeEngine
+    def initialize(messages)
+      @messages = messages
+    end
+
+    def fetch_messages(topic, offset: 0, limit: 100)
+      @messages.select { |message| message[:id] >= offset }.first(limit)
+    end
+  end
+
+  def engine
+    now = Time.now.to_i
+    FakeEngine.new([
+      { id: 0, timestamp: now - 7200 },
+      { id: 1, timestamp: now - 3600 },
+      { id: 2, timestamp: now - 60 },
+    ])
+  end
+
+  def start(policy, **opts)
+    Shortbus::DeliverPolicy.start_offset('events', policy, engine:, **opts)
+  end
+
+  def test_positions
+    assert_equal 0, start('all')
+    assert_equal 2, start('last')
+    assert_equal 3, start('new')
+    assert_equal 1, start('by_start_sequence', start_sequence: 1)
+    assert_equal 2, start('by-start-time', start_time: '30m')
+  end
+
+  def test_unknown_policy_raises
+    assert_raises(ArgumentError) { start('sometimes') }
+  end
+end
@@ -0,0 +1,94 @@
+require_relative '../test_helper'
+
+class DoctorTest < ShortbusTest
+  class FakeEngine
+    def initialize(topics: [], healthy: true)
+      @topics = topics
+      @healthy = healthy
+    end
+
+    def healthy?
+      @healthy
+    end
+
+    def list_topics
+      @topics.map { |name| { name: name } }
+    end
+  end
+
+  def doctor(engine: FakeEngine.new(topics: %w[jobs]))
+    Shortbus::Doctor.new(engine:)
+  end
+
+  def levels(findings, check)
+    findings.select { |finding| finding.check == check }.map(&:level)
+  end
+
+  def test_clean_rendezvous_is_healthy
+    Shortbus.topics.create('jobs')
+    doctor = self.doctor
+    findings = doctor.run
+
+    assert doctor.healthy?
+    assert_equal [:ok], findings.map(&:level).uniq
+  end
+
+  def test_reports_bad_config_and_state
+    Shortbus.topics.create('jobs', dlq: 'jobs.dlq')
+    FileUtils.mkdir_p(Shortbus.config.sessions_dir)
+    File.write(Shortbus.config.sessions_dir / 'billing.json', '{"topics": [')
+
+    doctor = self.doctor(engine: FakeEngine.new(healthy: false))
+    findings = doctor.run
+
+    refute doctor.healthy?
+    assert_equal [:warn], levels(findings, :config)
+    assert_equal [:error], levels(findings, :state)
+    assert_equal [:error], levels(findings, :engine)
+    assert findings.reject { |finding| finding.level == :ok }.all?(&:fix)
+  end
+
+  def test_orphaned_groups
+    Shortbus.groups.commit('gone', 'workers', 3)
+
+    findings = doctor.run
+
+    assert_equal [:warn], levels(findings, :groups)
+    assert_match(/missing topic gone/, findings.find { |finding| finding.check == :groups }.message)
+  end
+
+  def test_verify_wal
+    path = rendezvous_path('blockqueue-wal')
+    File.binwrite(path, wal(frames: 3))
+    assert_equal({ frames: 3, committed: 3, torn: false }, Shortbus::Doctor.verify_wal(path))
+
+    data = wal(frames: 3)
+    data.setbyte(data.bytesize - 1, data.getbyte(data.bytesize - 1) ^ 0xff)
+    File.binwrite(path, data)
+    assert_equal({ frames: 2, committed: 2, torn: true }, Shortbus::Doctor.verify_wal(path))
+  end
+
+  # A little-endian-checksummed WAL with 512-byte pages, every frame a commit
+  def wal(frames:, page_size: 512)
+    checksum = ->(bytes, (s0, s1)) do
+      bytes.unpack('V*').each_slice(2) do |x0, x1|
+        s0 = (s0 + x0 + s1) & 0xffffffff
+        s1 = (s1 + x1 + s0) & 0xffffffff
+      end
+      [s0, s1]
+    end
+
+    header = [0x377f0682, 3007000, page_size, 0, 11, 22].pack('N6')
+    sums = checksum.call(header, [0, 0])
+    data = header + sums.pack('N2')
+
+    frames.times do |n|
+      page = ([n + 1] * (page_size / 4)).pack('V*')
+      frame = [n + 1, n + 1].pack('N2')
+      sums = checksum.call(page, checksum.call(frame, sums))
+      data << frame << [11, 22].pack('N2') << sums.pack('N2') << page
+    end
+
+    data
+  end
+end
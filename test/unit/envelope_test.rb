@@ -0,0 +1,50 @@
+require_relative '../test_helper'
+
+class EnvelopeTest < ShortbusTest
+  KEY = ("\0" * 32).b
+
+  def keys
+    { 'orders' => [KEY] }
+  end
+
+  def test_seal_and_open_round_trip
+    payload, metadata = Shortbus::Envelope.seal('orders.eu', 'secret', { region: 'eu' }, keys:)
+
+    refute_includes payload, 'secret'
+    assert_equal({ ns: 'orders', kid: '66687aad', alg: 'A256GCM' }, metadata[:sealed])
+    assert_equal ['secret', { region: 'eu' }], Shortbus::Envelope.open(payload, metadata, keys:)
+  end
+
+  def test_topics_outside_namespaces_pass_through
+    assert_equal ['plain', {}], Shortbus::Envelope.seal('ordersx', 'plain', {}, keys:)
+    assert_equal ['plain', {}], Shortbus::Envelope.open('plain', {}, keys:)
+  end
+
+  def test_opens_what_the_go_client_sealed
+    metadata = { sealed: { ns: 'orders', kid: '66687aad', alg: 'A256GCM' } }
+
+    assert_equal ['hi', {}], Shortbus::Envelope.open('VTHl/C6+HiPgBGDHptGQ7PgTgfuBM/hP1Pg2mqVp', metadata, keys:)
+  end
+
+  def test_rotation_opens_with_any_key
+    new_key = SecureRandom.bytes(32)
+    payload, metadata = Shortbus::Envelope.seal('orders', 'secret', {}, keys:)
+
+    rotated = { 'orders' => [new_key, KEY] }
+    assert_equal 'secret', Shortbus::Envelope.open(payload, metadata, keys: rotated).first
+    assert_equal Shortbus::Envelope.key_id(new_key), Shortbus::Envelope.seal('orders', 'x', {}, keys: rotated).last[:sealed][:kid]
+  end
+
+  def test_wrong_key_or_tampering_fails
+    payload, metadata = Shortbus::Envelope.seal('orders', 'secret', {}, keys:)
+
+    assert_raises(Shortbus::Error) { Shortbus::Envelope.open(payload, metadata, keys: { 'orders' => [SecureRandom.bytes(32)] }) }
+
+    # Passed off as another namespace's
+    forged = metadata.merge(sealed: metadata[:sealed].merge(ns: 'billing'))
+    assert_raises(Shortbus::Error) { Shortbus::Envelope.open(payload, forged, keys: { 'billing' => [KEY] }) }
+
+    tampered = [payload.unpack1('m0').tap { |data| data[-1] = (data[-1].ord ^ 1).chr }].pack('m0')
+    assert_raises(Shortbus::Error) { Shortbus::Envelope.open(tampered, metadata, keys:) }
+  end
+end
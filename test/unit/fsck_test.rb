@@ -0,0 +1,68 @@
+require_relative '../test_helper'
+
+class FsckTest < ShortbusTest
+  class StoppedEngine
+    def running?
+      false
+    end
+  end
+
+  def fsck(repair: false)
+    Shortbus::Fsck.new(repair:, process_manager: StoppedEngine.new)
+  end
+
+  def pending_path
+    Shortbus.config.groups_dir / 'jobs' / 'workers.pending.json'
+  end
+
+  def test_clean_rendezvous
+    Shortbus.groups.track('jobs', 'workers', [1, 2], consumer: 'c1')
+    fsck = self.fsck
+
+    assert_empty fsck.run
+    assert fsck.clean?
+  end
+
+  def test_report_only_changes_nothing
+    Shortbus.groups.track('jobs', 'workers', [41, 42], consumer: 'c1')
+    File.write(pending_path, pending_path.read[0..-10])
+    before = pending_path.read
+
+    fsck = self.fsck
+    problems = fsck.run
+
+    assert_equal 1, problems.size
+    refute fsck.clean?
+    assert_equal before, pending_path.read
+  end
+
+  def test_repairs_truncated_pending_list
+    Shortbus.groups.track('jobs', 'workers', [41, 42], consumer: 'c1')
+    File.write(pending_path, pending_path.read[0..-10])
+
+    fsck = self.fsck(repair: true)
+    fsck.run
+
+    assert fsck.clean?
+    reclaimed = Shortbus.groups.reclaim('jobs', 'workers', consumer: 'c2')
+    assert_equal [41, 42], reclaimed.sort
+  end
+
+  def test_moves_unreadable_state_aside
+    Shortbus.groups.commit('jobs', 'workers', 7)
+    offset = Shortbus.config.groups_dir / 'jobs' / 'workers.offset'
+    File.write(offset, "\x00\x00garbage")
+
+    FileUtils.mkdir_p(Shortbus.config.sessions_dir)
+    session = Shortbus.config.sessions_dir / 'billing.json'
+    File.write(session, '{"name": "bill')
+
+    problems = fsck(repair: true).run
+
+    assert_equal 2, problems.size
+    refute offset.exist?
+    refute session.exist?
+    assert Pathname.new("#{session}.corrupt").exist?
+    assert_equal 0, Shortbus.groups.offset('jobs', 'workers')
+  end
+end
@@ -0,0 +1,74 @@
+require_relative '../test_helper'
+
+class GroupCommitTest < ShortbusTest
+  def config(durability = 'sync')
+    config = Shortbus::Config.new
+    config.root = @tmpdir
+    config.durability = durability
+    config.group_commit_ms = 0
+    config
+  end
+
+  def group_commit(durability = 'sync')
+    Shortbus::GroupCommit.new(config: config(durability))
+  end
+
+  def synced_at(commit)
+    commit.path.read.to_f
+  end
+
+  def test_one_sync_covers_earlier_writes
+    File.write(rendezvous_path('blockqueue.db'), 'sqlite')
+    File.write(rendezvous_path('blockqueue.db-wal'), 'frames')
+    commit = group_commit
+    written = Shortbus::GroupCommit.now
+
+    assert commit.sync!(written)
+    first = synced_at(commit)
+    assert_operator first, :>=, written
+
+    assert commit.sync!(written)
+    assert_equal first, synced_at(commit)
+
+    assert commit.sync!(Shortbus::GroupCommit.now)
+    assert_operator synced_at(commit), :>, first
+  end
+
+  def test_nothing_to_sync_without_a_database
+    refute group_commit.sync!
+  end
+
+  def test_policies
+    assert_equal 'os', Shortbus::GroupCommit.normalize(nil)
+    assert_equal 'always', Shortbus::GroupCommit.normalize('sync')
+    assert_equal 100, Shortbus::GroupCommit.normalize('100ms')
+    assert_equal 1500, Shortbus::GroupCommit.normalize('1.5s')
+    assert_equal 250, Shortbus::GroupCommit.normalize(250)
+    assert_raises(ArgumentError) { Shortbus::GroupCommit.normalize('sometimes') }
+    assert_raises(ArgumentError) { Shortbus::GroupCommit.normalize(0) }
+  end
+
+  def test_topics_choose_their_policy
+    File.write(rendezvous_path('blockqueue.db'), 'sqlite')
+    topics = Shortbus::Topics.new(config: config)
+    topics.create('payments', sync: 'always')
+    topics.create('metrics', sync: '50ms')
+    commit = Shortbus::GroupCommit.new(config: config('os'), topics:)
+
+    assert_equal 'fsync', commit.commit!(['payments'])
+    assert_equal 'enqueue', commit.commit!(['metrics'])
+    assert_equal 'enqueue', commit.commit!(['clicks'])
+    assert_equal 'fsync', commit.commit!(%w[clicks payments])
+  end
+
+  def test_interval_policies_sync_in_the_background
+    File.write(rendezvous_path('blockqueue.db'), 'sqlite')
+    commit = Shortbus::GroupCommit.new(config: config('10ms'), topics: Shortbus::Topics.new(config: config))
+    written = Shortbus::GroupCommit.now
+
+    assert_equal 'enqueue', commit.commit!(['clicks'], written)
+    deadline = Time.now + 2
+    sleep 0.01 until (commit.path.exist? && synced_at(commit) >= written) || Time.now > deadline
+    assert_operator synced_at(commit), :>=, written
+  end
+end
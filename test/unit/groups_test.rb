@@ -0,0 +1,134 @@
+require_relative '../test_helper'
+
+class GroupsTest < ShortbusTest
+  def groups
+    Shortbus::Groups.new(config: Shortbus.config)
+  end
+
+  def test_claim_advances_past_last_message
+    claimed = groups.claim('jobs', 'workers') { |offset| [{ id: offset }, { id: offset + 1 }] }
+
+    assert_equal 2, claimed.size
+    assert_equal 2, groups.offset('jobs', 'workers')
+  end
+
+  def test_commit_only_moves_forward
+    assert_equal 10, groups.commit('jobs', 'workers', 10)
+    assert_equal 10, groups.commit('jobs', 'workers', 5)
+    assert_equal 10, groups.offset('jobs', 'workers')
+  end
+
+  def test_groups_are_listed_per_topic
+    groups.commit('jobs', 'a', 1)
+    groups.commit('jobs', 'b', 1)
+
+    assert_equal %w[a b], groups.groups('jobs').sort
+  end
+
+  def test_partitions_split_across_members
+    groups.join('orders', 'billing', 'a')
+    groups.join('orders', 'billing', 'b')
+
+    a = groups.assignment('orders', 'billing', 'a', 4)
+    b = groups.assignment('orders', 'billing', 'b', 4)
+
+    assert_equal [0, 2], a
+    assert_equal [1, 3], b
+
+    groups.leave('orders', 'billing', 'b')
+    assert_equal [0, 1, 2, 3], groups.assignment('orders', 'billing', 'a', 4)
+  end
+
+  def test_same_key_same_partition
+    one = Shortbus::Groups.partition_for({ id: 1, metadata: { key: 'customer-42' } }, 8)
+    two = Shortbus::Groups.partition_for({ id: 9, metadata: { key: 'customer-42' } }, 8)
+
+    assert_equal one, two
+  end
+
+  def test_ack_clears_pending
+    groups.track('jobs', 'workers', [1, 2], consumer: 'a')
+    assert_equal [1, 2], groups.pending('jobs', 'workers').map { |entry| entry[:id] }
+
+    assert_equal 1, groups.ack('jobs', 'workers', [2, 3])
+    assert_equal [1], groups.pending('jobs', 'workers').map { |entry| entry[:id] }
+  end
+
+  def test_reclaim_from_dead_or_idle_consumers
+    dead = Process.spawn('true')
+    Process.wait(dead)
+
+    groups.track('jobs', 'workers', [1], consumer: 'gone', pid: dead)
+    groups.track('jobs', 'workers', [2], consumer: 'slow')
+
+    assert_equal [1], groups.reclaim('jobs', 'workers', consumer: 'b')
+    assert_equal [2], groups.reclaim('jobs', 'workers', consumer: 'b', min_idle: 0)
+
+    entry = groups.pending('jobs', 'workers').first
+    assert_equal 'b', entry[:consumer]
+    assert_equal 2, entry[:deliveries]
+  end
+
+  def test_extended_messages_are_not_reclaimed_until_they_lapse
+    dead = Process.spawn('true')
+    Process.wait(dead)
+
+    groups.track('jobs', 'workers', [1, 2], consumer: 'a')
+    groups.track('jobs', 'workers', [3], consumer: 'gone', pid: dead)
+
+    assert_equal 1, groups.touch('jobs', 'workers', [1, 3], consumer: 'a', extend_by: 3600)
+    assert groups.pending('jobs', 'workers').first[:visible_until]
+
+    assert_equal [2, 3], groups.reclaim('jobs', 'workers', consumer: 'b', min_idle: 0)
+
+    groups.touch('jobs', 'workers', [1], consumer: 'a', extend_by: -1)
+    assert_equal [1], groups.reclaim('jobs', 'workers', consumer: 'b', min_idle: 0)
+    assert_nil groups.pending('jobs', 'workers').first[:visible_until]
+  end
+
+  def test_paused_groups_hand_nothing_out
+    groups.pause('jobs', 'workers')
+    assert groups.paused?('jobs', 'workers')
+    refute groups.paused?('jobs', 'indexer')
+
+    taken = groups.claim('jobs', 'workers') { flunk 'read while paused' }
+    assert_equal [], taken
+    assert_equal 0, groups.offset('jobs', 'workers')
+
+    groups.resume('jobs', 'workers')
+    assert_equal [{ id: 1 }], groups.claim('jobs', 'workers') { [{ id: 1 }] }
+  end
+
+  def test_drain_waits_for_in_flight_acks
+    groups.track('jobs', 'workers', [1, 2], consumer: 'a')
+    groups.nack('jobs', 'workers', [2], delay_for: ->(_attempt) { 3600 })
+
+    assert_equal({ drained: false, in_flight: 1 }, groups.drain('jobs', 'workers', wait: 0))
+
+    groups.ack('jobs', 'workers', [1])
+    assert_equal({ drained: true, in_flight: 0 }, groups.drain('jobs', 'workers', wait: 0))
+    assert groups.paused?('jobs', 'workers')
+  end
+
+  def test_nacked_messages_wait_out_their_backoff
+    groups.track('jobs', 'workers', [1, 2], consumer: 'a')
+
+    assert_equal 1, groups.nack('jobs', 'workers', [1], delay_for: ->(_attempt) { 3600 })
+    assert_equal 1, groups.nack('jobs', 'workers', [2], delay_for: ->(_attempt) { 0 })
+
+    assert_equal [2], groups.redeliver('jobs', 'workers', consumer: 'b')
+    assert_equal [], groups.reclaim('jobs', 'workers', consumer: 'c')
+    assert_equal 2, groups.pending('jobs', 'workers').find { |entry| entry[:id] == 2 }[:deliveries]
+  end
+
+  def test_failed_nacks_build_error_history
+    groups.track('jobs', 'workers', [1], consumer: 'a')
+    groups.nack('jobs', 'workers', [1], delay_for: ->(_attempt) { 0 }, error: 'boom')
+    groups.nack('jobs', 'workers', [1], delay_for: ->(_attempt) { 0 })
+
+    errors = groups.errors('jobs', 'workers', 1)
+    assert_equal ['boom'], errors.map { |failure| failure[:error] }
+    assert_equal 1, groups.pending('jobs', 'workers').first[:failures]
+    assert_equal 'boom', groups.pending('jobs', 'workers').first[:last_error]
+  end
+end
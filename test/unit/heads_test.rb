@@ -0,0 +1,62 @@
+require_relative '../test_helper'
+
+class HeadsTest < ShortbusTest
+  class FakeEngine
+    attr_reader :messages
+
+    def initialize
+      @messages = []
+    end
+
+    def publish(topic, payload, metadata: {})
+      @messages << { id: @messages.size + 1, topic:, payload:, metadata: }
+      { status: :ok, message_id: "id-#{@messages.size}", offset: @messages.size }
+    end
+
+    def fetch_messages(topic, offset: 0, limit: 100, tiered: true)
+      @messages.select { |message| message[:topic] == topic && message[:id] >= offset }.first(limit)
+    end
+  end
+
+  def engine
+    @engine ||= FakeEngine.new
+  end
+
+  def heads
+    @heads ||= Shortbus::Heads.new(config: Shortbus.config)
+  end
+
+  def publish(expected, payload = 'on')
+    heads.publish('thermostat', expected, engine:) { engine.publish('thermostat', payload) }
+  end
+
+  def test_publishes_at_the_expected_head
+    assert_equal 1, publish(0)[:offset]
+    assert_equal 2, publish(1)[:offset]
+    assert_equal 2, heads.last('thermostat', engine:)
+  end
+
+  def test_moved_head_is_refused
+    publish(0)
+
+    error = assert_raises(Shortbus::ConflictError) { publish(0, 'off') }
+    assert_equal 1, error.current
+    assert_equal ['on'], engine.messages.map { |message| message[:payload] }
+  end
+
+  def test_unconditional_publishes_move_the_head
+    publish(0)
+    engine.publish('thermostat', 'off')
+    engine.publish('other', 'elsewhere')
+
+    assert_raises(Shortbus::ConflictError) { publish(1) }
+    assert_equal 2, heads.last('thermostat', engine:)
+    assert_equal 4, publish(2)[:offset]
+  end
+
+  def test_expected_sequence_must_be_a_sequence
+    assert_raises(ArgumentError) { publish(-1) }
+    assert_raises(ArgumentError) { publish('latest') }
+    assert_empty engine.messages
+  end
+end
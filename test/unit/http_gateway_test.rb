@@ -0,0 +1,65 @@
+require_relative '../test_helper'
+
+class HttpGatewayTest < ShortbusTest
+  def gateway
+    @gateway ||= Shortbus::HttpGateway.new(port: 0)
+  end
+
+  def test_health
+    assert_equal [200, { status: :ok }], gateway.handle('GET', '/health', {}, {})
+  end
+
+  def test_read_only_brokers_refuse_publishes
+    Shortbus.config.read_only = 'true'
+
+    assert_equal [200, { status: :ok, read_only: true }], gateway.handle('GET', '/health', {}, {})
+    status, body = gateway.handle('POST', '/topics/jobs/messages', {}, { payload: 'x' })
+    assert_equal 403, status
+    assert_equal 'Broker is read-only', body[:error]
+    Shortbus.metrics.flush!
+    assert_equal 0, Shortbus.metrics.get('jobs')[:published]
+    assert_raises(Shortbus::ReadOnlyError) { Shortbus.engine.publish('jobs', 'x') }
+  ensure
+    Shortbus.config.read_only = false
+  end
+
+  def test_metrics_in_the_prometheus_format
+    Shortbus.metrics.record('jobs', 'x')
+
+    status, body = gateway.handle('GET', '/metrics', {}, {})
+    assert_equal 200, status
+    assert_includes body, 'shortbus_published_total{topic="jobs"} 1'
+  end
+
+  def test_routing_errors
+    assert_equal 404, gateway.handle('GET', '/nope', {}, {}).first
+    assert_equal 405, gateway.handle('POST', '/topics/jobs/next', {}, {}).first
+    assert_equal 400, gateway.handle('GET', '/topics/jobs/next', {}, {}).first
+    assert_equal 400, gateway.handle('POST', '/topics/jobs/ack', {}, { group: 'workers' }).first
+  end
+
+  def test_inboxes_are_off_limits
+    assert_equal 403, gateway.handle('GET', '/topics/_INBOX.conn1.abc/next', { 'group' => 'g' }, {}).first
+  end
+
+  def test_ack_clears_pending
+    Shortbus.groups.track('jobs', 'workers', [41], consumer: 'http-1')
+
+    status, body = gateway.handle('POST', '/topics/jobs/ack', {}, { group: 'workers', ids: [41] })
+
+    assert_equal 200, status
+    assert_equal 1, body[:acked]
+  end
+
+  def test_openapi_covers_every_route
+    spec = Shortbus::HttpGateway.openapi
+
+    assert_equal '3.0.3', spec[:openapi]
+    Shortbus::HttpGateway::ROUTES.each do |route|
+      assert spec[:paths][route.path][route.method.downcase], "#{route.method} #{route.path} missing"
+    end
+
+    refs = JSON.generate(spec).scan(%r{#/components/schemas/(\w+)}).flatten.uniq
+    assert_empty refs - spec[:components][:schemas].keys.map(&:to_s)
+  end
+end
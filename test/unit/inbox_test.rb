@@ -0,0 +1,19 @@
+require_relative '../test_helper'
+
+class InboxTest < ShortbusTest
+  def test_generate_is_owned_by_connection
+    inbox = Shortbus::Inbox.generate('conn1', topics: Shortbus::Topics.new(config: Shortbus.config))
+
+    assert Shortbus::Inbox.inbox?(inbox)
+    assert_equal 'conn1', Shortbus::Inbox.owner(inbox)
+    refute_equal inbox, Shortbus::Inbox.generate('conn1')
+  end
+
+  def test_authorize
+    inbox = '_INBOX.conn1.abc'
+
+    assert Shortbus::Inbox.authorize!(inbox, 'conn1')
+    assert Shortbus::Inbox.authorize!('events', 'conn2')
+    assert_raises(Shortbus::AccessError) { Shortbus::Inbox.authorize!(inbox, 'conn2') }
+  end
+end
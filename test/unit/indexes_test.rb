@@ -0,0 +1,74 @@
+require_relative '../test_helper'
+
+class IndexesTest < ShortbusTest
+  class FakeEngine
+    attr_reader :fetched
+    attr_accessor :messages
+
+    def initialize(count, start: Time.at(1_000_000))
+      @messages = (1..count).map { |id| { id:, timestamp: start.to_i + id } }
+      @fetched = 0
+    end
+
+    def fetch_messages(topic, offset: 0, limit: 100)
+      page = @messages.select { |message| message[:id] >= offset }.first(limit)
+      @fetched += page.size
+      page
+    end
+  end
+
+  class StoppedEngine
+    def running?
+      false
+    end
+  end
+
+  def indexes
+    @indexes ||= Shortbus::Indexes.new(config: Shortbus.config)
+  end
+
+  def test_seek_lands_in_the_segment_holding_the_time
+    engine = FakeEngine.new(3500)
+
+    assert_equal 2001, indexes.seek('events', Time.at(1_002_500), engine:)
+    assert_equal 0, indexes.seek('events', Time.at(1_000_000), engine:)
+    assert_equal 3001, indexes.tail('events', engine:)
+  end
+
+  def test_indexing_reads_one_message_per_segment
+    engine = FakeEngine.new(3500)
+    indexes.seek('events', Time.at(1_002_500), engine:)
+    assert_equal 4, engine.fetched
+
+    engine.messages.concat((3501..4200).map { |id| { id:, timestamp: 1_000_000 + id } })
+    assert_equal 4001, indexes.tail('events', engine:)
+    assert_equal 4 + 2, engine.fetched
+  end
+
+  def test_start_time_seeks_instead_of_scanning
+    engine = FakeEngine.new(5000)
+
+    offset = Shortbus::DeliverPolicy.start_offset('events', 'by_start_time', start_time: 1_004_200, engine:, indexes:)
+    assert_equal 4200, offset
+    assert_operator engine.fetched, :<, 1100
+
+    assert_equal 5000, Shortbus::DeliverPolicy.start_offset('events', 'last', engine:, indexes:)
+  end
+
+  def test_recreated_topic_is_reindexed
+    indexes.rebuild('events', engine: FakeEngine.new(2500))
+
+    assert_equal 1001, indexes.tail('events', engine: FakeEngine.new(1500, start: Time.at(2_000_000)))
+  end
+
+  def test_fsck_rebuilds_damaged_indexes
+    indexes.rebuild('events', engine: FakeEngine.new(10))
+    File.write(indexes.path('events'), '{"entries": [[1, 5], [1001')
+
+    problems = Shortbus::Fsck.new(repair: true, process_manager: StoppedEngine.new).run
+
+    assert_equal ['unreadable time index'], problems.map(&:problem)
+    refute indexes.path('events').exist?
+    assert_equal 1, indexes.rebuild('events', engine: FakeEngine.new(10))
+  end
+end
@@ -0,0 +1,73 @@
+require_relative '../test_helper'
+
+class JobsTest < ShortbusTest
+  class FakeEngine
+    attr_reader :published
+
+    def initialize
+      @published = []
+    end
+
+    def publish(topic, payload, metadata: {})
+      @published << { topic:, payload:, metadata: }
+      { status: :ok, message_id: @published.size }
+    end
+  end
+
+  def jobs
+    @jobs ||= Shortbus::Jobs.new(config: Shortbus.config)
+  end
+
+  def test_enqueue_publishes_and_records_job
+    engine = FakeEngine.new
+    job = jobs.enqueue('thumbnails', 'img-7', engine:)
+
+    assert_equal 'queued', job[:state]
+    assert_equal 1, job[:message_id]
+    assert_equal job[:id], engine.published.first[:metadata][:job_id]
+    assert_equal job, jobs.get(job[:id])
+  end
+
+  def test_reports_move_job_through_states
+    id = jobs.enqueue('thumbnails', 'img-7', engine: FakeEngine.new)[:id]
+
+    assert_equal 'running', jobs.report(id, '', metadata: { progress: 0.5 })[:state]
+    assert_equal 0.5, jobs.get(id)[:progress]
+
+    done = jobs.report(id, 'https://cdn/7.png')
+    assert_equal 'done', done[:state]
+    assert_equal 'https://cdn/7.png', jobs.await(id, wait: 0)[:result]
+
+    assert_raises(ArgumentError) { jobs.report(id, 'again') }
+  end
+
+  def test_failure_and_unknown_jobs
+    id = jobs.enqueue('thumbnails', 'img-7', engine: FakeEngine.new)[:id]
+    failed = jobs.report(id, '', metadata: { error: 'RuntimeError: boom' })
+
+    assert_equal 'failed', failed[:state]
+    assert_equal 'RuntimeError: boom', failed[:error]
+    assert_raises(ArgumentError) { jobs.await('nope', wait: 0) }
+  end
+
+  def test_await_returns_unfinished_job_when_wait_runs_out
+    id = jobs.enqueue('thumbnails', 'img-7', engine: FakeEngine.new)[:id]
+
+    assert_equal 'queued', jobs.await(id, wait: 0)[:state]
+  end
+
+  def test_result_topics
+    assert_equal 'abc123', Shortbus::Jobs.result_for('result.abc123')
+    assert_nil Shortbus::Jobs.result_for('thumbnails')
+  end
+
+  def test_prune_removes_old_finished_jobs
+    finished = jobs.enqueue('thumbnails', 'a', engine: FakeEngine.new)[:id]
+    queued = jobs.enqueue('thumbnails', 'b', engine: FakeEngine.new)[:id]
+    jobs.report(finished, 'ok')
+
+    assert_equal [finished], jobs.prune!(retain: -1)
+    assert_nil jobs.get(finished)
+    refute_nil jobs.get(queued)
+  end
+end
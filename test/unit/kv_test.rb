@@ -0,0 +1,97 @@
+require_relative '../test_helper'
+
+class KVTest < ShortbusTest
+  class FakeEngine
+    attr_reader :messages, :created
+
+    def initialize
+      @messages = []
+      @created = []
+    end
+
+    def create_topic(name)
+      @created << name
+      { status: :ok, topic: name }
+    end
+
+    def publish(topic, payload, metadata: {})
+      @messages << { id: @messages.size + 1, topic:, payload:, metadata:, timestamp: Time.now.to_i }
+      { status: :ok, offset: @messages.size, timestamp: Time.now.to_i }
+    end
+
+    def fetch_messages(topic, offset: 0, limit: 100, tiered: true)
+      @messages.select { |message| message[:topic] == topic && message[:id] >= offset }.first(limit)
+    end
+
+    def delete_message(topic, id)
+      @messages.reject! { |message| message[:topic] == topic && message[:id] == id }
+    end
+  end
+
+  def engine
+    @engine ||= FakeEngine.new
+  end
+
+  def kv
+    @kv ||= Shortbus::KV.new(config: Shortbus.config)
+  end
+
+  def test_put_and_get
+    first = kv.put('config', 'billing.rate_limit', 100, engine:)
+    second = kv.put('config', 'billing.rate_limit', '200', engine:)
+
+    assert_equal 1, first[:revision]
+    assert_equal 'put', first[:operation]
+
+    entry = kv.get('config', 'billing.rate_limit', engine:)
+    assert_equal '200', entry[:value]
+    assert_equal second[:revision], entry[:revision]
+    assert_nil kv.get('config', 'missing', engine:)
+  end
+
+  def test_first_put_creates_a_compacted_bucket
+    kv.put('config', 'a', '1', engine:)
+
+    assert Shortbus.topics.compacted?('kv.config')
+    assert_equal ['kv.config'], engine.created
+    assert_equal ['config'], kv.buckets
+
+    kv.put('config', 'b', '2', engine:)
+    assert_equal ['kv.config'], engine.created
+  end
+
+  def test_delete_leaves_a_tombstone
+    kv.put('config', 'a', '1', engine:)
+    kv.put('config', 'b', '2', engine:)
+    entry = kv.delete('config', 'a', engine:)
+
+    assert_equal 'delete', entry[:operation]
+    assert_nil kv.get('config', 'a', engine:)
+    assert_equal ['b'], kv.keys('config', engine:)
+    assert engine.messages.last[:metadata][:tombstone]
+  end
+
+  def test_compaction_keeps_current_values
+    kv.put('config', 'a', '1', engine:)
+    kv.put('config', 'a', '2', engine:)
+    kv.put('config', 'b', '3', engine:)
+
+    Shortbus::Compactor.new(engine:).compact!
+    assert_equal 2, engine.messages.size
+    assert_equal %w[2 3], kv.keys('config', engine:).map { |key| kv.get('config', key, engine:)[:value] }
+  end
+
+  def test_create_refuses_uncompacted_topics
+    Shortbus.topics.create('kv.legacy')
+
+    assert_raises(Shortbus::TopicError) { kv.create('legacy', engine:) }
+    kv.create('fresh', engine:, retention: '1d')
+    kv.create('fresh', engine:)
+    assert_equal 86_400, Shortbus.topics.get('kv.fresh')[:retention]
+  end
+
+  def test_validates_names
+    assert_raises(ArgumentError) { kv.put('no.dots', 'a', '1', engine:) }
+    assert_raises(ArgumentError) { kv.put('config', 'white space', '1', engine:) }
+  end
+end
@@ -0,0 +1,66 @@
+require_relative '../test_helper'
+
+class ListenerTest < ShortbusTest
+  # Stands in for `shortbus pipe`: prints its flags, then echoes commands
+  ECHO = ['sh', '-c', 'echo "$@"; cat', 'pipe'].freeze
+
+  def test_urls
+    assert_equal "shortbus+unix://#{Shortbus.config.socket_path}", Shortbus::Listener.new.url
+    assert_equal 'shortbus://0.0.0.0:7070', Shortbus::Listener.new(port: 7070, bind: '0.0.0.0').url
+    assert_equal 'shortbus://127.0.0.1:7070?tls=1', Shortbus::Listener.new(port: 7070, tls_cert: 'c', tls_key: 'k').url
+  end
+
+  def test_invalid_combinations
+    assert_raises(ArgumentError) { Shortbus::Listener.new(socket: '/tmp/s.sock', port: 7070) }
+    assert_raises(ArgumentError) { Shortbus::Listener.new(tls_cert: 'c', tls_key: 'k') }
+    assert_raises(ArgumentError) { Shortbus::Listener.new(port: 7070, tls_cert: 'c') }
+  end
+
+  def test_connect_line_becomes_pipe_flags
+    client, server = UNIXSocket.pair
+    serving = Thread.new { Shortbus::Listener.new(command: ECHO).send(:serve, server) }
+
+    client.puts JSON.generate(op: 'connect', name: 'billing', durable: 'billing')
+    client.puts '{"op": "ping"}'
+
+    assert_equal '--name billing --durable billing', client.gets.chomp
+    assert_equal '{"op": "ping"}', client.gets.chomp
+
+    client.close_write
+    assert_nil client.gets
+    serving.join(5)
+  end
+
+  def test_token_is_required_when_set
+    client, server = UNIXSocket.pair
+    serving = Thread.new { Shortbus::Listener.new(token: 's3cret', command: ECHO).send(:serve, server) }
+
+    client.puts JSON.generate(op: 'connect', name: 'billing', token: 'guess')
+
+    assert_match(/Unauthorized/, JSON.parse(client.gets)['error'])
+    assert_nil client.gets
+    serving.join(5)
+
+    client, server = UNIXSocket.pair
+    serving = Thread.new { Shortbus::Listener.new(token: 's3cret', command: ECHO).send(:serve, server) }
+
+    client.puts JSON.generate(op: 'connect', name: 'billing', token: 's3cret')
+
+    assert_equal '--name billing', client.gets.chomp
+    client.close_write
+    serving.join(5)
+  end
+
+  def test_other_first_lines_pass_through
+    client, server = UNIXSocket.pair
+    serving = Thread.new { Shortbus::Listener.new(command: ECHO).send(:serve, server) }
+
+    client.puts '{"op": "ping"}'
+
+    assert_equal '', client.gets.chomp
+    assert_equal '{"op": "ping"}', client.gets.chomp
+
+    client.close_write
+    serving.join(5)
+  end
+end
@@ -0,0 +1,62 @@
+require_relative '../test_helper'
+
+class LocksTest < ShortbusTest
+  def locks
+    @locks ||= Shortbus::Locks.new(config: Shortbus.config)
+  end
+
+  # Age a lease past its TTL
+  def lapse(name)
+    state = JSON.parse(File.read(locks.path), symbolize_names: true)
+    state[:locks][name.to_sym][:expires_at] = (Time.now - 1).utc.iso8601(3)
+    File.write(locks.path, JSON.generate(state))
+  end
+
+  def test_one_holder_at_a_time
+    lease = locks.acquire('reconcile', owner: 'worker-1', ttl: '30s', connection_id: 'a')
+
+    assert_equal 1, lease[:token]
+    assert_nil locks.acquire('reconcile', owner: 'worker-2', connection_id: 'b')
+    assert_equal 'worker-1', locks.get('reconcile')[:owner]
+
+    again = locks.acquire('reconcile', owner: 'worker-1', ttl: 60, connection_id: 'a')
+    assert_equal 1, again[:token]
+    assert_operator Time.iso8601(again[:expires_at]), :>, Time.iso8601(lease[:expires_at])
+  end
+
+  def test_lapsed_leases_free_the_lock_with_a_new_token
+    locks.acquire('reconcile', owner: 'worker-1')
+    lapse('reconcile')
+
+    lease = locks.acquire('reconcile', owner: 'worker-2')
+    assert_equal 2, lease[:token]
+    assert_nil locks.renew('reconcile', token: 1)
+    refute locks.release('reconcile', token: 1)
+  end
+
+  def test_renew_and_release
+    lease = locks.acquire('reconcile', owner: 'worker-1', ttl: 10)
+
+    renewed = locks.renew('reconcile', token: lease[:token], ttl: 60)
+    assert_operator Time.iso8601(renewed[:expires_at]), :>, Time.iso8601(lease[:expires_at])
+
+    assert locks.release('reconcile', token: lease[:token])
+    assert_empty locks.list
+    assert_equal 2, locks.acquire('reconcile', owner: 'worker-2')[:token]
+  end
+
+  def test_release_connection
+    locks.acquire('a', owner: 'worker-1', connection_id: 'c1')
+    locks.acquire('b', owner: 'worker-1', connection_id: 'c1')
+    locks.acquire('c', owner: 'worker-2', connection_id: 'c2')
+
+    assert_equal %w[a b], locks.release_connection('c1')
+    assert_equal ['c'], locks.list.map { |lease| lease[:name] }
+  end
+
+  def test_validates
+    assert_raises(ArgumentError) { locks.acquire('', owner: 'worker-1') }
+    assert_raises(ArgumentError) { locks.acquire('a', owner: '') }
+    assert_raises(ArgumentError) { locks.acquire('a', owner: 'worker-1', ttl: 0) }
+  end
+end
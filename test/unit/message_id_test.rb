@@ -0,0 +1,33 @@
+require_relative '../test_helper'
+
+class MessageIdTest < ShortbusTest
+  def test_format
+    id = Shortbus::MessageId.generate
+
+    assert_match(/\A\h{8}-\h{4}-7\h{3}-[89ab]\h{3}-\h{12}\z/, id)
+    assert Shortbus::MessageId.valid?(id)
+    refute Shortbus::MessageId.valid?(41)
+    refute Shortbus::MessageId.valid?('not-an-id')
+  end
+
+  def test_ids_sort_in_publish_order
+    now = Time.now
+    ids = Array.new(5000) { Shortbus::MessageId.generate(now) }
+
+    assert_equal ids, ids.sort
+    assert_equal ids.size, ids.uniq.size
+  end
+
+  def test_never_steps_backwards
+    later = Shortbus::MessageId.generate(Time.now + 60)
+    earlier = Shortbus::MessageId.generate(Time.now)
+
+    assert_operator earlier, :>, later
+  end
+
+  def test_time
+    assert_equal Time.at(1_728_662_376, 250, :millisecond).utc, Shortbus::MessageId.time('01927c4e-8f3a-7d21-9c0e-5b7a2f1e4d3c')
+    assert_operator Shortbus::MessageId.time(Shortbus::MessageId.generate), :>=, Time.now - 1
+    assert_raises(ArgumentError) { Shortbus::MessageId.time('41') }
+  end
+end
@@ -0,0 +1,98 @@
+require_relative '../test_helper'
+
+class MetricsTest < ShortbusTest
+  def metrics
+    @metrics ||= Shortbus::Metrics.new(config: Shortbus.config)
+  end
+
+  def test_record_counts_sizes_and_producers
+    metrics.record('orders', 'x' * 100, metadata: { published_by: 'billing' })
+    metrics.record('orders', 'x' * 2000, metadata: { published_by: 'billing' })
+    metrics.record('orders', 'x' * 10, metadata: { published_by: 'web' })
+    metrics.flush!
+
+    orders = metrics.get('orders')
+
+    assert_equal 3, orders[:published]
+    assert_equal 2110, orders[:bytes]
+    assert_equal 2000, orders[:max_size]
+    assert_equal({ '256': 2, '4096': 1 }, orders[:sizes])
+    assert_equal({ published: 2, bytes: 2100 }, orders[:producers][:billing])
+  end
+
+  def test_flushes_from_several_processes_add_up
+    metrics.record('orders', 'one')
+    metrics.flush!
+
+    other = Shortbus::Metrics.new(config: Shortbus.config)
+    other.record('orders', 'two')
+    other.flush!
+
+    assert_equal 2, metrics.get('orders')[:published]
+    assert_equal %w[orders], metrics.all.map { |metric| metric[:topic] }
+  end
+
+  def test_metadata_cardinality_ignores_broker_keys
+    5.times { |i| metrics.record('orders', '{}', metadata: { region: 'eu', request_id: i, published_by: "p#{i}" }) }
+    metrics.flush!
+
+    assert_equal({ region: 1, request_id: 5 }, metrics.get('orders')[:metadata_keys])
+  end
+
+  def test_deliveries_are_stamped_and_their_latency_counted
+    now = Time.now
+    msg = { id: 1, annotations: { received_at: (now - 0.1).utc.iso8601(3) } }
+
+    stamped = metrics.delivered('orders', msg, group: 'workers', now:)
+    metrics.delivered('orders', msg.merge(annotations: { received_at: (now - 3).utc.iso8601(3) }), now:)
+    metrics.delivered('orders', { id: 3 }, now:)
+    metrics.flush!
+
+    assert_equal now.utc.iso8601(3), stamped[:annotations][:delivered_at]
+
+    latency = metrics.get('orders')[:latency]
+    assert_equal 2, latency[:count]
+    assert_equal({ '128': 1, '4096': 1 }, latency[:buckets])
+    assert_equal 128, metrics.percentile(latency, 0.5)
+    assert_equal 4096, metrics.percentile(latency, 0.99)
+    assert_equal 1, metrics.get('orders')[:group_latency][:workers][:count]
+    assert_nil metrics.percentile(metrics.get('idle')[:latency], 0.5)
+  end
+
+  def test_prometheus_exposition
+    metrics.record('orders', 'x' * 100)
+    metrics.record('orders', 'x' * 2000)
+    metrics.delivered('orders', { annotations: { received_at: (Time.now - 0.1).utc.iso8601(3) } }, group: 'work"ers')
+    metrics.flush!
+
+    text = metrics.prometheus
+
+    assert_includes text, "# TYPE shortbus_published_total counter\nshortbus_published_total{topic=\"orders\"} 2\n"
+    assert_includes text, 'shortbus_payload_size_bytes_bucket{topic="orders",le="256"} 1'
+    assert_includes text, 'shortbus_payload_size_bytes_bucket{topic="orders",le="4096"} 2'
+    assert_includes text, 'shortbus_payload_size_bytes_sum{topic="orders"} 2100'
+    assert_includes text, 'shortbus_delivery_latency_seconds_bucket{topic="orders",le="0.128"} 1'
+    assert_includes text, 'shortbus_delivery_latency_seconds_bucket{topic="orders",le="+Inf"} 1'
+    assert_includes text, 'shortbus_group_delivery_latency_seconds_count{topic="orders",group="work\\"ers"} 1'
+  end
+
+  def test_schema_failures_are_counted
+    Shortbus.topics.create('orders', schema: { required: %w[amount] })
+
+    assert Shortbus::Schema.check!('orders', '{"amount": 5}', {}, metrics:)
+    error = assert_raises(Shortbus::TopicError) { Shortbus::Schema.check!('orders', '{"total": 5}', {}, metrics:) }
+    assert_match(/payload missing: amount/, error.message)
+
+    metrics.flush!
+    assert_equal 1, metrics.get('orders')[:schema_failures]
+    assert_equal 'payload missing: amount', metrics.get('orders')[:last_schema_error]
+  end
+
+  def test_schema_violations
+    assert_nil Shortbus::Schema.violation(nil, 'anything')
+    assert_equal 'payload is not JSON', Shortbus::Schema.violation(Shortbus::Schema.normalize('json'), 'nope')
+    assert_equal 'missing metadata: tenant', Shortbus::Schema.violation({ 'metadata' => ['tenant'] }, 'x', { region: 'eu' })
+    assert_nil Shortbus::Schema.violation({ 'metadata' => ['tenant'] }, 'x', { tenant: 'acme' })
+    assert_raises(ArgumentError) { Shortbus::Schema.normalize(payload: 'xml') }
+  end
+end
@@ -0,0 +1,69 @@
+require_relative '../test_helper'
+
+class MirrorsTest < ShortbusTest
+  class FakeEngine
+    attr_reader :messages, :published
+
+    def initialize(messages)
+      @messages = messages
+      @published = []
+    end
+
+    def fetch_messages(topic, offset: 0, limit: 100, tiered: true)
+      @messages.select { |message| message[:topic] == topic && message[:id] >= offset }.first(limit)
+    end
+
+    def publish(topic, payload, metadata: {}, annotations: {})
+      @published << { topic:, payload:, metadata:, annotations: }
+      { status: :ok, offset: @published.size }
+    end
+  end
+
+  def message(id, key: nil, topic: 'orders')
+    { id:, topic:, payload: "order #{id}", message_id: "m#{id}", metadata: key ? { key: } : {} }
+  end
+
+  def test_copies_new_traffic_into_the_shadow_topic
+    Shortbus.topics.create('orders', mirror: 'orders.canary')
+    engine = FakeEngine.new([message(1)])
+    mirrors = Shortbus::Mirrors.new(engine:)
+
+    # A new mirror starts at the head: the backlog stays where it is
+    assert_equal({ 'orders' => 0 }, mirrors.mirror!)
+
+    engine.messages.push(message(2), message(3), message(4, topic: 'events'))
+    assert_equal({ 'orders' => 2 }, mirrors.mirror!)
+    assert_equal({ 'orders' => 0 }, mirrors.mirror!)
+
+    copy = engine.published.first
+    assert_equal 'orders.canary', copy[:topic]
+    assert_equal 'order 2', copy[:payload]
+    assert_equal({ mirrored_from: 'orders', original_id: 2 }, copy[:metadata])
+    assert_equal({ message_id: 'm2' }, copy[:annotations])
+  end
+
+  def test_samples_by_key
+    Shortbus.topics.create('orders', mirror: 'orders.canary', mirror_sample: '50%')
+    engine = FakeEngine.new([])
+    mirrors = Shortbus::Mirrors.new(engine:)
+    mirrors.mirror!
+
+    engine.messages.concat((1..200).map { |id| message(id, key: "customer-#{id % 20}") })
+    mirrors.mirror!
+
+    keys = engine.published.map { |copy| copy[:metadata][:key] }
+    assert_includes 40..160, keys.size
+    keys.uniq.each do |key|
+      assert_equal 10, keys.count(key), "#{key} was mirrored in part"
+    end
+  end
+
+  def test_mirror_settings
+    assert_equal 0.1, Shortbus.topics.create('orders', mirror: 'orders.canary', mirror_sample: '10%')[:mirror_sample]
+    assert_raises(Shortbus::TopicError) { Shortbus.topics.create('events', mirror: 'not a topic') }
+    assert_raises(Shortbus::TopicError) { Shortbus.topics.create('jobs', mirror: 'jobs.canary', mirror_sample: '200%') }
+
+    assert Shortbus::Mirrors.sampled?(message(1), 1.0)
+    refute Shortbus::Mirrors.sampled?(message(1), 0)
+  end
+end
@@ -0,0 +1,144 @@
+require_relative '../test_helper'
+require 'stringio'
+
+class OutboundTest < ShortbusTest
+  # Counts write calls, each standing for a syscall
+  class CountingIO < StringIO
+    attr_reader :calls
+
+    def initialize
+      super
+      @calls = 0
+    end
+
+    def write(*frames)
+      @calls += 1
+      super
+    end
+  end
+
+  # Blocks writes until released, like a consumer that stopped reading
+  class StalledIO < CountingIO
+    def initialize
+      super
+      @release = Queue.new
+    end
+
+    def release!
+      @release << true
+    end
+
+    def write(*frames)
+      @release.pop
+      super
+    end
+  end
+
+  def outbound(io, **options)
+    Shortbus::Outbound.new(io, **{ interval_ms: 0, buffer: 1024, policy: 'block' }.merge(options))
+  end
+
+  def test_frames_go_out_without_waiting_by_default
+    io = CountingIO.new
+    out = outbound(io)
+
+    3.times { |i| out << %({"n":#{i}}) }
+    sleep 0.1
+
+    assert_equal %({"n":0}\n{"n":1}\n{"n":2}\n), io.string
+    assert_operator io.calls, :<=, 3
+    out.close
+  end
+
+  def test_frames_within_an_interval_share_a_write
+    io = CountingIO.new
+    out = outbound(io, interval_ms: 50)
+
+    ('a'..'j').each { |frame| out << frame }
+    sleep 0.2
+
+    assert_equal ('a'..'j').map { |frame| "#{frame}\n" }.join, io.string
+    assert_equal 1, io.calls
+    assert_equal 10, out.frames
+    out.close
+  end
+
+  def test_close_writes_what_is_queued
+    io = CountingIO.new
+    out = outbound(io, interval_ms: 10_000)
+
+    out << 'last'
+    out.close
+
+    assert_equal "last\n", io.string
+    out << 'after'
+    assert_equal "last\nafter\n", io.string
+  end
+
+  def test_full_batches_go_out_early
+    io = CountingIO.new
+    out = outbound(io, interval_ms: 10_000, buffer: '1MB')
+
+    out << ('x' * Shortbus::Outbound::MAX_BATCH)
+    sleep 0.2
+
+    assert_equal 1, io.calls
+    out.close
+  end
+
+  def test_write_errors_reach_the_next_sender
+    io = CountingIO.new
+    io.close_write
+    out = outbound(io, interval_ms: 1)
+
+    out << 'lost'
+    sleep 0.1
+
+    assert_raises(IOError) { out << 'next' }
+  end
+
+  def test_block_waits_for_room
+    io = StalledIO.new
+    out = outbound(io, buffer: 100)
+
+    out << ('a' * 60)
+    sender = Thread.new { out << ('b' * 60) }
+    sleep 0.1
+    assert sender.alive?, 'sender should wait while the buffer is full'
+
+    io.release!
+    io.release!
+    sender.join(1)
+    refute sender.alive?
+    out.close
+    assert_equal 2, out.frames
+  end
+
+  def test_drop_discards_deliveries_but_not_replies
+    io = StalledIO.new
+    slow = 0
+    out = outbound(io, buffer: 100, policy: 'drop', on_slow: ->(_) { slow += 1 })
+
+    assert out.<<('a' * 60, delivery: true)
+    refute out.<<('b' * 60, delivery: true)
+    assert out.<<('reply' * 12)
+
+    assert_equal 1, out.dropped
+    assert_equal 2, slow
+    assert_operator out.high_watermark, :>, 100
+
+    3.times { io.release! }
+    out.close
+    refute_includes io.string, 'b'
+  end
+
+  def test_policies_and_sizes
+    assert_equal 'disconnect', Shortbus::Outbound.normalize('close')
+    assert_equal 'block', Shortbus::Outbound.normalize(nil)
+    assert_raises(ArgumentError) { Shortbus::Outbound.normalize('spill') }
+
+    assert_equal 8 * 1024 * 1024, Shortbus.parse_size('8MB')
+    assert_equal 512, Shortbus.parse_size(512)
+    assert_raises(ArgumentError) { Shortbus.parse_size('lots') }
+  end
+end
@@ -0,0 +1,62 @@
+require_relative '../test_helper'
+require 'shortbus/outbox'
+
+class OutboxTest < ShortbusTest
+  class FakeEngine
+    attr_reader :published
+
+    def initialize
+      @published = []
+    end
+
+    def publish(topic, payload, metadata: {}, trigger: true, annotations: {})
+      @published << { topic: topic, payload: payload, metadata: metadata }
+      { status: :ok, message_id: @published.size - 1, topic: topic }
+    end
+  end
+
+  # Just enough of an outbox table to answer the relay's two queries
+  class FakeTable
+    attr_reader :rows
+
+    def initialize(rows)
+      @rows = rows
+    end
+
+    def call(sql, params)
+      return @rows.reject { |row| row['published_at'] } if sql.start_with?('SELECT')
+
+      @rows.find { |row| row['id'] == params.first }['published_at'] = Time.now
+      []
+    end
+  end
+
+  def setup
+    super
+    @engine = FakeEngine.new
+    @table = FakeTable.new([
+      { 'id' => 1, 'topic' => 'orders', 'payload' => 'a', 'metadata' => '{"source":"api"}' },
+      { 'id' => 2, 'topic' => 'orders', 'payload' => 'b', 'dedupe_key' => 'order-2' },
+    ])
+  end
+
+  def outbox
+    Shortbus::Outbox.new(@table, dialect: :postgres, engine: @engine, dedupe: Shortbus::Dedupe.new(config: Shortbus.config))
+  end
+
+  def test_relay_publishes_and_marks_rows
+    assert_equal 2, outbox.relay!
+    assert_equal %w[a b], @engine.published.map { |message| message[:payload] }
+    assert_equal 'api', @engine.published.first[:metadata]['source']
+    assert_equal 'order-2', @engine.published.last[:metadata]['dedupe_key']
+    assert_equal 0, outbox.relay!
+  end
+
+  def test_republishing_unmarked_rows_is_deduped
+    outbox.relay!
+    @table.rows.each { |row| row.delete('published_at') }
+
+    assert_equal 2, outbox.relay!
+    assert_equal 2, @engine.published.size
+  end
+end
@@ -0,0 +1,152 @@
+require_relative '../test_helper'
+require 'stringio'
+
+class PipeModeTest < ShortbusTest
+  def setup
+    super
+    @output = StringIO.new
+    @stdout, $stdout = $stdout, @output
+    @pipe = Shortbus::PipeMode.new(principal: nil)
+  ensure
+    $stdout = @stdout
+  end
+
+  def command(cmd)
+    @pipe.send(:handle_command, cmd)
+  end
+
+  # Frames written so far
+  def frames
+    @pipe.instance_variable_get(:@outbound).close
+    @output.string.lines.map { |line| JSON.parse(line, symbolize_names: true) }
+  end
+
+  def test_requeue_refuses_another_connections_inbox
+    command(op: 'requeue', topic: '_INBOX.someone-else.abc', request_id: 1)
+
+    error = frames.last
+    assert_equal 'error', error[:type]
+    assert_equal 1, error[:request_id]
+    assert_match(/belongs to another connection/, error[:error])
+  end
+
+  def test_staged_publishes_are_counted_at_commit
+    command(op: 'begin', request_id: 1)
+    txn = @pipe.instance_variable_get(:@transactions).keys.first
+    command(op: 'publish', topic: 'jobs', payload: 'x', txn:, request_id: 2)
+    command(op: 'rollback', txn:, request_id: 3)
+
+    assert_equal 'rolled_back', frames.last[:op]
+    Shortbus.metrics.flush!
+    assert_equal 0, Shortbus.metrics.get('jobs')[:published]
+  end
+
+  class FullEngine
+    attr_reader :published
+
+    def initialize(depth)
+      @messages = (1..depth).map { |id| { id:, payload: 'x' } }
+      @published = []
+    end
+
+    def fetch_messages(topic, offset: 0, limit: 100, tiered: true)
+      @messages.select { |message| message[:id] >= offset }.first(limit)
+    end
+
+    def publish(topic, payload, **)
+      @published << topic
+      { status: :ok, offset: @published.size }
+    end
+  end
+
+  def test_transaction_commits_into_a_full_topic_are_refused
+    Shortbus.topics.create('jobs', max_depth: 3)
+    engine = FullEngine.new(3)
+    Shortbus.instance_variable_set(:@engine, engine)
+
+    command(op: 'begin', request_id: 1)
+    txn = @pipe.instance_variable_get(:@transactions).keys.first
+    command(op: 'publish', topic: 'jobs', payload: 'x', txn:, request_id: 2)
+    command(op: 'commit_transaction', txn:, request_id: 3)
+
+    error = frames.last
+    assert_equal 'error', error[:type]
+    assert_equal 3, error[:request_id]
+    assert_match(/max_depth is 3/, error[:error])
+    assert_empty engine.published
+  ensure
+    Shortbus.instance_variable_set(:@engine, nil)
+  end
+
+  def test_pending_refuses_another_connections_inbox
+    command(op: 'pending', topic: '_INBOX.someone-else.abc', group: 'workers', request_id: 1)
+
+    error = frames.last
+    assert_equal 'error', error[:type]
+    assert_match(/belongs to another connection/, error[:error])
+  end
+
+  def test_refused_publishes_are_not_counted
+    Shortbus.config.read_only = 'true'
+    command(op: 'publish', topic: 'jobs', payload: 'x', request_id: 1)
+
+    assert frames.last[:read_only]
+    Shortbus.metrics.flush!
+    assert_equal 0, Shortbus.metrics.get('jobs')[:published]
+  ensure
+    Shortbus.config.read_only = false
+  end
+
+  def test_read_only_writes_are_refused_before_touching_state
+    Shortbus.config.read_only = 'true'
+    before = Shortbus.config.topics_yml.exist? && Shortbus.config.topics_yml.read
+
+    requests = [
+      { op: 'inbox' },
+      { op: 'kv', action: 'put', bucket: 'config', key: 'rate', value: '1' },
+      { op: 'append', topic: 'orders.42', payload: 'x' },
+      { op: 'schedules', action: 'add', name: 'tick', schedule: { cron: '* * * * *', topic: 'ticks' } },
+      { op: 'acquire', name: 'leader' }
+    ]
+    requests.each_with_index { |cmd, index| command(cmd.merge(request_id: index + 1)) }
+
+    refused = frames.select { |frame| frame[:read_only] }.map { |frame| frame[:request_id] }
+    assert_equal (1..requests.size).to_a, refused
+    assert_equal before, Shortbus.config.topics_yml.exist? && Shortbus.config.topics_yml.read
+    refute Shortbus.config.schedules_yml.exist?
+  ensure
+    Shortbus.config.read_only = false
+  end
+
+  # Watchers deliver while the input thread acks and grants credits; the
+  # window, credits and counts must come out the same as one at a time
+  def test_acks_and_credits_race_deliveries
+    topic = 'jobs'
+    state = ->(name) { @pipe.instance_variable_get(name) }
+    state.(:@subscribers)[topic] << { request_id: 1 }
+    state.(:@windows)[topic] = 1_000
+    state.(:@credits)[topic] = 0
+    state.(:@paused)[topic] = true  # nothing to fetch: deliveries come from the thread below
+
+    deliveries = 500
+    delivered = Queue.new
+    watcher = Thread.new do
+      (1..deliveries).each do |id|
+        @pipe.send(:deliver, topic, { id: id, topic: topic, message_id: "m#{id}", payload: 'x' })
+        delivered << id
+      end
+    end
+
+    deliveries.times do
+      @pipe.send(:release_in_flight, topic, [delivered.pop])
+      command(op: 'credit', topic: topic, credits: 1)
+    end
+    watcher.join
+
+    assert_empty state.(:@in_flight)[topic]
+    assert_empty state.(:@in_flight_ids)[topic]
+    assert_equal 0, state.(:@credits)[topic]
+    assert_equal deliveries, state.(:@delivered)[topic]
+    assert_equal deliveries, frames.count { |frame| frame[:op] == 'credited' }
+  end
+end
@@ -0,0 +1,78 @@
+require_relative '../test_helper'
+
+class PresenceTest < ShortbusTest
+  class FakeEngine
+    attr_reader :published
+
+    def initialize
+      @published = []
+    end
+
+    def publish(topic, payload, metadata: {})
+      @published << { topic: topic, payload: JSON.parse(payload, symbolize_names: true), metadata: metadata }
+      { status: :ok, message_id: @published.size }
+    end
+
+    def events
+      @published.map { |message| message[:payload].values_at(:event, :name, :reason).compact }
+    end
+  end
+
+  def presence
+    @presence ||= Shortbus::Presence.new(config: Shortbus.config)
+  end
+
+  # Age an entry past its TTL
+  def lapse(name)
+    entries = JSON.parse(File.read(presence.path), symbolize_names: true)
+    entries[name.to_sym][:expires_at] = (Time.now - 1).utc.iso8601(3)
+    File.write(presence.path, JSON.generate(entries))
+  end
+
+  def test_announce_joins_once_and_heartbeats_extend
+    engine = FakeEngine.new
+    first = presence.announce('billing/1', ttl: '30s', info: { version: '2.1' }, engine:)
+    again = presence.announce('billing/1', ttl: 60, info: { version: '2.1' }, engine:)
+
+    assert_equal first[:joined_at], again[:joined_at]
+    assert_operator Time.iso8601(again[:expires_at]), :>, Time.iso8601(first[:expires_at])
+    assert_equal [%w[joined billing/1]], engine.events
+    assert_equal ['$sys.presence'], engine.published.map { |message| message[:topic] }
+    assert_equal({ version: '2.1' }, engine.published.first[:payload][:info])
+  end
+
+  def test_list_filters_and_expires
+    engine = FakeEngine.new
+    presence.announce('billing/1', engine:)
+    presence.announce('billing/2', engine:)
+    presence.announce('search/1', engine:)
+    lapse('billing/2')
+
+    assert_equal %w[billing/1], presence.list('billing/*', engine:).map { |entry| entry[:name] }
+    assert_equal %w[billing/1 search/1], presence.list(engine:).map { |entry| entry[:name] }
+    assert_includes engine.events, %w[left billing/2 expired]
+  end
+
+  def test_leave_and_disconnect
+    engine = FakeEngine.new
+    presence.announce('billing/1', connection_id: 'c1', engine:)
+    presence.announce('billing/2', connection_id: 'c1', engine:)
+    presence.announce('search/1', connection_id: 'c2', engine:)
+
+    assert presence.leave('search/1', engine:)
+    refute presence.leave('search/1', engine:)
+    assert_equal %w[billing/1 billing/2], presence.disconnect('c1', engine:)
+    assert_empty presence.list(engine:)
+
+    assert_equal [%w[left search/1 left], %w[left billing/1 disconnected], %w[left billing/2 disconnected]], engine.events.last(3)
+  end
+
+  def test_reap
+    engine = FakeEngine.new
+    presence.announce('billing/1', engine:)
+    lapse('billing/1')
+
+    assert_equal %w[billing/1], presence.reap!(engine:)
+    assert_empty presence.reap!(engine:)
+  end
+end
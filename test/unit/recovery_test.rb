@@ -0,0 +1,59 @@
+require_relative '../test_helper'
+
+class RecoveryTest < ShortbusTest
+  def recovery
+    @recovery ||= Shortbus::Recovery.new(config: Shortbus.config)
+  end
+
+  def write_wal(bytes)
+    File.write(rendezvous_path('blockqueue.db'), 'sqlite')
+    File.write(rendezvous_path('blockqueue.db-wal'), 'x' * bytes)
+  end
+
+  def test_nothing_to_recover_without_a_log
+    assert_nil recovery.start!(Process.pid)
+    refute recovery.recovering?
+
+    write_wal(0)
+    assert_nil recovery.start!(Process.pid)
+  end
+
+  def test_progress_is_reported_until_the_engine_is_up
+    write_wal(4096)
+    recovery.start!(Process.pid)
+
+    assert recovery.recovering?
+    assert_equal 4096, recovery.status[:wal_bytes]
+
+    # This process stands in for the engine, and has read plenty already
+    if File.exist?("/proc/#{Process.pid}/io")
+      assert recovery.progress!
+      assert_equal 99.9, recovery.status[:percent]
+    end
+
+    recovery.finish!
+    refute recovery.recovering?
+  end
+
+  def test_a_dead_engine_is_not_recovering
+    write_wal(4096)
+    pid = Process.spawn('true')
+    Process.wait(pid)
+    recovery.start!(pid)
+
+    refute recovery.recovering?
+    refute recovery.progress!
+  end
+
+  def test_health_reports_recovery
+    write_wal(4096)
+    Shortbus.recovery.start!(Process.pid)
+
+    status, body = Shortbus::HttpGateway.new(port: 0).handle('GET', '/health', {}, {})
+    assert_equal 503, status
+    assert_equal :recovering, body[:status]
+    assert_equal 4096, body[:recovery][:wal_bytes]
+  ensure
+    Shortbus.recovery.finish!(recovered: false)
+  end
+end
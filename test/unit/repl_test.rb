@@ -0,0 +1,74 @@
+require_relative '../test_helper'
+require 'stringio'
+
+class ReplTest < ShortbusTest
+  class FakeEngine
+    attr_reader :published
+
+    def initialize
+      @published = []
+    end
+
+    def publish(topic, payload, metadata: {}, trigger: true)
+      @published << { id: @published.size, topic: topic, payload: payload, metadata: metadata }
+      { status: :ok, message_id: @published.size - 1, topic: topic }
+    end
+
+    def fetch_messages(topic, offset: 0, limit: 100)
+      @published.select { |message| message[:topic] == topic }.drop(offset).first(limit)
+    end
+
+    def list_topics
+      raise Shortbus::ConnectionError, "engine down"
+    end
+  end
+
+  def engine
+    @engine ||= FakeEngine.new
+  end
+
+  def output
+    @output ||= StringIO.new
+  end
+
+  def repl
+    @repl ||= Shortbus::Repl.new(engine:, output:)
+  end
+
+  def test_publish_and_peek_pretty_print
+    repl.execute('publish jobs {"id": 42}')
+    repl.execute('peek jobs')
+
+    assert_equal '{"id": 42}', engine.published.first[:payload]
+    assert_includes output.string, "published jobs/0"
+    assert_includes output.string, %(  {\n    "id": 42\n  })
+  end
+
+  def test_errors_are_printed_not_raised
+    repl.execute('peek')
+    repl.execute('bogus')
+
+    assert_includes output.string, "error: usage: peek TOPIC"
+    assert_includes output.string, "unknown command: bogus"
+  end
+
+  def test_completion
+    Shortbus.topics.create('jobs')
+    Shortbus.topics.create('jobs.dlq')
+    Shortbus.topics.create('events')
+
+    assert_equal %w[peek pending publish purge], repl.complete('p').sort
+    assert_equal %w[jobs jobs.dlq], repl.complete('jo', 'peek ')
+  end
+
+  def test_completion_scripts
+    Shortbus::Completion::SHELLS.each do |shell|
+      script = Shortbus::Completion.script(shell, commands: %w[publish topic])
+
+      assert_includes script, 'shortbus completion topics'
+      assert_includes script, 'publish'
+    end
+
+    assert_raises(ArgumentError) { Shortbus::Completion.script('tcsh', commands: []) }
+  end
+end
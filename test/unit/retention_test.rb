@@ -0,0 +1,49 @@
+require_relative '../test_helper'
+
+class RetentionTest < ShortbusTest
+  class FakeEngine
+    attr_reader :messages
+
+    def initialize(messages)
+      @messages = messages
+    end
+
+    def fetch_messages(topic, offset: 0, limit: 100, tiered: true)
+      @messages.select { |message| message[:topic] == topic && message[:id] >= offset }.first(limit)
+    end
+
+    def delete_message(topic, id)
+      @messages.reject! { |message| message[:topic] == topic && message[:id] == id }
+    end
+  end
+
+  def day
+    86_400
+  end
+
+  def now
+    @now ||= Time.utc(2024, 10, 20, 12)
+  end
+
+  def message(id, topic, age)
+    { id:, topic:, payload: "#{topic} #{id}", metadata: {}, timestamp: (now - age).to_i }
+  end
+
+  def test_messages_past_retention_are_deleted
+    engine = FakeEngine.new([
+      message(1, 'events', 9 * day), message(2, 'events', 8 * day), message(3, 'events', 60),
+      message(4, 'jobs', 30 * day), message(5, 'prices', 30 * day), message(6, 'audit', 30 * day)
+    ])
+    Shortbus.topics.create('events', retention: '7d')
+    Shortbus.topics.create('jobs', retention: '7d', archive: true)  # the Archiver's
+    Shortbus.topics.create('prices', retention: '7d', compact: true)  # tombstones only
+    Shortbus.topics.create('audit')
+
+    retention = Shortbus::Retention.new(engine:)
+    assert_equal({ 'events' => 2 }, retention.expire!(now:))
+    assert_equal [3, 4, 5, 6], engine.messages.map { |msg| msg[:id] }
+
+    assert_equal({ 'events' => 1 }, retention.expire!(now: now + 8 * day))
+    assert_equal [4, 5, 6], engine.messages.map { |msg| msg[:id] }
+  end
+end
@@ -0,0 +1,80 @@
+require_relative '../test_helper'
+
+class RoutesTest < ShortbusTest
+  class FakeEngine
+    attr_reader :published
+
+    def initialize(failing: [])
+      @published = []
+      @failing = failing
+    end
+
+    def publish(topic, payload, metadata: {})
+      raise Shortbus::EngineError, "#{topic} is down" if @failing.include?(topic)
+
+      @published << { topic:, payload:, metadata: }
+      { status: :ok, topic:, offset: @published.size }
+    end
+  end
+
+  def routes(rules)
+    File.write(Shortbus.config.routes_yml, YAML.dump(rules))
+    Shortbus::Routes.new(engine: FakeEngine.new)
+  end
+
+  def test_copies_and_moves_by_topic_and_metadata
+    routes = routes([
+      { 'match' => 'orders.*', 'where' => { 'region' => 'eu-*' }, 'to' => 'orders.eu' },
+      { 'match' => %w[orders.* payments], 'where' => { 'tier' => %w[gold platinum] }, 'to' => 'vip' },
+      { 'match' => 'payments', 'where' => { 'priority' => 'high', 'test' => nil }, 'to' => 'payments.urgent', 'action' => 'move' }
+    ])
+
+    assert_equal({ topic: 'orders.new', copies: %w[orders.eu vip] }, routes.resolve('orders.new', region: 'eu-west', tier: 'gold'))
+    assert_equal({ topic: 'orders.new', copies: [] }, routes.resolve('orders.new', region: 'us-east', tier: 'silver'))
+    assert_equal({ topic: 'payments.urgent', copies: [] }, routes.resolve('payments', priority: 'high'))
+    assert_equal({ topic: 'payments', copies: [] }, routes.resolve('payments', priority: 'high', test: true))
+    assert_equal({ topic: 'orders.new', copies: [] }, routes.resolve('orders.new', region: 'eu-west', routed_from: 'elsewhere'))
+  end
+
+  def test_publish_writes_where_the_routes_say
+    routes = routes([
+      { 'match' => 'orders.*', 'to' => 'audit' },
+      { 'match' => 'orders.*', 'where' => { 'region' => 'eu' }, 'to' => 'orders.eu', 'action' => 'move' }
+    ])
+    engine = FakeEngine.new
+
+    result = routes.publish('orders.new', 'hi', metadata: { region: 'eu' }, engine:)
+    assert_equal 'orders.eu', result[:moved_to]
+    assert_equal %w[audit], result[:copied_to]
+    assert_equal %w[orders.eu audit], Shortbus::Routes.written('orders.new', result)
+
+    assert_equal %w[orders.eu audit], engine.published.map { |message| message[:topic] }
+    assert(engine.published.all? { |message| message[:metadata] == { region: 'eu', routed_from: 'orders.new' } })
+
+    plain = routes.publish('events', 'hi', engine:)
+    assert_equal({ status: :ok, topic: 'events', offset: 3 }, plain)
+  end
+
+  def test_failed_copies_dont_fail_the_publish
+    routes = routes([{ 'match' => 'orders', 'to' => 'audit' }])
+    engine = FakeEngine.new(failing: %w[audit])
+
+    result = routes.publish('orders', 'hi', engine:)
+    assert_nil result[:copied_to]
+    assert_equal %w[orders], engine.published.map { |message| message[:topic] }
+  end
+
+  def test_invalid_rules
+    assert_empty Shortbus::Routes.new.rules
+
+    [
+      { 'to' => 'x' },
+      { 'match' => 'orders', 'to' => 'not a topic' },
+      { 'match' => 'orders', 'to' => 'x', 'action' => 'fork' },
+      { 'match' => 'orders', 'to' => 'x', 'where' => 'region' }
+    ].each do |rule|
+      assert_raises(Shortbus::ConfigurationError) { routes([rule]).rules }
+    end
+    assert_raises(Shortbus::ConfigurationError) { routes({ 'match' => 'orders' }).rules }
+  end
+end
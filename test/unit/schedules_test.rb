@@ -0,0 +1,65 @@
+require_relative '../test_helper'
+
+class SchedulesTest < ShortbusTest
+  class FakeEngine
+    attr_reader :published
+
+    def initialize
+      @published = []
+    end
+
+    def publish(topic, payload, metadata: {})
+      @published << { topic:, payload:, metadata: }
+      { status: :ok, message_id: @published.size }
+    end
+  end
+
+  def schedules
+    @schedules ||= Shortbus::Schedules.new(config: Shortbus.config)
+  end
+
+  def test_publishes_when_due_and_not_again
+    engine = FakeEngine.new
+    schedules.add('heartbeat', cron: '*/5 * * * *', topic: 'heartbeat', payload: 'tick')
+    added = Time.now
+
+    assert_empty schedules.tick!(now: added, engine:)
+
+    later = added + 600
+    assert_equal({ 'heartbeat' => 1 }, schedules.tick!(now: later, engine:))
+    assert_empty schedules.tick!(now: later, engine:)
+
+    message = engine.published.first
+    assert_equal 'heartbeat', message[:topic]
+    assert_equal 'tick', message[:payload]
+    assert_equal 'heartbeat', message[:metadata][:schedule]
+    assert_equal 1, schedules.status.first[:runs]
+  end
+
+  def test_state_survives_a_new_instance
+    engine = FakeEngine.new
+    schedules.add('report', cron: '@hourly', topic: 'jobs')
+    schedules.tick!(now: Time.now + 7200, engine:)
+
+    again = Shortbus::Schedules.new(config: Shortbus.config)
+    assert_empty again.tick!(now: Time.now + 7200, engine:)
+    assert_equal 1, engine.published.size
+  end
+
+  def test_add_validates
+    assert_raises(ArgumentError) { schedules.add('bad', cron: 'often', topic: 'jobs') }
+    assert_raises(ArgumentError) { schedules.add('bad', cron: '* * * * *') }
+    assert_raises(ArgumentError) { schedules.add('bad', cron: '* * * * *', topic: 'jobs', every: 5) }
+
+    schedules.add('ok', cron: '* * * * *', topic: 'jobs')
+    assert_raises(ArgumentError) { schedules.add('ok', cron: '* * * * *', topic: 'jobs') }
+  end
+
+  def test_remove
+    schedules.add('heartbeat', cron: '* * * * *', topic: 'heartbeat')
+    schedules.remove('heartbeat')
+
+    assert_empty schedules.all
+    assert_raises(ArgumentError) { schedules.remove('heartbeat') }
+  end
+end
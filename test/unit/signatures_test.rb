@@ -0,0 +1,45 @@
+require_relative '../test_helper'
+
+class SignaturesTest < ShortbusTest
+  SECRET = 'billing-secret'
+
+  def setup
+    super
+    @ed25519 = OpenSSL::PKey.generate_key('ED25519')
+
+    File.write(Shortbus.config.keys_yml, {
+      'billing' => { 'alg' => 'HS256', 'secret' => [SECRET].pack('m0') },
+      'pos-1' => { 'alg' => 'Ed25519', 'public_key' => [@ed25519.public_to_der.byteslice(-32, 32)].pack('m0') }
+    }.to_yaml)
+  end
+
+  def signatures
+    @signatures ||= Shortbus::Signatures.new(config: Shortbus.config)
+  end
+
+  def signed(payload, kid, alg, key)
+    { signature: Shortbus::Signatures.sign(payload, kid:, alg:, key:) }
+  end
+
+  def test_hmac_and_ed25519_verify
+    assert_equal 'billing', signatures.verify('order 1', signed('order 1', 'billing', 'HS256', SECRET))
+    assert_equal 'pos-1', signatures.verify('sale 1', signed('sale 1', 'pos-1', 'Ed25519', @ed25519))
+  end
+
+  def test_wrong_payload_key_or_alg_fails
+    assert_nil signatures.verify('order 2', signed('order 1', 'billing', 'HS256', SECRET))
+    assert_nil signatures.verify('order 1', signed('order 1', 'billing', 'HS256', 'guess'))
+    assert_nil signatures.verify('order 1', signed('order 1', 'unknown', 'HS256', SECRET))
+    assert_nil signatures.verify('sale 1', signed('sale 1', 'pos-1', 'HS256', SECRET))
+    assert_nil signatures.verify('order 1', {})
+  end
+
+  def test_topics_with_signers_refuse_others
+    Shortbus.topics.create('payments', signers: 'billing')
+
+    assert signatures.check!('payments', 'p', signed('p', 'billing', 'HS256', SECRET))
+    assert signatures.check!('events', 'p', {})
+    assert_raises(Shortbus::AccessError) { signatures.check!('payments', 'p', {}) }
+    assert_raises(Shortbus::AccessError) { signatures.check!('payments', 'p', signed('p', 'pos-1', 'Ed25519', @ed25519)) }
+  end
+end
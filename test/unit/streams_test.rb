@@ -0,0 +1,75 @@
+require_relative '../test_helper'
+
+class StreamsTest < ShortbusTest
+  class FakeEngine
+    attr_reader :messages
+
+    def initialize
+      @messages = []
+    end
+
+    def publish(topic, payload, metadata: {})
+      @messages << { id: @messages.size + 1, topic:, payload:, metadata: }
+      { status: :ok, message_id: "id-#{@messages.size}", offset: @messages.size }
+    end
+
+    def fetch_messages(topic, offset: 0, limit: 100, tiered: true)
+      @messages.select { |message| message[:topic] == topic && message[:id] >= offset }.first(limit)
+    end
+  end
+
+  def engine
+    @engine ||= FakeEngine.new
+  end
+
+  def streams
+    @streams ||= Shortbus::Streams.new(config: Shortbus.config)
+  end
+
+  def placed
+    [{ type: 'placed', payload: '{"total": 30}' }]
+  end
+
+  def test_append_versions_events
+    result = streams.append('order-42', placed, expected_version: 0, engine:)
+    assert_equal 1, result[:version]
+
+    result = streams.append('order-42', [{ type: 'paid', payload: '{}' }, { type: 'shipped', payload: '{}' }], expected_version: 1, engine:)
+    assert_equal 3, result[:version]
+    assert_equal [2, 3], result[:events].map { |event| event[:version] }
+
+    message = engine.messages.last
+    assert_equal 'stream.order-42', message[:topic]
+    assert_equal({ stream: 'order-42', version: 3, event_type: 'shipped' }, message[:metadata])
+    assert_equal 3, streams.version('order-42')
+  end
+
+  def test_conflicting_appends_are_refused
+    streams.append('order-42', placed, engine:)
+
+    error = assert_raises(Shortbus::ConflictError) { streams.append('order-42', placed, expected_version: 0, engine:) }
+    assert_equal 1, error.current
+    assert_equal 1, engine.messages.size
+  end
+
+  def test_read_from_a_version
+    streams.append('order-42', placed * 3, engine:)
+    engine.publish('stream.order-42', 'not an event')
+
+    assert_equal [2, 3], streams.read('order-42', from: 2, engine:).map { |event| event[:metadata][:version] }
+    assert_equal [1], streams.read('order-42', limit: 1, engine:).map { |event| event[:metadata][:version] }
+  end
+
+  def test_events_from_an_interrupted_append_are_counted
+    streams.append('order-42', placed, engine:)
+    engine.publish('stream.order-42', '{}', metadata: { version: 2 })
+
+    assert_equal 3, streams.append('order-42', placed, expected_version: 2, engine:)[:version]
+  end
+
+  def test_validates
+    assert_raises(ArgumentError) { streams.append('order 42', placed, engine:) }
+    assert_raises(ArgumentError) { streams.append('order-42', [], engine:) }
+    assert_raises(ArgumentError) { streams.append('order-42', [{ type: 'placed' }], engine:) }
+  end
+end
@@ -0,0 +1,68 @@
+require_relative '../test_helper'
+
+class TapTest < ShortbusTest
+  class FakeEngine
+    attr_reader :messages
+
+    def initialize(messages)
+      @messages = messages
+    end
+
+    def list_topics
+      @messages.keys
+    end
+
+    def fetch_messages(topic, offset: 0, limit: 100, tiered: true)
+      @messages.fetch(topic, []).select { |message| message[:id] >= offset }.first(limit)
+    end
+
+    def publish(topic, payload, metadata: {})
+      list = @messages[topic] ||= []
+      list << { id: list.size + 1, payload:, metadata: }
+    end
+  end
+
+  def engine
+    @engine ||= FakeEngine.new(
+      'orders.eu' => [{ id: 1, payload: 'old', metadata: {} }],
+      'events' => [],
+      '_INBOX.conn1.abc' => []
+    )
+  end
+
+  def test_parse_sample
+    assert_equal 0.01, Shortbus::Tap.parse_sample('1%')
+    assert_equal 0.25, Shortbus::Tap.parse_sample('0.25')
+    assert_equal 1.0, Shortbus::Tap.parse_sample(nil)
+    assert_raises(ArgumentError) { Shortbus::Tap.parse_sample('150%') }
+    assert_raises(ArgumentError) { Shortbus::Tap.parse_sample('lots') }
+  end
+
+  def test_taps_new_traffic_on_matching_topics
+    tap = Shortbus::Tap.new('orders.*', engine:)
+    seen = []
+
+    assert_equal 0, tap.poll { |msg| seen << msg }
+    engine.publish('orders.eu', 'new')
+    engine.publish('orders.us', 'later topic')
+    engine.publish('events', 'elsewhere')
+    tap.scan!
+    tap.poll { |msg| seen << msg }
+
+    assert_equal ['new', 'later topic'], seen.map { |msg| msg[:payload] }
+  end
+
+  def test_samples_and_copies_into_a_tap_topic
+    tap = Shortbus::Tap.new('orders.*', sample: 0.5, to: 'debug.orders', engine:, random: Random.new(1))
+    tap.scan!
+
+    100.times { |i| engine.publish('orders.eu', "order #{i}") }
+    tap.poll
+
+    copies = engine.messages['debug.orders']
+    assert_includes 30..70, copies.size
+    assert_equal({ tapped_from: 'orders.eu' }, copies.first[:metadata])
+
+    assert_raises(ArgumentError) { Shortbus::Tap.new('debug.*', to: 'debug.orders', engine:) }
+  end
+end
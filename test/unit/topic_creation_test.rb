@@ -0,0 +1,66 @@
+require_relative '../test_helper'
+
+class TopicCreationTest < ShortbusTest
+  class FakeEngine
+    attr_reader :listed
+
+    def initialize(topics)
+      @topics = topics
+      @listed = 0
+    end
+
+    def list_topics
+      @listed += 1
+      @topics.map { |name| { name: } }
+    end
+  end
+
+  def config(auto_create = 'auto')
+    config = Shortbus::Config.new
+    config.root = @tmpdir
+    config.auto_create = auto_create
+    config
+  end
+
+  def creation(auto_create = 'auto', engine: FakeEngine.new([]))
+    Shortbus::TopicCreation.new(config: config(auto_create), engine:, topics: Shortbus::Topics.new(config: config))
+  end
+
+  def test_auto_allows_anything
+    assert creation.check!('typo.topic')
+  end
+
+  def test_strict_refuses_unknown_topics
+    Shortbus::Topics.new(config: config).create('orders')
+    strict = creation('false', engine: FakeEngine.new(%w[events]))
+
+    assert strict.check!('orders')
+    assert strict.check!('events')
+    assert strict.check!(Shortbus::Inbox.generate('conn1'))
+    error = assert_raises(Shortbus::TopicError) { strict.check!('oders') }
+    assert_match(/Unknown topic: oders/, error.message)
+  end
+
+  def test_known_topics_are_remembered
+    engine = FakeEngine.new(%w[events])
+    strict = creation('strict', engine:)
+
+    3.times { strict.check!('events') }
+    assert_equal 1, engine.listed
+  end
+
+  def test_namespaces_override_the_default
+    File.write(config.auto_create_yml, { 'orders' => 'strict', 'orders.scratch' => 'auto' }.to_yaml)
+    topics = creation
+
+    assert_equal 'strict', topics.mode('orders.eu')
+    assert_equal 'strict', topics.mode('orders')
+    assert_equal 'auto', topics.mode('orders.scratch.1')
+    assert_equal 'auto', topics.mode('ordersx')
+    assert_raises(Shortbus::TopicError) { topics.check!('orders.eu') }
+  end
+
+  def test_invalid_modes_raise
+    assert_raises(ArgumentError) { Shortbus::TopicCreation.normalize('sometimes') }
+  end
+end
@@ -0,0 +1,51 @@
+require_relative '../test_helper'
+
+class TopicEventsTest < ShortbusTest
+  class FakeEngine
+    attr_reader :published
+
+    def initialize(fail: false)
+      @fail = fail
+      @published = []
+    end
+
+    def publish(topic, payload, metadata: {})
+      raise Shortbus::ConnectionError, 'engine down' if @fail
+
+      @published << { topic: topic, payload: payload, metadata: metadata }
+      { status: :ok, message_id: @published.size }
+    end
+  end
+
+  def test_emit_publishes_to_sys_topics
+    engine = FakeEngine.new
+    Shortbus::TopicEvents.emit(:updated, 'jobs', settings: { retention: 86_400 }, engine:)
+
+    event = engine.published.first
+    payload = JSON.parse(event[:payload], symbolize_names: true)
+
+    assert_equal '$sys.topics', event[:topic]
+    assert_equal({ event: 'updated', topic: 'jobs' }, event[:metadata])
+    assert_equal 'updated', payload[:event]
+    assert_equal({ retention: 86_400 }, payload[:settings])
+    assert Time.iso8601(payload[:at])
+  end
+
+  def test_no_events_for_sys_topics_or_inboxes
+    engine = FakeEngine.new
+    Shortbus::TopicEvents.emit(:created, '$sys.topics', engine:)
+    Shortbus::TopicEvents.emit(:created, '_INBOX.conn1.abc', engine:)
+
+    assert_empty engine.published
+  end
+
+  def test_emit_failure_does_not_raise
+    assert_nil Shortbus::TopicEvents.emit(:deleted, 'jobs', engine: FakeEngine.new(fail: true))
+    assert_raises(ArgumentError) { Shortbus::TopicEvents.emit(:renamed, 'jobs', engine: FakeEngine.new) }
+  end
+
+  def test_clients_cannot_publish_to_sys_topics
+    assert Shortbus::TopicEvents.authorize!('jobs')
+    assert_raises(Shortbus::AccessError) { Shortbus::TopicEvents.authorize!('$sys.topics') }
+  end
+end
@@ -0,0 +1,81 @@
+require_relative '../test_helper'
+
+class TopicGCTest < ShortbusTest
+  class FakeEngine
+    attr_reader :deleted
+
+    def initialize(messages)
+      @messages = messages  # topic => message count
+      @deleted = []
+    end
+
+    def list_topics
+      @messages.keys.map { |name| { name: } }
+    end
+
+    def fetch_messages(topic, offset: 0, limit: 100, tiered: true)
+      Array.new([@messages.fetch(topic, 0), limit].min) { |i| { id: i + 1 } }
+    end
+
+    def delete_topic(name, reason: nil)
+      @deleted << [name, reason]
+      @messages.delete(name)
+      { status: :ok, topic: name }
+    end
+  end
+
+  def config(ttl = '1h')
+    config = Shortbus::Config.new
+    config.root = @tmpdir
+    config.idle_topic_ttl = ttl
+    config
+  end
+
+  def gc(ttl = '1h')
+    Shortbus::TopicGC.new(config: config(ttl), topics: Shortbus::Topics.new(config: config(ttl)),
+                          subscribers: Shortbus::Subscribers.new(config: config(ttl)))
+  end
+
+  def test_idle_topics_are_collected_after_the_ttl
+    engine = FakeEngine.new('scratch.1' => 0, 'orders' => 3)
+    collector = gc
+    now = Time.now
+
+    assert_empty collector.collect!(engine:, now:)
+    assert_empty collector.collect!(engine:, now: now + 1800)
+    assert_equal ['scratch.1'], collector.collect!(engine:, now: now + 3600)
+    assert_equal [['scratch.1', 'idle']], engine.deleted
+  end
+
+  def test_subscribers_restart_the_clock
+    engine = FakeEngine.new('scratch.1' => 0)
+    subscribers = Shortbus::Subscribers.new(config: config)
+    collector = gc
+    now = Time.now
+
+    collector.collect!(engine:, now:)
+    subscribers.add('scratch.1', 'conn1')
+    collector.collect!(engine:, now: now + 60)
+    subscribers.remove('scratch.1', 'conn1')
+
+    assert_empty collector.collect!(engine:, now: now + 3600)
+    assert_equal ['scratch.1'], collector.collect!(engine:, now: now + 7200)
+  end
+
+  def test_configured_and_system_topics_need_their_own_ttl
+    engine = FakeEngine.new('jobs' => 0, 'tmp' => 0, '$sys.topics' => 0)
+    topics = Shortbus::Topics.new(config: config)
+    topics.create('jobs', retention: '7d')
+    topics.create('tmp', idle_ttl: '10m')
+    collector = gc(nil)
+    now = Time.now
+
+    assert_nil collector.ttl('jobs')
+    assert_nil collector.ttl('$sys.topics')
+    assert_equal 600, collector.ttl('tmp')
+
+    collector.collect!(engine:, now:)
+    assert_equal ['tmp'], collector.collect!(engine:, now: now + 600)
+    refute topics.exists?('tmp')
+  end
+end
@@ -0,0 +1,137 @@
+require_relative '../test_helper'
+
+class TopicsTest < ShortbusTest
+  def topics
+    Shortbus::Topics.new(config: Shortbus.config)
+  end
+
+  def test_create_and_get
+    topics.create('jobs', retention: '7d', max_depth: '100', dlq: 'jobs.dlq')
+
+    settings = topics.get('jobs')
+    assert_equal 604_800, settings[:retention]
+    assert_equal 100, settings[:max_depth]
+    assert_equal 'jobs.dlq', settings[:dlq]
+  end
+
+  def test_create_duplicate_raises
+    topics.create('jobs')
+    assert_raises(Shortbus::TopicError) { topics.create('jobs') }
+  end
+
+  def test_update_merges_settings
+    topics.create('jobs', retention: '1h')
+    topics.update('jobs', ordering: 'fifo')
+
+    settings = topics.get('jobs')
+    assert_equal 3600, settings[:retention]
+    assert_equal 'fifo', settings[:ordering]
+  end
+
+  def test_fifo_topics_ignore_priority
+    topics.create('jobs', ordering: 'fifo')
+    topics.create('urgent')
+    messages = [{ id: 1, metadata: { priority: 0 } }, { id: 2, metadata: { priority: 5 } }]
+
+    assert_equal [1, 2], Shortbus::WorkQueue.ordered('jobs', messages, topics:).map { |msg| msg[:id] }
+    assert_equal [2, 1], Shortbus::WorkQueue.ordered('urgent', messages, topics:).map { |msg| msg[:id] }
+  end
+
+  def test_delete
+    topics.create('jobs')
+    topics.delete('jobs')
+    refute topics.exists?('jobs')
+  end
+
+  def test_invalid_settings_raise
+    assert_raises(Shortbus::TopicError) { topics.create('jobs', ordering: 'random') }
+    assert_raises(Shortbus::TopicError) { topics.create('jobs', bogus: 1) }
+    assert_raises(Shortbus::TopicError) { topics.create('bad name') }
+  end
+
+  def test_reap_ephemeral_topic_without_subscribers
+    subscribers = Shortbus::Subscribers.new(config: Shortbus.config)
+    engine = Object.new
+    def engine.delete_topic(name) = { status: :ok, topic: name }
+
+    topics.create('session', ephemeral: true)
+    subscribers.add('session', 'conn1')
+    assert_empty topics.reap!(subscribers:, engine:)
+
+    subscribers.remove('session', 'conn1')
+    assert_equal ['session'], topics.reap!(subscribers:, engine:)
+    refute topics.exists?('session')
+  end
+
+  def test_reap_ephemeral_topic_nobody_subscribed_to
+    subscribers = Shortbus::Subscribers.new(config: Shortbus.config)
+    engine = Object.new
+    def engine.delete_topic(name) = { status: :ok, topic: name }
+
+    topics.create('session', ephemeral: true)
+    topics.create('waiting', ephemeral: true, grace_period: '1h')
+    topics.create('durable')
+
+    assert_equal ['session'], topics.reap!(subscribers:, engine:)
+    assert topics.exists?('waiting')
+    assert topics.exists?('durable')
+  end
+
+  def test_reap_respects_grace_period
+    subscribers = Shortbus::Subscribers.new(config: Shortbus.config)
+
+    topics.create('session', ephemeral: true, grace_period: '1h')
+    subscribers.add('session', 'conn1')
+    subscribers.remove('session', 'conn1')
+
+    assert_empty topics.reap!(subscribers:, engine: nil)
+    assert topics.exists?('session')
+  end
+
+  def test_poison_topic_falls_back_to_dlq
+    topics.create('jobs', dlq: 'jobs.dlq')
+    topics.create('mail', poison: 'mail.bad', max_failures: 3)
+
+    assert_equal 'jobs.dlq', topics.poison_topic('jobs')
+    assert_equal 'mail.bad', topics.poison_topic('mail')
+    assert_equal 'other.poison', topics.poison_topic('other')
+    assert_equal 3, topics.max_failures('mail')
+    assert_equal Shortbus::Topics::DEFAULT_MAX_FAILURES, topics.max_failures('jobs')
+  end
+
+  def write_classes(classes)
+    FileUtils.mkdir_p(Shortbus.config.config_dir)
+    File.write(Shortbus.config.classes_yml, classes.to_yaml)
+  end
+
+  def test_classes_give_defaults_by_name
+    write_classes(
+      'metrics' => { 'match' => 'metrics.*', 'retention' => '1h' },
+      'jobs' => { 'match' => ['jobs.*', '*.jobs'], 'max_failures' => 5, 'dlq' => 'jobs.dlq' },
+      'billing_jobs' => { 'match' => 'jobs.billing.*', 'max_failures' => 10 }
+    )
+
+    assert_equal({ retention: 3600 }, topics.get('metrics.cpu'))
+    assert_equal 5, topics.max_failures('mail.jobs')
+    assert_equal 'jobs.dlq', topics.poison_topic('jobs.resize')
+    assert_equal 'billing_jobs', topics.class_for('jobs.billing.invoice')
+    assert_equal 10, topics.max_failures('jobs.billing.invoice')
+    assert_nil topics.get('orders')
+  end
+
+  def test_topic_settings_override_their_class
+    write_classes('metrics' => { 'match' => 'metrics.*', 'retention' => '1h', 'compact' => true })
+    topics.create('metrics.cpu', retention: '1d')
+
+    assert_equal({ retention: 86_400, compact: true }, topics.get('metrics.cpu'))
+    assert_equal({ 'metrics.cpu' => { retention: 86_400, compact: true } }, topics.all)
+  end
+
+  def test_invalid_classes_raise
+    write_classes('metrics' => { 'retention' => '1h' })
+    assert_raises(Shortbus::TopicError) { topics.classes }
+
+    write_classes('metrics' => { 'match' => 'metrics.*', 'retention' => 'soon' })
+    assert_raises(Shortbus::TopicError) { topics.classes }
+  end
+end
@@ -0,0 +1,61 @@
+require_relative '../test_helper'
+
+class TransactionsTest < ShortbusTest
+  class FakeEngine
+    attr_reader :published
+
+    def initialize(fail_after: nil)
+      @published = []
+      @fail_after = fail_after
+    end
+
+    def publish(topic, payload, metadata: {}, trigger: true)
+      raise Shortbus::EngineError, "engine down" if @fail_after && @published.size >= @fail_after
+
+      @published << { id: @published.size, topic: topic, payload: payload, metadata: metadata }
+      { status: :ok, message_id: @published.size - 1, topic: topic }
+    end
+  end
+
+  def transactions
+    @transactions ||= Shortbus::Transactions.new(config: Shortbus.config)
+  end
+
+  def staged
+    [
+      { topic: 'orders', payload: 'a', metadata: {} },
+      { topic: 'audit', payload: 'b', metadata: {} },
+    ]
+  end
+
+  def test_commit_publishes_everything_visibly
+    engine = FakeEngine.new
+    results = transactions.commit('tx1', staged, engine:)
+
+    assert_equal [0, 1], results.map { |result| result[:message_id] }
+    assert_equal %w[tx1 tx1], engine.published.map { |message| message[:metadata][:txn] }
+    assert_equal 'committed', transactions.state('tx1')
+    assert_equal engine.published, transactions.visible(engine.published)
+  end
+
+  def test_failed_commit_is_aborted_and_skipped
+    engine = FakeEngine.new(fail_after: 1)
+
+    assert_raises(Shortbus::EngineError) { transactions.commit('tx1', staged, engine:) }
+    assert_equal 'aborted', transactions.state('tx1')
+    assert_equal :aborted, transactions.visibility(engine.published.first)
+  end
+
+  def test_visible_holds_at_pending
+    FileUtils.mkdir_p(Shortbus.config.transactions_dir)
+    File.write(Shortbus.config.transactions_dir / 'tx1.json', JSON.generate(id: 'tx1', state: 'committing', pid: Process.pid))
+
+    messages = [
+      { id: 0, metadata: {} },
+      { id: 1, metadata: { txn: 'tx1' } },
+      { id: 2, metadata: {} },
+    ]
+
+    assert_equal [0], transactions.visible(messages).map { |message| message[:id] }
+  end
+end